@@ -222,7 +222,7 @@ func (c *controllerAPI) KillJob(ctx context.Context, w http.ResponseWriter, req
 		return
 	}
 
-	if err = client.StopJob(job.ID); err != nil {
+	if err = client.StopJobWithReason(job.ID, host.StopReasonOperator); err != nil {
 		if _, ok := err.(ct.NotFoundError); ok {
 			err = ErrNotFound
 		}
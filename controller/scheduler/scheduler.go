@@ -1089,6 +1089,8 @@ func (s *Scheduler) HandleJobEvent(e *host.Event) {
 		log.Debug("handled job start event", "job", job)
 	case host.JobEventStop:
 		log.Debug("handled job stop event", "job", job)
+	case host.JobEventReady:
+		log.Debug("handled job ready event", "job", job)
 	}
 }
 
@@ -1148,7 +1150,7 @@ func (s *Scheduler) handleJobStatus(job *Job, status host.JobStatus) {
 	switch status {
 	case host.StatusStarting:
 		job.state = JobStateStarting
-	case host.StatusRunning:
+	case host.StatusRunning, host.StatusReady:
 		job.state = JobStateRunning
 	case host.StatusDone, host.StatusCrashed, host.StatusFailed:
 		job.state = JobStateStopped
@@ -1331,7 +1333,7 @@ func (s *Scheduler) stopJob(job *Job) error {
 		return nil
 	}
 
-	host, ok := s.hosts[job.HostID]
+	h, ok := s.hosts[job.HostID]
 	if !ok {
 		return fmt.Errorf("unknown host: %q", job.HostID)
 	}
@@ -1340,7 +1342,7 @@ func (s *Scheduler) stopJob(job *Job) error {
 	job.state = JobStateStopping
 	go func() {
 		// host.StopJob can block, so run it in a goroutine
-		if err := host.client.StopJob(job.JobID); err != nil {
+		if err := h.client.StopJobWithReason(job.JobID, host.StopReasonScheduler); err != nil {
 			log.Error("error requesting host to stop job", "err", err)
 		}
 	}()
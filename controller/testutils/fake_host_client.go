@@ -102,6 +102,10 @@ func (c *FakeHostClient) GetJob(id string) (*host.ActiveJob, error) {
 	return &job, nil
 }
 
+func (c *FakeHostClient) StopJobWithReason(id string, reason host.StopReason) error {
+	return c.StopJob(id)
+}
+
 func (c *FakeHostClient) StopJob(id string) error {
 	c.jobsMtx.Lock()
 	defer c.jobsMtx.Unlock()
@@ -111,7 +115,7 @@ func (c *FakeHostClient) StopJob(id string) error {
 		switch job.Status {
 		case host.StatusStarting:
 			job.Status = host.StatusFailed
-		case host.StatusRunning:
+		case host.StatusRunning, host.StatusReady:
 			job.Status = host.StatusDone
 		default:
 			return nil
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"os"
 	"path"
 	"regexp"
@@ -14,11 +15,13 @@ import (
 
 	"github.com/flynn/flynn/controller/client"
 	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/host/resource"
 	"github.com/flynn/flynn/host/types"
 	"github.com/flynn/flynn/pkg/cluster"
 	"github.com/flynn/flynn/pkg/exec"
 	"github.com/flynn/flynn/pkg/random"
 	"github.com/flynn/flynn/pkg/shutdown"
+	"github.com/flynn/flynn/pkg/typeconv"
 	"github.com/flynn/flynn/pkg/version"
 	"github.com/flynn/go-docopt"
 )
@@ -30,6 +33,7 @@ func init() {
 }
 
 var typesPattern = regexp.MustCompile("types.* -> (.+)\n")
+var limitsPattern = regexp.MustCompile("limits -> (.+)\n")
 
 const blobstoreURL = "http://blobstore.discoverd"
 
@@ -53,11 +57,12 @@ func main() {
 	}
 
 	usage := `
-Usage: flynn-receiver <app> <rev> [-e <var>=<val>]... [-m <key>=<val>]...
+Usage: flynn-receiver <app> <rev> [-e <var>=<val>]... [-m <key>=<val>]... [--no-cache]
 
 Options:
 	-e,--env <var>=<val>
 	-m,--meta <key>=<val>
+	--no-cache            build without restoring the build cache
 `[1:]
 	args, _ := docopt.Parse(usage, nil, true, version.String(), false)
 
@@ -88,6 +93,9 @@ Options:
 
 	jobEnv := make(map[string]string)
 	jobEnv["BUILD_CACHE_URL"] = fmt.Sprintf("%s/%s-cache.tgz", blobstoreURL, app.ID)
+	if args.Bool["--no-cache"] {
+		jobEnv["BUILD_CACHE_SKIP"] = "true"
+	}
 	if buildpackURL, ok := env["BUILDPACK_URL"]; ok {
 		jobEnv["BUILDPACK_URL"] = buildpackURL
 	} else if buildpackURL, ok := prevRelease.Env["BUILDPACK_URL"]; ok {
@@ -135,14 +143,23 @@ Options:
 	}
 
 	shutdown.BeforeExit(func() { cmd.Kill() })
+	buildStart := time.Now()
 	if err := cmd.Run(); err != nil {
 		log.Fatalln("Build failed:", err)
 	}
+	buildDuration := time.Since(buildStart) / time.Millisecond * time.Millisecond
 
 	var types []string
 	if match := typesPattern.FindSubmatch(output.Bytes()); match != nil {
 		types = strings.Split(string(match[1]), ", ")
 	}
+	var limits map[string]resource.Resources
+	if match := limitsPattern.FindSubmatch(output.Bytes()); match != nil {
+		limits, err = parseLimits(string(match[1]))
+		if err != nil {
+			log.Fatalln("Invalid build manifest limits:", err)
+		}
+	}
 
 	fmt.Printf("-----> Creating release...\n")
 
@@ -193,9 +210,22 @@ Options:
 				},
 			}}
 		}
+		if l, ok := limits[t]; ok {
+			if proc.Resources == nil {
+				proc.Resources = resource.Defaults()
+			}
+			for typ, spec := range l {
+				proc.Resources[typ] = spec
+			}
+		}
 		procs[t] = proc
 	}
 	release.Processes = procs
+	for t := range limits {
+		if _, ok := procs[t]; !ok {
+			log.Printf("Warning: ignoring limits for undeclared process type %q", t)
+		}
+	}
 
 	if err := client.CreateRelease(release); err != nil {
 		log.Fatalln("Error creating release:", err)
@@ -238,6 +268,54 @@ Options:
 			log.Fatalln(err.Error())
 		}
 	}
+
+	if size, err := slugSize(slugURL); err != nil {
+		log.Println("Error determining slug size:", err)
+	} else {
+		fmt.Printf("=====> Slug size: %d bytes\n", size)
+	}
+	fmt.Printf("=====> Build duration: %s\n", buildDuration)
+}
+
+// slugSize returns the size in bytes of the slug stored in the blobstore at
+// the given URL.
+func slugSize(url string) (int64, error) {
+	res, err := http.Head(url)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+	return res.ContentLength, nil
+}
+
+// parseLimits parses the resource limits declared in the build manifest as
+// reported by the slugbuilder, for example "web.memory=512MB, worker.cpu=500".
+func parseLimits(s string) (map[string]resource.Resources, error) {
+	limits := make(map[string]resource.Resources)
+	for _, limit := range strings.Split(s, ", ") {
+		keyVal := strings.SplitN(limit, "=", 2)
+		i := strings.LastIndex(keyVal[0], ".")
+		if len(keyVal) != 2 || i < 1 {
+			return nil, fmt.Errorf("invalid resource limit: %q", limit)
+		}
+		proc := keyVal[0][:i]
+		typ, ok := resource.ToType(keyVal[0][i+1:])
+		if !ok {
+			return nil, fmt.Errorf("invalid resource limit type: %q", keyVal[0][i+1:])
+		}
+		val, err := resource.ParseLimit(typ, keyVal[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid resource limit value: %q", keyVal[1])
+		}
+		if limits[proc] == nil {
+			limits[proc] = make(resource.Resources)
+		}
+		limits[proc][typ] = resource.Spec{Limit: typeconv.Int64Ptr(val)}
+	}
+	return limits, nil
 }
 
 // needsDefaultScale indicates whether a release needs a default scale based on
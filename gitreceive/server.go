@@ -22,6 +22,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
 	"syscall"
 
 	"github.com/flynn/flynn/controller/client"
@@ -47,6 +48,7 @@ func main() {
 type gitHandler struct {
 	controller controller.Client
 	authKey    []byte
+	pushLocks  *appLocks
 }
 
 type gitService struct {
@@ -68,7 +70,37 @@ var gitServices = [...]gitService{
 }
 
 func newGitHandler(controller controller.Client, authKey []byte) *gitHandler {
-	return &gitHandler{controller, authKey}
+	return &gitHandler{controller, authKey, newAppLocks()}
+}
+
+// appLocks serializes pushes to the same app so that concurrent pushes don't
+// operate on separate copies of the repo and overwrite each other's upload.
+type appLocks struct {
+	mtx   sync.Mutex
+	locks map[string]chan struct{}
+}
+
+func newAppLocks() *appLocks {
+	return &appLocks{locks: make(map[string]chan struct{})}
+}
+
+// Lock blocks until the lock for the given app is acquired, returning a
+// function which releases it, or until cancel is closed, returning nil.
+func (l *appLocks) Lock(appID string, cancel <-chan bool) func() {
+	l.mtx.Lock()
+	lock, ok := l.locks[appID]
+	if !ok {
+		lock = make(chan struct{}, 1)
+		l.locks[appID] = lock
+	}
+	l.mtx.Unlock()
+
+	select {
+	case lock <- struct{}{}:
+		return func() { <-lock }
+	case <-cancel:
+		return nil
+	}
 }
 
 func (h *gitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -112,6 +144,16 @@ func (h *gitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if g.rpc == "git-receive-pack" {
+		// hold the lock until the repo has been uploaded (deferred calls
+		// run in reverse order), queueing any concurrent push to the app
+		unlock := h.pushLocks.Lock(app.ID, w.(http.CloseNotifier).CloseNotify())
+		if unlock == nil {
+			return
+		}
+		defer unlock()
+	}
+
 	repoPath, err := prepareRepo(app.ID)
 	if err != nil {
 		fail500(w, "prepareRepo", err)
@@ -302,7 +344,12 @@ git-archive-all() {
 	tar --create --exclude-vcs .
 }
 while read oldrev newrev refname; do
-	[[ $refname = "refs/heads/master" ]] && git-archive-all $newrev | /bin/flynn-receiver "$RECEIVE_APP" "$newrev" --meta git=true | sed -u "s/^/"$'\e[1G\e[K'"/"
+	case $refname in
+		refs/heads/master) args=() ;;
+		refs/heads/flynn-nocache) args=(--no-cache) ;;
+		*) continue ;;
+	esac
+	git-archive-all $newrev | /bin/flynn-receiver "$RECEIVE_APP" "$newrev" --meta git=true "${args[@]}" | sed -u "s/^/"$'\e[1G\e[K'"/"
 done
 `)
 
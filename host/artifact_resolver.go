@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/flynn/flynn/host/types"
+)
+
+// ArtifactResolver pulls the image referenced by an artifact into the local
+// image graph, returning the ID of the image
+type ArtifactResolver interface {
+	Pull(artifact *host.Artifact) (string, error)
+}
+
+// artifactResolvers maps artifact URI schemes to the resolvers which pull
+// them
+type artifactResolvers struct {
+	mtx     sync.RWMutex
+	schemes map[string]ArtifactResolver
+}
+
+func newArtifactResolvers() *artifactResolvers {
+	return &artifactResolvers{schemes: make(map[string]ArtifactResolver)}
+}
+
+// Register sets the resolver for artifact URIs with the given scheme,
+// replacing any existing resolver
+func (a *artifactResolvers) Register(scheme string, r ArtifactResolver) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.schemes[strings.ToLower(scheme)] = r
+}
+
+// Get returns the resolver for the given artifact URI, treating URIs without
+// a scheme as https like pinkerton does
+func (a *artifactResolvers) Get(uri string) (ArtifactResolver, error) {
+	scheme := "https"
+	if strings.Contains(uri, "://") {
+		u, err := url.Parse(uri)
+		if err != nil {
+			return nil, err
+		}
+		scheme = u.Scheme
+	}
+	a.mtx.RLock()
+	defer a.mtx.RUnlock()
+	r, ok := a.schemes[strings.ToLower(scheme)]
+	if !ok {
+		return nil, fmt.Errorf("host: unsupported artifact URI scheme %q", scheme)
+	}
+	return r, nil
+}
+
+// dockerArtifactResolver pulls Docker images using pinkerton, resolving
+// registry hosts ending in .discoverd using discoverd
+type dockerArtifactResolver struct {
+	l *LibvirtLXCBackend
+}
+
+func (d *dockerArtifactResolver) Pull(artifact *host.Artifact) (string, error) {
+	uri, err := d.l.resolveDiscoverdURI(artifact.URI)
+	if err != nil {
+		return "", err
+	}
+	// TODO(lmars): stream pull progress (maybe to the app log?)
+	imageID, err := d.l.pinkerton.PullDocker(uri, ioutil.Discard)
+	if err != nil {
+		// the resolved address may be of a dead instance
+		d.l.invalidateDiscoverdURI(artifact.URI)
+		return "", err
+	}
+	if artifact.Digest != "" {
+		if err := d.l.pinkerton.VerifyDigest(uri, imageID, artifact.Digest); err != nil {
+			return "", err
+		}
+	}
+	return imageID, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/flynn/flynn/host/types"
+	. "github.com/flynn/go-check"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+type fakeArtifactResolver struct {
+	pulled []string
+	err    error
+}
+
+func (f *fakeArtifactResolver) Pull(artifact *host.Artifact) (string, error) {
+	f.pulled = append(f.pulled, artifact.URI)
+	if f.err != nil {
+		return "", f.err
+	}
+	return "fake-image", nil
+}
+
+func (S) TestArtifactResolvers(c *C) {
+	resolvers := newArtifactResolvers()
+	docker := &fakeArtifactResolver{}
+	resolvers.Register("https", docker)
+	fake := &fakeArtifactResolver{}
+	resolvers.Register("FAKE", fake)
+
+	for uri, expected := range map[string]*fakeArtifactResolver{
+		"fake://bucket/image.tar":                      fake,
+		"https://registry.example.com?name=foo":        docker,
+		"registry.example.com?name=foo":                docker,
+		"Fake://bucket/image.tar":                      fake,
+		"https://blobstore.discoverd/docker?name=test": docker,
+	} {
+		r, err := resolvers.Get(uri)
+		c.Assert(err, IsNil, Commentf("uri %q", uri))
+		id, err := r.Pull(&host.Artifact{URI: uri})
+		c.Assert(err, IsNil)
+		c.Assert(id, Equals, "fake-image")
+		c.Assert(expected.pulled[len(expected.pulled)-1], Equals, uri)
+	}
+
+	_, err := resolvers.Get("s3://bucket/image.tar")
+	c.Assert(err, ErrorMatches, `host: unsupported artifact URI scheme "s3"`)
+}
+
+func (S) TestPrewarmImage(c *C) {
+	log := log15.New()
+	log.SetHandler(log15.DiscardHandler())
+	l := &LibvirtLXCBackend{
+		logger:            log,
+		artifactResolvers: newArtifactResolvers(),
+		pullSlots:         make(chan struct{}, 1),
+	}
+	fake := &fakeArtifactResolver{}
+	l.artifactResolvers.Register("fake", fake)
+
+	// prewarming is repeatable
+	for i := 0; i < 2; i++ {
+		c.Assert(l.PrewarmImage(&host.Artifact{URI: "fake://image"}), IsNil)
+	}
+	c.Assert(fake.pulled, DeepEquals, []string{"fake://image", "fake://image"})
+	c.Assert(l.pullSlots, HasLen, 0)
+
+	// missing images and unsupported URIs are not temporary errors
+	for _, t := range []struct {
+		uri      string
+		err      error
+		notFound bool
+	}{
+		{uri: "fake://image", err: errors.New("Tag latest not found in repository fake/image"), notFound: true},
+		{uri: "fake://image", err: errors.New("connection refused"), notFound: false},
+		{uri: "s3://bucket/image.tar", notFound: true},
+	} {
+		fake.err = t.err
+		err := l.PrewarmImage(&host.Artifact{URI: t.uri})
+		pullErr, ok := err.(*ImagePullError)
+		c.Assert(ok, Equals, true, Commentf("err %v", err))
+		c.Assert(pullErr.NotFound, Equals, t.notFound, Commentf("err %v", err))
+		c.Assert(pullErr.Temporary(), Equals, !t.notFound)
+	}
+	fake.err = nil
+
+	// prewarming waits for a pull slot
+	l.pullSlots <- struct{}{}
+	done := make(chan error)
+	go func() { done <- l.PrewarmImage(&host.Artifact{URI: "fake://image"}) }()
+	select {
+	case <-done:
+		c.Fatal("expected prewarm to wait for a pull slot")
+	case <-time.After(50 * time.Millisecond):
+	}
+	l.releasePullSlot()
+	select {
+	case err := <-done:
+		c.Assert(err, IsNil)
+	case <-time.After(time.Second):
+		c.Fatal("timed out waiting for prewarm")
+	}
+}
@@ -110,6 +110,7 @@ func (h *attachHandler) attach(req *host.AttachReq, conn io.ReadWriteCloser) {
 		Height:   req.Height,
 		Width:    req.Width,
 		Attached: attached,
+		TeeFile:  req.TeeFile,
 	}
 	var stdinW *io.PipeWriter
 	if req.Flags&host.AttachFlagStdin != 0 {
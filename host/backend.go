@@ -3,6 +3,7 @@ package main
 import (
 	"io"
 	"net"
+	"time"
 
 	"github.com/flynn/flynn/host/types"
 )
@@ -20,11 +21,17 @@ type AttachRequest struct {
 	Stderr  io.WriteCloser
 	InitLog io.WriteCloser
 	Stdin   io.Reader
+
+	// TeeFile, if set, is the name of a file which is created in the
+	// backend's tee directory to record a copy of the output streamed
+	// during the attach
+	TeeFile string
 }
 
 type Backend interface {
 	Run(*host.Job, *RunConfig) error
 	Stop(string) error
+	Restart(string) error
 	JobExists(id string) bool
 	Signal(string, int) error
 	ResizeTTY(id string, height, width uint16) error
@@ -34,11 +41,21 @@ type Backend interface {
 	ConfigureNetworking(config *host.NetworkConfig) error
 	SetDefaultEnv(k, v string)
 	OpenLogs(host.LogBuffers) error
+	FlushLogs(timeout time.Duration) []string
 	CloseLogs() (host.LogBuffers, error)
 }
 
 type RunConfig struct {
 	IP net.IP
+
+	// Restarts is the number of times the job has been restarted by its
+	// RestartPolicy
+	Restarts int
+
+	// Update is set when UpdateImage runs the job with a new image, in
+	// which case the job is not marked as failed if it can't be started
+	// so that it can be run again with its previous image
+	Update bool
 }
 
 type JobStateSaver interface {
@@ -49,11 +66,18 @@ type StateSaver interface {
 	MarshalGlobalState() ([]byte, error)
 }
 
+// IPPoolReporter is implemented by backends which allocate job IPs from a
+// pool, returning the number of free IPs and whether the pool is configured
+type IPPoolReporter interface {
+	FreeIPs() (int, bool)
+}
+
 // MockBackend is used when testing flynn-host without the need to actually run jobs
 type MockBackend struct{}
 
 func (MockBackend) Run(*host.Job, *RunConfig) error                 { return nil }
 func (MockBackend) Stop(string) error                               { return nil }
+func (MockBackend) Restart(string) error                            { return nil }
 func (MockBackend) JobExists(string) bool                           { return false }
 func (MockBackend) Signal(string, int) error                        { return nil }
 func (MockBackend) ResizeTTY(id string, height, width uint16) error { return nil }
@@ -62,6 +86,7 @@ func (MockBackend) Cleanup([]string) error                          { return nil
 func (MockBackend) SetDefaultEnv(k, v string)                       {}
 func (MockBackend) ConfigureNetworking(*host.NetworkConfig) error   { return nil }
 func (MockBackend) OpenLogs(host.LogBuffers) error                  { return nil }
+func (MockBackend) FlushLogs(time.Duration) []string                { return nil }
 func (MockBackend) CloseLogs() (host.LogBuffers, error)             { return nil, nil }
 func (MockBackend) UnmarshalState(map[string]*host.ActiveJob, map[string][]byte, []byte, host.LogBuffers) error {
 	return nil
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type BackendEventType string
+
+const (
+	// JobStarted is emitted once a connection has been established to the
+	// job's containerinit
+	JobStarted BackendEventType = "started"
+	// JobRunning is emitted once the job's process is running
+	JobRunning BackendEventType = "running"
+	// JobReady is emitted once the job has passed its readiness check
+	JobReady BackendEventType = "ready"
+	// JobExited is emitted when the job's process exits
+	JobExited BackendEventType = "exited"
+	// JobFailed is emitted when the job fails to start or the backend loses
+	// track of it
+	JobFailed BackendEventType = "failed"
+)
+
+// BackendEvent is a job state transition observed by a backend
+type BackendEvent struct {
+	Type       BackendEventType `json:"type"`
+	JobID      string           `json:"job_id"`
+	ExitStatus *int             `json:"exit_status,omitempty"`
+	Error      string           `json:"error,omitempty"`
+	Time       time.Time        `json:"time"`
+}
+
+// backendEventBufferSize is the number of events buffered for each
+// subscriber, further events are dropped until the subscriber catches up
+const backendEventBufferSize = 100
+
+// backendEvents broadcasts BackendEvents to subscribers without blocking the
+// sender on slow subscribers
+type backendEvents struct {
+	mtx  sync.RWMutex
+	subs map[chan *BackendEvent]struct{}
+}
+
+func newBackendEvents() *backendEvents {
+	return &backendEvents{subs: make(map[chan *BackendEvent]struct{})}
+}
+
+// Subscribe returns a channel which receives a copy of every subsequent event
+func (b *backendEvents) Subscribe() chan *BackendEvent {
+	ch := make(chan *BackendEvent, backendEventBufferSize)
+	b.mtx.Lock()
+	b.subs[ch] = struct{}{}
+	b.mtx.Unlock()
+	return ch
+}
+
+// Unsubscribe stops sending events to ch and closes it
+func (b *backendEvents) Unsubscribe(ch chan *BackendEvent) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if _, ok := b.subs[ch]; !ok {
+		return
+	}
+	delete(b.subs, ch)
+	close(ch)
+}
+
+func (b *backendEvents) Send(event *BackendEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+	for ch := range b.subs {
+		e := *event
+		select {
+		case ch <- &e:
+		default:
+			// drop the event rather than blocking on a slow subscriber
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"time"
+
+	. "github.com/flynn/go-check"
+)
+
+func (S) TestBackendEvents(c *C) {
+	events := newBackendEvents()
+	sub1 := events.Subscribe()
+	sub2 := events.Subscribe()
+
+	// each subscriber should get a copy of the event
+	status := 1
+	events.Send(&BackendEvent{Type: JobExited, JobID: "job1", ExitStatus: &status})
+	for _, ch := range []chan *BackendEvent{sub1, sub2} {
+		select {
+		case e := <-ch:
+			c.Assert(e.Type, Equals, JobExited)
+			c.Assert(e.JobID, Equals, "job1")
+			c.Assert(*e.ExitStatus, Equals, 1)
+			c.Assert(e.Time.IsZero(), Equals, false)
+		case <-time.After(time.Second):
+			c.Fatal("timed out waiting for event")
+		}
+	}
+
+	// a full subscriber should not block sending to the others
+	for i := 0; i < backendEventBufferSize+10; i++ {
+		events.Send(&BackendEvent{Type: JobRunning, JobID: "job2"})
+		<-sub2
+	}
+	c.Assert(sub1, HasLen, backendEventBufferSize)
+
+	// unsubscribing closes the channel
+	events.Unsubscribe(sub1)
+	events.Unsubscribe(sub1)
+	for range sub1 {
+	}
+	events.Send(&BackendEvent{Type: JobStarted, JobID: "job3"})
+	c.Assert((<-sub2).Type, Equals, JobStarted)
+}
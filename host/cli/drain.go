@@ -0,0 +1,39 @@
+package cli
+
+import (
+	"github.com/flynn/flynn/pkg/cluster"
+	"github.com/flynn/go-docopt"
+)
+
+func init() {
+	Register("drain", runDrain, `
+usage: flynn-host drain [--stop-jobs] HOSTID
+
+Stop a host from running new jobs.
+
+Options:
+  --stop-jobs  also stop the jobs running on the host, waiting for them to stop
+`)
+
+	Register("undrain", runUndrain, `
+usage: flynn-host undrain HOSTID
+
+Allow a drained host to run new jobs again.
+`)
+}
+
+func runDrain(args *docopt.Args, client *cluster.Client) error {
+	host, err := client.Host(args.String["HOSTID"])
+	if err != nil {
+		return err
+	}
+	return host.Drain(args.Bool["--stop-jobs"])
+}
+
+func runUndrain(args *docopt.Args, client *cluster.Client) error {
+	host, err := client.Host(args.String["HOSTID"])
+	if err != nil {
+		return err
+	}
+	return host.Undrain()
+}
@@ -78,7 +78,7 @@ func jobList(client *cluster.Client, all bool) (sortJobs, error) {
 
 	sorted := make(sortJobs, 0, len(jobs))
 	for _, job := range jobs {
-		if !all && job.Status != host.StatusStarting && job.Status != host.StatusRunning {
+		if !all && job.Status != host.StatusStarting && job.Status != host.StatusRunning && job.Status != host.StatusReady {
 			continue
 		}
 		sorted = append(sorted, job)
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 
+	"github.com/flynn/flynn/host/types"
 	"github.com/flynn/flynn/pkg/cluster"
 	"github.com/flynn/go-docopt"
 )
@@ -36,7 +37,7 @@ func runStop(args *docopt.Args, client *cluster.Client) error {
 			}
 			clients[hostID] = hostClient
 		}
-		if err := hostClient.StopJob(id); err != nil {
+		if err := hostClient.StopJobWithReason(id, host.StopReasonOperator); err != nil {
 			fmt.Printf("could not stop job %s: %s\n", id, err)
 			success = false
 			continue
@@ -15,6 +15,7 @@ package containerinit
 // The code is released under the Apache 2.0 license.
 
 import (
+	"bufio"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -30,6 +31,7 @@ import (
 	"path/filepath"
 	"runtime/pprof"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -61,6 +63,17 @@ type Config struct {
 	Ports         []host.Port
 	Resources     resource.Resources
 	FileArtifacts []*host.Artifact
+	Readiness     *host.ReadinessCheck
+	// NoExecMounts are remounted noexec,nosuid,nodev before the process
+	// is started
+	NoExecMounts []string
+	// PostStart is run once the process has started, killing the process
+	// if it fails and PostStartFatal is set
+	PostStart      []string
+	PostStartFatal bool
+	// PreStop is run when the backend calls RunPreStop before stopping
+	// the process
+	PreStop []string
 }
 
 const SharedPath = "/.container-shared"
@@ -72,6 +85,9 @@ const (
 	StateRunning
 	StateExited
 	StateFailed
+	// StateReady follows StateRunning once the process has passed its
+	// readiness check, if it has one
+	StateReady
 )
 
 func (s State) String() string {
@@ -84,6 +100,8 @@ func (s State) String() string {
 		return "exited"
 	case StateFailed:
 		return "failed"
+	case StateReady:
+		return "ready"
 	default:
 		return "unknown"
 	}
@@ -157,6 +175,11 @@ func (c *Client) GetStdin() (*os.File, error) {
 	return os.NewFile(uintptr(fd.FD), "stdin"), nil
 }
 
+// RunPreStop runs the pre-stop hook, if any, killing it after timeout
+func (c *Client) RunPreStop(timeout time.Duration) error {
+	return c.c.Call("ContainerInit.RunPreStop", timeout, &struct{}{})
+}
+
 func (c *Client) Signal(signal int) error {
 	err := c.c.Call("ContainerInit.Signal", signal, &struct{}{})
 	if err != nil {
@@ -171,6 +194,7 @@ func newContainerInit(c *Config, logFile *os.File) *ContainerInit {
 		streams:   make(map[chan StateChange]struct{}),
 		openStdin: c.OpenStdin,
 		logFile:   logFile,
+		config:    c,
 	}
 }
 
@@ -187,6 +211,8 @@ type ContainerInit struct {
 	logFile    *os.File
 	ptyMaster  *os.File
 	openStdin  bool
+	config     *Config
+	preStop    sync.Once
 
 	streams    map[chan StateChange]struct{}
 	streamsMtx sync.RWMutex
@@ -213,6 +239,25 @@ func (c *ContainerInit) Signal(sig int, res *struct{}) error {
 	return nil
 }
 
+// RunPreStop runs the pre-stop hook the first time it is called, killing it
+// after timeout
+func (c *ContainerInit) RunPreStop(timeout time.Duration, res *struct{}) error {
+	if len(c.config.PreStop) == 0 {
+		return nil
+	}
+	var err error
+	c.preStop.Do(func() {
+		log := logger.New("fn", "RunPreStop")
+		log.Info("running pre-stop hook", "cmd", c.config.PreStop)
+		if err = runHook("pre-stop", c.config.PreStop, c.config, log, timeout); err != nil {
+			log.Error("error running pre-stop hook", "err", err)
+			return
+		}
+		log.Info("pre-stop hook succeeded")
+	})
+	return err
+}
+
 func (c *ContainerInit) GetPtyMaster(arg struct{}, fd *fdrpc.FD) error {
 	c.mtx.Lock()
 	defer c.mtx.Unlock()
@@ -382,6 +427,16 @@ func setupNetworking(c *Config) error {
 	return nil
 }
 
+func setupNoExecMounts(c *Config) error {
+	for _, path := range c.NoExecMounts {
+		flags := uintptr(syscall.MS_REMOUNT | syscall.MS_BIND | syscall.MS_NOEXEC | syscall.MS_NOSUID | syscall.MS_NODEV)
+		if err := syscall.Mount("", path, "", flags, ""); err != nil {
+			return fmt.Errorf("Unable to remount %s noexec: %v", path, err)
+		}
+	}
+	return nil
+}
+
 func getCredential(c *Config) (*syscall.Credential, error) {
 	if c.User == "" {
 		return nil, nil
@@ -408,6 +463,10 @@ func setupCommon(c *Config, log log15.Logger) error {
 		return err
 	}
 
+	if err := setupNoExecMounts(c); err != nil {
+		return err
+	}
+
 	// fetch file artifacts in parallel now that the network is configured
 	fetchErr := make(chan error)
 	for _, artifact := range c.FileArtifacts {
@@ -580,6 +639,120 @@ func monitor(port host.Port, container *ContainerInit, env map[string]string, lo
 	return reg.Register(), nil
 }
 
+// readyFD is the file descriptor number of the pipe passed to the process
+// for a ReadinessCheckFD check (the first of cmd.ExtraFiles)
+const readyFD = 3
+
+// readinessInterval is how often a ReadinessCheckPort check is attempted
+const readinessInterval = 100 * time.Millisecond
+
+// waitReady waits for the process to pass its readiness check, returning
+// false if the process exits first
+func waitReady(c *Config, readyPipe *os.File, exited <-chan struct{}) bool {
+	switch c.Readiness.Type {
+	case host.ReadinessCheckFD:
+		// the read returns EOF without data if the process closes the
+		// pipe or exits without signalling readiness
+		defer readyPipe.Close()
+		n, _ := readyPipe.Read(make([]byte, 1))
+		return n > 0
+	case host.ReadinessCheckPort:
+		addr := fmt.Sprintf("127.0.0.1:%d", c.Readiness.Port)
+		for {
+			if conn, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+				conn.Close()
+				return true
+			}
+			select {
+			case <-time.After(readinessInterval):
+			case <-exited:
+				return false
+			}
+		}
+	}
+	return false
+}
+
+// reaper tracks child processes other than the app which babySit reaps on
+// their behalf, since it waits for any child as pid 1
+var reaper = &childReaper{waiting: make(map[int]chan syscall.WaitStatus)}
+
+type childReaper struct {
+	mtx     sync.Mutex
+	waiting map[int]chan syscall.WaitStatus
+}
+
+// Start starts cmd and returns a channel which receives its wait status
+// once it has been reaped
+func (r *childReaper) Start(cmd *exec.Cmd) (<-chan syscall.WaitStatus, error) {
+	// hold the lock whilst starting so the child cannot be reaped before
+	// it is registered
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	ch := make(chan syscall.WaitStatus, 1)
+	r.waiting[cmd.Process.Pid] = ch
+	return ch, nil
+}
+
+func (r *childReaper) reaped(pid int, status syscall.WaitStatus) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if ch, ok := r.waiting[pid]; ok {
+		ch <- status
+		delete(r.waiting, pid)
+	}
+}
+
+// runHook runs the named hook command, logging its output and killing it
+// after timeout if it is non-zero
+func runHook(name string, args []string, c *Config, log log15.Logger, timeout time.Duration) error {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = c.WorkDir
+	cmd.Env = make([]string, 0, len(c.Env))
+	for k, v := range c.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	cmd.Stdout = w
+	cmd.Stderr = w
+	// run the hook in its own process group so it can be killed along
+	// with any processes it starts, which would otherwise keep the output
+	// pipe open
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	exited, err := reaper.Start(cmd)
+	w.Close()
+	if err != nil {
+		return err
+	}
+	var timedOut int32
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, func() {
+			atomic.StoreInt32(&timedOut, 1)
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		})
+		defer timer.Stop()
+	}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		log.Info(name+" hook output", "line", scanner.Text())
+	}
+	if status := <-exited; atomic.LoadInt32(&timedOut) == 1 {
+		return fmt.Errorf("%s hook timed out after %s", name, timeout)
+	} else if status.Signaled() {
+		return fmt.Errorf("%s hook killed by signal %s", name, status.Signal())
+	} else if status.ExitStatus() != 0 {
+		return fmt.Errorf("%s hook exited with status %d", name, status.ExitStatus())
+	}
+	return nil
+}
+
 func babySit(process *os.Process) int {
 	log := logger.New("fn", "babySit")
 
@@ -605,6 +778,9 @@ func babySit(process *os.Process) int {
 		if err == nil && pid == process.Pid {
 			break
 		}
+		if err == nil {
+			reaper.reaped(pid, wstatus)
+		}
 	}
 
 	if wstatus.Signaled() {
@@ -665,6 +841,20 @@ func containerInitApp(c *Config, logFile *os.File) error {
 	// App runs in its own session
 	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
 
+	// Pass the write end of a pipe to the app which it uses to signal
+	// readiness
+	var readyPipe *os.File
+	if c.Readiness != nil && c.Readiness.Type == host.ReadinessCheckFD {
+		r, w, err := os.Pipe()
+		if err != nil {
+			log.Error("error creating readiness pipe", "err", err)
+			return err
+		}
+		readyPipe = r
+		cmd.ExtraFiles = []*os.File{w}
+		cmd.Env = append(cmd.Env, fmt.Sprintf("READY_FD=%d", readyFD))
+	}
+
 	// Console setup.  Hook up the container app's stdin/stdout/stderr to
 	// either a pty or pipes.  The FDs for the controlling side of the
 	// pty/pipes will be passed to flynn-host later via a UNIX socket.
@@ -750,6 +940,43 @@ func containerInitApp(c *Config, logFile *os.File) error {
 	init.process = cmd.Process
 	init.changeState(StateRunning, "", -1)
 
+	exited := make(chan struct{})
+	if c.Readiness != nil {
+		if len(cmd.ExtraFiles) > 0 {
+			// close our copy of the write end so the process exiting
+			// results in EOF
+			cmd.ExtraFiles[0].Close()
+		}
+		go func(log log15.Logger) {
+			log.Info("waiting for readiness", "type", c.Readiness.Type)
+			if !waitReady(c, readyPipe, exited) {
+				log.Info("command exited before becoming ready")
+				return
+			}
+			init.mtx.Lock()
+			defer init.mtx.Unlock()
+			if init.state == StateRunning {
+				log.Info("setting state to ready")
+				init.changeState(StateReady, "", -1)
+			}
+		}(log)
+	}
+
+	if len(c.PostStart) > 0 {
+		go func(log log15.Logger) {
+			log.Info("running post-start hook", "cmd", c.PostStart)
+			if err := runHook("post-start", c.PostStart, c, log, 0); err != nil {
+				log.Error("error running post-start hook", "err", err)
+				if c.PostStartFatal {
+					log.Info("killing the command")
+					init.process.Kill()
+				}
+				return
+			}
+			log.Info("post-start hook succeeded")
+		}(log)
+	}
+
 	init.mtx.Unlock() // Allow calls
 	// monitor services
 	hbs := make([]discoverd.Heartbeater, 0, len(c.Ports))
@@ -768,6 +995,7 @@ func containerInitApp(c *Config, logFile *os.File) error {
 	}
 	exitCode := babySit(init.process)
 	log.Info("command exited", "status", exitCode)
+	close(exited)
 	init.mtx.Lock()
 	for _, hb := range hbs {
 		hb.Close()
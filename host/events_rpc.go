@@ -0,0 +1,68 @@
+package main
+
+import (
+	"github.com/flynn/flynn/pkg/rpcplus"
+)
+
+// eventsRPCPath is the path the events RPC server is served on using HTTP
+// CONNECT (see rpcplus.DialHTTPPath)
+const eventsRPCPath = "/host/events/rpc"
+
+// eventSubscriber is implemented by backends which emit BackendEvents
+type eventSubscriber interface {
+	SubscribeEvents() chan *BackendEvent
+	UnsubscribeEvents(chan *BackendEvent)
+}
+
+// EventFilter restricts the events streamed by Events.Stream to those of the
+// given jobs, all events being streamed if JobIDs is empty
+type EventFilter struct {
+	JobIDs []string `json:"job_ids,omitempty"`
+}
+
+// Events is an RPC service which streams backend events to remote
+// subscribers, so schedulers can follow job state transitions without
+// polling
+type Events struct {
+	backend eventSubscriber
+}
+
+func newEventsRPCServer(backend eventSubscriber) *rpcplus.Server {
+	server := rpcplus.NewServer()
+	server.Register(&Events{backend: backend})
+	return server
+}
+
+// Stream sends events matching the filter until the subscriber disconnects.
+//
+// Events are buffered per subscriber and dropped if the subscriber falls
+// behind, so a slow subscriber never blocks the backend from emitting them.
+func (e *Events) Stream(filter EventFilter, stream rpcplus.Stream) error {
+	var jobIDs map[string]struct{}
+	if len(filter.JobIDs) > 0 {
+		jobIDs = make(map[string]struct{}, len(filter.JobIDs))
+		for _, id := range filter.JobIDs {
+			jobIDs[id] = struct{}{}
+		}
+	}
+
+	ch := e.backend.SubscribeEvents()
+	defer e.backend.UnsubscribeEvents(ch)
+	for {
+		select {
+		case event := <-ch:
+			if jobIDs != nil {
+				if _, ok := jobIDs[event.JobID]; !ok {
+					continue
+				}
+			}
+			select {
+			case stream.Send <- event:
+			case <-stream.Error:
+				return nil
+			}
+		case <-stream.Error:
+			return nil
+		}
+	}
+}
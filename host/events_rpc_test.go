@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/rpcplus"
+	. "github.com/flynn/go-check"
+)
+
+func (S) TestEventsRPC(c *C) {
+	l := &LibvirtLXCBackend{events: newBackendEvents()}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer listener.Close()
+	mux := http.NewServeMux()
+	mux.Handle(eventsRPCPath, newEventsRPCServer(l))
+	go http.Serve(listener, mux)
+
+	client, err := rpcplus.DialHTTPPath("tcp", listener.Addr().String(), eventsRPCPath, nil)
+	c.Assert(err, IsNil)
+	defer client.Close()
+	events := make(chan *BackendEvent)
+	stream := client.StreamGo("Events.Stream", EventFilter{JobIDs: []string{"job1"}}, events)
+
+	// wait for the subscription to be registered
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		l.events.mtx.RLock()
+		n := len(l.events.subs)
+		l.events.mtx.RUnlock()
+		if n > 0 {
+			break
+		}
+	}
+
+	// run a short-lived job alongside another job which is filtered out
+	job := &libvirtContainer{l: l, job: &host.Job{ID: "job1"}}
+	other := &libvirtContainer{l: l, job: &host.Job{ID: "job2"}}
+	status := 0
+	job.sendEvent(JobStarted, nil, nil)
+	other.sendEvent(JobStarted, nil, nil)
+	job.sendEvent(JobRunning, nil, nil)
+	other.sendEvent(JobRunning, nil, nil)
+	job.sendEvent(JobExited, &status, nil)
+
+	for _, typ := range []BackendEventType{JobStarted, JobRunning, JobExited} {
+		select {
+		case e, ok := <-events:
+			c.Assert(ok, Equals, true, Commentf("stream closed: %v", stream.Error))
+			c.Assert(e.JobID, Equals, "job1")
+			c.Assert(e.Type, Equals, typ)
+		case <-time.After(5 * time.Second):
+			c.Fatalf("timed out waiting for %s event", typ)
+		}
+	}
+
+	// closing the stream unsubscribes from the backend
+	c.Assert(stream.CloseStream(), IsNil)
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		l.events.mtx.RLock()
+		n := len(l.events.subs)
+		l.events.mtx.RUnlock()
+		if n == 0 {
+			return
+		}
+	}
+	c.Fatal("timed out waiting for the subscription to be removed")
+}
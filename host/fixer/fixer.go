@@ -197,7 +197,7 @@ outer:
 				return fmt.Errorf("error listing jobs on %s: %s", h.ID(), err)
 			}
 			for _, j := range jobs {
-				if j.Status == host.StatusRunning &&
+				if (j.Status == host.StatusRunning || j.Status == host.StatusReady) &&
 					j.Job.Metadata["flynn-controller.app_name"] == "discoverd" &&
 					j.Job.Metadata["flynn-controller.type"] == "app" {
 					continue outer
@@ -226,7 +226,7 @@ func (f *ClusterFixer) FixFlannel() error {
 			fmt.Errorf("error getting jobs list from %s: %s", h.ID(), err)
 		}
 		for _, j := range jobs {
-			if j.Status != host.StatusRunning ||
+			if (j.Status != host.StatusRunning && j.Status != host.StatusReady) ||
 				j.Job.Metadata["flynn-controller.app_name"] != "flannel" ||
 				j.Job.Metadata["flynn-controller.type"] != "app" {
 				continue
@@ -368,10 +368,10 @@ func (f *ClusterFixer) KillSchedulers() error {
 			if j.Job.Metadata["flynn-controller.app_name"] != "controller" || j.Job.Metadata["flynn-controller.type"] != "scheduler" {
 				continue
 			}
-			if j.Status != host.StatusRunning && j.Status != host.StatusStarting {
+			if j.Status != host.StatusRunning && j.Status != host.StatusReady && j.Status != host.StatusStarting {
 				continue
 			}
-			if err := h.StopJob(j.Job.ID); err != nil {
+			if err := h.StopJobWithReason(j.Job.ID, host.StopReasonOperator); err != nil {
 				f.l.Error("error stopping scheduler job", "id", j.Job.ID, "error", err)
 			}
 			f.l.Info("stopped scheduler instance", "job.id", j.Job.ID)
@@ -8,10 +8,14 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
+	"github.com/armon/go-metrics"
+	"github.com/docker/go-units"
 	"github.com/flynn/flynn/bootstrap/discovery"
 	"github.com/flynn/flynn/host/cli"
 	"github.com/flynn/flynn/host/config"
@@ -20,6 +24,7 @@ import (
 	"github.com/flynn/flynn/host/volume"
 	"github.com/flynn/flynn/host/volume/manager"
 	zfsVolume "github.com/flynn/flynn/host/volume/zfs"
+	"github.com/flynn/flynn/pinkerton"
 	"github.com/flynn/flynn/pkg/shutdown"
 	"github.com/flynn/flynn/pkg/version"
 	"github.com/flynn/go-docopt"
@@ -46,12 +51,35 @@ options:
   --flynn-init=PATH          path to flynn-init binary [default: /usr/local/bin/flynn-init]
   --nsumount=PATH            path to flynn-nsumount binary [default: /usr/local/bin/flynn-nsumount]
   --log-dir=DIR              directory to store job logs [default: /var/log/flynn]
+  --log-max-line=BYTES       truncate job log lines longer than BYTES [default: 65536]
   --discovery=TOKEN          join cluster with discovery token
   --peer-ips=IPLIST          join existing cluster using IPs
   --bridge-name=NAME         network bridge name [default: flynnbr0]
   --no-resurrect             disable cluster resurrection
   --max-job-concurrency=NUM  maximum number of jobs to start concurrently
-  --partitions=PARTITIONS    specify resource partitions for host [default: system=cpu_shares:4096 background=cpu_shares:4096 user=cpu_shares:8192]
+  --max-image-pulls=NUM      maximum number of images to pull concurrently (defaults to the number of CPUs)
+  --allow-init-override      allow jobs to override the container init binary (for debugging)
+  --discoverd-timeout=DUR    how long jobs wait for discoverd and networking to be configured before failing [default: 5m]
+  --config-wait-warning=DUR  log a warning every DUR while jobs wait for discoverd or networking to be configured [default: 1m]
+  --statsd-addr=ADDR         send backend metrics to the statsd server at ADDR
+  --resolv-options=OPTS      options to set in the resolv.conf of containers (space separated, e.g. "ndots:0 timeout:1")
+  --resolv-fallback          add the host's resolvers to the resolv.conf of containers after discoverd
+  --docker-socket-apps=IDS   IDs of apps permitted to mount the Docker socket into their jobs (space separated)
+  --min-free-ips=NUM         reject jobs needing an IP when fewer than NUM container IPs are free [default: 0]
+  --default-memory=SIZE      memory limit of jobs which don't specify one (e.g. 512M) [default: 1G]
+  --memory-density=NUM       set the default memory limit to the host's RAM divided by NUM jobs, overriding --default-memory
+  --memballoon=MODEL         add a memory balloon device of MODEL (virtio or xen) to job domains so unused memory can be reclaimed
+  --max-pids=NUM             pids limit of jobs which don't specify one (0 for no limit) [default: 4096]
+  --discoverd-cache-ttl=DUR  how long to cache the addresses of discoverd services images are pulled from (disabled if 0) [default: 5s]
+  --gc-interval=DUR          remove image checkouts left by jobs which are not running every DUR (disabled if 0) [default: 0]
+  --ca-bundle=PATH           append the CA certificates in PATH to the CA bundle of containers
+  --tee-dir=DIR              directory attach output may be copied to files in (disabled if empty) [default: /var/lib/flynn/attach-tee]
+  --http-proxy=URL           proxy to pull images over HTTP through (defaults to $HTTP_PROXY)
+  --https-proxy=URL          proxy to pull images over HTTPS through (defaults to $HTTPS_PROXY)
+  --no-proxy=HOSTS           hosts to pull images from without a proxy (comma separated, defaults to $NO_PROXY)
+  --partition-fallback       run jobs with an unknown partition in the default partition rather than failing them
+  --noexec-tmp               mount /dev/shm and /tmp in containers noexec,nosuid,nodev unless jobs override it
+  --partitions=PARTITIONS    specify resource partitions for host, optionally pinned to CPUs with cpuset:CPUS (e.g. background=cpu_shares:4096,cpuset:0-3) [default: system=cpu_shares:4096 background=cpu_shares:4096 user=cpu_shares:8192]
 	`)
 }
 
@@ -174,27 +202,84 @@ func runDaemon(args *docopt.Args) {
 		maxJobConcurrency = m
 	}
 
-	var partitionCGroups = make(map[string]int64) // name -> cpu shares
-	for _, p := range strings.Split(args.String["--partitions"], " ") {
-		nameShares := strings.Split(p, "=cpu_shares:")
-		if len(nameShares) != 2 {
-			shutdown.Fatalf("invalid partition specifier: %q", p)
+	maxImagePulls := runtime.NumCPU()
+	if m, err := strconv.Atoi(args.String["--max-image-pulls"]); err == nil && m > 0 {
+		maxImagePulls = m
+	}
+
+	minFreeIPs, err := strconv.Atoi(args.String["--min-free-ips"])
+	if err != nil || minFreeIPs < 0 {
+		shutdown.Fatalf("invalid minimum free IPs: %q", args.String["--min-free-ips"])
+	}
+
+	defaultMemory, err := units.RAMInBytes(args.String["--default-memory"])
+	if err != nil || defaultMemory <= 0 {
+		shutdown.Fatalf("invalid default memory limit: %q", args.String["--default-memory"])
+	}
+	if s := args.String["--memory-density"]; s != "" {
+		density, err := strconv.Atoi(s)
+		if err != nil {
+			shutdown.Fatalf("invalid memory density: %q", s)
 		}
-		shares, err := strconv.ParseInt(nameShares[1], 10, 64)
-		if err != nil || shares < 2 {
-			shutdown.Fatalf("invalid cpu shares specifier: %q", shares)
+		if defaultMemory, err = memoryPerJob(density); err != nil {
+			shutdown.Fatal(err)
 		}
-		partitionCGroups[nameShares[0]] = shares
 	}
-	for _, s := range []string{"user", "system", "background"} {
-		if _, ok := partitionCGroups[s]; !ok {
-			shutdown.Fatal("missing mandatory resource partition: %s", s)
-		}
+
+	switch args.String["--memballoon"] {
+	case "", "virtio", "xen":
+	default:
+		shutdown.Fatalf("invalid memory balloon model: %q", args.String["--memballoon"])
+	}
+
+	maxPIDs, err := strconv.ParseInt(args.String["--max-pids"], 10, 64)
+	if err != nil || maxPIDs < 0 {
+		shutdown.Fatalf("invalid maximum pids: %q", args.String["--max-pids"])
+	}
+
+	logMaxLine, err := strconv.Atoi(args.String["--log-max-line"])
+	if err != nil || logMaxLine <= 0 {
+		shutdown.Fatalf("invalid maximum log line length: %q", args.String["--log-max-line"])
+	}
+
+	discoverdTimeout, err := time.ParseDuration(args.String["--discoverd-timeout"])
+	if err != nil || discoverdTimeout <= 0 {
+		shutdown.Fatalf("invalid discoverd timeout: %q", args.String["--discoverd-timeout"])
+	}
+
+	discoverdCacheTTL, err := time.ParseDuration(args.String["--discoverd-cache-ttl"])
+	if err != nil || discoverdCacheTTL < 0 {
+		shutdown.Fatalf("invalid discoverd cache TTL: %q", args.String["--discoverd-cache-ttl"])
+	}
+
+	gcInterval, err := time.ParseDuration(args.String["--gc-interval"])
+	if err != nil || gcInterval < 0 {
+		shutdown.Fatalf("invalid GC interval: %q", args.String["--gc-interval"])
+	}
+
+	configWaitWarning, err := time.ParseDuration(args.String["--config-wait-warning"])
+	if err != nil || configWaitWarning < 0 {
+		shutdown.Fatalf("invalid config wait warning: %q", args.String["--config-wait-warning"])
+	}
+
+	partitionCGroups, err := parsePartitionArgs(args.String["--partitions"])
+	if err != nil {
+		shutdown.Fatal(err)
 	}
 
 	log := logger.New("fn", "runDaemon", "host.id", hostID)
 	log.Info("starting daemon")
 
+	proxy := pinkerton.ProxyConfig{
+		HTTPProxy:  args.String["--http-proxy"],
+		HTTPSProxy: args.String["--https-proxy"],
+		NoProxy:    args.String["--no-proxy"],
+	}
+	log.Info("configuring image pull proxy", "proxy", proxy.String())
+	if err := pinkerton.SetProxy(proxy); err != nil {
+		shutdown.Fatal(err)
+	}
+
 	log.Info("validating host ID")
 	if strings.Contains(hostID, "-") {
 		shutdown.Fatal("host id must not contain dashes")
@@ -226,6 +311,21 @@ func runDaemon(args *docopt.Args) {
 		log.Info("registered with cluster discovery service", "id", discoveryID)
 	}
 
+	if addr := args.String["--statsd-addr"]; addr != "" {
+		log.Info("sending metrics to statsd", "addr", addr)
+		sink, err := metrics.NewStatsdSink(addr)
+		if err != nil {
+			log.Error("error creating statsd sink", "err", err)
+			shutdown.Fatal(err)
+		}
+		conf := metrics.DefaultConfig("flynn-host")
+		conf.HostName = hostID
+		if _, err := metrics.NewGlobal(conf, sink); err != nil {
+			log.Error("error initializing metrics", "err", err)
+			shutdown.Fatal(err)
+		}
+	}
+
 	state := NewState(hostID, stateFile)
 	shutdown.BeforeExit(func() { state.CloseDB() })
 
@@ -267,12 +367,31 @@ func runDaemon(args *docopt.Args) {
 	shutdown.BeforeExit(func() { vman.CloseDB() })
 
 	mux := logmux.New(hostID, logDir, logger.New("host.id", hostID, "component", "logmux"))
+	mux.MaxLineLength = logMaxLine
 
 	log.Info("initializing job backend", "type", backendName)
 	var backend Backend
 	switch backendName {
 	case "libvirt-lxc":
-		backend, err = NewLibvirtLXCBackend(state, vman, bridgeName, flynnInit, nsumount, mux, partitionCGroups, logger.New("host.id", hostID, "component", "backend", "backend", "libvirt-lxc"))
+		backend, err = NewLibvirtLXCBackend(state, vman, bridgeName, flynnInit, nsumount, mux, partitionCGroups, LibvirtLXCConfig{
+			MaxImagePulls:     maxImagePulls,
+			AllowInitOverride: args.Bool["--allow-init-override"],
+			DiscoverdTimeout:  discoverdTimeout,
+			ConfigWaitWarning: configWaitWarning,
+			ResolvOptions:     strings.Fields(args.String["--resolv-options"]),
+			ResolvFallback:    args.Bool["--resolv-fallback"],
+			DockerSocketApps:  strings.Fields(args.String["--docker-socket-apps"]),
+			PartitionFallback: args.Bool["--partition-fallback"],
+			NoExecTmp:         args.Bool["--noexec-tmp"],
+			MinFreeIPs:        minFreeIPs,
+			DefaultMemory:     defaultMemory,
+			MemBalloonModel:   args.String["--memballoon"],
+			DefaultPIDs:       maxPIDs,
+			CABundle:          args.String["--ca-bundle"],
+			TeeDir:            args.String["--tee-dir"],
+			GCInterval:        gcInterval,
+			DiscoverdCacheTTL: discoverdCacheTTL,
+		}, logger.New("host.id", hostID, "component", "backend", "backend", "libvirt-lxc"))
 	case "mock":
 		backend = MockBackend{}
 	default:
@@ -380,6 +499,21 @@ func runDaemon(args *docopt.Args) {
 			log.Error("error stopping all jobs except discoverd", "err", err)
 			return err
 		}
+		// Cleanup skips system critical jobs, so stop them explicitly
+		// (still leaving discoverd until the end)
+		for id, job := range state.Get() {
+			if !job.Job.Config.SystemCritical || !backend.JobExists(id) {
+				continue
+			}
+			if len(except) > 0 && id == except[0] {
+				continue
+			}
+			log.Info("stopping system critical job", "job.id", id)
+			if e := backend.Stop(id); e != nil {
+				log.Error("error stopping system critical job", "job.id", id, "err", e)
+				err = e
+			}
+		}
 		for _, id := range except {
 			log.Info("stopping discoverd")
 			if e := backend.Stop(id); e != nil {
@@ -499,6 +633,48 @@ func parseTagArgs(args string) map[string]string {
 	return tags
 }
 
+func parsePartitionArgs(args string) (map[string]PartitionConfig, error) {
+	partitions := make(map[string]PartitionConfig)
+	for _, p := range strings.Split(args, " ") {
+		nameParams := strings.SplitN(p, "=", 2)
+		if len(nameParams) != 2 {
+			return nil, fmt.Errorf("invalid partition specifier: %q", p)
+		}
+		var config PartitionConfig
+		for _, param := range strings.Split(nameParams[1], ",") {
+			keyVal := strings.SplitN(param, ":", 2)
+			if len(keyVal) != 2 {
+				return nil, fmt.Errorf("invalid partition specifier: %q", p)
+			}
+			switch keyVal[0] {
+			case "cpu_shares":
+				shares, err := strconv.ParseInt(keyVal[1], 10, 64)
+				if err != nil || shares < 2 {
+					return nil, fmt.Errorf("invalid cpu shares specifier: %q", keyVal[1])
+				}
+				config.CPUShares = shares
+			case "cpuset":
+				if _, err := parseCPUSet(keyVal[1]); err != nil {
+					return nil, fmt.Errorf("invalid cpuset specifier: %q", keyVal[1])
+				}
+				config.CPUSet = keyVal[1]
+			default:
+				return nil, fmt.Errorf("invalid partition specifier: %q", p)
+			}
+		}
+		if config.CPUShares == 0 {
+			return nil, fmt.Errorf("missing cpu shares in partition specifier: %q", p)
+		}
+		partitions[nameParams[0]] = config
+	}
+	for _, s := range []string{"user", "system", "background"} {
+		if _, ok := partitions[s]; !ok {
+			return nil, fmt.Errorf("missing mandatory resource partition: %s", s)
+		}
+	}
+	return partitions, nil
+}
+
 func setupLogger(logDir string) (log15.Logger, error) {
 	if err := os.MkdirAll(logDir, 0755); err != nil {
 		return nil, err
@@ -57,3 +57,25 @@ func (S) TestParseTagArgs(c *C) {
 		c.Assert(actual, DeepEquals, t.expected, Commentf("parsing %q", t.args))
 	}
 }
+
+func (S) TestParsePartitionArgs(c *C) {
+	partitions, err := parsePartitionArgs("system=cpu_shares:4096 background=cpu_shares:2048,cpuset:0-3 user=cpu_shares:8192")
+	c.Assert(err, IsNil)
+	c.Assert(partitions, DeepEquals, map[string]PartitionConfig{
+		"system":     {CPUShares: 4096},
+		"background": {CPUShares: 2048, CPUSet: "0-3"},
+		"user":       {CPUShares: 8192},
+	})
+
+	for _, args := range []string{
+		"system=cpu_shares:4096 background=cpu_shares:4096",
+		"system=cpu_shares:4096 background=cpu_shares:1 user=cpu_shares:8192",
+		"system=cpu_shares:4096 background=cpuset:0-3 user=cpu_shares:8192",
+		"system=cpu_shares:4096 background=cpu_shares:4096,cpuset:3-0 user=cpu_shares:8192",
+		"system=cpu_shares:4096 background=cpu_shares:4096,foo:bar user=cpu_shares:8192",
+		"system background=cpu_shares:4096 user=cpu_shares:8192",
+	} {
+		_, err := parsePartitionArgs(args)
+		c.Assert(err, NotNil, Commentf("parsing %q", args))
+	}
+}
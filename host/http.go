@@ -16,6 +16,7 @@ import (
 	"time"
 
 	"github.com/flynn/flynn/host/downloader"
+	"github.com/flynn/flynn/host/logmux"
 	"github.com/flynn/flynn/host/types"
 	"github.com/flynn/flynn/host/volume/api"
 	"github.com/flynn/flynn/host/volume/manager"
@@ -54,8 +55,13 @@ type Host struct {
 
 var ErrNotFound = errors.New("host: unknown job")
 
-func (h *Host) StopJob(id string) error {
-	log := h.log.New("fn", "StopJob", "job.id", id)
+func (h *Host) StopJob(id string, reason host.StopReason) error {
+	log := h.log.New("fn", "StopJob", "job.id", id, "reason", reason)
+
+	if !reason.Valid() {
+		log.Warn("invalid stop reason")
+		return fmt.Errorf("host: invalid stop reason %q", reason)
+	}
 
 	log.Info("acquiring state database")
 	if err := h.state.Acquire(); err != nil {
@@ -72,7 +78,7 @@ func (h *Host) StopJob(id string) error {
 	switch job.Status {
 	case host.StatusStarting:
 		log.Info("job status is starting, marking it as stopped")
-		h.state.SetForceStop(id)
+		h.state.SetForceStop(id, reason)
 
 		// if the job doesn't exist in the backend, mark it as done
 		// to avoid it remaining in the starting state indefinitely
@@ -81,8 +87,9 @@ func (h *Host) StopJob(id string) error {
 		}
 
 		return nil
-	case host.StatusRunning:
+	case host.StatusRunning, host.StatusReady:
 		log.Info("stopping job")
+		h.state.SetForceStop(id, reason)
 		return h.backend.Stop(id)
 	default:
 		log.Warn("job already stopped")
@@ -90,6 +97,29 @@ func (h *Host) StopJob(id string) error {
 	}
 }
 
+func (h *Host) RestartJob(id string) error {
+	log := h.log.New("fn", "RestartJob", "job.id", id)
+
+	log.Info("acquiring state database")
+	if err := h.state.Acquire(); err != nil {
+		log.Error("error acquiring state database", "err", err)
+		return err
+	}
+	defer h.state.Release()
+
+	job := h.state.GetJob(id)
+	if job == nil {
+		log.Warn("job not found")
+		return ErrNotFound
+	}
+	if job.Status != host.StatusRunning && job.Status != host.StatusReady {
+		log.Warn("job not running")
+		return host.ErrJobNotRunning
+	}
+	log.Info("restarting job")
+	return h.backend.Restart(id)
+}
+
 func (h *Host) SignalJob(id string, sig int) error {
 	log := h.log.New("fn", "SignalJob", "job.id", id, "sig", sig)
 
@@ -150,7 +180,21 @@ func (h *jobAPI) GetJob(w http.ResponseWriter, r *http.Request, ps httprouter.Pa
 
 func (h *jobAPI) StopJob(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	id := ps.ByName("id")
-	if err := h.host.StopJob(id); err != nil {
+	reason := host.StopReason(r.URL.Query().Get("reason"))
+	if !reason.Valid() {
+		httphelper.ValidationError(w, "reason", "is not a known stop reason")
+		return
+	}
+	if err := h.host.StopJob(id, reason); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+func (h *jobAPI) RestartJob(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id := ps.ByName("id")
+	if err := h.host.RestartJob(id); err != nil {
 		httphelper.Error(w, err)
 		return
 	}
@@ -301,6 +345,11 @@ func (h *jobAPI) AddJob(w http.ResponseWriter, r *http.Request, ps httprouter.Pa
 		httphelper.ValidationError(w, "ImageArtifact", "must be set")
 		return
 	}
+	if size := job.Config.LogBufferSize; size < 0 || size > logmux.MaxBufferSize {
+		log.Warn("rejecting job with invalid LogBufferSize", "size", size)
+		httphelper.ValidationError(w, "Config.LogBufferSize", fmt.Sprintf("must be between 0 and %d", logmux.MaxBufferSize))
+		return
+	}
 
 	log.Info("acquiring state database")
 	if err := h.host.state.Acquire(); err != nil {
@@ -403,7 +452,13 @@ func (h *jobAPI) ConfigureNetworking(w http.ResponseWriter, r *http.Request, _ h
 func (h *jobAPI) GetStatus(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	h.host.statusMtx.RLock()
 	defer h.host.statusMtx.RUnlock()
-	httphelper.JSON(w, 200, &h.host.status)
+	status := *h.host.status
+	if r, ok := h.host.backend.(IPPoolReporter); ok {
+		if free, ok := r.FreeIPs(); ok {
+			status.FreeIPs = &free
+		}
+	}
+	httphelper.JSON(w, 200, &status)
 }
 
 func (h *jobAPI) UpdateTags(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
@@ -429,6 +484,53 @@ func (h *Host) UpdateTags(tags map[string]string) error {
 	return nil
 }
 
+// drainer is implemented by backends which support draining the host
+type drainer interface {
+	Drain(stopJobs bool) error
+	Undrain()
+}
+
+var errDrainUnsupported = errors.New("host: backend does not support draining")
+
+func (h *jobAPI) Drain(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	stopJobs := r.URL.Query().Get("stop_jobs") == "true"
+	if err := h.host.Drain(stopJobs); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+func (h *jobAPI) Undrain(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if err := h.host.Undrain(); err != nil {
+		httphelper.Error(w, err)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+// Drain stops the host from running new jobs, and if stopJobs is true stops
+// its running jobs, waiting for them to stop
+func (h *Host) Drain(stopJobs bool) error {
+	backend, ok := h.backend.(drainer)
+	if !ok {
+		return errDrainUnsupported
+	}
+	h.log.Info("draining host", "fn", "Drain", "stop_jobs", stopJobs)
+	return backend.Drain(stopJobs)
+}
+
+// Undrain allows the host to run new jobs again after a call to Drain
+func (h *Host) Undrain() error {
+	backend, ok := h.backend.(drainer)
+	if !ok {
+		return errDrainUnsupported
+	}
+	h.log.Info("undraining host", "fn", "Undrain")
+	backend.Undrain()
+	return nil
+}
+
 func checkPort(port host.Port) bool {
 	l, err := net.Listen(port.Proto, fmt.Sprintf(":%d", port.Port))
 	if err != nil {
@@ -517,6 +619,7 @@ func (h *jobAPI) RegisterRoutes(r *httprouter.Router) error {
 	r.PUT("/host/jobs/:id", h.AddJob)
 	r.DELETE("/host/jobs/:id", h.StopJob)
 	r.PUT("/host/jobs/:id/signal/:signal", h.SignalJob)
+	r.POST("/host/jobs/:id/restart", h.RestartJob)
 	r.POST("/host/pull/images", h.PullImages)
 	r.POST("/host/pull/binaries", h.PullBinariesAndConfig)
 	r.POST("/host/discoverd", h.ConfigureDiscoverd)
@@ -525,6 +628,8 @@ func (h *jobAPI) RegisterRoutes(r *httprouter.Router) error {
 	r.POST("/host/resource-check", h.ResourceCheck)
 	r.POST("/host/update", h.Update)
 	r.POST("/host/tags", h.UpdateTags)
+	r.POST("/host/drain", h.Drain)
+	r.POST("/host/undrain", h.Undrain)
 	return nil
 }
 
@@ -533,6 +638,10 @@ func (h *Host) ServeHTTP() {
 
 	r.POST("/attach", newAttachHandler(h.state, h.backend, h.log).ServeHTTP)
 
+	if backend, ok := h.backend.(eventSubscriber); ok {
+		r.Handler("CONNECT", eventsRPCPath, newEventsRPCServer(backend))
+	}
+
 	jobAPI := &jobAPI{
 		host: h,
 		addJobRatelimitBucket: make(chan struct{}, h.maxJobConcurrency),
@@ -563,6 +672,10 @@ func (h *Host) OpenLogs(buffers host.LogBuffers) error {
 	return h.backend.OpenLogs(buffers)
 }
 
+func (h *Host) FlushLogs(timeout time.Duration) []string {
+	return h.backend.FlushLogs(timeout)
+}
+
 func (h *Host) CloseLogs() (host.LogBuffers, error) {
 	return h.backend.CloseLogs()
 }
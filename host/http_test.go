@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+
+	"github.com/flynn/flynn/host/logmux"
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/cluster"
+	. "github.com/flynn/go-check"
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+func (S) TestStopJobReason(c *C) {
+	state := NewState("host1", filepath.Join(c.MkDir(), "host-state-db"))
+	c.Assert(state.OpenDB(), IsNil)
+	defer state.CloseDB()
+	job := &host.Job{ID: "job1"}
+	c.Assert(state.AddJob(job), IsNil)
+	state.SetStatusRunning(job.ID)
+
+	log := log15.New()
+	log.SetHandler(log15.DiscardHandler())
+	h := &Host{state: state, backend: MockBackend{}, log: log}
+	r := httprouter.New()
+	(&jobAPI{host: h}).RegisterRoutes(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	stop := func(reason string) int {
+		req, err := http.NewRequest("DELETE", srv.URL+"/host/jobs/"+job.ID+"?reason="+reason, nil)
+		c.Assert(err, IsNil)
+		res, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	// an unknown reason is rejected without stopping the job
+	c.Assert(stop("bogus"), Equals, 400)
+	c.Assert(state.GetJob(job.ID).ForceStop, Equals, false)
+	c.Assert(h.StopJob(job.ID, host.StopReason("bogus")), NotNil)
+	c.Assert(state.GetJob(job.ID).ForceStop, Equals, false)
+
+	c.Assert(stop(string(host.StopReasonOperator)), Equals, 200)
+	c.Assert(state.GetJob(job.ID).StopReason, Equals, host.StopReasonOperator)
+}
+
+func (S) TestAddJobLogBufferSize(c *C) {
+	state := NewState("host1", filepath.Join(c.MkDir(), "host-state-db"))
+	c.Assert(state.OpenDB(), IsNil)
+	defer state.CloseDB()
+
+	log := log15.New()
+	log.SetHandler(log15.DiscardHandler())
+	h := &Host{state: state, backend: MockBackend{}, log: log}
+	r := httprouter.New()
+	(&jobAPI{host: h, addJobRatelimitBucket: make(chan struct{}, 10)}).RegisterRoutes(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	addJob := func(id string, size int) int {
+		job := &host.Job{
+			ImageArtifact: &host.Artifact{URI: "http://example.com/image.json", Type: host.ArtifactTypeDocker},
+			Config:        host.ContainerConfig{LogBufferSize: size},
+		}
+		data, err := json.Marshal(job)
+		c.Assert(err, IsNil)
+		req, err := http.NewRequest("PUT", srv.URL+"/host/jobs/"+id, bytes.NewReader(data))
+		c.Assert(err, IsNil)
+		req.Header.Set("Content-Type", "application/json")
+		res, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	c.Assert(addJob("too-large", logmux.MaxBufferSize+1), Equals, 400)
+	c.Assert(state.GetJob("too-large"), IsNil)
+	c.Assert(addJob("negative", -1), Equals, 400)
+	c.Assert(state.GetJob("negative"), IsNil)
+	c.Assert(addJob("max", logmux.MaxBufferSize), Equals, 200)
+	c.Assert(state.GetJob("max"), NotNil)
+}
+
+type drainBackend struct {
+	MockBackend
+	draining bool
+	stopJobs bool
+}
+
+func (b *drainBackend) Drain(stopJobs bool) error {
+	b.draining = true
+	b.stopJobs = stopJobs
+	return nil
+}
+
+func (b *drainBackend) Undrain() {
+	b.draining = false
+}
+
+func (S) TestDrainRoute(c *C) {
+	log := log15.New()
+	log.SetHandler(log15.DiscardHandler())
+	backend := &drainBackend{}
+	h := &Host{backend: backend, log: log}
+	r := httprouter.New()
+	(&jobAPI{host: h}).RegisterRoutes(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	client := cluster.NewHost("host1", srv.URL, nil, nil)
+
+	c.Assert(client.Drain(false), IsNil)
+	c.Assert(backend.draining, Equals, true)
+	c.Assert(backend.stopJobs, Equals, false)
+	c.Assert(client.Undrain(), IsNil)
+	c.Assert(backend.draining, Equals, false)
+	c.Assert(client.Drain(true), IsNil)
+	c.Assert(backend.draining, Equals, true)
+	c.Assert(backend.stopJobs, Equals, true)
+
+	// backends which don't support draining return an error
+	h.backend = MockBackend{}
+	c.Assert(client.Drain(false), NotNil)
+	c.Assert(client.Undrain(), NotNil)
+}
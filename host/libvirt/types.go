@@ -64,6 +64,7 @@ type Devices struct {
 	HostDevs    []HostDev    `xml:"hostdev"`
 	Interfaces  []Interface  `xml:"interface"`
 	Consoles    []Console    `xml:"console"`
+	MemBalloon  *MemBalloon  `xml:"memballoon,omitempty"`
 }
 
 type Filesystem struct {
@@ -109,6 +110,10 @@ type Console struct {
 	Type string `xml:"type,attr"`
 }
 
+type MemBalloon struct {
+	Model string `xml:"model,attr"`
+}
+
 type Network struct {
 	XMLName xml.Name `xml:"network"`
 	Name    string   `xml:"name"`
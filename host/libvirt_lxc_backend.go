@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"net"
 	"net/url"
 	"os"
@@ -18,12 +19,16 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/alexzorin/libvirt-go"
+	"github.com/armon/go-metrics"
+	"github.com/docker/docker/pkg/symlink"
 	"github.com/docker/docker/pkg/term"
 	"github.com/docker/libcontainer/netlink"
+	"github.com/docker/libcontainer/user"
 	"github.com/docker/libnetwork/ipallocator"
 	"github.com/flynn/flynn/discoverd/client"
 	"github.com/flynn/flynn/host/containerinit"
@@ -45,30 +50,43 @@ import (
 
 const (
 	imageRoot        = "/var/lib/docker"
+	storageDriver    = "aufs"
 	flynnRoot        = "/var/lib/flynn"
+	sharedMountRoot  = "/var/lib/flynn/shared-mounts"
+	envFileRoot      = "/var/lib/flynn/env-files"
+	dockerSocketPath = "/var/run/docker.sock"
+	caBundleRoot     = "/var/lib/flynn/ca-bundles"
+	caBundlePath     = "etc/ssl/certs/ca-certificates.crt"
 	defaultPartition = "user"
 )
 
-func NewLibvirtLXCBackend(state *State, vman *volumemanager.Manager, bridgeName, initPath, umountPath string, mux *logmux.Mux, partitionCGroups map[string]int64, logger log15.Logger) (Backend, error) {
+func NewLibvirtLXCBackend(state *State, vman *volumemanager.Manager, bridgeName, initPath, umountPath string, mux *logmux.Mux, partitionCGroups map[string]PartitionConfig, config LibvirtLXCConfig, logger log15.Logger) (Backend, error) {
 	libvirtc, err := libvirt.NewVirConnection("lxc:///")
 	if err != nil {
 		return nil, err
 	}
 
-	pinkertonCtx, err := pinkerton.BuildContext("aufs", imageRoot)
+	pinkertonCtx, err := pinkerton.BuildContext(storageDriver, imageRoot)
 	if err != nil {
 		return nil, err
 	}
 
-	for name, shares := range partitionCGroups {
-		if err := createCGroupPartition(name, shares); err != nil {
+	if config.MaxImagePulls < 1 {
+		return nil, fmt.Errorf("host: invalid maximum concurrent image pulls %d", config.MaxImagePulls)
+	}
+
+	for name, partition := range partitionCGroups {
+		if err := createCGroupPartition(name, partition); err != nil {
 			return nil, err
 		}
 	}
 
-	return &LibvirtLXCBackend{
+	removeOrphanedContainerInitSymlinks(logger, containerInitSymlinkDir)
+
+	l := &LibvirtLXCBackend{
 		InitPath:            initPath,
 		UmountPath:          umountPath,
+		LibvirtLXCConfig:    config,
 		libvirt:             libvirtc,
 		state:               state,
 		vman:                vman,
@@ -77,14 +95,109 @@ func NewLibvirtLXCBackend(state *State, vman *volumemanager.Manager, bridgeName,
 		containers:          make(map[string]*libvirtContainer),
 		defaultEnv:          make(map[string]string),
 		resolvConf:          "/etc/resolv.conf",
+		localtime:           "/etc/localtime",
+		zoneinfoRoot:        "/usr/share/zoneinfo",
 		mux:                 mux,
 		ipalloc:             ipallocator.New(),
+		jobIPs:              make(map[string]net.IP),
 		bridgeName:          bridgeName,
 		discoverdConfigured: make(chan struct{}),
 		networkConfigured:   make(chan struct{}),
 		partitionCGroups:    partitionCGroups,
+		sharedMounts:        newSharedMountRegistry(sharedMountRoot),
+		events:              newBackendEvents(),
+		pullSlots:           make(chan struct{}, config.MaxImagePulls),
+		cpusets:             newCPUSetReservations(),
+		hostPorts:           newHostPortReservations(),
+		artifactResolvers:   newArtifactResolvers(),
+		discoverdAddrs:      newServiceAddrCache(config.DiscoverdCacheTTL),
 		logger:              logger,
-	}, nil
+	}
+	docker := &dockerArtifactResolver{l}
+	l.RegisterArtifactResolver("http", docker)
+	l.RegisterArtifactResolver("https", docker)
+	go l.reapLogStreamsLoop()
+	if config.GCInterval > 0 {
+		go l.gcLoop(config.GCInterval)
+	}
+	return l, nil
+}
+
+// LibvirtLXCConfig is the configuration of a LibvirtLXCBackend
+type LibvirtLXCConfig struct {
+	// MaxImagePulls is the maximum number of concurrent image pulls and
+	// checkouts
+	MaxImagePulls int
+
+	// AllowInitOverride permits jobs to set Config.InitPath to run with
+	// an alternative container init binary
+	AllowInitOverride bool
+
+	// DiscoverdTimeout is how long jobs wait for discoverd and networking
+	// to be configured before failing, defaulting to
+	// defaultDiscoverdTimeout if not set
+	DiscoverdTimeout time.Duration
+
+	// ConfigWaitWarning, if non-zero, is how often a warning is logged
+	// while a job is waiting for discoverd or networking to be configured
+	ConfigWaitWarning time.Duration
+
+	// ResolvOptions are added as an options line to the resolv.conf
+	// mounted into containers (e.g. "ndots:0", "timeout:1")
+	ResolvOptions []string
+
+	// ResolvFallback adds the host's resolvers to the resolv.conf mounted
+	// into containers after the discoverd resolver, so that external names
+	// still resolve if discoverd is unavailable
+	ResolvFallback bool
+
+	// DockerSocketApps are the IDs of apps whose jobs may mount the Docker
+	// socket
+	DockerSocketApps []string
+
+	// PartitionFallback runs jobs with an unknown partition in the
+	// default partition rather than failing them
+	PartitionFallback bool
+
+	// NoExecTmp mounts /dev/shm and a tmpfs at /tmp noexec,nosuid,nodev
+	// in containers, unless overridden by the job
+	NoExecTmp bool
+
+	// MinFreeIPs is the number of container IPs which must be free for
+	// jobs which need an IP to be run, so they fail before the image is
+	// pulled rather than when the pool is exhausted
+	MinFreeIPs int
+
+	// DefaultMemory is the memory limit in bytes of jobs which don't
+	// specify one, defaulting to defaultJobMemory if zero
+	DefaultMemory int64
+
+	// MemBalloonModel, if set, is the model of a memory balloon device
+	// added to job domains (e.g. "virtio") so the host can reclaim memory
+	// the jobs are not using
+	MemBalloonModel string
+
+	// DefaultPIDs is the pids limit of jobs which don't specify one, so a
+	// fork bomb can't exhaust the host's PIDs, with zero meaning no limit
+	DefaultPIDs int64
+
+	// CABundle is the path of a file of CA certificates which is appended
+	// to the system CA bundle of containers, unless the job sets
+	// DisableCABundle
+	CABundle string
+
+	// TeeDir is the directory attach clients may have a copy of the
+	// output written to (see AttachRequest.TeeFile), which is disabled if
+	// empty
+	TeeDir string
+
+	// GCInterval, if non-zero, is how often image checkouts left behind
+	// by jobs which are no longer running are removed
+	GCInterval time.Duration
+
+	// DiscoverdCacheTTL is how long the addresses of discoverd services
+	// are cached when resolving artifact URIs, zero disabling the cache
+	DiscoverdCacheTTL time.Duration
 }
 
 type LibvirtLXCBackend struct {
@@ -96,12 +209,29 @@ type LibvirtLXCBackend struct {
 	pinkerton  *pinkerton.Context
 	ipalloc    *ipallocator.IPAllocator
 
+	// jobIPs maps job IDs to their container IPs, including those of jobs
+	// restored from state which are only reserved in ipalloc once
+	// networking is configured (indicated by ipsReserved)
+	ipMtx       sync.Mutex
+	jobIPs      map[string]net.IP
+	ipsReserved bool
+
+	// networkMtx serializes checking and recreating the libvirt network
+	networkMtx sync.Mutex
+
+	LibvirtLXCConfig
+
 	ifaceMTU   int
 	bridgeName string
 	bridgeAddr net.IP
 	bridgeNet  *net.IPNet
 	resolvConf string
 
+	// localtime is the host's timezone file and zoneinfoRoot the directory
+	// containing the timezone database
+	localtime    string
+	zoneinfoRoot string
+
 	logStreamMtx sync.Mutex
 	logStreams   map[string]map[string]*logmux.LogStream
 	mux          *logmux.Mux
@@ -109,18 +239,57 @@ type LibvirtLXCBackend struct {
 	containersMtx sync.RWMutex
 	containers    map[string]*libvirtContainer
 
+	// starting are the IDs of jobs being started by Run which have yet to
+	// be added to containers, and is also guarded by containersMtx
+	starting map[string]struct{}
+
 	envMtx     sync.RWMutex
 	defaultEnv map[string]string
 
 	discoverdConfigured chan struct{}
 	networkConfigured   chan struct{}
 
-	partitionCGroups map[string]int64 // name -> cpu shares
+	// discoverdWaiting and networkWaiting are the number of jobs waiting
+	// for discoverdConfigured and networkConfigured to be closed
+	discoverdWaiting int32
+	networkWaiting   int32
+
+	partitionCGroups map[string]PartitionConfig
+
+	sharedMounts *sharedMountRegistry
+
+	events *backendEvents
+
+	// pullSlots limits the number of concurrent image pulls and checkouts
+	pullSlots chan struct{}
+
+	// draining is set to 1 when the host is draining and should not run
+	// new jobs
+	draining int32
+
+	cpusets *cpusetReservations
+
+	hostPorts *hostPortReservations
+
+	artifactResolvers *artifactResolvers
+
+	// discoverdAddrs caches the addresses of services resolved by
+	// resolveDiscoverdURI
+	discoverdAddrs *serviceAddrCache
 
 	logger log15.Logger
 }
 
+// libvirtContainerStateVersion is the version of the serialized
+// libvirtContainer state, and should be incremented (with a migration added
+// to decodeContainerState) when the format changes
+const libvirtContainerStateVersion = 1
+
 type libvirtContainer struct {
+	// Version is the libvirtContainerStateVersion the container state was
+	// serialized with, zero being the unversioned format which preceded it
+	Version int
+
 	RootPath string
 	Domain   *lt.Domain
 	IP       net.IP
@@ -128,17 +297,121 @@ type libvirtContainer struct {
 	l        *LibvirtLXCBackend
 	done     chan struct{}
 	*containerinit.Client
+
+	// restarting is set to 1 when the container is being stopped by Restart
+	// or UpdateImage, or has exited and is to be run again due to the job's
+	// restart policy
+	restarting int32
+
+	// exitStatus is the exit status of a container stopped by Restart,
+	// which is set before done is closed
+	exitStatus int
+
+	// stopped is set to 1 when the container is being stopped by Stop, in
+	// which case it is not restarted by the job's RestartPolicy
+	stopped int32
+
+	// paused is set to 1 while the container's processes are frozen by
+	// Pause
+	paused int32
+
+	// Restarts is the number of times the job has been restarted by its
+	// RestartPolicy
+	Restarts int
+
+	// initLogTail retains the last lines of the init log so they can be
+	// included in the job error if the container fails to start
+	initLogTail tailBuffer
+
+	// sharedMounts are the names of the shared mounts acquired for the
+	// job, which are released on cleanup
+	sharedMountsMtx sync.Mutex
+	sharedMounts    []string
+
+	// DockerSocket is the path the Docker socket is mounted at if the job
+	// has MountDockerSocket set
+	DockerSocket string
+
+	// CABundle is the path the CA bundle is mounted at if the backend has
+	// a CABundle configured
+	CABundle string
+
+	// networkErr is set if the job is stopped by its NetworkCheck, and
+	// is used as the job's error once it exits
+	networkErrMtx sync.Mutex
+	networkErr    error
+
+	// unbindOnce and cleanupOnce ensure the container's mounts are
+	// unbound and its resources released exactly once, as both watch and
+	// the code which started the container may clean up after it
+	unbindOnce  sync.Once
+	cleanupOnce sync.Once
+}
+
+func (c *libvirtContainer) isRestarting() bool {
+	return atomic.LoadInt32(&c.restarting) == 1
+}
+
+func (c *libvirtContainer) isStopped() bool {
+	return atomic.LoadInt32(&c.stopped) == 1
+}
+
+func (c *libvirtContainer) isPaused() bool {
+	return atomic.LoadInt32(&c.paused) == 1
+}
+
+// logger returns a logger with the given context which redacts the values of
+// the job's secret environment variables
+func (c *libvirtContainer) logger(ctx ...interface{}) log15.Logger {
+	return redactSecrets(c.l.logger.New(ctx...), &c.job.Config)
 }
 
 type dockerImageConfig struct {
 	User       string
 	Env        []string
-	Cmd        []string
-	Entrypoint []string
+	Cmd        dockerCommand
+	Entrypoint dockerCommand
 	WorkingDir string
 	Volumes    map[string]struct{}
 }
 
+// dockerCommand is a Cmd or Entrypoint from a Docker image config, which is
+// either a list of arguments (exec form) or a single string to be run by
+// /bin/sh (shell form).
+type dockerCommand struct {
+	Args  []string
+	Shell bool
+}
+
+func (d *dockerCommand) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		if s != "" {
+			d.Args = []string{"/bin/sh", "-c", s}
+			d.Shell = true
+		}
+		return nil
+	}
+	return json.Unmarshal(data, &d.Args)
+}
+
+// containerArgs returns the arguments to run in the container, combining the
+// job's entrypoint and cmd with those from the image in the same way as
+// Docker (a shell form image entrypoint ignores any cmd).
+func containerArgs(job *host.Job, image *dockerImageConfig) []string {
+	if len(job.Config.Entrypoint) > 0 {
+		return append(job.Config.Entrypoint, job.Config.Cmd...)
+	}
+	args := image.Entrypoint.Args
+	if image.Entrypoint.Shell {
+		return args
+	}
+	if len(job.Config.Cmd) > 0 {
+		return append(args, job.Config.Cmd...)
+	}
+	return append(args, image.Cmd.Args...)
+}
+
 func writeContainerConfig(path string, c *containerinit.Config, envs ...map[string]string) error {
 	f, err := os.Create(path)
 	if err != nil {
@@ -193,11 +466,52 @@ var networkConfigAttempts = attempt.Strategy{
 	Delay: 200 * time.Millisecond,
 }
 
+// maxNameservers is the maximum number of nameservers used by the resolver
+// (MAXNS in glibc)
+const maxNameservers = 3
+
+// containerResolvConf returns the contents of the resolv.conf to mount into
+// containers
+func containerResolvConf(search, nameservers, options []string) []byte {
+	var buf bytes.Buffer
+	if len(search) > 0 {
+		fmt.Fprintf(&buf, "search %s\n", strings.Join(search, " "))
+	}
+	for _, nameserver := range nameservers {
+		fmt.Fprintf(&buf, "nameserver %s\n", nameserver)
+	}
+	if len(options) > 0 {
+		fmt.Fprintf(&buf, "options %s\n", strings.Join(options, " "))
+	}
+	return buf.Bytes()
+}
+
+// containerNameservers returns the nameservers for containers, which is the
+// discoverd resolver followed, if fallback is set, by the host's upstream
+// resolvers which are reachable from containers
+func containerNameservers(discoverd string, resolvers []string, fallback bool) []string {
+	nameservers := []string{discoverd}
+	if !fallback {
+		return nameservers
+	}
+	for _, r := range resolvers {
+		if len(nameservers) == maxNameservers {
+			break
+		}
+		// loopback resolvers (e.g. systemd-resolved) are not reachable
+		// from the container network namespace
+		if ip := net.ParseIP(r); ip == nil || ip.IsLoopback() || r == discoverd {
+			continue
+		}
+		nameservers = append(nameservers, r)
+	}
+	return nameservers
+}
+
 // ConfigureNetworking is called once during host startup and passed the
 // strategy and identifier of the networking coordinatior job. Currently the
 // only strategy implemented uses flannel.
 func (l *LibvirtLXCBackend) ConfigureNetworking(config *host.NetworkConfig) error {
-	log := l.logger.New("fn", "ConfigureNetworking")
 	var err error
 	l.bridgeAddr, l.bridgeNet, err = net.ParseCIDR(config.Subnet)
 	if err != nil {
@@ -248,29 +562,9 @@ func (l *LibvirtLXCBackend) ConfigureNetworking(config *host.NetworkConfig) erro
 		return err
 	}
 
-	network, err := l.libvirt.LookupNetworkByName(l.bridgeName)
-	if err != nil {
-		// network doesn't exist
-		networkConfig := &lt.Network{
-			Name:    l.bridgeName,
-			Bridge:  lt.Bridge{Name: l.bridgeName},
-			Forward: lt.Forward{Mode: "bridge"},
-		}
-		network, err = l.libvirt.NetworkDefineXML(string(networkConfig.XML()))
-		if err != nil {
-			return err
-		}
-	}
-	defer network.Free()
-	active, err := network.IsActive()
-	if err != nil {
+	if err := l.ensureNetwork(); err != nil {
 		return err
 	}
-	if !active {
-		if err := network.Create(); err != nil {
-			return err
-		}
-	}
 	if defaultNet, err := l.libvirt.LookupNetworkByName("default"); err == nil {
 		// The default network causes dnsmasq to run and bind to all interfaces,
 		// including ours. This prevents discoverd from binding its DNS server.
@@ -302,28 +596,202 @@ func (l *LibvirtLXCBackend) ConfigureNetworking(config *host.NetworkConfig) erro
 	if err := os.MkdirAll("/etc/flynn", 0755); err != nil {
 		return err
 	}
-	var resolvSearch string
-	if len(dnsConf.Search) > 0 {
-		resolvSearch = fmt.Sprintf("search %s\n", strings.Join(dnsConf.Search, " "))
-	}
-	if err := ioutil.WriteFile("/etc/flynn/resolv.conf", []byte(fmt.Sprintf("%snameserver %s\n", resolvSearch, l.bridgeAddr.String())), 0644); err != nil {
+	nameservers := containerNameservers(l.bridgeAddr.String(), dnsConf.Servers, l.ResolvFallback)
+	resolvConf := containerResolvConf(dnsConf.Search, nameservers, l.ResolvOptions)
+	if err := ioutil.WriteFile("/etc/flynn/resolv.conf", resolvConf, 0644); err != nil {
 		return err
 	}
 	l.resolvConf = "/etc/flynn/resolv.conf"
 
-	// Allocate IPs for running jobs
-	for i, container := range l.containers {
-		if !container.job.Config.HostNetwork {
-			var err error
-			l.containers[i].IP, err = l.ipalloc.RequestIP(l.bridgeNet, container.IP)
-			if err != nil {
-				log.Error("error requesting ip", "job.id", container.job.ID, "err", err)
-			}
+	// Allocate IPs for running jobs before any new jobs can be started
+	l.reserveJobIPs()
+
+	close(l.networkConfigured)
+
+	go l.reconcileNetworkingLoop()
+
+	return nil
+}
+
+// noexecMounts are the container paths mounted noexec,nosuid,nodev when
+// NoExecTmp is enabled
+var noexecMounts = []string{"/dev/shm", "/tmp"}
+
+// noexecTmp returns whether /dev/shm and /tmp should be mounted noexec for
+// the given job
+func (l *LibvirtLXCBackend) noexecTmp(job *host.Job) bool {
+	if job.Config.NoExecTmp != nil {
+		return *job.Config.NoExecTmp
+	}
+	return l.NoExecTmp
+}
+
+// domainFilesystems returns the filesystems of a container domain with the
+// given root, adding a tmpfs at /tmp if noexecTmp is set. Libvirt does not
+// support mount options for these filesystems, so containerinit remounts
+// them noexec (see containerinit.Config.NoExecMounts).
+func domainFilesystems(rootPath string, noexecTmp bool) []lt.Filesystem {
+	filesystems := []lt.Filesystem{
+		{
+			Type:   "mount",
+			Source: lt.FSRef{Dir: rootPath},
+			Target: lt.FSRef{Dir: "/"},
+		},
+		{
+			Type:   "ram",
+			Source: lt.FSRef{Usage: "65535"}, // 64MiB
+			Target: lt.FSRef{Dir: "/dev/shm"},
+		},
+	}
+	if noexecTmp {
+		filesystems = append(filesystems, lt.Filesystem{
+			Type:   "ram",
+			Source: lt.FSRef{Usage: "65535"}, // 64MiB
+			Target: lt.FSRef{Dir: "/tmp"},
+		})
+	}
+	return filesystems
+}
+
+// ensureNetwork defines and starts the libvirt network for the bridge if it
+// does not exist or is inactive, which happens if libvirtd restarts after
+// ConfigureNetworking has been called
+func (l *LibvirtLXCBackend) ensureNetwork() error {
+	l.networkMtx.Lock()
+	defer l.networkMtx.Unlock()
+	network, err := l.libvirt.LookupNetworkByName(l.bridgeName)
+	if err != nil {
+		// network doesn't exist
+		l.logger.Info("defining libvirt network", "fn", "ensureNetwork", "network", l.bridgeName)
+		networkConfig := &lt.Network{
+			Name:    l.bridgeName,
+			Bridge:  lt.Bridge{Name: l.bridgeName},
+			Forward: lt.Forward{Mode: "bridge"},
+		}
+		network, err = l.libvirt.NetworkDefineXML(string(networkConfig.XML()))
+		if err != nil {
+			return err
+		}
+	}
+	defer network.Free()
+	active, err := network.IsActive()
+	if err != nil {
+		return err
+	}
+	if !active {
+		l.logger.Info("starting libvirt network", "fn", "ensureNetwork", "network", l.bridgeName)
+		if err := network.Create(); err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
-	close(l.networkConfigured)
+// reserveJobIPs reserves the IPs of jobs restored from state, and must be
+// called before new jobs are allocated IPs
+func (l *LibvirtLXCBackend) reserveJobIPs() {
+	l.ipMtx.Lock()
+	defer l.ipMtx.Unlock()
+	for jobID, ip := range l.jobIPs {
+		if _, err := l.ipalloc.RequestIP(l.bridgeNet, ip); err != nil {
+			l.logger.Error("error requesting ip", "fn", "reserveJobIPs", "job.id", jobID, "ip", ip, "err", err)
+		}
+	}
+	l.ipsReserved = true
+}
+
+// restoreJobIP records the IP of a job restored from state, reserving it
+// immediately if networking is already configured
+func (l *LibvirtLXCBackend) restoreJobIP(jobID string, ip net.IP) {
+	l.ipMtx.Lock()
+	defer l.ipMtx.Unlock()
+	l.jobIPs[jobID] = ip
+	if !l.ipsReserved {
+		return
+	}
+	if _, err := l.ipalloc.RequestIP(l.bridgeNet, ip); err != nil {
+		l.logger.Error("error requesting ip", "fn", "restoreJobIP", "job.id", jobID, "ip", ip, "err", err)
+	}
+}
+
+// ErrInsufficientIPs is returned when running a job which needs an IP on a
+// host with fewer than MinFreeIPs free, and the job should be retried on
+// another host
+var ErrInsufficientIPs = errors.New("host: insufficient free IP addresses")
+
+// FreeIPs returns the number of free addresses in the container IP pool, and
+// false if networking has not yet been configured
+func (l *LibvirtLXCBackend) FreeIPs() (int, bool) {
+	l.ipMtx.Lock()
+	defer l.ipMtx.Unlock()
+	if !l.ipsReserved {
+		return 0, false
+	}
+	// the bridge address is also allocated from the pool
+	return ipPoolSize(l.bridgeNet) - len(l.jobIPs) - 1, true
+}
 
+// requestJobIP allocates an IP for a new job, which is ip if set. A job being
+// run again (e.g. by Restart) keeps the IP still allocated to it.
+func (l *LibvirtLXCBackend) requestJobIP(jobID string, ip net.IP) (net.IP, error) {
+	l.ipMtx.Lock()
+	defer l.ipMtx.Unlock()
+	if current, ok := l.jobIPs[jobID]; ok && (ip == nil || ip.Equal(current)) {
+		return current, nil
+	}
+	ip, err := l.ipalloc.RequestIP(l.bridgeNet, ip)
+	if err != nil {
+		return nil, err
+	}
+	l.jobIPs[jobID] = ip
+	return ip, nil
+}
+
+// releaseJobIP releases the IP allocated to a job, if any
+func (l *LibvirtLXCBackend) releaseJobIP(jobID string) {
+	l.ipMtx.Lock()
+	defer l.ipMtx.Unlock()
+	ip, ok := l.jobIPs[jobID]
+	if !ok {
+		return
+	}
+	delete(l.jobIPs, jobID)
+	if l.ipsReserved {
+		l.ipalloc.ReleaseIP(l.bridgeNet, ip)
+	}
+}
+
+// networkReconcileInterval is how often the iptables rules for the bridge
+// are checked and restored if missing
+const networkReconcileInterval = 30 * time.Second
+
+func (l *LibvirtLXCBackend) reconcileNetworkingLoop() {
+	for range time.Tick(networkReconcileInterval) {
+		if err := l.ReconcileNetworking(); err != nil {
+			l.logger.Error("error reconciling networking", "fn", "reconcileNetworkingLoop", "err", err)
+		}
+	}
+}
+
+// ReconcileNetworking restores the iptables rules which provide outbound
+// connectivity for containers if they have been removed (e.g. by another
+// tool flushing iptables).
+func (l *LibvirtLXCBackend) ReconcileNetworking() error {
+	select {
+	case <-l.networkConfigured:
+	default:
+		return errors.New("host: networking not configured")
+	}
+	if err := iptables.EnableOutboundNAT(l.bridgeName, l.bridgeNet.String()); err != nil {
+		return err
+	}
+	for _, r := range l.hostPorts.All() {
+		for _, p := range r.ports {
+			if err := iptables.ForwardPort(l.bridgeName, p.Proto, p.HostPort, r.ip.String(), p.Port); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
@@ -357,680 +825,2615 @@ func (l *LibvirtLXCBackend) SetDefaultEnv(k, v string) {
 	}
 }
 
-func (l *LibvirtLXCBackend) Run(job *host.Job, runConfig *RunConfig) (err error) {
-	log := l.logger.New("fn", "run", "job.id", job.ID)
+// ErrJobRunning is returned when running a job which is already being run
+var ErrJobRunning = errors.New("host: job already running")
 
-	// if the job has been stopped, just return
-	if l.state.GetJob(job.ID).ForceStop {
-		log.Info("skipping start of stopped job")
-		return nil
+// claimJob marks the given job as starting, returning ErrJobRunning if it is
+// already starting or running so that it is not run twice
+func (l *LibvirtLXCBackend) claimJob(id string) error {
+	l.containersMtx.Lock()
+	defer l.containersMtx.Unlock()
+	if _, ok := l.containers[id]; ok {
+		return ErrJobRunning
+	}
+	if _, ok := l.starting[id]; ok {
+		return ErrJobRunning
+	}
+	if l.starting == nil {
+		l.starting = make(map[string]struct{})
 	}
+	l.starting[id] = struct{}{}
+	return nil
+}
 
-	log.Info("starting job", "job.artifact.uri", job.ImageArtifact.URI, "job.cmd", job.Config.Cmd)
+func (l *LibvirtLXCBackend) releaseJob(id string) {
+	l.containersMtx.Lock()
+	delete(l.starting, id)
+	l.containersMtx.Unlock()
+}
 
-	defer func() {
-		if err != nil {
-			l.state.SetStatusFailed(job.ID, err)
-		}
-	}()
+// ErrHostDraining is returned when running a job on a draining host, and the
+// job should be retried on another host
+var ErrHostDraining = errors.New("host: host is draining")
 
-	if job.Partition == "" {
-		job.Partition = defaultPartition
-	}
-	if _, ok := l.partitionCGroups[job.Partition]; !ok {
-		return fmt.Errorf("host: invalid job partition %q", job.Partition)
+// Drain marks the host as draining so that new jobs are rejected with
+// ErrHostDraining, and if stopJobs is true, gracefully stops all running
+// jobs, waiting for them to stop.
+func (l *LibvirtLXCBackend) Drain(stopJobs bool) error {
+	log := l.logger.New("fn", "Drain")
+	log.Info("draining host")
+	atomic.StoreInt32(&l.draining, 1)
+	if !stopJobs {
+		return nil
 	}
 
-	if !job.Config.HostNetwork {
-		<-l.networkConfigured
-	}
-	if _, ok := job.Config.Env["DISCOVERD"]; !ok {
-		<-l.discoverdConfigured
+	l.containersMtx.RLock()
+	containers := make([]*libvirtContainer, 0, len(l.containers))
+	for _, c := range l.containers {
+		containers = append(containers, c)
 	}
+	l.containersMtx.RUnlock()
 
-	if runConfig == nil {
-		runConfig = &RunConfig{}
-	}
-	container := &libvirtContainer{
-		l:    l,
-		job:  job,
-		done: make(chan struct{}),
-	}
-	if !job.Config.HostNetwork {
-		container.IP, err = l.ipalloc.RequestIP(l.bridgeNet, runConfig.IP)
-		if err != nil {
-			log.Error("error requesting ip", "err", err)
-			return err
-		}
-		log.Info("obtained ip", "network", l.bridgeNet.String(), "ip", container.IP.String())
-		l.state.SetContainerIP(job.ID, container.IP)
+	var wg sync.WaitGroup
+	errs := make(chan error, len(containers))
+	for _, c := range containers {
+		wg.Add(1)
+		go func(c *libvirtContainer) {
+			defer wg.Done()
+			log.Info("stopping job", "job.id", c.job.ID)
+			l.state.SetForceStop(c.job.ID, host.StopReasonDrain)
+			if err := c.Stop(); err != nil && err != rpcplus.ErrShutdown {
+				log.Error("error stopping job", "job.id", c.job.ID, "err", err)
+				errs <- err
+				return
+			}
+			<-c.done
+		}(c)
 	}
-	defer func() {
-		if err != nil {
-			go container.cleanup()
-		}
-	}()
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
 
-	log.Info("pulling image")
-	artifactURI, err := l.resolveDiscoverdURI(job.ImageArtifact.URI)
-	if err != nil {
-		log.Error("error resolving artifact URI", "err", err)
-		return err
-	}
-	// TODO(lmars): stream pull progress (maybe to the app log?)
-	imageID, err := l.pinkerton.PullDocker(artifactURI, ioutil.Discard)
-	if err != nil {
-		log.Error("error pulling image", "err", err)
-		return err
-	}
+// Undrain allows the host to run new jobs again after a call to Drain
+func (l *LibvirtLXCBackend) Undrain() {
+	l.logger.Info("undraining host", "fn", "Undrain")
+	atomic.StoreInt32(&l.draining, 0)
+}
 
-	log.Info("reading image config")
-	imageConfig, err := readDockerImageConfig(imageID)
-	if err != nil {
-		log.Error("error reading image config", "err", err)
-		return err
-	}
+func (l *LibvirtLXCBackend) IsDraining() bool {
+	return atomic.LoadInt32(&l.draining) == 1
+}
 
-	log.Info("checking out image")
-	var rootPath string
-	// creating an AUFS mount can fail intermittently with EINVAL, so try a
-	// few times (see https://github.com/flynn/flynn/issues/2044)
-	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(50 * time.Millisecond) {
-		rootPath, err = l.pinkerton.Checkout(job.ID, imageID)
-		if err == nil || !strings.HasSuffix(err.Error(), "invalid argument") {
-			break
+// pullSlotCheckInterval is how often a job waiting for an image pull slot
+// checks whether it has been stopped
+const pullSlotCheckInterval = 100 * time.Millisecond
+
+// acquirePullSlot blocks until fewer than the maximum number of image pulls
+// are running, returning false if the job is stopped while waiting
+func (l *LibvirtLXCBackend) acquirePullSlot(jobID string) bool {
+	ticker := time.NewTicker(pullSlotCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case l.pullSlots <- struct{}{}:
+			return true
+		case <-ticker.C:
+			if l.jobStopped(jobID) {
+				return false
+			}
 		}
 	}
-	if err != nil {
-		log.Error("error checking out image", "err", err)
-		return err
+}
+
+func (l *LibvirtLXCBackend) releasePullSlot() {
+	<-l.pullSlots
+}
+
+// jobStopped returns whether the given job has been force stopped or removed
+func (l *LibvirtLXCBackend) jobStopped(jobID string) bool {
+	job := l.state.GetJob(jobID)
+	return job == nil || job.ForceStop
+}
+
+var errPullAbandoned = errors.New("host: job stopped while pulling image")
+
+// pullImage pulls the job's image using the given resolver, returning
+// errPullAbandoned as soon as the job is stopped rather than waiting for the
+// pull to finish. The pull itself can't be interrupted, so it continues in the
+// background and releases the caller's pull slot once it finishes.
+func (l *LibvirtLXCBackend) pullImage(resolver ArtifactResolver, job *host.Job) (string, error) {
+	type result struct {
+		imageID string
+		err     error
+	}
+	pulled := make(chan result, 1)
+	go func() {
+		imageID, err := resolver.Pull(job.ImageArtifact)
+		pulled <- result{imageID, err}
+	}()
+
+	ticker := time.NewTicker(pullSlotCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case res := <-pulled:
+			return res.imageID, res.err
+		case <-ticker.C:
+			if l.jobStopped(job.ID) {
+				go func() {
+					<-pulled
+					l.releasePullSlot()
+				}()
+				return "", errPullAbandoned
+			}
+		}
 	}
-	container.RootPath = rootPath
+}
 
-	log.Info("mounting container directories and files")
-	if err := bindMount(l.InitPath, filepath.Join(rootPath, ".containerinit"), false, true); err != nil {
-		log.Error("error bind mounting .containerinit", "err", err)
-		return err
+// ImagePullError is returned by PrewarmImage when an image can't be pulled,
+// distinguishing images which don't exist from failures which may succeed
+// if retried
+type ImagePullError struct {
+	URI      string
+	NotFound bool
+	Err      error
+}
+
+func (e *ImagePullError) Error() string {
+	if e.NotFound {
+		return fmt.Sprintf("host: image not found: %s: %s", e.URI, e.Err)
 	}
-	if err := os.MkdirAll(filepath.Join(rootPath, "etc"), 0755); err != nil {
-		log.Error("error creating /etc in container root", "err", err)
-		return err
+	return fmt.Sprintf("host: error pulling image %s: %s", e.URI, e.Err)
+}
+
+// Temporary returns whether pulling the image may succeed if retried
+func (e *ImagePullError) Temporary() bool {
+	return !e.NotFound
+}
+
+// isImageNotFound returns whether err from pulling an image indicates that
+// the image or tag doesn't exist, which the registry client only reports in
+// the error message
+func isImageNotFound(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "not found") || strings.Contains(msg, "unknown manifest")
+}
+
+// PrewarmImage pulls the given artifact into the local image cache without
+// checking it out or running it, so that jobs using it start sooner. Pulling
+// an image which is already cached is a no-op, and the pull counts towards
+// the maximum number of concurrent image pulls.
+func (l *LibvirtLXCBackend) PrewarmImage(artifact *host.Artifact) error {
+	log := l.logger.New("fn", "PrewarmImage", "artifact.uri", artifact.URI)
+
+	resolver, err := l.artifactResolvers.Get(artifact.URI)
+	if err != nil {
+		log.Error("error resolving artifact URI", "err", err)
+		return &ImagePullError{URI: artifact.URI, NotFound: true, Err: err}
 	}
 
-	if err := bindMount(l.resolvConf, filepath.Join(rootPath, "etc/resolv.conf"), false, true); err != nil {
-		log.Error("error bind mounting resolv.conf", "err", err)
-		return err
+	log.Info("waiting for image pull slot")
+	l.pullSlots <- struct{}{}
+	defer l.releasePullSlot()
+
+	log.Info("pulling image")
+	pullStart := time.Now()
+	imageID, err := resolver.Pull(artifact)
+	if err != nil {
+		log.Error("error pulling image", "err", err)
+		return &ImagePullError{URI: artifact.URI, NotFound: isImageNotFound(err), Err: err}
 	}
+	metrics.MeasureSince([]string{"backend", "prewarm", "pull"}, pullStart)
+	log.Info("pulled image", "image.id", imageID)
+	return nil
+}
 
-	jobIDParts := strings.SplitN(job.ID, "-", 2)
-	var hostname string
-	if len(jobIDParts) == 1 {
-		hostname = jobIDParts[0]
-	} else {
-		hostname = jobIDParts[1]
+// initPath returns the path of the init binary to run the job with, which is
+// the job's InitPath if overriding is allowed, or the backend's InitPath
+func (l *LibvirtLXCBackend) initPath(job *host.Job) (string, error) {
+	path := job.Config.InitPath
+	if path == "" {
+		return l.InitPath, nil
 	}
-	if len(hostname) > 64 {
-		hostname = hostname[:64]
+	if !l.AllowInitOverride {
+		return "", errors.New("host: overriding the init path is not enabled on this host")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("host: invalid init path %q: %s", path, err)
+	}
+	if !info.Mode().IsRegular() || info.Mode().Perm()&0111 == 0 {
+		return "", fmt.Errorf("host: invalid init path %q: not an executable file", path)
 	}
+	return path, nil
+}
 
-	if err := writeHostname(filepath.Join(rootPath, "etc/hosts"), hostname); err != nil {
-		log.Error("error writing hosts file", "err", err)
-		return err
+// defaultTimezone is the timezone jobs run in if they don't specify one
+const defaultTimezone = "UTC"
+
+// timezone returns the name of the timezone to run the job in along with the
+// path of the timezone file to mount at /etc/localtime. The name is empty if
+// the job uses the host's timezone and it cannot be determined.
+func (l *LibvirtLXCBackend) timezone(job *host.Job) (string, string, error) {
+	tz := job.Config.Timezone
+	if tz == "" {
+		tz = defaultTimezone
+	}
+	if tz == "host" {
+		path, err := filepath.EvalSymlinks(l.localtime)
+		if err != nil {
+			return "", "", fmt.Errorf("host: error determining host timezone: %s", err)
+		}
+		name, err := filepath.Rel(l.zoneinfoRoot, path)
+		if err != nil || strings.HasPrefix(name, "..") {
+			name = ""
+		}
+		return name, path, nil
 	}
-	if err := os.MkdirAll(filepath.Join(rootPath, ".container-shared"), 0700); err != nil {
-		log.Error("error createing .container-shared", "err", err)
-		return err
+	if filepath.IsAbs(tz) || filepath.Clean(tz) != tz || strings.HasPrefix(tz, "..") {
+		return "", "", fmt.Errorf("host: unknown timezone %q", tz)
+	}
+	path := filepath.Join(l.zoneinfoRoot, tz)
+	if info, err := os.Stat(path); err != nil || !info.Mode().IsRegular() {
+		return "", "", fmt.Errorf("host: unknown timezone %q", tz)
 	}
+	return tz, path, nil
+}
+
+// mountTargets returns the paths in the container at which the job's mounts,
+// volumes and shared mounts are mounted
+func mountTargets(job *host.Job) []string {
+	var targets []string
 	for _, m := range job.Config.Mounts {
-		if err := os.MkdirAll(filepath.Join(rootPath, m.Location), 0755); err != nil {
-			log.Error("error creating directory for mount point", "dir", m.Location, "err", err)
-			return err
+		targets = append(targets, m.Location)
+	}
+	for _, v := range job.Config.Volumes {
+		targets = append(targets, v.Target)
+	}
+	for _, m := range job.Config.SharedMounts {
+		targets = append(targets, m.Target)
+	}
+	return targets
+}
+
+// createMountedWorkDir creates the working directory if it is inside one of
+// the given mount targets, as the directory cannot be provided by the image.
+// Each path component is created in turn so that symlinks inside the mount
+// cannot be used to create directories outside of it.
+func createMountedWorkDir(rootPath, dir string, targets []string) error {
+	if dir == "" {
+		return nil
+	}
+	dir = filepath.Clean(dir)
+	if !filepath.IsAbs(dir) {
+		return fmt.Errorf("host: invalid working directory %q: must be an absolute path", dir)
+	}
+	for _, target := range targets {
+		target = filepath.Join("/", target)
+		rel, err := filepath.Rel(target, dir)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			continue
 		}
-		if m.Target == "" {
-			return errors.New("host: invalid empty mount target")
+		path := filepath.Join(rootPath, target)
+		for _, name := range strings.Split(rel, "/") {
+			if name == "." {
+				continue
+			}
+			path = filepath.Join(path, name)
+			info, err := os.Lstat(path)
+			if os.IsNotExist(err) {
+				if err := os.Mkdir(path, 0755); err != nil {
+					return fmt.Errorf("host: error creating working directory %q: %s", dir, err)
+				}
+				continue
+			} else if err != nil {
+				return fmt.Errorf("host: error creating working directory %q: %s", dir, err)
+			}
+			if !info.IsDir() {
+				return fmt.Errorf("host: error creating working directory %q: %s is not a directory", dir, name)
+			}
 		}
-		if err := bindMount(m.Target, filepath.Join(rootPath, m.Location), m.Writeable, true); err != nil {
-			log.Error("error bind mounting", "target", m.Target, "location", m.Location, "err", err)
-			return err
+		return nil
+	}
+	return nil
+}
+
+// checkDockerSocket returns an error if the job mounts the Docker socket but
+// its app is not in DockerSocketApps
+func (l *LibvirtLXCBackend) checkDockerSocket(job *host.Job) error {
+	if !job.Config.MountDockerSocket {
+		return nil
+	}
+	appID := job.Metadata["flynn-controller.app"]
+	if appID != "" {
+		for _, id := range l.DockerSocketApps {
+			if id == appID {
+				return nil
+			}
 		}
 	}
+	return fmt.Errorf("host: app %q is not permitted to mount the Docker socket", appID)
+}
 
-	// apply volumes
-	for _, v := range job.Config.Volumes {
-		vol := l.vman.GetVolume(v.VolumeID)
-		if vol == nil {
-			err := fmt.Errorf("job %s required volume %s, but that volume does not exist", job.ID, v.VolumeID)
-			log.Error("missing required volume", "volumeID", v.VolumeID, "err", err)
+// writeCABundle writes the system CA bundle of the container root at rootPath
+// followed by the CA certificates in the file extra to dst. If the system
+// bundle is a symlink it is resolved in the container root and replaced with
+// an empty file so the combined bundle can be mounted over it. An error is
+// returned if a directory containing either the bundle or the file it links
+// to is a symlink, as it would be resolved on the host.
+func writeCABundle(dst, rootPath, extra string) error {
+	if err := checkSymlinkParents(rootPath, caBundlePath); err != nil {
+		return err
+	}
+	target := filepath.Join(rootPath, caBundlePath)
+	var bundle []byte
+	info, err := os.Lstat(target)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return err
+	case info.Mode()&os.ModeSymlink != 0:
+		link, err := os.Readlink(target)
+		if err != nil {
 			return err
 		}
-		if err := os.MkdirAll(filepath.Join(rootPath, v.Target), 0755); err != nil {
-			log.Error("error creating mount point for volume", "dir", v.Target, "err", err)
+		if !filepath.IsAbs(link) {
+			link = filepath.Join(filepath.Dir(caBundlePath), link)
+		}
+		// clean the link as an absolute path so that ".." can't
+		// resolve outside of the container root
+		link = filepath.Join("/", link)
+		if err := checkSymlinkParents(rootPath, link); err != nil {
 			return err
 		}
-		if err := bindMount(vol.Location(), filepath.Join(rootPath, v.Target), v.Writeable, true); err != nil {
-			log.Error("error bind mounting volume", "target", v.Target, "volumeID", v.VolumeID, "err", err)
+		// only follow the link to a regular file so that it can't be
+		// used to read files on the host
+		link = filepath.Join(rootPath, link)
+		if info, err := os.Lstat(link); err == nil && info.Mode().IsRegular() {
+			if bundle, err = ioutil.ReadFile(link); err != nil {
+				return err
+			}
+		}
+		if err := os.Remove(target); err != nil {
+			return err
+		}
+	default:
+		if bundle, err = ioutil.ReadFile(target); err != nil {
 			return err
 		}
 	}
-
-	// mutating job state, take state write lock
-	l.state.mtx.Lock()
-	if job.Config.Env == nil {
-		job.Config.Env = make(map[string]string)
+	if len(bundle) > 0 && bundle[len(bundle)-1] != '\n' {
+		bundle = append(bundle, '\n')
 	}
-	for i, p := range job.Config.Ports {
-		if p.Proto != "tcp" && p.Proto != "udp" {
-			err := fmt.Errorf("unknown port proto %q", p.Proto)
-			log.Error("error allocating port", "proto", p.Proto, "err", err)
+	certs, err := ioutil.ReadFile(extra)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst, append(bundle, certs...), 0644)
+}
+
+// checkSymlinkParents returns an error if any existing directory containing
+// path in the container root at rootPath is a symlink
+func checkSymlinkParents(rootPath, path string) error {
+	dir := rootPath
+	for _, name := range strings.Split(filepath.Dir(filepath.Join("/", path)), "/") {
+		if name == "" {
+			continue
+		}
+		dir = filepath.Join(dir, name)
+		info, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
 			return err
 		}
-
-		if p.Port == 0 {
-			job.Config.Ports[i].Port = 5000 + i
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("host: refusing to resolve %s in the container root, %s is a symlink", path, strings.TrimPrefix(dir, rootPath))
 		}
-		if i == 0 {
-			job.Config.Env["PORT"] = strconv.Itoa(job.Config.Ports[i].Port)
+	}
+	return nil
+}
+
+// dockerSocketTarget returns the path in the container root to mount the
+// Docker socket at. Images commonly have /var/run as an absolute symlink to
+// /run which would resolve on the host, so /run/docker.sock is used instead
+// in that case.
+func dockerSocketTarget(rootPath string) (string, error) {
+	dir := filepath.Join(rootPath, "var/run")
+	if info, err := os.Lstat(dir); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		dir = filepath.Join(rootPath, "run")
+	}
+	info, err := os.Lstat(dir)
+	if os.IsNotExist(err) {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", err
 		}
-		job.Config.Env[fmt.Sprintf("PORT_%d", i)] = strconv.Itoa(job.Config.Ports[i].Port)
+	} else if err != nil {
+		return "", err
+	} else if !info.IsDir() {
+		return "", fmt.Errorf("host: cannot mount the Docker socket in %s, it is not a directory", strings.TrimPrefix(dir, rootPath))
 	}
+	return filepath.Join(dir, "docker.sock"), nil
+}
 
-	if !job.Config.HostNetwork {
-		job.Config.Env["EXTERNAL_IP"] = container.IP.String()
+// defaultJobMemory is the memory limit of jobs which don't specify one if the
+// backend has no DefaultMemory configured
+const defaultJobMemory = 1 << 30
+
+// jobMemory returns the job's memory limit in bytes, defaulting to
+// DefaultMemory if the job doesn't specify one
+func (l *LibvirtLXCBackend) jobMemory(job *host.Job) int64 {
+	if spec, ok := job.Resources[resource.TypeMemory]; ok && spec.Limit != nil {
+		return *spec.Limit
 	}
-	// release the write lock, we won't mutate global structures from here on out
-	l.state.mtx.Unlock()
+	if l.DefaultMemory > 0 {
+		return l.DefaultMemory
+	}
+	return defaultJobMemory
+}
 
-	config := &containerinit.Config{
-		TTY:           job.Config.TTY,
-		OpenStdin:     job.Config.Stdin,
-		WorkDir:       job.Config.WorkingDir,
-		Resources:     job.Resources,
-		FileArtifacts: job.FileArtifacts,
+// jobPIDs returns the job's pids limit, defaulting to DefaultPIDs if the job
+// doesn't specify one
+func (l *LibvirtLXCBackend) jobPIDs(job *host.Job) int64 {
+	if spec, ok := job.Resources[resource.TypePIDs]; ok && spec.Limit != nil {
+		return *spec.Limit
 	}
-	if !job.Config.HostNetwork {
-		config.IP = container.IP.String() + "/24"
-		config.Gateway = l.bridgeAddr.String()
+	return l.DefaultPIDs
+}
+
+// pidsCGroupSupported returns whether the pids cgroup controller is mounted,
+// which requires Linux 4.3
+func pidsCGroupSupported() bool {
+	_, err := os.Stat(filepath.Join(cgroupRoot, "pids", "cgroup.procs"))
+	return err == nil
+}
+
+// limitPIDs creates the job's pids cgroup with the given limit and moves the
+// container's processes into it, as libvirt does not manage the pids
+// controller. The container's processes are paused until resumed in watch, so
+// none are missed, and the processes they go on to start are created in the
+// cgroup.
+func limitPIDs(partition, jobID string, limit int64) error {
+	dir := jobCGroupPath("pids", partition, jobID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("error creating pids cgroup: %s", err)
+	}
+	if err := writePIDsLimit(dir, limit); err != nil {
+		return err
 	}
-	if config.WorkDir == "" {
-		config.WorkDir = imageConfig.WorkingDir
+	pids, err := ioutil.ReadFile(filepath.Join(jobCGroupPath("cpu", partition, jobID), "cgroup.procs"))
+	if err != nil {
+		return fmt.Errorf("error reading cgroup param: %s", err)
 	}
-	if job.Config.Uid > 0 {
-		config.User = strconv.Itoa(job.Config.Uid)
-	} else if imageConfig.User != "" {
-		// TODO: check and lookup user from image config
+	f, err := os.OpenFile(filepath.Join(dir, "cgroup.procs"), os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("error writing cgroup param: %s", err)
 	}
-	if len(job.Config.Entrypoint) > 0 {
-		config.Args = job.Config.Entrypoint
-		config.Args = append(config.Args, job.Config.Cmd...)
-	} else {
-		config.Args = imageConfig.Entrypoint
-		if len(job.Config.Cmd) > 0 {
-			config.Args = append(config.Args, job.Config.Cmd...)
-		} else {
-			config.Args = append(config.Args, imageConfig.Cmd...)
+	defer f.Close()
+	// the kernel moves a single process per write
+	for _, pid := range strings.Fields(string(pids)) {
+		if _, err := f.Write([]byte(pid + "\n")); err != nil {
+			return fmt.Errorf("error moving process %s to pids cgroup: %s", pid, err)
 		}
 	}
-	for _, port := range job.Config.Ports {
-		config.Ports = append(config.Ports, port)
-	}
+	return nil
+}
 
-	log.Info("writing config")
-	l.envMtx.RLock()
-	err = writeContainerConfig(filepath.Join(rootPath, ".containerconfig"), config,
-		map[string]string{
-			"PATH": "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
-			"TERM": "xterm",
-			"HOME": "/",
-		},
-		l.defaultEnv,
-		job.Config.Env,
-		map[string]string{
-			"HOSTNAME": hostname,
-		},
-	)
-	l.envMtx.RUnlock()
-	if err != nil {
-		log.Error("error writing config", "err", err)
+// removePIDsCGroup removes the job's pids cgroup created by limitPIDs, if any,
+// once its processes have exited
+func removePIDsCGroup(partition, jobID string) error {
+	if err := os.Remove(jobCGroupPath("pids", partition, jobID)); err != nil && !os.IsNotExist(err) {
 		return err
 	}
+	return nil
+}
 
-	domain := &lt.Domain{
-		Type:   "lxc",
-		Name:   job.ID,
-		Memory: lt.UnitInt{Value: 1, Unit: "GiB"},
-		OS: lt.OS{
-			Type: lt.OSType{Value: "exe"},
-			Init: "/.containerinit",
-		},
-		Devices: lt.Devices{
-			Filesystems: []lt.Filesystem{
-				{
-					Type:   "mount",
-					Source: lt.FSRef{Dir: rootPath},
-					Target: lt.FSRef{Dir: "/"},
-				},
-				{
-					Type:   "ram",
-					Source: lt.FSRef{Usage: "65535"}, // 64MiB
-					Target: lt.FSRef{Dir: "/dev/shm"},
-				},
-			},
-			Consoles: []lt.Console{{Type: "pty"}},
-		},
-		Resource: &lt.Resource{
-			Partition: "/machine/" + job.Partition,
-		},
-		OnPoweroff: "preserve",
-		OnCrash:    "preserve",
+// writePIDsLimit limits the number of processes and threads in the given
+// pids cgroup
+func writePIDsLimit(dir string, limit int64) error {
+	if err := ioutil.WriteFile(filepath.Join(dir, "pids.max"), strconv.AppendInt(nil, limit, 10), 0644); err != nil {
+		return fmt.Errorf("error writing cgroup param: %s", err)
 	}
-	if spec, ok := job.Resources[resource.TypeMemory]; ok && spec.Limit != nil {
-		domain.Memory = lt.UnitInt{Value: *spec.Limit, Unit: "bytes"}
+	return nil
+}
+
+// memBalloon returns the memory balloon device of job domains, or nil if
+// MemBalloonModel is not set
+func (l *LibvirtLXCBackend) memBalloon() *lt.MemBalloon {
+	if l.MemBalloonModel == "" {
+		return nil
 	}
-	if spec, ok := job.Resources[resource.TypeCPU]; ok && spec.Limit != nil {
-		domain.CPUTune = &lt.CPUTune{Shares: milliCPUToShares(*spec.Limit)}
+	return &lt.MemBalloon{Model: l.MemBalloonModel}
+}
+
+// memoryPerJob returns the host's RAM divided between the given number of
+// jobs
+func memoryPerJob(jobs int) (int64, error) {
+	if jobs <= 0 {
+		return 0, fmt.Errorf("host: invalid job density %d", jobs)
+	}
+	var info syscall.Sysinfo_t
+	if err := syscall.Sysinfo(&info); err != nil {
+		return 0, err
 	}
+	return int64(info.Totalram) * int64(info.Unit) / int64(jobs), nil
+}
 
-	if !job.Config.HostNetwork {
-		domain.Devices.Interfaces = []lt.Interface{{
-			Type:   "network",
-			Source: lt.InterfaceSrc{Network: l.bridgeName},
-		}}
+// setJobPartition defaults the job's partition, falling back to the default
+// partition if the job's partition is unknown and PartitionFallback is set
+func (l *LibvirtLXCBackend) setJobPartition(log log15.Logger, job *host.Job) error {
+	if job.Partition == "" {
+		job.Partition = defaultPartition
+	}
+	if _, ok := l.partitionCGroups[job.Partition]; ok {
+		return nil
+	}
+	if _, ok := l.partitionCGroups[defaultPartition]; !ok || !l.PartitionFallback {
+		return fmt.Errorf("host: invalid job partition %q", job.Partition)
 	}
+	log.Warn("unknown job partition, falling back to the default partition", "partition", job.Partition, "default", defaultPartition)
+	job.Partition = defaultPartition
+	return nil
+}
 
-	// attempt to run libvirt commands multiple times in case the libvirt daemon is
-	// temporarily unavailable (e.g. it has restarted, which sometimes happens in CI)
-	log.Info("defining domain")
-	var vd libvirt.VirDomain
-	if err := l.withConnRetries(func() (err error) {
-		vd, err = l.libvirt.DomainDefineXML(string(domain.XML()))
-		return
-	}); err != nil {
-		log.Error("error defining domain", "err", err)
-		return err
+func validateReadiness(r *host.ReadinessCheck) error {
+	if r == nil {
+		return nil
+	}
+	switch r.Type {
+	case host.ReadinessCheckFD:
+		return nil
+	case host.ReadinessCheckPort:
+		if r.Port <= 0 || r.Port > 65535 {
+			return fmt.Errorf("host: invalid readiness check port %d", r.Port)
+		}
+		return nil
+	default:
+		return fmt.Errorf("host: unknown readiness check type %q", r.Type)
+	}
+}
+
+func validateRestartPolicy(p *host.RestartPolicy) error {
+	if p == nil {
+		return nil
+	}
+	switch p.Type {
+	case host.RestartPolicyNever, host.RestartPolicyOnFailure, host.RestartPolicyAlways:
+	default:
+		return fmt.Errorf("host: unknown restart policy type %q", p.Type)
+	}
+	if p.MaxRetries < 0 {
+		return fmt.Errorf("host: invalid restart policy max retries %d", p.MaxRetries)
+	}
+	if p.Backoff < 0 {
+		return fmt.Errorf("host: invalid restart policy backoff %s", p.Backoff)
+	}
+	return nil
+}
+
+const (
+	defaultRestartBackoff = time.Second
+	maxRestartBackoff     = time.Minute
+)
+
+// shouldRestart returns whether a job which exited with the given status
+// after being restarted the given number of times should be restarted
+// according to its restart policy, and if so how long to wait first
+func shouldRestart(p *host.RestartPolicy, exitStatus, restarts int) (bool, time.Duration) {
+	if p == nil {
+		return false, 0
+	}
+	switch p.Type {
+	case host.RestartPolicyAlways:
+	case host.RestartPolicyOnFailure:
+		if exitStatus == 0 {
+			return false, 0
+		}
+	default:
+		return false, 0
+	}
+	if p.MaxRetries > 0 && restarts >= p.MaxRetries {
+		return false, 0
+	}
+	delay := p.Backoff
+	if delay == 0 {
+		delay = defaultRestartBackoff
+	}
+	for i := 0; i < restarts && delay < maxRestartBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxRestartBackoff {
+		delay = maxRestartBackoff
+	}
+	return true, delay
+}
+
+func timezoneEnv(name string) map[string]string {
+	if name == "" {
+		return nil
+	}
+	return map[string]string{"TZ": name}
+}
+
+func (l *LibvirtLXCBackend) Run(job *host.Job, runConfig *RunConfig) (err error) {
+	log := redactSecrets(l.logger.New("fn", "run", "job.id", job.ID), &job.Config)
+
+	// reject duplicate runs (e.g. a retried request) before acquiring any
+	// resources or updating the state of the job
+	if err := l.claimJob(job.ID); err != nil {
+		log.Error("job is already running")
+		return err
+	}
+	var started bool
+	defer func() {
+		// once started, the claim is released by watch
+		if !started {
+			l.releaseJob(job.ID)
+		}
+	}()
+
+	// if the job has been stopped, just return
+	if l.state.GetJob(job.ID).ForceStop {
+		log.Info("skipping start of stopped job")
+		return nil
+	}
+
+	log.Info("starting job", "job.artifact.uri", job.ImageArtifact.URI, "job.cmd", job.Config.Cmd)
+
+	runStart := time.Now()
+	defer func() {
+		if err != nil {
+			metrics.IncrCounter([]string{"backend", "run", "failed"}, 1)
+		} else {
+			metrics.MeasureSince([]string{"backend", "run", "start"}, runStart)
+		}
+	}()
+
+	defer func() {
+		if err != nil && (runConfig == nil || !runConfig.Update) {
+			l.state.SetStatusFailed(job.ID, err)
+		}
+	}()
+
+	if l.IsDraining() {
+		log.Info("rejecting job as host is draining")
+		return ErrHostDraining
+	}
+	if !job.Config.HostNetwork {
+		if free, ok := l.FreeIPs(); ok && free < l.MinFreeIPs {
+			log.Info("rejecting job as there are not enough free IPs", "free", free, "min", l.MinFreeIPs)
+			return ErrInsufficientIPs
+		}
+	}
+
+	if err := l.setJobPartition(log, job); err != nil {
+		return err
+	}
+	tzName, tzPath, err := l.timezone(job)
+	if err != nil {
+		log.Error("error determining timezone", "err", err)
+		return err
+	}
+	if err := validateReadiness(job.Config.Readiness); err != nil {
+		log.Error("invalid readiness check", "err", err)
+		return err
+	}
+	if err := validateRestartPolicy(job.Config.RestartPolicy); err != nil {
+		log.Error("invalid restart policy", "err", err)
+		return err
+	}
+	if err := validateSecretEnv(job.Config.SecretEnv); err != nil {
+		log.Error("invalid secret env", "err", err)
+		return err
+	}
+	if err := validateStopSignals(job.Config.StopSignals); err != nil {
+		log.Error("invalid stop signals", "err", err)
+		return err
+	}
+	if err := validateNetworkCheck(job.Config.NetworkCheck); err != nil {
+		log.Error("invalid network check", "err", err)
+		return err
+	}
+	if err := l.checkDockerSocket(job); err != nil {
+		log.Error("error checking Docker socket mount", "err", err)
+		return err
+	}
+
+	if !job.Config.HostNetwork {
+		if err := l.waitNetworkConfigured(log); err != nil {
+			log.Error("error waiting for networking", "err", err)
+			return err
+		}
+	}
+	if _, ok := job.Config.Env["DISCOVERD"]; !ok {
+		if err := l.waitDiscoverdConfigured(log); err != nil {
+			log.Error("error waiting for discoverd", "err", err)
+			return err
+		}
+	}
+
+	log.Info("waiting for image pull slot")
+	if !l.acquirePullSlot(job.ID) {
+		log.Info("skipping start of job stopped while waiting to pull image")
+		return nil
+	}
+	var releasePullSlotOnce sync.Once
+	releasePullSlot := func() { releasePullSlotOnce.Do(l.releasePullSlot) }
+	defer releasePullSlot()
+
+	if runConfig == nil {
+		runConfig = &RunConfig{}
+	}
+	container := &libvirtContainer{
+		Version:  libvirtContainerStateVersion,
+		Restarts: runConfig.Restarts,
+		l:        l,
+		job:      job,
+		done:     make(chan struct{}),
+	}
+	if !job.Config.HostNetwork {
+		container.IP, err = l.requestJobIP(job.ID, runConfig.IP)
+		if err != nil {
+			log.Error("error requesting ip", "err", err)
+			return err
+		}
+		log.Info("obtained ip", "network", l.bridgeNet.String(), "ip", container.IP.String())
+		l.state.SetContainerIP(job.ID, container.IP)
+	}
+	defer func() {
+		if err != nil {
+			// keep the IP of a job being updated as it is run
+			// again with its previous image
+			if runConfig.Update {
+				atomic.StoreInt32(&container.restarting, 1)
+			}
+			go container.cleanup()
+		}
+	}()
+
+	if job.Config.CPUSet != "" {
+		log.Info("reserving cpuset", "cpuset", job.Config.CPUSet, "exclusive", job.Config.CPUSetExclusive)
+		partitionCPUs, err := ioutil.ReadFile(filepath.Join("/sys/fs/cgroup/cpuset/machine", job.Partition+".partition", "cpuset.cpus"))
+		if err != nil {
+			log.Error("error reading partition cpuset", "err", err)
+			return err
+		}
+		if err := validateCPUSet(job.Config.CPUSet, string(partitionCPUs)); err != nil {
+			log.Error("error validating cpuset", "err", err)
+			return err
+		}
+		if err := l.cpusets.Reserve(job.ID, job.Config.CPUSet, job.Config.CPUSetExclusive); err != nil {
+			log.Error("error reserving cpuset", "err", err)
+			return err
+		}
+	}
+
+	log.Info("pulling image")
+	resolver, err := l.artifactResolvers.Get(job.ImageArtifact.URI)
+	if err != nil {
+		log.Error("error resolving artifact URI", "err", err)
+		return err
+	}
+	pullStart := time.Now()
+	imageID, err := l.pullImage(resolver, job)
+	if err == errPullAbandoned {
+		// the abandoned pull now owns the pull slot
+		releasePullSlotOnce.Do(func() {})
+		log.Info("skipping start of job stopped while pulling image")
+		go container.cleanup()
+		return nil
+	} else if err != nil {
+		log.Error("error pulling image", "err", err)
+		return err
+	}
+	metrics.MeasureSince([]string{"backend", "run", "pull"}, pullStart)
+
+	log.Info("reading image config")
+	imageConfig, err := readDockerImageConfig(imageID)
+	if err != nil {
+		log.Error("error reading image config", "err", err)
+		return err
+	}
+
+	log.Info("checking out image")
+	checkoutStart := time.Now()
+	rootPath, err := checkoutWithRetry(func() (string, error) {
+		return l.pinkerton.Checkout(job.ID, imageID)
+	}, transientMountErrors[storageDriver], checkoutRetryTimeout, checkoutRetryInterval)
+	if err != nil {
+		log.Error("error checking out image", "err", err)
+		return err
+	}
+	metrics.MeasureSince([]string{"backend", "run", "checkout"}, checkoutStart)
+	container.RootPath = rootPath
+	releasePullSlot()
+
+	log.Info("mounting container directories and files")
+	initPath, err := l.initPath(job)
+	if err != nil {
+		log.Error("error determining init path", "err", err)
+		return err
+	}
+	if err := bindMount(initPath, filepath.Join(rootPath, ".containerinit"), bindMountOptions{Private: true}); err != nil {
+		log.Error("error bind mounting .containerinit", "err", err)
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(rootPath, "etc"), 0755); err != nil {
+		log.Error("error creating /etc in container root", "err", err)
+		return err
+	}
+
+	if err := bindMount(l.resolvConf, filepath.Join(rootPath, "etc/resolv.conf"), bindMountOptions{Private: true}); err != nil {
+		log.Error("error bind mounting resolv.conf", "err", err)
+		return err
+	}
+
+	// images commonly have /etc/localtime as an absolute symlink which
+	// would resolve on the host, so replace it before mounting over it
+	localtime := filepath.Join(rootPath, "etc/localtime")
+	if info, err := os.Lstat(localtime); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		if err := os.Remove(localtime); err != nil {
+			log.Error("error removing /etc/localtime symlink", "err", err)
+			return err
+		}
+	}
+	if err := bindMount(tzPath, localtime, bindMountOptions{Private: true}); err != nil {
+		log.Error("error bind mounting localtime", "err", err)
+		return err
+	}
+
+	if job.Config.MountDockerSocket {
+		target, err := dockerSocketTarget(rootPath)
+		if err != nil {
+			log.Error("error determining Docker socket mount point", "err", err)
+			return err
+		}
+		if err := bindMount(dockerSocketPath, target, bindMountOptions{Private: true, NoExec: true, NoSUID: true}); err != nil {
+			log.Error("error bind mounting Docker socket", "err", err)
+			return err
+		}
+		container.DockerSocket = target
+	}
+
+	if l.CABundle != "" && !job.Config.DisableCABundle {
+		bundle := filepath.Join(caBundleRoot, job.ID)
+		if err := writeCABundle(bundle, rootPath, l.CABundle); err != nil {
+			log.Error("error writing CA bundle", "err", err)
+			return err
+		}
+		target := filepath.Join(rootPath, caBundlePath)
+		if err := bindMount(bundle, target, bindMountOptions{Private: true, NoExec: true, NoSUID: true}); err != nil {
+			log.Error("error bind mounting CA bundle", "err", err)
+			return err
+		}
+		container.CABundle = target
+	}
+
+	jobIDParts := strings.SplitN(job.ID, "-", 2)
+	var hostname string
+	if len(jobIDParts) == 1 {
+		hostname = jobIDParts[0]
+	} else {
+		hostname = jobIDParts[1]
+	}
+	if len(hostname) > 64 {
+		hostname = hostname[:64]
+	}
+
+	if err := writeHostname(filepath.Join(rootPath, "etc/hosts"), hostname); err != nil {
+		log.Error("error writing hosts file", "err", err)
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(rootPath, ".container-shared"), 0700); err != nil {
+		log.Error("error createing .container-shared", "err", err)
+		return err
+	}
+	for _, m := range job.Config.Mounts {
+		if err := os.MkdirAll(filepath.Join(rootPath, m.Location), 0755); err != nil {
+			log.Error("error creating directory for mount point", "dir", m.Location, "err", err)
+			return err
+		}
+		if m.Target == "" {
+			return errors.New("host: invalid empty mount target")
+		}
+		if err := bindMount(m.Target, filepath.Join(rootPath, m.Location), bindMountOptions{Writeable: m.Writeable, Private: true}); err != nil {
+			log.Error("error bind mounting", "target", m.Target, "location", m.Location, "err", err)
+			return err
+		}
+	}
+
+	// apply volumes
+	for _, v := range job.Config.Volumes {
+		switch v.Type {
+		case "", host.VolumeTypeDisk:
+		case host.VolumeTypeTmpfs:
+			if err := mountTmpfsVolume(filepath.Join(rootPath, v.Target), v, job.Config.Uid); err != nil {
+				log.Error("error mounting tmpfs volume", "target", v.Target, "err", err)
+				return err
+			}
+			continue
+		default:
+			err := fmt.Errorf("host: unknown volume type %q", v.Type)
+			log.Error("invalid volume", "target", v.Target, "err", err)
+			return err
+		}
+		vol := l.vman.GetVolume(v.VolumeID)
+		if vol == nil {
+			err := fmt.Errorf("job %s required volume %s, but that volume does not exist", job.ID, v.VolumeID)
+			log.Error("missing required volume", "volumeID", v.VolumeID, "err", err)
+			return err
+		}
+		if err := os.MkdirAll(filepath.Join(rootPath, v.Target), 0755); err != nil {
+			log.Error("error creating mount point for volume", "dir", v.Target, "err", err)
+			return err
+		}
+		if err := bindMount(vol.Location(), filepath.Join(rootPath, v.Target), bindMountOptions{Writeable: v.Writeable, Private: true, NoExec: v.NoExec, NoSUID: v.NoSUID}); err != nil {
+			log.Error("error bind mounting volume", "target", v.Target, "volumeID", v.VolumeID, "err", err)
+			return err
+		}
+	}
+
+	// apply shared mounts
+	sharedMountDirs, err := container.acquireSharedMounts()
+	if err != nil {
+		log.Error("error acquiring shared mounts", "err", err)
+		return err
+	}
+	for i, m := range job.Config.SharedMounts {
+		if m.Target == "" {
+			return errors.New("host: invalid empty shared mount target")
+		}
+		if err := bindMount(sharedMountDirs[i], filepath.Join(rootPath, m.Target), bindMountOptions{Writeable: true, Private: true}); err != nil {
+			log.Error("error bind mounting shared mount", "name", m.Name, "target", m.Target, "err", err)
+			return err
+		}
+	}
+
+	if len(job.Config.EnvFiles) > 0 {
+		gid, err := jobGid(rootPath, job.Config.Uid)
+		if err != nil {
+			log.Error("error determining job gid", "uid", job.Config.Uid, "err", err)
+			return err
+		}
+		dir := filepath.Join(envFileRoot, job.ID)
+		if err := writeEnvFiles(dir, job.Config.EnvFiles, job.Config.Uid, gid); err != nil {
+			log.Error("error writing env files", "err", err)
+			return err
+		}
+		for i, f := range job.Config.EnvFiles {
+			target, err := resolveRootPath(rootPath, f.Path)
+			if err != nil {
+				log.Error("error resolving env file path", "path", f.Path, "err", err)
+				return err
+			}
+			if err := bindMount(filepath.Join(dir, strconv.Itoa(i)), target, bindMountOptions{Private: true, NoExec: true, NoSUID: true}); err != nil {
+				log.Error("error bind mounting env file", "path", f.Path, "err", err)
+				return err
+			}
+		}
+	}
+
+	workDir := job.Config.WorkingDir
+	if workDir == "" {
+		workDir = imageConfig.WorkingDir
+	}
+	if err := createMountedWorkDir(rootPath, workDir, mountTargets(job)); err != nil {
+		log.Error("error creating working directory", "dir", workDir, "err", err)
+		return err
+	}
+	noexecTmp := l.noexecTmp(job)
+
+	// mutating job state, take state write lock
+	l.state.mtx.Lock()
+	if job.Config.Env == nil {
+		job.Config.Env = make(map[string]string)
+	}
+	for i, p := range job.Config.Ports {
+		if p.Proto != "tcp" && p.Proto != "udp" {
+			err := fmt.Errorf("unknown port proto %q", p.Proto)
+			log.Error("error allocating port", "proto", p.Proto, "err", err)
+			return err
+		}
+
+		if p.Port == 0 {
+			job.Config.Ports[i].Port = 5000 + i
+		}
+		if i == 0 {
+			job.Config.Env["PORT"] = strconv.Itoa(job.Config.Ports[i].Port)
+		}
+		job.Config.Env[fmt.Sprintf("PORT_%d", i)] = strconv.Itoa(job.Config.Ports[i].Port)
+	}
+
+	if !job.Config.HostNetwork {
+		job.Config.Env["EXTERNAL_IP"] = container.IP.String()
+	}
+	// release the write lock, we won't mutate global structures from here on out
+	l.state.mtx.Unlock()
+
+	if err := l.forwardHostPorts(job, container.IP); err != nil {
+		log.Error("error forwarding host ports", "err", err)
+		return err
+	}
+
+	config := &containerinit.Config{
+		TTY:            job.Config.TTY,
+		OpenStdin:      job.Config.Stdin,
+		WorkDir:        workDir,
+		Resources:      job.Resources,
+		FileArtifacts:  job.FileArtifacts,
+		Readiness:      job.Config.Readiness,
+		PostStart:      job.Config.PostStart,
+		PostStartFatal: job.Config.PostStartFatal,
+		PreStop:        job.Config.PreStop,
+	}
+	if noexecTmp {
+		config.NoExecMounts = noexecMounts
+	}
+	if !job.Config.HostNetwork {
+		config.IP = container.IP.String() + "/24"
+		config.Gateway = l.bridgeAddr.String()
+	}
+	if job.Config.Uid > 0 {
+		config.User = strconv.Itoa(job.Config.Uid)
+	} else if imageConfig.User != "" {
+		// TODO: check and lookup user from image config
+	}
+	config.Args = containerArgs(job, imageConfig)
+	for _, port := range job.Config.Ports {
+		config.Ports = append(config.Ports, port)
+	}
+
+	log.Info("writing config")
+	l.envMtx.RLock()
+	err = writeContainerConfig(filepath.Join(rootPath, ".containerconfig"), config,
+		map[string]string{
+			"PATH": "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+			"TERM": "xterm",
+			"HOME": "/",
+		},
+		l.defaultEnv,
+		timezoneEnv(tzName),
+		job.Config.Env,
+		map[string]string{
+			"HOSTNAME": hostname,
+		},
+	)
+	l.envMtx.RUnlock()
+	if err != nil {
+		log.Error("error writing config", "err", err)
+		return err
+	}
+
+	domain := &lt.Domain{
+		Type:   "lxc",
+		Name:   job.ID,
+		UUID:   l.domainUUID(job.ID),
+		Memory: lt.UnitInt{Value: l.jobMemory(job), Unit: "bytes"},
+		OS: lt.OS{
+			Type: lt.OSType{Value: "exe"},
+			Init: "/.containerinit",
+		},
+		Devices: lt.Devices{
+			Filesystems: domainFilesystems(rootPath, noexecTmp),
+			Consoles:    []lt.Console{{Type: "pty"}},
+			MemBalloon:  l.memBalloon(),
+		},
+		Resource: &lt.Resource{
+			Partition: "/machine/" + job.Partition,
+		},
+		OnPoweroff: "preserve",
+		OnCrash:    "preserve",
+	}
+	if spec, ok := job.Resources[resource.TypeCPU]; ok && spec.Limit != nil {
+		domain.CPUTune = &lt.CPUTune{Shares: milliCPUToShares(*spec.Limit)}
+	}
+
+	if !job.Config.HostNetwork {
+		domain.Devices.Interfaces = []lt.Interface{{
+			Type:   "network",
+			Source: lt.InterfaceSrc{Network: l.bridgeName},
+		}}
+
+		// the network may have been lost if libvirtd has restarted
+		log.Info("checking libvirt network")
+		if err := l.withConnRetries(l.ensureNetwork); err != nil {
+			log.Error("error ensuring libvirt network", "err", err)
+			return err
+		}
+	}
+
+	// attempt to run libvirt commands multiple times in case the libvirt daemon is
+	// temporarily unavailable (e.g. it has restarted, which sometimes happens in CI)
+	log.Info("defining domain")
+	var vd libvirt.VirDomain
+	if err := l.withConnRetries(func() (err error) {
+		vd, err = l.libvirt.DomainDefineXML(string(domain.XML()))
+		return
+	}); err != nil {
+		log.Error("error defining domain", "err", err)
+		return err
+	}
+	defer vd.Free()
+
+	log.Info("creating domain")
+	if err := l.withConnRetries(vd.Create); err != nil {
+		log.Error("error creating domain", "err", err)
+		if err := vd.Undefine(); err != nil {
+			log.Error("error undefining domain", "err", err)
+		}
+		return err
+	}
+	log.Info("getting domain uuid")
+	uuid, err := vd.GetUUIDString()
+	if err != nil {
+		log.Error("error getting domain uuid", "err", err)
+		return err
+	}
+	l.state.SetContainerID(job.ID, uuid)
+
+	// the container process is paused until resumed in watch, so restrict
+	// device access before it gets a chance to run
+	log.Info("restricting device access")
+	devices := job.Config.AllowedDevices
+	if devices == nil {
+		devices = host.DefaultDeviceRules
+	}
+	if err := writeDeviceRules(jobCGroupPath("devices", job.Partition, job.ID), devices); err != nil {
+		log.Error("error restricting device access", "err", err)
+		return err
+	}
+	if limit := l.jobPIDs(job); limit > 0 {
+		if pidsCGroupSupported() {
+			log.Info("limiting pids", "limit", limit)
+			if err := limitPIDs(job.Partition, job.ID, limit); err != nil {
+				log.Error("error limiting pids", "err", err)
+				return err
+			}
+		} else {
+			log.Warn("not limiting pids as the pids cgroup controller is not available", "limit", limit)
+		}
+	}
+	if job.Config.CPUSet != "" {
+		log.Info("pinning job to cpuset", "cpuset", job.Config.CPUSet)
+		if err := ioutil.WriteFile(filepath.Join(jobCGroupPath("cpuset", job.Partition, job.ID), "cpuset.cpus"), []byte(job.Config.CPUSet), 0644); err != nil {
+			log.Error("error writing job cpuset", "err", err)
+			return fmt.Errorf("error writing cgroup param: %s", err)
+		}
+	}
+
+	domainXML, err := vd.GetXMLDesc(0)
+	if err != nil {
+		log.Error("error getting domain xml", "err", err)
+		return err
+	}
+	container.Domain = &lt.Domain{}
+	if err := xml.Unmarshal([]byte(domainXML), container.Domain); err != nil {
+		log.Error("error unmarshalling domain xml", "err", err)
+		return err
+	}
+
+	started = true
+	go container.watch(nil, nil)
+
+	log.Info("job started")
+	return nil
+}
+
+// waitDiscoverdConfigured waits for discoverd to be configured, returning an
+// error if it is not configured within DiscoverdTimeout
+func (l *LibvirtLXCBackend) waitDiscoverdConfigured(log log15.Logger) error {
+	return l.waitConfigured(log, "discoverd", l.discoverdConfigured, &l.discoverdWaiting)
+}
+
+// waitNetworkConfigured waits for networking to be configured, returning an
+// error if it is not configured within DiscoverdTimeout
+func (l *LibvirtLXCBackend) waitNetworkConfigured(log log15.Logger) error {
+	return l.waitConfigured(log, "network", l.networkConfigured, &l.networkWaiting)
+}
+
+// defaultDiscoverdTimeout is how long jobs wait for discoverd and networking
+// to be configured if DiscoverdTimeout is not set
+const defaultDiscoverdTimeout = 5 * time.Minute
+
+func (l *LibvirtLXCBackend) discoverdTimeout() time.Duration {
+	if l.DiscoverdTimeout <= 0 {
+		return defaultDiscoverdTimeout
+	}
+	return l.DiscoverdTimeout
+}
+
+// waitConfigured waits for the given channel to be closed, tracking the
+// number of waiting jobs in a gauge and logging a warning every
+// ConfigWaitWarning so that a host which is slow to come up is noticed
+func (l *LibvirtLXCBackend) waitConfigured(log log15.Logger, name string, configured <-chan struct{}, waiting *int32) error {
+	select {
+	case <-configured:
+		return nil
+	default:
+	}
+
+	start := time.Now()
+	metrics.SetGauge([]string{"backend", "run", "waiting", name}, float32(atomic.AddInt32(waiting, 1)))
+	defer func() {
+		metrics.SetGauge([]string{"backend", "run", "waiting", name}, float32(atomic.AddInt32(waiting, -1)))
+		metrics.MeasureSince([]string{"backend", "run", "wait", name}, start)
+	}()
+
+	var warn <-chan time.Time
+	if l.ConfigWaitWarning > 0 {
+		ticker := time.NewTicker(l.ConfigWaitWarning)
+		defer ticker.Stop()
+		warn = ticker.C
+	}
+	timeout := l.discoverdTimeout()
+	timeoutCh := time.After(timeout)
+	for {
+		select {
+		case <-configured:
+			return nil
+		case <-warn:
+			log.Warn(fmt.Sprintf("still waiting for %s to be configured", name), "waited", time.Since(start))
+		case <-timeoutCh:
+			return fmt.Errorf("host: %s not configured after %s", name, timeout)
+		}
+	}
+}
+
+// RegisterArtifactResolver sets the resolver used to pull image artifacts
+// with URIs of the given scheme
+func (l *LibvirtLXCBackend) RegisterArtifactResolver(scheme string, r ArtifactResolver) {
+	l.artifactResolvers.Register(scheme, r)
+}
+
+// resolveDiscoverdURI resolves a discoverd host in the given URI to an address
+// using the configured discoverd URL as the host is likely not using discoverd
+// to resolve DNS queries
+func (l *LibvirtLXCBackend) resolveDiscoverdURI(uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasSuffix(u.Host, ".discoverd") {
+		return uri, nil
+	}
+
+	// ensure discoverd is configured
+	if err := l.waitDiscoverdConfigured(l.logger.New("fn", "resolveDiscoverdURI", "host", u.Host)); err != nil {
+		return "", fmt.Errorf("host: error resolving %s: %s", u.Host, err)
+	}
+	l.envMtx.Lock()
+	discURL := l.defaultEnv["DISCOVERD"]
+	l.envMtx.Unlock()
+
+	// lookup the service and pick a random address
+	service := strings.TrimSuffix(u.Host, ".discoverd")
+	addrs, err := l.discoverdAddrs.Get(service, func(service string) ([]string, error) {
+		return discoverd.NewClientWithURL(discURL).Service(service).Addrs()
+	})
+	if err != nil {
+		return "", err
+	} else if len(addrs) == 0 {
+		return "", fmt.Errorf("lookup %s: no such host", u.Host)
+	}
+	u.Host = addrs[random.Math.Intn(len(addrs))]
+	return u.String(), nil
+}
+
+// invalidateDiscoverdURI removes the cached addresses of the discoverd service
+// in the given URI, if any, so that they are looked up again
+func (l *LibvirtLXCBackend) invalidateDiscoverdURI(uri string) {
+	u, err := url.Parse(uri)
+	if err != nil || !strings.HasSuffix(u.Host, ".discoverd") {
+		return
+	}
+	l.discoverdAddrs.Invalidate(strings.TrimSuffix(u.Host, ".discoverd"))
+}
+
+var cleanupMountsAttempts = attempt.Strategy{
+	Total: 5 * time.Second,
+	Delay: 200 * time.Millisecond,
+}
+
+type nsumountError struct {
+	pid         int
+	desc        string
+	mountpoints []string
+}
+
+func (e *nsumountError) Error() string {
+	return fmt.Sprintf("host: error running nsumount %d: %s (remaining mountpoints: %s)", e.pid, e.desc, strings.Join(e.mountpoints, ", "))
+}
+
+// cleanupMounts unmounts leaked mountpoints from the namespace of the given
+// pid, retrying with whichever mountpoints remain if nsumount fails as
+// mounts may be briefly busy
+func (c *libvirtContainer) cleanupMounts(pid int) error {
+	return cleanupMountsAttempts.RunWithValidator(func() error {
+		mountpoints, err := leakedMountpoints(pid)
+		if err != nil {
+			return err
+		}
+		if len(mountpoints) == 0 {
+			// no mountpoints to clean up
+			return nil
+		}
+
+		out, err := exec.Command(c.l.UmountPath, append([]string{strconv.Itoa(pid)}, mountpoints...)...).CombinedOutput()
+		if err != nil {
+			desc := err.Error()
+			if len(out) > 0 {
+				desc = string(out)
+			}
+			return &nsumountError{pid: pid, desc: desc, mountpoints: mountpoints}
+		}
+		return nil
+	}, func(err error) bool {
+		_, ok := err.(*nsumountError)
+		return ok
+	})
+}
+
+// leakedMountpoints returns the image and flynn mountpoints in the mount
+// namespace of the given pid, deepest first. There are none if the process
+// has already exited, as its mount namespace is then torn down with it.
+func leakedMountpoints(pid int) ([]string, error) {
+	list, err := mounts.ParseFile(fmt.Sprintf("/proc/%d/mounts", pid))
+	if err != nil {
+		if isProcessGone(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	sort.Sort(mounts.ByDepth(list))
+
+	var mountpoints []string
+	for _, m := range list {
+		if strings.HasPrefix(m.Mountpoint, imageRoot) || strings.HasPrefix(m.Mountpoint, flynnRoot) {
+			mountpoints = append(mountpoints, m.Mountpoint)
+		}
+	}
+	return mountpoints, nil
+}
+
+// isProcessGone returns whether err is the result of reading a /proc/<pid>
+// file of a process which has exited
+func isProcessGone(err error) bool {
+	if os.IsNotExist(err) {
+		return true
+	}
+	if e, ok := err.(*os.PathError); ok {
+		err = e.Err
+	}
+	return err == syscall.ESRCH
+}
+
+const (
+	defaultStopTimeout = 10 * time.Second
+
+	defaultWaitExitTimeout = 5 * time.Second
+	maxWaitExitTimeout     = 2 * time.Minute
+)
+
+func stopTimeout(job *host.Job) time.Duration {
+	if job.Config.StopTimeout > 0 {
+		return job.Config.StopTimeout
+	}
+	return defaultStopTimeout
+}
+
+// stopSignals returns the sequence of signals to stop the job with, which
+// defaults to SIGTERM followed by the job's stop timeout
+func stopSignals(job *host.Job) []host.StopSignal {
+	if len(job.Config.StopSignals) == 0 {
+		return []host.StopSignal{{Signal: int(syscall.SIGTERM), Timeout: stopTimeout(job)}}
+	}
+	signals := make([]host.StopSignal, len(job.Config.StopSignals))
+	for i, s := range job.Config.StopSignals {
+		if s.Timeout == 0 {
+			s.Timeout = stopTimeout(job)
+		}
+		signals[i] = s
+	}
+	return signals
+}
+
+func validateStopSignals(signals []host.StopSignal) error {
+	for _, s := range signals {
+		if s.Signal <= 0 || s.Signal > 31 {
+			return fmt.Errorf("host: invalid stop signal %d", s.Signal)
+		}
+		if s.Timeout < 0 {
+			return fmt.Errorf("host: invalid stop signal timeout %s", s.Timeout)
+		}
+	}
+	return nil
+}
+
+// stopWithSignals sends each of the given signals in turn, waiting up to
+// the signal's timeout for the job to exit before sending the next, and
+// sends SIGKILL if the job is still running at the end of the sequence
+func stopWithSignals(signals []host.StopSignal, signal func(int) error, wait func(time.Duration) error) error {
+	for _, s := range signals {
+		if err := signal(s.Signal); err != nil {
+			return err
+		}
+		if err := wait(s.Timeout); err == nil {
+			return nil
+		}
+	}
+	if len(signals) > 0 && signals[len(signals)-1].Signal == int(syscall.SIGKILL) {
+		return nil
+	}
+	return signal(int(syscall.SIGKILL))
+}
+
+// waitExitTimeout returns how long to wait for the domain of the given job
+// to exit, which is the job's StopTimeout if set (so that jobs which are slow
+// to shut down are not cut short) capped at maxWaitExitTimeout
+func waitExitTimeout(job *host.Job) time.Duration {
+	timeout := job.Config.StopTimeout
+	if timeout <= 0 {
+		return defaultWaitExitTimeout
+	}
+	if timeout > maxWaitExitTimeout {
+		return maxWaitExitTimeout
+	}
+	return timeout
+}
+
+// waitExit waits for the libvirt domain to be marked as done or the job's
+// wait exit timeout to elapse
+func (c *libvirtContainer) waitExit() {
+	log := c.logger("fn", "waitExit", "job.id", c.job.ID)
+	log.Info("waiting for domain to exit")
+	domain, err := c.l.libvirt.LookupDomainByName(c.job.ID)
+	if err != nil {
+		log.Error("error looking up domain", "err", err)
+		return
+	}
+	defer domain.Free()
+
+	timeout := waitExitTimeout(c.job)
+	maxWait := time.After(timeout)
+	for {
+		state, err := domain.GetState()
+		if err != nil {
+			log.Error("error getting domain state", "err", err)
+			return
+		}
+		if state[0] != libvirt.VIR_DOMAIN_RUNNING && state[0] != libvirt.VIR_DOMAIN_SHUTDOWN {
+			log.Info("finished waiting for domain")
+			return
+		}
+		select {
+		case <-maxWait:
+			log.Error("reached max wait, domain still running", "timeout", timeout, "state", state[0])
+			return
+		default:
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+}
+
+// undefineDomain removes the persistent definition of the container's domain
+// once it has exited so that the job can be run again (e.g. by Restart)
+// without leaving definitions behind
+func (c *libvirtContainer) undefineDomain() {
+	log := c.logger("fn", "undefineDomain", "job.id", c.job.ID)
+	domain, err := c.l.libvirt.LookupDomainByName(c.job.ID)
+	if err != nil {
+		log.Error("error looking up domain", "err", err)
+		return
+	}
+	defer domain.Free()
+	if err := domain.Undefine(); err != nil {
+		log.Error("error undefining domain", "err", err)
+	}
+}
+
+// domainUUID returns the UUID of the domain previously run for the given job,
+// if any, so that redefining the domain when the job is run again updates the
+// existing definition rather than conflicting with it if it was not undefined
+func (l *LibvirtLXCBackend) domainUUID(jobID string) string {
+	if job := l.state.GetJob(jobID); job != nil {
+		return job.ContainerID
+	}
+	return ""
+}
+
+// ContainerInitUnreachableError is returned when a connection to
+// containerinit cannot be established, which does not necessarily mean the
+// job has failed. Err is the error of the last connection attempt.
+type ContainerInitUnreachableError struct {
+	Err error
+}
+
+func (e *ContainerInitUnreachableError) Error() string {
+	return fmt.Sprintf("failed to connect to container: %s", e.Err)
+}
+
+const (
+	containerInitConnectTimeout = 10 * time.Second
+
+	// containerInitReconnectRetries is the number of additional connection
+	// attempts made when reconnecting to a container restored from state
+	containerInitReconnectRetries = 1
+)
+
+const (
+	containerInitSymlinkDir    = "/tmp"
+	containerInitSymlinkPrefix = "containerinit-rpc."
+)
+
+// removeOrphanedContainerInitSymlinks removes symlinks to containerinit
+// sockets in dir which no longer exist, which are left behind if the host
+// exits while connecting to a container.
+func removeOrphanedContainerInitSymlinks(log log15.Logger, dir string) {
+	links, err := filepath.Glob(filepath.Join(dir, containerInitSymlinkPrefix+"*"))
+	if err != nil {
+		log.Error("error listing containerinit symlinks", "err", err)
+		return
+	}
+	for _, link := range links {
+		if info, err := os.Lstat(link); err != nil || info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		if _, err := os.Stat(link); !os.IsNotExist(err) {
+			continue
+		}
+		log.Info("removing orphaned containerinit symlink", "path", link)
+		if err := os.Remove(link); err != nil {
+			log.Error("error removing orphaned containerinit symlink", "path", link, "err", err)
+		}
+	}
+}
+
+// connectContainerInit connects to the containerinit socket at socketPath,
+// trying for up to timeout and then retrying up to retries more times before
+// returning a ContainerInitUnreachableError.
+func connectContainerInit(log log15.Logger, socketPath, symlink string, timeout time.Duration, retries int) (*containerinit.Client, error) {
+	for attempt := 0; ; attempt++ {
+		client, err := dialContainerInit(socketPath, symlink, timeout)
+		if err == nil {
+			return client, nil
+		}
+		log.Error("error connecting to container", "attempt", attempt+1, "err", err)
+		if attempt >= retries {
+			return nil, &ContainerInitUnreachableError{Err: err}
+		}
+	}
+}
+
+func dialContainerInit(socketPath, symlink string, timeout time.Duration) (*containerinit.Client, error) {
+	// We can't connect to the socket file directly because
+	// the path to it is longer than 108 characters (UNIX_PATH_MAX).
+	// Create a temporary symlink to connect to, which is only needed
+	// to dial so is removed on return (replacing any stale symlink
+	// left by a previous host process first).
+	os.Remove(symlink)
+	defer os.Remove(symlink)
+
+	var err error
+	for startTime := time.Now(); time.Since(startTime) < timeout; time.Sleep(time.Millisecond) {
+		if err = os.Symlink(socketPath, symlink); err != nil && !os.IsExist(err) {
+			continue
+		}
+
+		var client *containerinit.Client
+		client, err = containerinit.NewClient(symlink)
+		if err == nil {
+			return client, nil
+		}
+	}
+	return nil, err
+}
+
+func (c *libvirtContainer) watch(ready chan<- error, buffer host.LogBuffer) error {
+	log := c.logger("fn", "watch", "job.id", c.job.ID)
+	log.Info("start watching container")
+
+	defer func() {
+		c.waitExit()
+		c.undefineDomain()
+		// TODO: kill containerinit/domain if it is still running
+		c.l.containersMtx.Lock()
+		delete(c.l.containers, c.job.ID)
+		delete(c.l.starting, c.job.ID)
+		c.l.containersMtx.Unlock()
+		c.l.updateMetrics()
+		c.cleanup()
+		close(c.done)
+	}()
+
+	symlink := filepath.Join(containerInitSymlinkDir, containerInitSymlinkPrefix+c.job.ID)
+	socketPath := path.Join(c.RootPath, containerinit.SocketPath)
+	var retries int
+	if ready != nil {
+		// we are reconnecting to a container restored from state, so give
+		// containerinit another chance in case the host is still slow to
+		// come up after a reboot
+		retries = containerInitReconnectRetries
+	}
+	client, err := connectContainerInit(log, socketPath, symlink, containerInitConnectTimeout, retries)
+	if ready != nil {
+		ready <- err
+	}
+	if err != nil {
+		c.l.state.SetStatusFailed(c.job.ID, err)
+		c.sendEvent(JobFailed, nil, err)
+
+		d, e := c.l.libvirt.LookupDomainByName(c.job.ID)
+		if e != nil {
+			return e
+		}
+		defer d.Free()
+		if err := d.Destroy(); err != nil {
+			log.Error("error destroying domain", "err", err)
+		}
+		return err
+	}
+	c.Client = client
+	defer c.Client.Close()
+	c.sendEvent(JobStarted, nil, nil)
+
+	// this runs as part of unbinding the mounts so that cleanup waits for
+	// it rather than removing the checkout while it is still in use
+	go c.unbindOnce.Do(func() {
+		// Workaround for mounts leaking into the libvirt_lxc supervisor process,
+		// see https://github.com/flynn/flynn/issues/1125 for details. Remove
+		// nsumount from the tree when deleting.
+		log.Info("cleaning up mounts")
+		if err := c.cleanupMounts(c.Domain.ID); err != nil {
+			log.Error("error cleaning up mounts", "err", err)
+		}
+
+		// The bind mounts are copied when we spin up the container, we don't
+		// need them in the root mount namespace any more.
+		c.unbindMountsOnce()
+		log.Info("finished cleaning up mounts")
+	})
+
+	c.l.containersMtx.Lock()
+	c.l.containers[c.job.ID] = c
+	delete(c.l.starting, c.job.ID)
+	c.l.containersMtx.Unlock()
+	c.l.updateMetrics()
+
+	if check := c.job.Config.NetworkCheck; check != nil && !c.job.Config.HostNetwork {
+		go c.monitorNetwork(log, check)
+	}
+
+	if !c.job.Config.DisableLog && !c.job.Config.TTY {
+		if err := c.followLogs(log, buffer); err != nil {
+			return err
+		}
+	}
+
+	log.Info("watching for changes")
+	for change := range c.Client.StreamState() {
+		log.Info("state change", "state", change.State.String())
+		if change.Error != "" {
+			err := c.initLogError(change.Error)
+			log.Error("error in change state", "err", change.Error)
+			c.Client.Resume()
+			c.l.state.SetStatusFailed(c.job.ID, err)
+			c.sendEvent(JobFailed, nil, err)
+			return err
+		}
+		switch change.State {
+		case containerinit.StateInitial:
+			log.Info("waiting for attach")
+			c.l.state.WaitAttach(c.job.ID)
+			log.Info("resuming")
+			c.Client.Resume()
+			log.Info("resumed")
+		case containerinit.StateRunning:
+			log.Info("container running")
+			c.l.state.SetStatusRunning(c.job.ID)
+			c.sendEvent(JobRunning, nil, nil)
+
+			// if the job was stopped before it started, exit
+			if c.l.state.GetJob(c.job.ID).ForceStop {
+				c.Stop()
+			}
+		case containerinit.StateReady:
+			log.Info("container ready")
+			c.l.state.SetStatusReady(c.job.ID)
+			c.sendEvent(JobReady, nil, nil)
+		case containerinit.StateExited:
+			log.Info("container exited", "status", change.ExitStatus)
+			c.Client.Resume()
+			if c.isRestarting() {
+				// leave the job running as it is about to be
+				// started again by Restart
+				log.Info("container is restarting")
+				c.exitStatus = change.ExitStatus
+				return nil
+			}
+			if err := c.getNetworkErr(); err != nil {
+				c.l.state.SetStatusFailed(c.job.ID, err)
+				c.sendEvent(JobFailed, nil, err)
+				return nil
+			}
+			if restart, delay := shouldRestart(c.job.Config.RestartPolicy, change.ExitStatus, c.Restarts); restart && !c.isStopped() {
+				// leave the job running and start it again once
+				// the container has been cleaned up
+				log.Info("restarting container due to restart policy", "restarts", c.Restarts, "delay", delay)
+				atomic.StoreInt32(&c.restarting, 1)
+				c.sendEvent(JobExited, &change.ExitStatus, nil)
+				go c.restartAfter(delay, change.ExitStatus)
+				return nil
+			}
+			c.l.state.SetStatusDone(c.job.ID, change.ExitStatus)
+			c.sendEvent(JobExited, &change.ExitStatus, nil)
+			return nil
+		case containerinit.StateFailed:
+			log.Info("container failed to start")
+			c.Client.Resume()
+			err := c.initLogError("container failed to start")
+			c.l.state.SetStatusFailed(c.job.ID, err)
+			c.sendEvent(JobFailed, nil, err)
+			return nil
+		}
+	}
+	log.Error("unknown failure")
+	err = errors.New("unknown failure")
+	c.l.state.SetStatusFailed(c.job.ID, err)
+	c.sendEvent(JobFailed, nil, err)
+
+	return nil
+}
+
+// monitorNetwork checks the host side of the container's network interface
+// until the container exits, stopping the job if the check fails.
+func (c *libvirtContainer) monitorNetwork(log log15.Logger, check *host.NetworkCheck) {
+	dev := c.vethName()
+	if dev == "" {
+		log.Error("unable to monitor network, unknown interface name")
+		return
+	}
+	err := monitorLink(log, dev, check, checkLinkUp, c.done)
+	if err == nil {
+		return
+	}
+	log.Error("stopping job after losing network interface", "err", err)
+	c.networkErrMtx.Lock()
+	c.networkErr = err
+	c.networkErrMtx.Unlock()
+	if err := c.Stop(); err != nil {
+		log.Error("error stopping job", "err", err)
+	}
+}
+
+func (c *libvirtContainer) getNetworkErr() error {
+	c.networkErrMtx.Lock()
+	defer c.networkErrMtx.Unlock()
+	return c.networkErr
+}
+
+// vethName returns the name of the host side of the container's network
+// interface as assigned by libvirt when the domain was created
+func (c *libvirtContainer) vethName() string {
+	if c.Domain == nil {
+		return ""
+	}
+	for _, iface := range c.Domain.Devices.Interfaces {
+		if iface.Type == "network" && iface.Target != nil {
+			return iface.Target.Dev
+		}
+	}
+	return ""
+}
+
+// restartAfter waits for the container to be cleaned up and then runs the
+// job again after the given delay with the same IP address. The container is
+// marked as restarting until the job has been run again.
+func (c *libvirtContainer) restartAfter(delay time.Duration, exitStatus int) {
+	defer atomic.StoreInt32(&c.restarting, 0)
+	log := c.logger("fn", "restartAfter", "job.id", c.job.ID)
+	<-c.done
+	time.Sleep(delay)
+
+	defer c.l.releaseRestartIP(c.job.ID)
+
+	job := c.l.state.GetJob(c.job.ID)
+	if job == nil {
+		log.Info("job was removed, skipping restart")
+		return
+	}
+
+	// if the job was stopped whilst waiting to restart, it won't be
+	// started again so mark it as done
+	if job.ForceStop {
+		log.Info("job was stopped, skipping restart")
+		c.l.state.SetStatusDone(c.job.ID, exitStatus)
+		return
+	}
+
+	log.Info("starting container", "restarts", c.Restarts+1)
+	if err := c.l.Run(c.job, &RunConfig{IP: c.IP, Restarts: c.Restarts + 1}); err != nil {
+		log.Error("error restarting container", "err", err)
+	}
+}
+
+func (c *libvirtContainer) sendEvent(typ BackendEventType, exitStatus *int, err error) {
+	event := &BackendEvent{Type: typ, JobID: c.job.ID, ExitStatus: exitStatus}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	c.l.events.Send(event)
+}
+
+// SubscribeEvents returns a channel which receives the state transitions of
+// all jobs run by the backend. Events are dropped if the channel is not
+// drained quickly enough, and it should be passed to UnsubscribeEvents once
+// no longer needed.
+func (l *LibvirtLXCBackend) SubscribeEvents() chan *BackendEvent {
+	return l.events.Subscribe()
+}
+
+// UnsubscribeEvents stops sending events to a channel returned by
+// SubscribeEvents and closes it.
+func (l *LibvirtLXCBackend) UnsubscribeEvents(ch chan *BackendEvent) {
+	l.events.Unsubscribe(ch)
+}
+
+func (c *libvirtContainer) followLogs(log log15.Logger, buffer host.LogBuffer) error {
+	c.l.logStreamMtx.Lock()
+	defer c.l.logStreamMtx.Unlock()
+	if _, ok := c.l.logStreams[c.job.ID]; ok {
+		return nil
+	}
+
+	log.Info("getting stdout")
+	stdout, stderr, initLog, err := c.Client.GetStreams()
+	if err != nil {
+		log.Error("error getting streams", "err", err)
+		return err
+	}
+
+	nonblocking := func(file *os.File) (net.Conn, error) {
+		// convert to a net.Conn so we do non-blocking I/O on the fd and Close
+		// will make calls to Read return straight away (using read(2) would
+		// not have this same behaviour, meaning we could potentially read
+		// from the stream after we have closed and returned the buffer).
+		defer file.Close()
+		return net.FileConn(file)
+	}
+
+	muxConfig := logmux.Config{
+		AppID:      c.job.Metadata["flynn-controller.app"],
+		HostID:     c.l.state.id,
+		JobType:    c.job.Metadata["flynn-controller.type"],
+		JobID:      c.job.ID,
+		BufferSize: c.job.Config.LogBufferSize,
+	}
+
+	logStreams := make(map[string]*logmux.LogStream, 3)
+	stdoutR, err := nonblocking(stdout)
+	if err != nil {
+		log.Error("error streaming stdout", "err", err)
+		return err
+	}
+	logStreams["stdout"] = c.l.mux.Follow(stdoutR, buffer["stdout"], 1, muxConfig)
+
+	stderrR, err := nonblocking(stderr)
+	if err != nil {
+		log.Error("error streaming stderr", "err", err)
+		return err
+	}
+	logStreams["stderr"] = c.l.mux.Follow(stderrR, buffer["stderr"], 2, muxConfig)
+
+	initLogR, err := nonblocking(initLog)
+	if err != nil {
+		log.Error("error streaming initial log", "err", err)
+		return err
+	}
+	initLogTee := struct {
+		io.Reader
+		io.Closer
+	}{io.TeeReader(initLogR, &c.initLogTail), initLogR}
+	logStreams["initLog"] = c.l.mux.Follow(initLogTee, buffer["initLog"], 3, muxConfig)
+	c.l.logStreams[c.job.ID] = logStreams
+
+	return nil
+}
+
+// initLogError returns an error with the given message followed by the last
+// lines written to the container's init log, which usually describe why the
+// container failed.
+func (c *libvirtContainer) initLogError(msg string) error {
+	lines := c.initLogTail.Lines()
+	if len(lines) == 0 {
+		return errors.New(msg)
+	}
+	return fmt.Errorf("%s\n\ninit log:\n%s", msg, strings.Join(lines, "\n"))
+}
+
+const (
+	initLogTailLines   = 10
+	initLogTailLineLen = 1024
+)
+
+// tailBuffer is an io.Writer which retains the last initLogTailLines lines
+// written to it.
+type tailBuffer struct {
+	mtx     sync.Mutex
+	lines   []string
+	partial []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	data := append(t.partial, p...)
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		t.add(string(data[:i]))
+		data = data[i+1:]
+	}
+	if len(data) > initLogTailLineLen {
+		data = data[:initLogTailLineLen]
+	}
+	t.partial = append(t.partial[:0], data...)
+	return len(p), nil
+}
+
+// add appends a line, caller must hold t.mtx
+func (t *tailBuffer) add(line string) {
+	if len(line) > initLogTailLineLen {
+		line = line[:initLogTailLineLen]
+	}
+	t.lines = append(t.lines, line)
+	if len(t.lines) > initLogTailLines {
+		t.lines = t.lines[len(t.lines)-initLogTailLines:]
+	}
+}
+
+// Lines returns the retained lines, including any trailing partial line
+func (t *tailBuffer) Lines() []string {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	lines := make([]string, len(t.lines), len(t.lines)+1)
+	copy(lines, t.lines)
+	if len(t.partial) > 0 {
+		lines = append(lines, string(t.partial))
+	}
+	return lines
+}
+
+// unbindMounts unmounts the container's bind mounts from the root mount
+// namespace the first time it is called, later calls waiting for the mounts
+// to be unbound and then doing nothing
+func (c *libvirtContainer) unbindMounts() {
+	c.unbindOnce.Do(c.unbindMountsOnce)
+}
+
+func (c *libvirtContainer) unbindMountsOnce() {
+	log := c.logger("fn", "unbindMounts", "job.id", c.job.ID)
+	log.Info("unbinding mounts")
+
+	if err := syscall.Unmount(filepath.Join(c.RootPath, ".containerinit"), 0); err != nil {
+		log.Error("error umounting .containerinit", "err", err)
+	}
+	if err := syscall.Unmount(filepath.Join(c.RootPath, "etc/resolv.conf"), 0); err != nil {
+		log.Error("error umounting resolv.conf", "err", err)
+	}
+	if err := syscall.Unmount(filepath.Join(c.RootPath, "etc/localtime"), 0); err != nil {
+		log.Error("error umounting localtime", "err", err)
+	}
+	if c.DockerSocket != "" {
+		if err := syscall.Unmount(c.DockerSocket, 0); err != nil {
+			log.Error("error umounting Docker socket", "err", err)
+		}
+	}
+	if c.CABundle != "" {
+		if err := syscall.Unmount(c.CABundle, 0); err != nil {
+			log.Error("error umounting CA bundle", "err", err)
+		}
+	}
+	for _, m := range c.job.Config.Mounts {
+		if err := syscall.Unmount(filepath.Join(c.RootPath, m.Location), 0); err != nil {
+			log.Error("error umounting mount point", "location", m.Location, "err", err)
+		}
+	}
+	for _, v := range c.job.Config.Volumes {
+		if err := syscall.Unmount(filepath.Join(c.RootPath, v.Target), 0); err != nil {
+			log.Error("error umounting volume", "target", v.Target, "volumeID", v.VolumeID, "err", err)
+		}
+	}
+	for _, m := range c.job.Config.SharedMounts {
+		if err := syscall.Unmount(filepath.Join(c.RootPath, m.Target), 0); err != nil {
+			log.Error("error umounting shared mount", "name", m.Name, "target", m.Target, "err", err)
+		}
+	}
+	for _, f := range c.job.Config.EnvFiles {
+		if err := syscall.Unmount(filepath.Join(c.RootPath, f.Path), 0); err != nil {
+			log.Error("error umounting env file", "path", f.Path, "err", err)
+		}
+	}
+	log.Info("finishing unbinding mounts")
+}
+
+// acquireSharedMounts acquires the job's shared mounts from the registry so
+// they are kept until the job has exited, returning the directory of each
+func (c *libvirtContainer) acquireSharedMounts() ([]string, error) {
+	c.sharedMountsMtx.Lock()
+	defer c.sharedMountsMtx.Unlock()
+	appID := c.job.Metadata["flynn-controller.app"]
+	dirs := make([]string, 0, len(c.job.Config.SharedMounts))
+	for _, m := range c.job.Config.SharedMounts {
+		dir, err := c.l.sharedMounts.Acquire(appID, m.Name)
+		if err != nil {
+			return nil, err
+		}
+		c.sharedMounts = append(c.sharedMounts, m.Name)
+		dirs = append(dirs, dir)
+	}
+	return dirs, nil
+}
+
+func (c *libvirtContainer) releaseSharedMounts() {
+	c.sharedMountsMtx.Lock()
+	defer c.sharedMountsMtx.Unlock()
+	appID := c.job.Metadata["flynn-controller.app"]
+	for _, name := range c.sharedMounts {
+		if err := c.l.sharedMounts.Release(appID, name); err != nil {
+			c.logger().Error("error releasing shared mount", "job.id", c.job.ID, "name", name, "err", err)
+		}
+	}
+	c.sharedMounts = nil
+}
+
+// cleanup releases the container's resources the first time it is called,
+// later calls waiting for it to finish and then doing nothing.
+//
+// The log streams are closed first, then the mounts are unbound (waiting for
+// watch to finish unbinding them if it already started to), and the image
+// checkout is removed and the IP released last, so neither is reused while
+// the container's mounts still reference them.
+func (c *libvirtContainer) cleanup() error {
+	c.cleanupOnce.Do(c.releaseResources)
+	return nil
+}
+
+func (c *libvirtContainer) releaseResources() {
+	log := c.logger("fn", "cleanup", "job.id", c.job.ID)
+	log.Info("starting cleanup")
+	defer metrics.MeasureSince([]string{"backend", "container", "cleanup"}, time.Now())
+
+	c.l.logStreamMtx.Lock()
+	for _, s := range c.l.logStreams[c.job.ID] {
+		s.Close()
+	}
+	delete(c.l.logStreams, c.job.ID)
+	c.l.logStreamMtx.Unlock()
+
+	c.unbindMounts()
+	c.releaseSharedMounts()
+	c.l.cpusets.Release(c.job.ID)
+	if err := removePIDsCGroup(c.job.Partition, c.job.ID); err != nil {
+		log.Error("error removing pids cgroup", "err", err)
+	}
+	c.l.removeHostPortForwards(c.job.ID)
+	if len(c.job.Config.EnvFiles) > 0 {
+		if err := removeEnvFiles(filepath.Join(envFileRoot, c.job.ID)); err != nil {
+			log.Error("error removing env files", "err", err)
+		}
+	}
+	if c.CABundle != "" {
+		if err := os.Remove(filepath.Join(caBundleRoot, c.job.ID)); err != nil && !os.IsNotExist(err) {
+			log.Error("error removing CA bundle", "err", err)
+		}
+	}
+	if err := c.l.pinkerton.Cleanup(c.job.ID); err != nil {
+		log.Error("error running pinkerton cleanup", "err", err)
+	}
+	// the IP of a restarting job is kept so that no other job is
+	// allocated it before the job is run again
+	if !c.isRestarting() {
+		c.l.releaseJobIP(c.job.ID)
+	}
+	log.Info("finished cleanup")
+}
+
+func (c *libvirtContainer) WaitStop(timeout time.Duration) error {
+	job := c.l.state.GetJob(c.job.ID)
+	if job.Status == host.StatusDone || job.Status == host.StatusFailed {
+		return nil
+	}
+	select {
+	case <-c.done:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("Timed out: %v", timeout)
+	}
+}
+
+func (c *libvirtContainer) Stop() error {
+	atomic.StoreInt32(&c.stopped, 1)
+	// frozen processes can't run the pre-stop hook or handle signals (not
+	// even SIGKILL), so thaw a paused job first
+	if c.isPaused() {
+		if err := c.l.setFrozen(c.job.ID, false); err != nil {
+			c.logger("fn", "Stop", "job.id", c.job.ID).Error("error resuming paused job", "err", err)
+		}
 	}
-	defer vd.Free()
+	c.runPreStop()
+	return stopWithSignals(stopSignals(c.job), c.Signal, c.WaitStop)
+}
 
-	log.Info("creating domain")
-	if err := l.withConnRetries(vd.Create); err != nil {
-		log.Error("error creating domain", "err", err)
-		return err
+// runPreStop runs the job's pre-stop hook, if any, which the container
+// runs at most once, bounded by the job's stop timeout
+func (c *libvirtContainer) runPreStop() {
+	if len(c.job.Config.PreStop) == 0 || c.Client == nil {
+		return
 	}
-	log.Info("getting domain uuid")
-	uuid, err := vd.GetUUIDString()
+	log := c.logger("fn", "runPreStop", "job.id", c.job.ID)
+	log.Info("running pre-stop hook")
+	if err := c.Client.RunPreStop(stopTimeout(c.job)); err != nil {
+		log.Error("error running pre-stop hook", "err", err)
+	}
+}
+
+func (l *LibvirtLXCBackend) Stop(id string) error {
+	c, err := l.getContainer(id)
 	if err != nil {
-		log.Error("error getting domain uuid", "err", err)
 		return err
 	}
-	l.state.SetContainerID(job.ID, uuid)
+	err = c.Stop()
+	if err == rpcplus.ErrShutdown {
+		// if the process is disconnected, the stop was probably successful
+		err = nil
+	}
+	return err
+}
 
-	domainXML, err := vd.GetXMLDesc(0)
+// Restart stops the given job's container and then runs the job again using
+// the same ID, config and IP address.
+func (l *LibvirtLXCBackend) Restart(id string) error {
+	log := l.logger.New("fn", "Restart", "job.id", id)
+
+	c, err := l.getContainer(id)
 	if err != nil {
-		log.Error("error getting domain xml", "err", err)
 		return err
 	}
-	container.Domain = &lt.Domain{}
-	if err := xml.Unmarshal([]byte(domainXML), container.Domain); err != nil {
-		log.Error("error unmarshalling domain xml", "err", err)
+
+	log.Info("stopping container")
+	atomic.StoreInt32(&c.restarting, 1)
+	if err := c.Stop(); err != nil && err != rpcplus.ErrShutdown {
+		log.Error("error stopping container", "err", err)
+		atomic.StoreInt32(&c.restarting, 0)
 		return err
 	}
+	<-c.done
+	defer l.releaseRestartIP(id)
 
-	go container.watch(nil, nil)
-
-	log.Info("job started")
+	log.Info("starting container")
+	if err := l.Run(c.job, &RunConfig{IP: c.IP}); err != nil {
+		return err
+	}
+	l.markStoppedRestartDone(log, c)
 	return nil
 }
 
-// resolveDiscoverdURI resolves a discoverd host in the given URI to an address
-// using the configured discoverd URL as the host is likely not using discoverd
-// to resolve DNS queries
-func (l *LibvirtLXCBackend) resolveDiscoverdURI(uri string) (string, error) {
-	u, err := url.Parse(uri)
-	if err != nil {
-		return "", err
-	}
-	if !strings.HasSuffix(u.Host, ".discoverd") {
-		return uri, nil
+// releaseRestartIP releases the IP kept for a restarted job if it was not
+// run again (e.g. because it was stopped or failed to start)
+func (l *LibvirtLXCBackend) releaseRestartIP(id string) {
+	if !l.jobClaimed(id) {
+		l.releaseJobIP(id)
 	}
+}
 
-	// ensure discoverd is configured
-	<-l.discoverdConfigured
-	l.envMtx.Lock()
-	discURL := l.defaultEnv["DISCOVERD"]
-	l.envMtx.Unlock()
-
-	// lookup the service and pick a random address
-	service := strings.TrimSuffix(u.Host, ".discoverd")
-	addrs, err := discoverd.NewClientWithURL(discURL).Service(service).Addrs()
-	if err != nil {
-		return "", err
-	} else if len(addrs) == 0 {
-		return "", fmt.Errorf("lookup %s: no such host", u.Host)
+// markStoppedRestartDone marks the job of the given restarted container as
+// done if Run skipped starting it again because it was stopped whilst
+// restarting, as the job would otherwise be left running
+func (l *LibvirtLXCBackend) markStoppedRestartDone(log log15.Logger, c *libvirtContainer) {
+	if l.jobClaimed(c.job.ID) || !l.jobStopped(c.job.ID) {
+		return
 	}
-	u.Host = addrs[random.Math.Intn(len(addrs))]
-	return u.String(), nil
+	log.Info("job was stopped whilst restarting, marking it as done")
+	l.state.SetStatusDone(c.job.ID, c.exitStatus)
 }
 
-func (c *libvirtContainer) cleanupMounts(pid int) error {
-	list, err := mounts.ParseFile(fmt.Sprintf("/proc/%d/mounts", pid))
+// jobClaimed returns whether the given job is being started or is running
+func (l *LibvirtLXCBackend) jobClaimed(id string) bool {
+	l.containersMtx.RLock()
+	defer l.containersMtx.RUnlock()
+	_, running := l.containers[id]
+	_, starting := l.starting[id]
+	return running || starting
+}
+
+// UpdateImage runs the given job again with a new image in place of its
+// current one, keeping the same ID, config, IP address and volumes.
+//
+// The new image is pulled before the job is stopped so that the job keeps
+// running if the pull fails, and if the job can't then be started with the
+// new image, it is started again with its previous one.
+func (l *LibvirtLXCBackend) UpdateImage(id string, artifact *host.Artifact) error {
+	log := l.logger.New("fn", "UpdateImage", "job.id", id, "artifact.uri", artifact.URI)
+
+	c, err := l.getContainer(id)
 	if err != nil {
 		return err
 	}
-	sort.Sort(mounts.ByDepth(list))
 
-	args := make([]string, 1, len(list)+1)
-	args[0] = strconv.Itoa(pid)
-	for _, m := range list {
-		if strings.HasPrefix(m.Mountpoint, imageRoot) || strings.HasPrefix(m.Mountpoint, flynnRoot) {
-			args = append(args, m.Mountpoint)
-		}
+	log.Info("pulling new image")
+	if err := l.PrewarmImage(artifact); err != nil {
+		return err
 	}
-	if len(args) <= 1 {
-		// no mountpoints to clean up
-		return nil
+
+	log.Info("stopping container")
+	atomic.StoreInt32(&c.restarting, 1)
+	if err := c.Stop(); err != nil && err != rpcplus.ErrShutdown {
+		log.Error("error stopping container", "err", err)
+		atomic.StoreInt32(&c.restarting, 0)
+		return err
 	}
+	<-c.done
+	defer l.releaseRestartIP(id)
 
-	out, err := exec.Command(c.l.UmountPath, args...).CombinedOutput()
-	if err != nil {
-		desc := err.Error()
-		if len(out) > 0 {
-			desc = string(out)
-		}
-		return fmt.Errorf("host: error running nsumount %d: %s", pid, desc)
+	if err := l.swapImage(log, c.job, artifact, &RunConfig{IP: c.IP}, l.Run); err != nil {
+		return err
 	}
+	l.markStoppedRestartDone(log, c)
 	return nil
 }
 
-// waitExit waits for the libvirt domain to be marked as done or five seconds to
-// elapse
-func (c *libvirtContainer) waitExit() {
-	log := c.l.logger.New("fn", "waitExit", "job.id", c.job.ID)
-	log.Info("waiting for domain to exit")
-	domain, err := c.l.libvirt.LookupDomainByName(c.job.ID)
-	if err != nil {
-		log.Error("error looking up domain", "err", err)
-		return
+// swapImage sets the image of the stopped job to artifact and runs it,
+// setting the image back and running the job again if it fails to start
+func (l *LibvirtLXCBackend) swapImage(log log15.Logger, job *host.Job, artifact *host.Artifact, runConfig *RunConfig, run func(*host.Job, *RunConfig) error) error {
+	prev := job.ImageArtifact
+	l.state.SetImageArtifact(job.ID, artifact)
+	job.ImageArtifact = artifact
+
+	log.Info("starting container with new image")
+	update := *runConfig
+	update.Update = true
+	err := run(job, &update)
+	if err == nil {
+		return nil
 	}
-	defer domain.Free()
+	log.Error("error starting container with new image, rolling back", "err", err)
 
-	maxWait := time.After(5 * time.Second)
-	for {
-		state, err := domain.GetState()
-		if err != nil {
-			log.Error("error getting domain state", "err", err)
-			return
-		}
-		if state[0] != libvirt.VIR_DOMAIN_RUNNING && state[0] != libvirt.VIR_DOMAIN_SHUTDOWN {
-			log.Info("finished waiting for domain")
-			return
-		}
-		select {
-		case <-maxWait:
-			log.Info("reached max wait")
-			return
-		default:
-			time.Sleep(100 * time.Millisecond)
-		}
+	l.state.SetImageArtifact(job.ID, prev)
+	job.ImageArtifact = prev
+	if rollbackErr := run(job, runConfig); rollbackErr != nil {
+		log.Error("error starting container with previous image", "err", rollbackErr)
+		return fmt.Errorf("host: error starting job with new image: %s (rollback failed: %s)", err, rollbackErr)
 	}
+	return fmt.Errorf("host: error starting job with new image, rolled back to previous image: %s", err)
 }
 
-func (c *libvirtContainer) watch(ready chan<- error, buffer host.LogBuffer) error {
-	log := c.l.logger.New("fn", "watch", "job.id", c.job.ID)
-	log.Info("start watching container")
-
-	defer func() {
-		c.waitExit()
-		// TODO: kill containerinit/domain if it is still running
-		c.l.containersMtx.Lock()
-		delete(c.l.containers, c.job.ID)
-		c.l.containersMtx.Unlock()
-		c.cleanup()
-		close(c.done)
-	}()
-
-	var symlinked bool
-	var err error
-	symlink := "/tmp/containerinit-rpc." + c.job.ID
-	socketPath := path.Join(c.RootPath, containerinit.SocketPath)
-	for startTime := time.Now(); time.Since(startTime) < 10*time.Second; time.Sleep(time.Millisecond) {
-		if !symlinked {
-			// We can't connect to the socket file directly because
-			// the path to it is longer than 108 characters (UNIX_PATH_MAX).
-			// Create a temporary symlink to connect to.
-			if err = os.Symlink(socketPath, symlink); err != nil && !os.IsExist(err) {
-				log.Error("error symlinking socket", "err", err)
-				continue
-			}
-			defer os.Remove(symlink)
-			symlinked = true
-		}
-
-		c.Client, err = containerinit.NewClient(symlink)
-		if err == nil {
-			break
-		}
+// Tail returns up to the last n lines logged by the given job, including
+// jobs which have exited
+func (l *LibvirtLXCBackend) Tail(id string, n int) ([]*rfc5424.Message, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("host: invalid number of lines %d", n)
 	}
-	if ready != nil {
-		ready <- err
+	job := l.state.GetJob(id)
+	if job == nil {
+		return nil, ErrNotFound
 	}
-	if err != nil {
-		log.Error("error connecting to container", "err", err)
-		c.l.state.SetStatusFailed(c.job.ID, errors.New("failed to connect to container"))
-
-		d, e := c.l.libvirt.LookupDomainByName(c.job.ID)
-		if e != nil {
-			return e
-		}
-		defer d.Free()
-		if err := d.Destroy(); err != nil {
-			log.Error("error destroying domain", "err", err)
-		}
-		return err
+	if job.Job.Config.DisableLog || job.Job.Config.TTY {
+		return nil, fmt.Errorf("host: logging is disabled for job %s", id)
 	}
-	defer c.Client.Close()
-
-	go func() {
-		// Workaround for mounts leaking into the libvirt_lxc supervisor process,
-		// see https://github.com/flynn/flynn/issues/1125 for details. Remove
-		// nsumount from the tree when deleting.
-		log.Info("cleaning up mounts")
-		if err := c.cleanupMounts(c.Domain.ID); err != nil {
-			log.Error("error cleaning up mounts", "err", err)
-		}
+	return l.mux.Tail(job.Job.Metadata["flynn-controller.app"], id, n)
+}
 
-		// The bind mounts are copied when we spin up the container, we don't
-		// need them in the root mount namespace any more.
-		c.unbindMounts()
-		log.Info("finished cleaning up mounts")
-	}()
+// transientMountErrors are the errors which each storage driver can fail to
+// mount a checkout with intermittently, and which are retried (see
+// https://github.com/flynn/flynn/issues/2044)
+var transientMountErrors = map[string][]syscall.Errno{
+	"aufs":    {syscall.EINVAL},
+	"overlay": {syscall.EINVAL, syscall.EBUSY},
+}
 
-	c.l.containersMtx.Lock()
-	c.l.containers[c.job.ID] = c
-	c.l.containersMtx.Unlock()
+const (
+	checkoutRetryTimeout  = time.Second
+	checkoutRetryInterval = 50 * time.Millisecond
+)
 
-	if !c.job.Config.DisableLog && !c.job.Config.TTY {
-		if err := c.followLogs(log, buffer); err != nil {
-			return err
+// checkoutWithRetry calls checkout, retrying for up to timeout if it fails
+// with one of the given transient errors
+func checkoutWithRetry(checkout func() (string, error), transient []syscall.Errno, timeout, interval time.Duration) (path string, err error) {
+	for start := time.Now(); ; time.Sleep(interval) {
+		path, err = checkout()
+		if err == nil || !isTransientMountError(err, transient) || time.Since(start) >= timeout {
+			return path, err
 		}
 	}
+}
 
-	log.Info("watching for changes")
-	for change := range c.Client.StreamState() {
-		log.Info("state change", "state", change.State.String())
-		if change.Error != "" {
-			err := errors.New(change.Error)
-			log.Error("error in change state", "err", err)
-			c.Client.Resume()
-			c.l.state.SetStatusFailed(c.job.ID, err)
-			return err
+func isTransientMountError(err error, transient []syscall.Errno) bool {
+	for _, errno := range transient {
+		// storage drivers don't always return the errno itself, so also
+		// check the error message
+		if err == errno || strings.HasSuffix(err.Error(), errno.Error()) {
+			return true
 		}
-		switch change.State {
-		case containerinit.StateInitial:
-			log.Info("waiting for attach")
-			c.l.state.WaitAttach(c.job.ID)
-			log.Info("resuming")
-			c.Client.Resume()
-			log.Info("resumed")
-		case containerinit.StateRunning:
-			log.Info("container running")
-			c.l.state.SetStatusRunning(c.job.ID)
+	}
+	return false
+}
 
-			// if the job was stopped before it started, exit
-			if c.l.state.GetJob(c.job.ID).ForceStop {
-				c.Stop()
-			}
-		case containerinit.StateExited:
-			log.Info("container exited", "status", change.ExitStatus)
-			c.Client.Resume()
-			c.l.state.SetStatusDone(c.job.ID, change.ExitStatus)
-			return nil
-		case containerinit.StateFailed:
-			log.Info("container failed to start")
-			c.Client.Resume()
-			c.l.state.SetStatusFailed(c.job.ID, errors.New("container failed to start"))
-			return nil
-		}
+// CgroupPath returns the path of the given running job's cgroup relative to
+// the root of each cgroup controller hierarchy (as in /proc/<pid>/cgroup),
+// which is /machine/<partition>.partition/<job-id>.libvirt-lxc, so the
+// cgroup directory for a controller is
+// /sys/fs/cgroup/<controller>/machine/<partition>.partition/<job-id>.libvirt-lxc
+func (l *LibvirtLXCBackend) CgroupPath(id string) (string, error) {
+	job := l.state.GetJob(id)
+	if job == nil || (job.Status != host.StatusRunning && job.Status != host.StatusReady) {
+		return "", ErrNotFound
 	}
-	log.Error("unknown failure")
-	c.l.state.SetStatusFailed(c.job.ID, errors.New("unknown failure"))
+	c, err := l.getContainer(id)
+	if err != nil || c.Domain == nil || c.Domain.Resource == nil {
+		return "", ErrNotFound
+	}
+	return domainCGroupPath(c.Domain), nil
+}
 
-	return nil
+const (
+	freezerFrozen = "FROZEN"
+	freezerThawed = "THAWED"
+
+	freezerTimeout       = 10 * time.Second
+	freezerCheckInterval = 10 * time.Millisecond
+)
+
+// Pause freezes the processes of the given running job using its freezer
+// cgroup, without killing them, until the job is resumed
+func (l *LibvirtLXCBackend) Pause(id string) error {
+	return l.setFrozen(id, true)
 }
 
-func (c *libvirtContainer) followLogs(log log15.Logger, buffer host.LogBuffer) error {
-	c.l.logStreamMtx.Lock()
-	defer c.l.logStreamMtx.Unlock()
-	if _, ok := c.l.logStreams[c.job.ID]; ok {
-		return nil
-	}
+// Resume thaws the processes of the given paused job
+func (l *LibvirtLXCBackend) Resume(id string) error {
+	return l.setFrozen(id, false)
+}
 
-	log.Info("getting stdout")
-	stdout, stderr, initLog, err := c.Client.GetStreams()
+func (l *LibvirtLXCBackend) setFrozen(id string, frozen bool) error {
+	job := l.state.GetJob(id)
+	if job == nil || (job.Status != host.StatusRunning && job.Status != host.StatusReady) {
+		return host.ErrJobNotRunning
+	}
+	c, err := l.getContainer(id)
 	if err != nil {
-		log.Error("error getting streams", "err", err)
+		return host.ErrJobNotRunning
+	}
+	state := freezerThawed
+	if frozen {
+		state = freezerFrozen
+	}
+	if err := setFreezerState(jobCGroupPath("freezer", c.job.Partition, id), state); err != nil {
 		return err
 	}
+	if frozen {
+		atomic.StoreInt32(&c.paused, 1)
+	} else {
+		atomic.StoreInt32(&c.paused, 0)
+	}
+	l.state.SetPaused(id, frozen)
+	return nil
+}
 
-	nonblocking := func(file *os.File) (net.Conn, error) {
-		// convert to a net.Conn so we do non-blocking I/O on the fd and Close
-		// will make calls to Read return straight away (using read(2) would
-		// not have this same behaviour, meaning we could potentially read
-		// from the stream after we have closed and returned the buffer).
-		defer file.Close()
-		return net.FileConn(file)
+// setFreezerState writes the given state to the freezer cgroup at dir and
+// waits for the kernel to report it, which can take a while for FROZEN as
+// each task has to be stopped (the cgroup reports FREEZING meanwhile)
+func setFreezerState(dir, state string) error {
+	path := filepath.Join(dir, "freezer.state")
+	if err := ioutil.WriteFile(path, []byte(state), 0644); err != nil {
+		return fmt.Errorf("error writing cgroup param: %s", err)
+	}
+	for start := time.Now(); ; time.Sleep(freezerCheckInterval) {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("error reading cgroup param: %s", err)
+		}
+		if strings.TrimSpace(string(data)) == state {
+			return nil
+		}
+		if time.Since(start) > freezerTimeout {
+			return fmt.Errorf("host: timed out waiting for freezer state %s", state)
+		}
+		// rewrite the state in case a new task raced with the freeze
+		if err := ioutil.WriteFile(path, []byte(state), 0644); err != nil {
+			return fmt.Errorf("error writing cgroup param: %s", err)
+		}
 	}
+}
 
-	muxConfig := logmux.Config{
-		AppID:   c.job.Metadata["flynn-controller.app"],
-		HostID:  c.l.state.id,
-		JobType: c.job.Metadata["flynn-controller.type"],
-		JobID:   c.job.ID,
+// DiskUsage returns the disk space used by the changes to the given job's
+// root filesystem and by each of its volumes
+func (l *LibvirtLXCBackend) DiskUsage(id string) (*host.DiskUsage, error) {
+	job := l.state.GetJob(id)
+	if job == nil {
+		return nil, ErrNotFound
+	}
+	size, err := l.pinkerton.CheckoutSize(id)
+	if err != nil {
+		return nil, err
+	}
+	usage := &host.DiskUsage{RootFS: size}
+	for _, v := range job.Job.Config.Volumes {
+		vol := l.vman.GetVolume(v.VolumeID)
+		if vol == nil {
+			continue
+		}
+		size, err := diskUsage(vol.Location())
+		if err != nil {
+			return nil, err
+		}
+		usage.Volumes = append(usage.Volumes, host.VolumeDiskUsage{
+			VolumeID: v.VolumeID,
+			Target:   v.Target,
+			Size:     size,
+		})
 	}
+	return usage, nil
+}
 
-	logStreams := make(map[string]*logmux.LogStream, 3)
-	stdoutR, err := nonblocking(stdout)
+// MemoryStats returns the memory of the given running job's domain,
+// including the current balloon size if MemBalloonModel is set
+func (l *LibvirtLXCBackend) MemoryStats(id string) (*host.MemoryStats, error) {
+	job := l.state.GetJob(id)
+	if job == nil || (job.Status != host.StatusRunning && job.Status != host.StatusReady) {
+		return nil, ErrNotFound
+	}
+	domain, err := l.libvirt.LookupDomainByName(id)
 	if err != nil {
-		log.Error("error streaming stdout", "err", err)
-		return err
+		return nil, err
 	}
-	logStreams["stdout"] = c.l.mux.Follow(stdoutR, buffer["stdout"], 1, muxConfig)
-
-	stderrR, err := nonblocking(stderr)
+	defer domain.Free()
+	info, err := domain.GetInfo()
 	if err != nil {
-		log.Error("error streaming stderr", "err", err)
-		return err
+		return nil, err
 	}
-	logStreams["stderr"] = c.l.mux.Follow(stderrR, buffer["stderr"], 2, muxConfig)
-
-	initLogR, err := nonblocking(initLog)
-	if err != nil {
-		log.Error("error streaming initial log", "err", err)
-		return err
+	// libvirt reports memory in KiB
+	stats := &host.MemoryStats{Limit: int64(info.GetMaxMem()) * 1024}
+	if l.MemBalloonModel != "" {
+		stats.Balloon = int64(info.GetMemory()) * 1024
 	}
-	logStreams["initLog"] = c.l.mux.Follow(initLogR, buffer["initLog"], 3, muxConfig)
-	c.l.logStreams[c.job.ID] = logStreams
-
-	return nil
+	return stats, nil
 }
 
-func (c *libvirtContainer) unbindMounts() {
-	log := c.l.logger.New("fn", "unbindMounts", "job.id", c.job.ID)
-	log.Info("unbinding mounts")
-
-	if err := syscall.Unmount(filepath.Join(c.RootPath, ".containerinit"), 0); err != nil {
-		log.Error("error umounting .containerinit", "err", err)
+// JobSpec returns the args, environment, working directory and resources the
+// given running job was started with, read from the config written to its
+// container rather than reconstructed from the job
+func (l *LibvirtLXCBackend) JobSpec(id string) (*host.ReproSpec, error) {
+	job := l.state.GetJob(id)
+	if job == nil || (job.Status != host.StatusRunning && job.Status != host.StatusReady) {
+		return nil, ErrNotFound
 	}
-	if err := syscall.Unmount(filepath.Join(c.RootPath, "etc/resolv.conf"), 0); err != nil {
-		log.Error("error umounting resolv.conf", "err", err)
+	c, err := l.getContainer(id)
+	if err != nil {
+		return nil, ErrNotFound
 	}
-	for _, m := range c.job.Config.Mounts {
-		if err := syscall.Unmount(filepath.Join(c.RootPath, m.Location), 0); err != nil {
-			log.Error("error umounting mount point", "location", m.Location, "err", err)
-		}
+	return readReproSpec(filepath.Join(c.RootPath, ".containerconfig"), &c.job.Config)
+}
+
+func readReproSpec(path string, jobConfig *host.ContainerConfig) (*host.ReproSpec, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
 	}
-	for _, v := range c.job.Config.Volumes {
-		if err := syscall.Unmount(filepath.Join(c.RootPath, v.Target), 0); err != nil {
-			log.Error("error umounting volume", "target", v.Target, "volumeID", v.VolumeID, "err", err)
+	defer f.Close()
+	var config containerinit.Config
+	if err := json.NewDecoder(f).Decode(&config); err != nil {
+		return nil, fmt.Errorf("host: error decoding container config: %s", err)
+	}
+	spec := &host.ReproSpec{
+		Args:      config.Args,
+		Env:       make(map[string]string, len(config.Env)),
+		WorkDir:   config.WorkDir,
+		User:      config.User,
+		Resources: config.Resources,
+	}
+	for k, v := range config.Env {
+		if isSecretEnv(jobConfig, k) {
+			v = redactedSecret
 		}
+		spec.Env[k] = v
 	}
-	log.Info("finishing unbinding mounts")
+	return spec, nil
 }
 
-func (c *libvirtContainer) cleanup() error {
-	log := c.l.logger.New("fn", "cleanup", "job.id", c.job.ID)
-	log.Info("starting cleanup")
-
-	c.l.logStreamMtx.Lock()
-	for _, s := range c.l.logStreams[c.job.ID] {
-		s.Close()
+// PIDStats returns the number of processes and threads in the given running
+// job's pids cgroup and their limit
+func (l *LibvirtLXCBackend) PIDStats(id string) (*host.PIDStats, error) {
+	job := l.state.GetJob(id)
+	if job == nil || (job.Status != host.StatusRunning && job.Status != host.StatusReady) {
+		return nil, ErrNotFound
 	}
-	delete(c.l.logStreams, c.job.ID)
-	c.l.logStreamMtx.Unlock()
-
-	c.unbindMounts()
-	if err := c.l.pinkerton.Cleanup(c.job.ID); err != nil {
-		log.Error("error running pinkerton cleanup", "err", err)
+	c, err := l.getContainer(id)
+	if err != nil {
+		return nil, ErrNotFound
 	}
-	if !c.job.Config.HostNetwork && c.l.bridgeNet != nil {
-		c.l.ipalloc.ReleaseIP(c.l.bridgeNet, c.IP)
+	dir := jobCGroupPath("pids", c.job.Partition, id)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		// jobs without a pids limit have no pids cgroup, so count
+		// their tasks in a cgroup libvirt manages instead
+		return countTasks(jobCGroupPath("cpu", c.job.Partition, id))
 	}
-	log.Info("finished cleanup")
-	return nil
+	return readPIDStats(dir)
 }
 
-func (c *libvirtContainer) WaitStop(timeout time.Duration) error {
-	job := c.l.state.GetJob(c.job.ID)
-	if job.Status == host.StatusDone || job.Status == host.StatusFailed {
-		return nil
-	}
-	select {
-	case <-c.done:
-		return nil
-	case <-time.After(timeout):
-		return fmt.Errorf("Timed out: %v", timeout)
+// countTasks returns the number of processes and threads in the given cgroup
+func countTasks(dir string) (*host.PIDStats, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "tasks"))
+	if err != nil {
+		return nil, fmt.Errorf("error reading cgroup param: %s", err)
 	}
+	return &host.PIDStats{Current: int64(len(strings.Fields(string(data))))}, nil
 }
 
-func (c *libvirtContainer) Stop() error {
-	if err := c.Signal(int(syscall.SIGTERM)); err != nil {
-		return err
+func readPIDStats(dir string) (*host.PIDStats, error) {
+	read := func(name string) (string, error) {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return "", fmt.Errorf("error reading cgroup param: %s", err)
+		}
+		return strings.TrimSpace(string(data)), nil
 	}
-	if err := c.WaitStop(10 * time.Second); err != nil {
-		return c.Signal(int(syscall.SIGKILL))
+	current, err := read("pids.current")
+	if err != nil {
+		return nil, err
 	}
-	return nil
-}
-
-func (l *LibvirtLXCBackend) Stop(id string) error {
-	c, err := l.getContainer(id)
+	stats := &host.PIDStats{}
+	if stats.Current, err = strconv.ParseInt(current, 10, 64); err != nil {
+		return nil, fmt.Errorf("error parsing pids.current: %s", err)
+	}
+	limit, err := read("pids.max")
 	if err != nil {
-		return err
+		return nil, err
 	}
-	err = c.Stop()
-	if err == rpcplus.ErrShutdown {
-		// if the process is disconnected, the stop was probably successful
-		err = nil
+	if limit != "max" {
+		if stats.Limit, err = strconv.ParseInt(limit, 10, 64); err != nil {
+			return nil, fmt.Errorf("error parsing pids.max: %s", err)
+		}
 	}
-	return err
+	return stats, nil
+}
+
+// diskUsage returns the disk space used by the files in dir, using statfs if
+// dir is the root of a filesystem (e.g. a ZFS dataset) rather than walking
+// every file
+func diskUsage(dir string) (int64, error) {
+	var st, parentSt syscall.Stat_t
+	if err := syscall.Stat(dir, &st); err != nil {
+		return 0, err
+	}
+	if err := syscall.Stat(filepath.Dir(dir), &parentSt); err != nil {
+		return 0, err
+	}
+	if st.Dev != parentSt.Dev {
+		var fs syscall.Statfs_t
+		if err := syscall.Statfs(dir, &fs); err != nil {
+			return 0, err
+		}
+		return int64(fs.Blocks-fs.Bfree) * int64(fs.Bsize), nil
+	}
+
+	var size int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			// count allocated blocks rather than the apparent size
+			size += st.Blocks * 512
+		}
+		return nil
+	})
+	return size, err
 }
 
 func (l *LibvirtLXCBackend) JobExists(id string) bool {
@@ -1089,15 +3492,51 @@ func (l *LibvirtLXCBackend) Attach(req *AttachRequest) (err error) {
 		}
 	}
 
+	// input written to a frozen job would block until it is resumed
+	if client != nil && client.isPaused() && (req.Job.Job.Config.TTY || req.Stdin != nil) {
+		return host.ErrJobPaused
+	}
+
+	if req.TeeFile != "" {
+		tee, err := openTeeFile(l.TeeDir, req.TeeFile)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := tee.Close(); err != nil {
+				l.logger.Error("error closing attach tee file", "fn", "Attach", "job.id", req.Job.Job.ID, "path", req.TeeFile, "err", err)
+			}
+			if dropped := tee.Dropped(); dropped > 0 {
+				l.logger.Warn("dropped output writing attach tee file", "fn", "Attach", "job.id", req.Job.Job.ID, "path", req.TeeFile, "bytes", dropped)
+			}
+		}()
+		req.Stdout = teeWriter(req.Stdout, tee)
+		req.Stderr = teeWriter(req.Stderr, tee)
+		req.InitLog = teeWriter(req.InitLog, tee)
+	}
+
 	defer func() {
 		if client != nil && (req.Job.Job.Config.TTY || req.Stream) && err == io.EOF {
 			<-client.done
+			if client.isRestarting() {
+				// the job is still running in a new container
+				return
+			}
 			job := l.state.GetJob(req.Job.Job.ID)
-			if job.Status == host.StatusDone || job.Status == host.StatusCrashed {
-				err = ExitError(*job.ExitStatus)
+			if job == nil {
 				return
 			}
-			err = errors.New(*job.Error)
+			switch job.Status {
+			case host.StatusDone, host.StatusCrashed:
+				err = ExitError(*job.ExitStatus)
+			case host.StatusRunning, host.StatusReady:
+				// the job was started again (e.g. due to its
+				// restart policy) after this container exited
+			default:
+				if job.Error != nil {
+					err = errors.New(*job.Error)
+				}
+			}
 		}
 	}()
 
@@ -1184,7 +3623,11 @@ func (l *LibvirtLXCBackend) Attach(req *AttachRequest) (err error) {
 		if w == nil {
 			continue
 		}
-		if _, err := w.Write(append(msg.Msg, '\n')); err != nil {
+		line := append([]byte{}, msg.Msg...)
+		if n := logmux.Truncated(msg); n > 0 {
+			line = append(line, fmt.Sprintf(logmux.TruncatedMarker, n)...)
+		}
+		if _, err := w.Write(append(line, '\n')); err != nil {
 			return nil
 		}
 	}
@@ -1194,6 +3637,7 @@ func (l *LibvirtLXCBackend) Attach(req *AttachRequest) (err error) {
 
 func (l *LibvirtLXCBackend) Cleanup(except []string) error {
 	log := l.logger.New("fn", "Cleanup")
+	defer metrics.MeasureSince([]string{"backend", "cleanup"}, time.Now())
 	shouldSkip := func(id string) bool {
 		for _, s := range except {
 			if id == s {
@@ -1204,10 +3648,14 @@ func (l *LibvirtLXCBackend) Cleanup(except []string) error {
 	}
 	l.containersMtx.Lock()
 	ids := make([]string, 0, len(l.containers))
-	for id := range l.containers {
+	for id, c := range l.containers {
 		if shouldSkip(id) {
 			continue
 		}
+		if c.job.Config.SystemCritical {
+			log.Info("skipping system critical job", "job.id", id)
+			continue
+		}
 		ids = append(ids, id)
 	}
 	l.containersMtx.Unlock()
@@ -1234,6 +3682,34 @@ func (l *LibvirtLXCBackend) Cleanup(except []string) error {
 	return err
 }
 
+var (
+	errUnsupportedStateVersion = errors.New("host: unsupported container state version")
+	errInvalidContainerState   = errors.New("host: invalid container state")
+)
+
+// decodeContainerState decodes serialized libvirtContainer state, migrating
+// it from older versions and rejecting it if it is from a newer version or
+// missing the fields needed to reconnect to the container.
+func decodeContainerState(log log15.Logger, data []byte) (*libvirtContainer, error) {
+	container := &libvirtContainer{}
+	if err := json.Unmarshal(data, container); err != nil {
+		return nil, err
+	}
+	if container.Version > libvirtContainerStateVersion {
+		log.Error("container state version is newer than supported", "version", container.Version, "supported", libvirtContainerStateVersion)
+		return nil, errUnsupportedStateVersion
+	}
+	if container.Version < libvirtContainerStateVersion {
+		// the unversioned format has the same fields as version 1
+		log.Info("migrating container state", "from", container.Version, "to", libvirtContainerStateVersion)
+		container.Version = libvirtContainerStateVersion
+	}
+	if container.RootPath == "" || container.Domain == nil {
+		return nil, errInvalidContainerState
+	}
+	return container, nil
+}
+
 /*
 	Loads a series of jobs, and reconstructs whatever additional backend state was saved.
 
@@ -1241,10 +3717,14 @@ func (l *LibvirtLXCBackend) Cleanup(except []string) error {
 	(thus this may take a significant moment; it's not just deserializing).
 */
 func (l *LibvirtLXCBackend) UnmarshalState(jobs map[string]*host.ActiveJob, jobBackendStates map[string][]byte, backendGlobalState []byte, buffers host.LogBuffers) error {
+	log := l.logger.New("fn", "UnmarshalState")
 	containers := make(map[string]*libvirtContainer)
 	for k, v := range jobBackendStates {
-		container := &libvirtContainer{}
-		if err := json.Unmarshal(v, container); err != nil {
+		container, err := decodeContainerState(log.New("job.id", k), v)
+		if err == errUnsupportedStateVersion || err == errInvalidContainerState {
+			log.Error("skipping restore of container", "job.id", k, "err", err)
+			continue
+		} else if err != nil {
 			return fmt.Errorf("failed to deserialize backed container state: %s", err)
 		}
 		containers[k] = container
@@ -1259,69 +3739,431 @@ func (l *LibvirtLXCBackend) UnmarshalState(jobs map[string]*host.ActiveJob, jobB
 		container.l = l
 		container.job = j.Job
 		container.done = make(chan struct{})
+		if j.Paused {
+			// the job's processes stay frozen while the host restarts
+			atomic.StoreInt32(&container.paused, 1)
+		}
+		if !j.Job.Config.HostNetwork && container.IP != nil {
+			// reserve the IP before UnmarshalState returns so it cannot be
+			// allocated to a new job, even if reconnecting is still pending
+			l.restoreJobIP(j.Job.ID, container.IP)
+		}
+		if _, err := container.acquireSharedMounts(); err != nil {
+			log.Error("error acquiring shared mounts", "job.id", j.Job.ID, "err", err)
+		}
+		if cpuset := j.Job.Config.CPUSet; cpuset != "" {
+			if err := l.cpusets.Reserve(j.Job.ID, cpuset, j.Job.Config.CPUSetExclusive); err != nil {
+				log.Error("error reserving cpuset", "job.id", j.Job.ID, "err", err)
+			}
+		}
+		if ports := forwardedPorts(j.Job); len(ports) > 0 && container.IP != nil {
+			// the forwarding rules are left in place while the host
+			// restarts, so just reserve the host ports again
+			if err := l.hostPorts.Reserve(j.Job.ID, container.IP, ports); err != nil {
+				log.Error("error reserving host ports", "job.id", j.Job.ID, "err", err)
+			}
+		}
 		readySignals[j.Job.ID] = make(chan error)
 		go container.watch(readySignals[j.Job.ID], buffers[j.Job.ID])
 	}
-	// gather connection attempts and finish reconstruction if success.  failures will time out.
-	for _, j := range jobs {
-		container, ok := containers[j.Job.ID]
-		if !ok {
+	// gather connection attempts and finish reconstruction if success.  failures will time out.
+	pending := waitReadySignals(readySignals, unmarshalStateTimeout, func(id string, err error) {
+		container := containers[id]
+		if err != nil {
+			if _, ok := err.(*ContainerInitUnreachableError); ok {
+				log.Error("containerinit unreachable after retrying, giving up", "job.id", id, "err", err)
+			} else {
+				log.Error("error reconnecting to container", "job.id", id, "err", err)
+			}
+			container.cleanup()
+			return
+		}
+		l.containersMtx.Lock()
+		l.containers[id] = container
+		l.containersMtx.Unlock()
+	})
+	if pending > 0 {
+		log.Error("timed out waiting for containers to reconnect, continuing in the background", "pending", pending, "timeout", unmarshalStateTimeout)
+	}
+	return nil
+}
+
+// unmarshalStateTimeout is how long UnmarshalState waits for containers to
+// reconnect before returning
+const unmarshalStateTimeout = 30 * time.Second
+
+// waitReadySignals waits concurrently for each signal, calling done with its
+// job ID and result. It returns once all signals have been received or the
+// timeout elapses, returning the number of signals still pending which will
+// continue to be handled in the background.
+func waitReadySignals(signals map[string]chan error, timeout time.Duration, done func(string, error)) int {
+	var wg sync.WaitGroup
+	remaining := int32(len(signals))
+	for id, ch := range signals {
+		wg.Add(1)
+		go func(id string, ch chan error) {
+			defer wg.Done()
+			done(id, <-ch)
+			atomic.AddInt32(&remaining, -1)
+		}(id, ch)
+	}
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return 0
+	case <-time.After(timeout):
+		return int(atomic.LoadInt32(&remaining))
+	}
+}
+
+func (l *LibvirtLXCBackend) MarshalJobState(jobID string) ([]byte, error) {
+	l.containersMtx.RLock()
+	defer l.containersMtx.RUnlock()
+	if associatedState, exists := l.containers[jobID]; exists {
+		return json.Marshal(associatedState)
+	}
+	return nil, nil
+}
+
+// updateMetrics updates the gauges for the number of containers and the
+// number of free addresses in the container IP pool
+func (l *LibvirtLXCBackend) updateMetrics() {
+	l.containersMtx.RLock()
+	containers := len(l.containers)
+	l.containersMtx.RUnlock()
+	metrics.SetGauge([]string{"backend", "containers"}, float32(containers))
+
+	if free, ok := l.FreeIPs(); ok {
+		metrics.SetGauge([]string{"backend", "ip_pool", "free"}, float32(free))
+	}
+}
+
+// ipPoolSize returns the number of allocatable addresses in n, excluding the
+// network and broadcast addresses
+func ipPoolSize(n *net.IPNet) int {
+	ones, bits := n.Mask.Size()
+	if size := 1<<uint(bits-ones) - 2; size > 0 {
+		return size
+	}
+	return 0
+}
+
+type libvirtDebugState struct {
+	Draining     bool                                   `json:"draining"`
+	BridgeName   string                                 `json:"bridge_name"`
+	BridgeAddr   string                                 `json:"bridge_addr,omitempty"`
+	BridgeNet    string                                 `json:"bridge_net,omitempty"`
+	MTU          int                                    `json:"mtu,omitempty"`
+	ResolvConf   string                                 `json:"resolv_conf"`
+	AllocatedIPs []string                               `json:"allocated_ips"`
+	DefaultEnv   map[string]string                      `json:"default_env"`
+	Partitions   map[string]PartitionConfig             `json:"partitions"`
+	Containers   map[string]*libvirtContainerDebugState `json:"containers"`
+}
+
+type libvirtContainerDebugState struct {
+	RootPath    string            `json:"root_path"`
+	IP          string            `json:"ip,omitempty"`
+	DomainID    int               `json:"domain_id,omitempty"`
+	Partition   string            `json:"partition"`
+	HostNetwork bool              `json:"host_network,omitempty"`
+	Env         map[string]string `json:"env"`
+	LogStreams  []string          `json:"log_streams"`
+	Restarting  bool              `json:"restarting,omitempty"`
+}
+
+// redactEnv returns a copy of env with the values replaced so that secrets
+// are not exposed
+func redactEnv(env map[string]string) map[string]string {
+	redacted := make(map[string]string, len(env))
+	for k := range env {
+		redacted[k] = "[redacted]"
+	}
+	return redacted
+}
+
+// DebugState returns a JSON snapshot of the backend's network config, IP
+// allocations and containers for diagnosing a misbehaving host. Environment
+// variable values are redacted.
+func (l *LibvirtLXCBackend) DebugState() ([]byte, error) {
+	state := &libvirtDebugState{
+		Draining:     l.IsDraining(),
+		BridgeName:   l.bridgeName,
+		ResolvConf:   l.resolvConf,
+		AllocatedIPs: []string{},
+		Partitions:   l.partitionCGroups,
+		Containers:   make(map[string]*libvirtContainerDebugState),
+	}
+
+	// the network config is only safe to read once networking is configured
+	select {
+	case <-l.networkConfigured:
+		state.BridgeAddr = l.bridgeAddr.String()
+		state.BridgeNet = l.bridgeNet.String()
+		state.MTU = l.ifaceMTU
+		state.AllocatedIPs = append(state.AllocatedIPs, l.bridgeAddr.String())
+	default:
+	}
+
+	l.envMtx.RLock()
+	state.DefaultEnv = redactEnv(l.defaultEnv)
+	l.envMtx.RUnlock()
+
+	l.containersMtx.RLock()
+	l.logStreamMtx.Lock()
+	for id, c := range l.containers {
+		s := &libvirtContainerDebugState{
+			RootPath:    c.RootPath,
+			Partition:   c.job.Partition,
+			HostNetwork: c.job.Config.HostNetwork,
+			Env:         redactEnv(c.job.Config.Env),
+			LogStreams:  []string{},
+			Restarting:  c.isRestarting(),
+		}
+		if c.IP != nil {
+			s.IP = c.IP.String()
+			if !c.job.Config.HostNetwork {
+				state.AllocatedIPs = append(state.AllocatedIPs, s.IP)
+			}
+		}
+		if c.Domain != nil {
+			s.DomainID = c.Domain.ID
+		}
+		for fd := range l.logStreams[id] {
+			s.LogStreams = append(s.LogStreams, fd)
+		}
+		sort.Strings(s.LogStreams)
+		state.Containers[id] = s
+	}
+	l.logStreamMtx.Unlock()
+	l.containersMtx.RUnlock()
+	sort.Strings(state.AllocatedIPs)
+
+	return json.Marshal(state)
+}
+
+func (l *LibvirtLXCBackend) OpenLogs(buffers host.LogBuffers) error {
+	l.containersMtx.RLock()
+	defer l.containersMtx.RUnlock()
+	for id, c := range l.containers {
+		if err := c.followLogs(c.logger("fn", "OpenLogs", "job.id", id), buffers[id]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FlushLogs waits for up to timeout for the log streams of all jobs to read
+// the data written to them, so it is not lost when CloseLogs is called, and
+// returns the IDs of jobs whose logs were not flushed in time
+func (l *LibvirtLXCBackend) FlushLogs(timeout time.Duration) []string {
+	l.logStreamMtx.Lock()
+	defer l.logStreamMtx.Unlock()
+	var wg sync.WaitGroup
+	var mtx sync.Mutex
+	failed := make(map[string]struct{})
+	for id, streams := range l.logStreams {
+		for _, stream := range streams {
+			wg.Add(1)
+			go func(id string, stream *logmux.LogStream) {
+				defer wg.Done()
+				if !stream.Flush(timeout) {
+					mtx.Lock()
+					failed[id] = struct{}{}
+					mtx.Unlock()
+				}
+			}(id, stream)
+		}
+	}
+	wg.Wait()
+	if len(failed) == 0 {
+		return nil
+	}
+	ids := make([]string, 0, len(failed))
+	for id := range failed {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (l *LibvirtLXCBackend) CloseLogs() (host.LogBuffers, error) {
+	log := l.logger.New("fn", "CloseLogs")
+	l.logStreamMtx.Lock()
+	defer l.logStreamMtx.Unlock()
+	buffers := make(host.LogBuffers, len(l.logStreams))
+	for id, streams := range l.logStreams {
+		log.Info("closing", "job.id", id)
+		buffer := make(host.LogBuffer, len(streams))
+		for fd, stream := range streams {
+			buffer[fd] = stream.Close()
+		}
+		buffers[id] = buffer
+		delete(l.logStreams, id)
+	}
+	return buffers, nil
+}
+
+// LogStreams returns the sorted names of the open log streams of each job
+func (l *LibvirtLXCBackend) LogStreams() map[string][]string {
+	l.logStreamMtx.Lock()
+	defer l.logStreamMtx.Unlock()
+	res := make(map[string][]string, len(l.logStreams))
+	for id, streams := range l.logStreams {
+		names := make([]string, 0, len(streams))
+		for name := range streams {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		res[id] = names
+	}
+	return res
+}
+
+// logStreamReapInterval is how often log streams of jobs which are no longer
+// running are closed
+const logStreamReapInterval = 5 * time.Minute
+
+func (l *LibvirtLXCBackend) reapLogStreamsLoop() {
+	for range time.Tick(logStreamReapInterval) {
+		l.ReapLogStreams()
+	}
+}
+
+func (l *LibvirtLXCBackend) gcLoop(interval time.Duration) {
+	log := l.logger.New("fn", "gcLoop")
+	for range time.Tick(interval) {
+		if _, err := l.GC(); err != nil {
+			log.Error("error removing orphaned checkouts", "err", err)
+		}
+	}
+}
+
+// GC removes the image checkouts of jobs which are not running, which are
+// left behind if a job's cleanup did not run (e.g. due to a crash), and
+// returns the IDs of the jobs whose checkouts were removed
+func (l *LibvirtLXCBackend) GC() ([]string, error) {
+	ids, err := l.pinkerton.Checkouts()
+	if err != nil {
+		return nil, err
+	}
+	return l.removeOrphanedCheckouts(ids, l.pinkerton.Cleanup)
+}
+
+// removeOrphanedCheckouts calls remove for each of the given checkout IDs
+// which is not the ID of a running or starting job, including jobs restored
+// from the state database which have yet to be reconnected to
+func (l *LibvirtLXCBackend) removeOrphanedCheckouts(ids []string, remove func(string) error) ([]string, error) {
+	log := l.logger.New("fn", "GC")
+
+	var removed []string
+	for _, id := range ids {
+		// hold the lock while removing so the job can't be started
+		// with the same ID until its old checkout is gone
+		l.containersMtx.RLock()
+		_, running := l.containers[id]
+		_, starting := l.starting[id]
+		if running || starting || l.jobActive(id) {
+			l.containersMtx.RUnlock()
 			continue
 		}
-		if err := <-readySignals[j.Job.ID]; err != nil {
-			// log error
-			container.cleanup()
-			continue
+		log.Info("removing orphaned checkout", "job.id", id)
+		err := remove(id)
+		l.containersMtx.RUnlock()
+		if err != nil {
+			log.Error("error removing orphaned checkout", "job.id", id, "err", err)
+			return removed, err
 		}
-		l.containers[j.Job.ID] = container
+		removed = append(removed, id)
 	}
-	return nil
+	return removed, nil
 }
 
-func (l *LibvirtLXCBackend) MarshalJobState(jobID string) ([]byte, error) {
-	l.containersMtx.RLock()
-	defer l.containersMtx.RUnlock()
-	if associatedState, exists := l.containers[jobID]; exists {
-		return json.Marshal(associatedState)
+// jobActive returns whether the state database has the given job in a
+// non-terminal status
+func (l *LibvirtLXCBackend) jobActive(id string) bool {
+	job := l.state.GetJob(id)
+	if job == nil {
+		return false
+	}
+	switch job.Status {
+	case host.StatusDone, host.StatusCrashed, host.StatusFailed:
+		return false
+	default:
+		return true
 	}
-	return nil, nil
 }
 
-func (l *LibvirtLXCBackend) OpenLogs(buffers host.LogBuffers) error {
+// ReapLogStreams closes the log streams of jobs which are no longer running,
+// which are left open if a job's cleanup did not run (e.g. due to a crash),
+// and returns the IDs of the jobs whose streams were closed
+func (l *LibvirtLXCBackend) ReapLogStreams() []string {
+	log := l.logger.New("fn", "ReapLogStreams")
+
+	// take the locks in the same order as DebugState
 	l.containersMtx.RLock()
 	defer l.containersMtx.RUnlock()
-	for id, c := range l.containers {
-		if err := c.followLogs(l.logger.New("fn", "OpenLogs", "job.id", id), buffers[id]); err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
-func (l *LibvirtLXCBackend) CloseLogs() (host.LogBuffers, error) {
-	log := l.logger.New("fn", "CloseLogs")
 	l.logStreamMtx.Lock()
 	defer l.logStreamMtx.Unlock()
-	buffers := make(host.LogBuffers, len(l.logStreams))
+
+	var reaped []string
 	for id, streams := range l.logStreams {
-		log.Info("closing", "job.id", id)
-		buffer := make(host.LogBuffer, len(streams))
-		for fd, stream := range streams {
-			buffer[fd] = stream.Close()
+		if _, ok := l.containers[id]; ok {
+			continue
+		}
+		for name, stream := range streams {
+			log.Info("closing orphaned log stream", "job.id", id, "stream", name)
+			stream.Close()
 		}
-		buffers[id] = buffer
 		delete(l.logStreams, id)
+		reaped = append(reaped, id)
 	}
-	return buffers, nil
+	sort.Strings(reaped)
+	return reaped
+}
+
+// resolveBindSource resolves any symlinks in the bind mount source src,
+// returning the resolved path and whether it is a directory
+func resolveBindSource(src string) (string, bool, error) {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return "", false, err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		resolved, err := filepath.EvalSymlinks(src)
+		if os.IsNotExist(err) {
+			return "", false, fmt.Errorf("host: bind mount source %s is a dangling symlink", src)
+		} else if err != nil {
+			return "", false, err
+		}
+		src = resolved
+		if info, err = os.Stat(src); err != nil {
+			return "", false, err
+		}
+	}
+	return src, info.IsDir(), nil
 }
 
-func bindMount(src, dest string, writeable, private bool) error {
-	srcStat, err := os.Stat(src)
+// bindMountOptions configure a bind mount, which is read-only unless
+// Writeable is set
+type bindMountOptions struct {
+	Writeable bool
+	Private   bool
+	NoExec    bool
+	NoSUID    bool
+}
+
+func bindMount(src, dest string, opts bindMountOptions) error {
+	src, isDir, err := resolveBindSource(src)
 	if err != nil {
 		return err
 	}
 	if _, err := os.Stat(dest); os.IsNotExist(err) {
-		if srcStat.IsDir() {
+		if isDir {
 			if err := os.MkdirAll(dest, 0755); err != nil {
 				return err
 			}
@@ -1340,14 +4182,31 @@ func bindMount(src, dest string, writeable, private bool) error {
 	}
 
 	flags := syscall.MS_BIND | syscall.MS_REC
-	if !writeable {
+	if !opts.Writeable {
 		flags |= syscall.MS_RDONLY
 	}
 
 	if err := syscall.Mount(src, dest, "bind", uintptr(flags), ""); err != nil {
 		return err
 	}
-	if private {
+	if !opts.Writeable || opts.NoExec || opts.NoSUID {
+		// these flags (including MS_RDONLY) are ignored when creating a
+		// bind mount, so apply them with a remount
+		flags = syscall.MS_BIND | syscall.MS_REMOUNT
+		if !opts.Writeable {
+			flags |= syscall.MS_RDONLY
+		}
+		if opts.NoExec {
+			flags |= syscall.MS_NOEXEC
+		}
+		if opts.NoSUID {
+			flags |= syscall.MS_NOSUID
+		}
+		if err := syscall.Mount("", dest, "none", uintptr(flags), ""); err != nil {
+			return err
+		}
+	}
+	if opts.Private {
 		if err := syscall.Mount("", dest, "none", uintptr(syscall.MS_PRIVATE), ""); err != nil {
 			return err
 		}
@@ -1377,34 +4236,531 @@ func milliCPUToShares(milliCPU int64) int64 {
 	return shares
 }
 
-func createCGroupPartition(name string, cpuShares int64) error {
-	name = name + ".partition"
-	for _, group := range []string{"blkio", "cpu", "cpuacct", "cpuset", "devices", "freezer", "memory", "net_cls", "perf_event"} {
-		if err := os.MkdirAll(filepath.Join("/sys/fs/cgroup/", group, "machine", name), 0755); err != nil {
+// PartitionConfig is the cgroup configuration of a resource partition
+type PartitionConfig struct {
+	CPUShares int64 `json:"cpu_shares"`
+
+	// CPUSet, if set, restricts jobs in the partition to the given CPUs
+	// (e.g. "0-3"), otherwise all CPUs available to the host are used
+	CPUSet string `json:"cpuset,omitempty"`
+}
+
+// parseCPUSet parses a cpuset list (e.g. "0-3,6") into the set of CPUs it
+// contains
+func parseCPUSet(s string) (map[int]struct{}, error) {
+	cpus := make(map[int]struct{})
+	for _, part := range strings.Split(strings.TrimSpace(s), ",") {
+		if part == "" {
+			continue
+		}
+		bounds := strings.SplitN(part, "-", 2)
+		start, err := strconv.Atoi(bounds[0])
+		if err != nil || start < 0 {
+			return nil, fmt.Errorf("invalid cpuset %q", s)
+		}
+		end := start
+		if len(bounds) == 2 {
+			end, err = strconv.Atoi(bounds[1])
+			if err != nil || end < start {
+				return nil, fmt.Errorf("invalid cpuset %q", s)
+			}
+		}
+		for cpu := start; cpu <= end; cpu++ {
+			cpus[cpu] = struct{}{}
+		}
+	}
+	return cpus, nil
+}
+
+// validateCPUSet checks that all CPUs in cpuset are in the available cpuset
+func validateCPUSet(cpuset, available string) error {
+	cpus, err := parseCPUSet(cpuset)
+	if err != nil {
+		return err
+	}
+	if len(cpus) == 0 {
+		return fmt.Errorf("invalid empty cpuset %q", cpuset)
+	}
+	availableCPUs, err := parseCPUSet(available)
+	if err != nil {
+		return err
+	}
+	for cpu := range cpus {
+		if _, ok := availableCPUs[cpu]; !ok {
+			return fmt.Errorf("cpuset %q contains CPU %d which is not in the available cpuset %q", cpuset, cpu, strings.TrimSpace(available))
+		}
+	}
+	return nil
+}
+
+type cpusetReservation struct {
+	cpus      map[int]struct{}
+	exclusive bool
+}
+
+// cpusetReservations tracks the CPUs jobs are pinned to so that jobs with an
+// exclusive cpuset do not share CPUs with any other pinned job
+type cpusetReservations struct {
+	mtx  sync.Mutex
+	jobs map[string]cpusetReservation
+}
+
+func newCPUSetReservations() *cpusetReservations {
+	return &cpusetReservations{jobs: make(map[string]cpusetReservation)}
+}
+
+// Reserve reserves the CPUs in cpuset for the given job, returning an error
+// if either the request or an existing reservation is exclusive and they
+// have CPUs in common
+func (r *cpusetReservations) Reserve(jobID, cpuset string, exclusive bool) error {
+	cpus, err := parseCPUSet(cpuset)
+	if err != nil {
+		return err
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	for id, other := range r.jobs {
+		if !exclusive && !other.exclusive {
+			continue
+		}
+		for cpu := range cpus {
+			if _, ok := other.cpus[cpu]; ok {
+				return fmt.Errorf("host: cpuset %q conflicts with the exclusive cpuset of job %s", cpuset, id)
+			}
+		}
+	}
+	r.jobs[jobID] = cpusetReservation{cpus: cpus, exclusive: exclusive}
+	return nil
+}
+
+func (r *cpusetReservations) Release(jobID string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	delete(r.jobs, jobID)
+}
+
+// writeEnvFiles mounts a tmpfs at dir and writes each env file to it, named
+// by its index, owned by uid and gid and readable only by uid
+func writeEnvFiles(dir string, files []host.EnvFile, uid, gid int) error {
+	for _, f := range files {
+		if f.Path == "" {
+			return errors.New("host: invalid empty env file path")
+		}
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if err := syscall.Mount("tmpfs", dir, "tmpfs", syscall.MS_NOEXEC|syscall.MS_NOSUID|syscall.MS_NODEV, "mode=0700"); err != nil {
+		return fmt.Errorf("host: error mounting env file tmpfs: %s", err)
+	}
+	for i, f := range files {
+		data, err := envFileData(f.Env)
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(dir, strconv.Itoa(i))
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			return err
+		}
+		if err := os.Chown(path, uid, gid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveRootPath returns the host path of path in the container root at
+// rootPath, evaluating symlinks as if rootPath were the root directory so that
+// the result can't be outside of it. Paths containing ".." are rejected.
+func resolveRootPath(rootPath, path string) (string, error) {
+	for _, name := range strings.Split(path, "/") {
+		if name == ".." {
+			return "", fmt.Errorf("host: invalid path %q: must not contain ..", path)
+		}
+	}
+	return symlink.FollowSymlinkInScope(filepath.Join(rootPath, path), rootPath)
+}
+
+// jobGid returns the primary group of uid from the passwd file in the
+// container root at rootPath, as used by containerinit when running the job,
+// defaulting to 0 if there is no such user
+func jobGid(rootPath string, uid int) (int, error) {
+	if uid == 0 {
+		return 0, nil
+	}
+	passwd, err := resolveRootPath(rootPath, "/etc/passwd")
+	if err != nil {
+		return 0, err
+	}
+	users, err := user.ParsePasswdFileFilter(passwd, func(u user.User) bool {
+		return u.Uid == uid
+	})
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	if len(users) == 0 {
+		return 0, nil
+	}
+	return users[0].Gid, nil
+}
+
+// envFileData returns the contents of an env file, one KEY=VALUE line per
+// variable sorted by key
+func envFileData(env map[string]string) ([]byte, error) {
+	keys := make([]string, 0, len(env))
+	for k, v := range env {
+		if k == "" || strings.ContainsAny(k, "=\n") {
+			return nil, fmt.Errorf("host: invalid env file key %q", k)
+		}
+		if strings.Contains(v, "\n") {
+			return nil, fmt.Errorf("host: invalid env file value for %s: contains a newline", k)
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	for _, k := range keys {
+		fmt.Fprintf(&buf, "%s=%s\n", k, env[k])
+	}
+	return buf.Bytes(), nil
+}
+
+// mountTmpfsVolume mounts a tmpfs of the volume's size at dest, owned by the
+// given uid. It is unmounted along with the job's other volumes and, being
+// in memory, never touches disk.
+func mountTmpfsVolume(dest string, v host.VolumeBinding, uid int) error {
+	if v.Size <= 0 {
+		return fmt.Errorf("host: invalid tmpfs volume size %d", v.Size)
+	}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+	flags := syscall.MS_NODEV
+	if !v.Writeable {
+		flags |= syscall.MS_RDONLY
+	}
+	if v.NoExec {
+		flags |= syscall.MS_NOEXEC
+	}
+	if v.NoSUID {
+		flags |= syscall.MS_NOSUID
+	}
+	data := fmt.Sprintf("size=%d,mode=0755,uid=%d", v.Size, uid)
+	return syscall.Mount("tmpfs", dest, "tmpfs", uintptr(flags), data)
+}
+
+// removeEnvFiles unmounts the env file tmpfs at dir and removes it
+func removeEnvFiles(dir string) error {
+	if err := syscall.Unmount(dir, 0); err != nil && err != syscall.EINVAL && !os.IsNotExist(err) {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+type hostPortReservation struct {
+	ip    net.IP
+	ports []host.Port
+}
+
+// hostPortReservations tracks the host ports forwarded to jobs so that
+// conflicting jobs fail to start with a clear error
+type hostPortReservations struct {
+	mtx  sync.Mutex
+	jobs map[string]hostPortReservation
+}
+
+func newHostPortReservations() *hostPortReservations {
+	return &hostPortReservations{jobs: make(map[string]hostPortReservation)}
+}
+
+// Reserve reserves the host ports of the given ports for a job with the
+// given IP, returning an error if any are reserved by another job
+func (r *hostPortReservations) Reserve(jobID string, ip net.IP, ports []host.Port) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	for i, p := range ports {
+		for _, q := range ports[:i] {
+			if p.HostPort == q.HostPort && p.Proto == q.Proto {
+				return fmt.Errorf("host: host port %d/%s is forwarded more than once", p.HostPort, p.Proto)
+			}
+		}
+		for id, other := range r.jobs {
+			for _, q := range other.ports {
+				if p.HostPort == q.HostPort && p.Proto == q.Proto {
+					return fmt.Errorf("host: host port %d/%s is already in use by job %s", p.HostPort, p.Proto, id)
+				}
+			}
+		}
+	}
+	r.jobs[jobID] = hostPortReservation{ip: ip, ports: ports}
+	return nil
+}
+
+// Release releases the host ports reserved for a job, returning the
+// released reservation
+func (r *hostPortReservations) Release(jobID string) (hostPortReservation, bool) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	res, ok := r.jobs[jobID]
+	delete(r.jobs, jobID)
+	return res, ok
+}
+
+func (r *hostPortReservations) All() []hostPortReservation {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	all := make([]hostPortReservation, 0, len(r.jobs))
+	for _, res := range r.jobs {
+		all = append(all, res)
+	}
+	return all
+}
+
+// forwardedPorts returns the job's ports which have a host port
+func forwardedPorts(job *host.Job) []host.Port {
+	var ports []host.Port
+	for _, p := range job.Config.Ports {
+		if p.HostPort != 0 {
+			ports = append(ports, p)
+		}
+	}
+	return ports
+}
+
+// checkHostPortFree returns an error if a process on the host is already
+// listening on the given port
+func checkHostPortFree(proto string, port int) error {
+	addr := fmt.Sprintf(":%d", port)
+	var err error
+	switch proto {
+	case "tcp":
+		var l net.Listener
+		if l, err = net.Listen("tcp", addr); err == nil {
+			l.Close()
+		}
+	case "udp":
+		var c net.PacketConn
+		if c, err = net.ListenPacket("udp", addr); err == nil {
+			c.Close()
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("host: host port %d/%s is already in use: %s", port, proto, err)
+	}
+	return nil
+}
+
+// forwardHostPorts forwards the job's host ports to the container
+func (l *LibvirtLXCBackend) forwardHostPorts(job *host.Job, ip net.IP) error {
+	ports := forwardedPorts(job)
+	if len(ports) == 0 {
+		return nil
+	}
+	if job.Config.HostNetwork {
+		return errors.New("host: host ports cannot be used with host networking")
+	}
+	for _, p := range ports {
+		if p.HostPort < 1 || p.HostPort > 65535 {
+			return fmt.Errorf("host: invalid host port %d", p.HostPort)
+		}
+	}
+	if err := l.hostPorts.Reserve(job.ID, ip, ports); err != nil {
+		return err
+	}
+	for i, p := range ports {
+		err := checkHostPortFree(p.Proto, p.HostPort)
+		if err == nil {
+			err = iptables.ForwardPort(l.bridgeName, p.Proto, p.HostPort, ip.String(), p.Port)
+		}
+		if err != nil {
+			for _, q := range ports[:i] {
+				iptables.RemovePortForward(l.bridgeName, q.Proto, q.HostPort, ip.String(), q.Port)
+			}
+			l.hostPorts.Release(job.ID)
+			return err
+		}
+	}
+	return nil
+}
+
+// removeHostPortForwards removes the forwarding of a job's host ports
+func (l *LibvirtLXCBackend) removeHostPortForwards(jobID string) {
+	res, ok := l.hostPorts.Release(jobID)
+	if !ok {
+		return
+	}
+	for _, p := range res.ports {
+		if err := iptables.RemovePortForward(l.bridgeName, p.Proto, p.HostPort, res.ip.String(), p.Port); err != nil {
+			l.logger.Error("error removing host port forward", "fn", "removeHostPortForwards", "job.id", jobID, "host_port", p.HostPort, "err", err)
+		}
+	}
+}
+
+func createCGroupPartition(name string, config PartitionConfig) error {
+	groups := []string{"blkio", "cpu", "cpuacct", "cpuset", "devices", "freezer", "memory", "net_cls", "perf_event"}
+	if pidsCGroupSupported() {
+		groups = append(groups, "pids")
+	}
+	for _, group := range groups {
+		if err := os.MkdirAll(partitionCGroupPath(group, name), 0755); err != nil {
 			return fmt.Errorf("error creating partition cgroup: %s", err)
 		}
 	}
+	machine := filepath.Join(cgroupRoot, "cpuset", "machine")
 	for _, param := range []string{"cpuset.cpus", "cpuset.mems"} {
-		data, err := ioutil.ReadFile(filepath.Join("/sys/fs/cgroup/cpuset/machine", param))
+		data, err := ioutil.ReadFile(filepath.Join(machine, param))
 		if err != nil {
 			return fmt.Errorf("error reading cgroup param: %s", err)
 		}
 		if len(bytes.TrimSpace(data)) == 0 {
 			// Populate our parent cgroup to avoid ENOSPC when creating containers
-			data, err = ioutil.ReadFile(filepath.Join("/sys/fs/cgroup/cpuset", param))
+			data, err = ioutil.ReadFile(filepath.Join(cgroupRoot, "cpuset", param))
 			if err != nil {
 				return fmt.Errorf("error reading cgroup param: %s", err)
 			}
-			if err := ioutil.WriteFile(filepath.Join("/sys/fs/cgroup/cpuset/machine", param), data, 0644); err != nil {
+			if err := ioutil.WriteFile(filepath.Join(machine, param), data, 0644); err != nil {
 				return fmt.Errorf("error writing cgroup param: %s", err)
 			}
 		}
-		if err := ioutil.WriteFile(filepath.Join("/sys/fs/cgroup/cpuset/machine", name, param), data, 0644); err != nil {
+		if param == "cpuset.cpus" && config.CPUSet != "" {
+			if err := validateCPUSet(config.CPUSet, string(data)); err != nil {
+				return fmt.Errorf("error validating partition cpuset: %s", err)
+			}
+			data = []byte(config.CPUSet)
+		}
+		if err := ioutil.WriteFile(filepath.Join(partitionCGroupPath("cpuset", name), param), data, 0644); err != nil {
 			return fmt.Errorf("error writing cgroup param: %s", err)
 		}
 	}
-	if err := ioutil.WriteFile(filepath.Join("/sys/fs/cgroup/cpu/machine", name, "cpu.shares"), strconv.AppendInt(nil, cpuShares, 10), 0644); err != nil {
+	if err := ioutil.WriteFile(filepath.Join(partitionCGroupPath("cpu", name), "cpu.shares"), strconv.AppendInt(nil, config.CPUShares, 10), 0644); err != nil {
+		return fmt.Errorf("error writing cgroup param: %s", err)
+	}
+	return nil
+}
+
+// PartitionInfo is the cgroup configuration in effect for a resource
+// partition, as read back from the partition's cgroups
+type PartitionInfo struct {
+	CPUShares int64  `json:"cpu_shares"`
+	CPUSet    string `json:"cpuset"`
+
+	// Memory and PIDs are the partition's memory limit in bytes and
+	// pids limit, or zero if unlimited
+	Memory int64 `json:"memory,omitempty"`
+	PIDs   int64 `json:"pids,omitempty"`
+
+	// Error is set if the partition's cgroups could not be read
+	Error string `json:"error,omitempty"`
+}
+
+// Partitions returns the cgroup configuration in effect for each configured
+// partition, reading it from the cgroup filesystem so that it reflects what
+// the kernel is actually enforcing rather than what was requested
+func (l *LibvirtLXCBackend) Partitions() map[string]PartitionInfo {
+	partitions := make(map[string]PartitionInfo, len(l.partitionCGroups))
+	for name := range l.partitionCGroups {
+		info, err := readCGroupPartition(name)
+		if err != nil {
+			l.logger.Error("error reading partition cgroup", "fn", "Partitions", "partition", name, "err", err)
+			info.Error = err.Error()
+		}
+		partitions[name] = info
+	}
+	return partitions
+}
+
+// cgroupMemoryUnlimited is the value of memory.limit_in_bytes for cgroups
+// without a memory limit (PAGE_COUNTER_MAX pages of 4KiB)
+const cgroupMemoryUnlimited = math.MaxInt64 &^ 4095
+
+func readCGroupPartition(name string) (PartitionInfo, error) {
+	var info PartitionInfo
+	read := func(controller, param string) (string, error) {
+		data, err := ioutil.ReadFile(filepath.Join(partitionCGroupPath(controller, name), param))
+		if err != nil {
+			return "", fmt.Errorf("error reading cgroup param: %s", err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	readInt := func(controller, param string) (int64, error) {
+		s, err := read(controller, param)
+		if err != nil {
+			return 0, err
+		}
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("error parsing %s: %s", param, err)
+		}
+		return n, nil
+	}
+
+	var err error
+	if info.CPUShares, err = readInt("cpu", "cpu.shares"); err != nil {
+		return info, err
+	}
+	if info.CPUSet, err = read("cpuset", "cpuset.cpus"); err != nil {
+		return info, err
+	}
+	if info.Memory, err = readInt("memory", "memory.limit_in_bytes"); err != nil {
+		return info, err
+	}
+	if info.Memory >= cgroupMemoryUnlimited {
+		info.Memory = 0
+	}
+	if !pidsCGroupSupported() {
+		return info, nil
+	}
+	pids, err := read("pids", "pids.max")
+	if err != nil {
+		return info, err
+	}
+	if pids != "max" {
+		if info.PIDs, err = strconv.ParseInt(pids, 10, 64); err != nil {
+			return info, fmt.Errorf("error parsing pids.max: %s", err)
+		}
+	}
+	return info, nil
+}
+
+// cgroupRoot is where the cgroup controller hierarchies are mounted
+var cgroupRoot = "/sys/fs/cgroup"
+
+// jobCGroupPath returns the path of the cgroup which libvirt creates for the
+// given job in the given controller hierarchy
+func jobCGroupPath(controller, partition, jobID string) string {
+	return filepath.Join(partitionCGroupPath(controller, partition), jobID+".libvirt-lxc")
+}
+
+// partitionCGroupPath returns the path of the given partition's cgroup in the
+// given controller hierarchy
+func partitionCGroupPath(controller, partition string) string {
+	return filepath.Join(cgroupRoot, controller, "machine", partition+".partition")
+}
+
+// domainCGroupPath returns the path of the cgroup which libvirt creates for
+// the given domain relative to the root of each controller hierarchy
+func domainCGroupPath(domain *lt.Domain) string {
+	return path.Join(domain.Resource.Partition+".partition", domain.Name+".libvirt-lxc")
+}
+
+// writeDeviceRules denies access to all devices in the given devices cgroup
+// before whitelisting the given rules
+func writeDeviceRules(dir string, rules []host.DeviceRule) error {
+	if err := ioutil.WriteFile(filepath.Join(dir, "devices.deny"), []byte("a\n"), 0644); err != nil {
+		return fmt.Errorf("error writing cgroup param: %s", err)
+	}
+	f, err := os.OpenFile(filepath.Join(dir, "devices.allow"), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
 		return fmt.Errorf("error writing cgroup param: %s", err)
 	}
+	defer f.Close()
+	// the kernel parses a single rule per write
+	for _, rule := range rules {
+		if _, err := f.Write([]byte(rule.String() + "\n")); err != nil {
+			return fmt.Errorf("error writing device rule %q: %s", rule, err)
+		}
+	}
 	return nil
 }
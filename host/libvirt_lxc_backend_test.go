@@ -0,0 +1,2444 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/daemon/graphdriver"
+	"github.com/docker/libnetwork/ipallocator"
+	"github.com/flynn/flynn/host/containerinit"
+	lt "github.com/flynn/flynn/host/libvirt"
+	"github.com/flynn/flynn/host/logmux"
+	"github.com/flynn/flynn/host/resource"
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pinkerton"
+	"github.com/flynn/flynn/pkg/rpcplus"
+	"github.com/flynn/flynn/pkg/rpcplus/fdrpc"
+	"github.com/flynn/flynn/pkg/syslog/rfc5424"
+	. "github.com/flynn/go-check"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+func (S) TestWriteDeviceRules(c *C) {
+	// create the files the devices cgroup would have
+	dir := c.MkDir()
+	for _, name := range []string{"devices.allow", "devices.deny"} {
+		c.Assert(ioutil.WriteFile(filepath.Join(dir, name), nil, 0644), IsNil)
+	}
+
+	rules := []host.DeviceRule{
+		{Type: "c", Major: 1, Minor: 3, Access: "rwm"},
+		{Type: "c", Major: 136, Minor: -1, Access: "rw"},
+	}
+	c.Assert(writeDeviceRules(dir, rules), IsNil)
+
+	deny, err := ioutil.ReadFile(filepath.Join(dir, "devices.deny"))
+	c.Assert(err, IsNil)
+	c.Assert(string(deny), Equals, "a\n")
+	allow, err := ioutil.ReadFile(filepath.Join(dir, "devices.allow"))
+	c.Assert(err, IsNil)
+	c.Assert(string(allow), Equals, "c 1:3 rwm\nc 136:* rw\n")
+}
+
+func (S) TestTailBuffer(c *C) {
+	var t tailBuffer
+	c.Assert(t.Lines(), HasLen, 0)
+
+	for i := 0; i < initLogTailLines+5; i++ {
+		fmt.Fprintf(&t, "line %d\n", i)
+	}
+	t.Write([]byte("partial"))
+	lines := t.Lines()
+	c.Assert(lines, HasLen, initLogTailLines+1)
+	c.Assert(lines[0], Equals, "line 5")
+	c.Assert(lines[initLogTailLines-1], Equals, fmt.Sprintf("line %d", initLogTailLines+4))
+	c.Assert(lines[initLogTailLines], Equals, "partial")
+}
+
+func (S) TestValidateCPUSet(c *C) {
+	for _, t := range []struct {
+		cpuset    string
+		available string
+		valid     bool
+	}{
+		{cpuset: "0-3", available: "0-7\n", valid: true},
+		{cpuset: "1,3,5-6", available: "0-7", valid: true},
+		{cpuset: "6-8", available: "0-7", valid: false},
+		{cpuset: "0-3", available: "0,2-3", valid: false},
+		{cpuset: "a", available: "0-7", valid: false},
+		{cpuset: "", available: "0-7", valid: false},
+	} {
+		err := validateCPUSet(t.cpuset, t.available)
+		c.Assert(err == nil, Equals, t.valid, Commentf("cpuset %q, available %q, err %v", t.cpuset, t.available, err))
+	}
+}
+
+func (S) TestConnectContainerInitRetry(c *C) {
+	log := log15.New()
+	log.SetHandler(log15.DiscardHandler())
+	dir := c.MkDir()
+	socketPath := filepath.Join(dir, "rpc.sock")
+	symlink := filepath.Join(dir, "rpc.link")
+
+	// with no retries, a missing socket is unreachable
+	_, err := connectContainerInit(log, socketPath, symlink, 50*time.Millisecond, 0)
+	c.Assert(err, FitsTypeOf, &ContainerInitUnreachableError{})
+	c.Assert(err.(*ContainerInitUnreachableError).Err, NotNil)
+	c.Assert(err, ErrorMatches, "failed to connect to container: .+")
+
+	// create the socket after the first attempt has timed out
+	timeout := 200 * time.Millisecond
+	listenErr := make(chan error, 1)
+	go func() {
+		time.Sleep(timeout + timeout/2)
+		l, err := net.Listen("unix", socketPath)
+		listenErr <- err
+		if err != nil {
+			return
+		}
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}()
+	client, err := connectContainerInit(log, socketPath, symlink, timeout, 1)
+	c.Assert(<-listenErr, IsNil)
+	c.Assert(err, IsNil)
+	client.Close()
+}
+
+func (S) TestDebugState(c *C) {
+	l := &LibvirtLXCBackend{
+		bridgeName:          "flynnbr0",
+		resolvConf:          "/etc/resolv.conf",
+		defaultEnv:          map[string]string{"DISCOVERD": "192.0.2.1:1111"},
+		partitionCGroups:    map[string]PartitionConfig{"user": {CPUShares: 8192}},
+		networkConfigured:   make(chan struct{}),
+		logStreams:          make(map[string]map[string]*logmux.LogStream),
+		containers:          make(map[string]*libvirtContainer),
+		discoverdConfigured: make(chan struct{}),
+	}
+	l.containers["job1"] = &libvirtContainer{
+		RootPath: "/var/lib/docker/aufs/mnt/job1",
+		IP:       net.ParseIP("192.0.2.5"),
+		job: &host.Job{
+			ID:        "job1",
+			Partition: "user",
+			Config:    host.ContainerConfig{Env: map[string]string{"SECRET": "s3cr3t"}},
+		},
+		l: l,
+	}
+
+	data, err := l.DebugState()
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(string(data), "s3cr3t"), Equals, false)
+	var state libvirtDebugState
+	c.Assert(json.Unmarshal(data, &state), IsNil)
+	c.Assert(state.BridgeName, Equals, "flynnbr0")
+	c.Assert(state.BridgeNet, Equals, "")
+	c.Assert(state.AllocatedIPs, DeepEquals, []string{"192.0.2.5"})
+	c.Assert(state.DefaultEnv, DeepEquals, map[string]string{"DISCOVERD": "[redacted]"})
+	c.Assert(state.Partitions, DeepEquals, map[string]PartitionConfig{"user": {CPUShares: 8192}})
+	c.Assert(state.Containers, HasLen, 1)
+	job := state.Containers["job1"]
+	c.Assert(job.IP, Equals, "192.0.2.5")
+	c.Assert(job.Partition, Equals, "user")
+	c.Assert(job.Env, DeepEquals, map[string]string{"SECRET": "[redacted]"})
+}
+
+func (S) TestWaitExitTimeout(c *C) {
+	for _, t := range []struct {
+		stopTimeout time.Duration
+		expected    time.Duration
+	}{
+		{stopTimeout: 0, expected: defaultWaitExitTimeout},
+		{stopTimeout: 30 * time.Second, expected: 30 * time.Second},
+		{stopTimeout: time.Hour, expected: maxWaitExitTimeout},
+	} {
+		job := &host.Job{Config: host.ContainerConfig{StopTimeout: t.stopTimeout}}
+		c.Assert(waitExitTimeout(job), Equals, t.expected)
+	}
+}
+
+func (S) TestStopSignals(c *C) {
+	// the default is SIGTERM followed by the stop timeout
+	job := &host.Job{Config: host.ContainerConfig{StopTimeout: 30 * time.Second}}
+	c.Assert(stopSignals(job), DeepEquals, []host.StopSignal{{Signal: int(syscall.SIGTERM), Timeout: 30 * time.Second}})
+	job.Config.StopSignals = []host.StopSignal{{Signal: int(syscall.SIGTERM)}, {Signal: int(syscall.SIGINT), Timeout: time.Second}}
+	c.Assert(stopSignals(job), DeepEquals, []host.StopSignal{
+		{Signal: int(syscall.SIGTERM), Timeout: 30 * time.Second},
+		{Signal: int(syscall.SIGINT), Timeout: time.Second},
+	})
+
+	c.Assert(validateStopSignals(job.Config.StopSignals), IsNil)
+	for _, s := range []host.StopSignal{{Signal: 0}, {Signal: 32}, {Signal: int(syscall.SIGTERM), Timeout: -time.Second}} {
+		c.Assert(validateStopSignals([]host.StopSignal{s}), NotNil, Commentf("signal %+v", s))
+	}
+
+	type sent struct {
+		signal int
+		at     time.Duration
+	}
+	run := func(signals []host.StopSignal, exitAfter int) []sent {
+		var res []sent
+		start := time.Now()
+		signal := func(sig int) error {
+			res = append(res, sent{sig, time.Since(start)})
+			return nil
+		}
+		wait := func(timeout time.Duration) error {
+			if len(res) == exitAfter {
+				return nil
+			}
+			time.Sleep(timeout)
+			return errors.New("timed out")
+		}
+		c.Assert(stopWithSignals(signals, signal, wait), IsNil)
+		return res
+	}
+	signals := []host.StopSignal{
+		{Signal: int(syscall.SIGTERM), Timeout: 20 * time.Millisecond},
+		{Signal: int(syscall.SIGINT), Timeout: 40 * time.Millisecond},
+	}
+
+	// each signal is sent in order after the previous timeout, ending in
+	// SIGKILL
+	res := run(signals, 0)
+	c.Assert(res, HasLen, 3)
+	for i, sig := range []syscall.Signal{syscall.SIGTERM, syscall.SIGINT, syscall.SIGKILL} {
+		c.Assert(res[i].signal, Equals, int(sig))
+	}
+	c.Assert(res[1].at-res[0].at >= 20*time.Millisecond, Equals, true, Commentf("sent %v", res))
+	c.Assert(res[2].at-res[1].at >= 40*time.Millisecond, Equals, true, Commentf("sent %v", res))
+
+	// the sequence stops once the job exits
+	res = run(signals, 1)
+	c.Assert(res, HasLen, 1)
+	c.Assert(res[0].signal, Equals, int(syscall.SIGTERM))
+
+	// SIGKILL is not sent twice
+	res = run(append(signals, host.StopSignal{Signal: int(syscall.SIGKILL), Timeout: time.Millisecond}), 0)
+	c.Assert(res, HasLen, 3)
+	c.Assert(res[2].signal, Equals, int(syscall.SIGKILL))
+}
+
+func (S) TestPullSlots(c *C) {
+	state := NewState("host1", filepath.Join(c.MkDir(), "host-state-db"))
+	c.Assert(state.OpenDB(), IsNil)
+	defer state.CloseDB()
+	const maxPulls = 2
+	l := &LibvirtLXCBackend{state: state, pullSlots: make(chan struct{}, maxPulls)}
+
+	// no more than maxPulls should run at once
+	var mtx sync.Mutex
+	var running, maxRunning int
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		id := fmt.Sprintf("job%d", i)
+		c.Assert(state.AddJob(&host.Job{ID: id}), IsNil)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !l.acquirePullSlot(id) {
+				c.Error("unexpected failure acquiring pull slot")
+				return
+			}
+			mtx.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			mtx.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			mtx.Lock()
+			running--
+			mtx.Unlock()
+			l.releasePullSlot()
+		}()
+	}
+	wg.Wait()
+	c.Assert(maxRunning, Equals, maxPulls)
+
+	// a job stopped while waiting for a slot should give up
+	for i := 0; i < maxPulls; i++ {
+		c.Assert(l.acquirePullSlot(fmt.Sprintf("job%d", i)), Equals, true)
+	}
+	c.Assert(state.AddJob(&host.Job{ID: "stopped"}), IsNil)
+	acquired := make(chan bool)
+	go func() { acquired <- l.acquirePullSlot("stopped") }()
+	state.SetForceStop("stopped", host.StopReasonOperator)
+	select {
+	case ok := <-acquired:
+		c.Assert(ok, Equals, false)
+	case <-time.After(time.Second):
+		c.Fatal("timed out waiting for stopped job to give up")
+	}
+}
+
+type blockingArtifactResolver struct {
+	unblock chan struct{}
+}
+
+func (b *blockingArtifactResolver) Pull(artifact *host.Artifact) (string, error) {
+	<-b.unblock
+	return "image", nil
+}
+
+func (S) TestPullImageStopped(c *C) {
+	state := NewState("host1", filepath.Join(c.MkDir(), "host-state-db"))
+	c.Assert(state.OpenDB(), IsNil)
+	defer state.CloseDB()
+	l := &LibvirtLXCBackend{state: state, pullSlots: make(chan struct{}, 1)}
+	resolver := &blockingArtifactResolver{unblock: make(chan struct{})}
+	job := &host.Job{ID: "job1", ImageArtifact: &host.Artifact{URI: "fake://image"}}
+	c.Assert(state.AddJob(job), IsNil)
+
+	// a completed pull returns the image
+	close(resolver.unblock)
+	imageID, err := l.pullImage(resolver, job)
+	c.Assert(err, IsNil)
+	c.Assert(imageID, Equals, "image")
+
+	// force stopping the job during a slow pull abandons it promptly
+	resolver.unblock = make(chan struct{})
+	c.Assert(l.acquirePullSlot(job.ID), Equals, true)
+	pulled := make(chan error)
+	go func() {
+		_, err := l.pullImage(resolver, job)
+		pulled <- err
+	}()
+	state.SetForceStop(job.ID, host.StopReasonOperator)
+	select {
+	case err := <-pulled:
+		c.Assert(err, Equals, errPullAbandoned)
+	case <-time.After(time.Second):
+		c.Fatal("timed out waiting for pull to be abandoned")
+	}
+
+	// the pull slot is held until the abandoned pull finishes
+	c.Assert(l.pullSlots, HasLen, 1)
+	close(resolver.unblock)
+	for start := time.Now(); len(l.pullSlots) > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > time.Second {
+			c.Fatal("timed out waiting for pull slot to be released")
+		}
+	}
+}
+
+func (S) TestInitPath(c *C) {
+	dir := c.MkDir()
+	exe := filepath.Join(dir, "init")
+	c.Assert(ioutil.WriteFile(exe, nil, 0755), IsNil)
+	nonExe := filepath.Join(dir, "non-exe")
+	c.Assert(ioutil.WriteFile(nonExe, nil, 0644), IsNil)
+
+	l := &LibvirtLXCBackend{InitPath: "/usr/local/bin/flynn-init"}
+	job := &host.Job{}
+	path, err := l.initPath(job)
+	c.Assert(err, IsNil)
+	c.Assert(path, Equals, l.InitPath)
+
+	// overriding is not permitted by default
+	job.Config.InitPath = exe
+	_, err = l.initPath(job)
+	c.Assert(err, NotNil)
+
+	l.AllowInitOverride = true
+	path, err = l.initPath(job)
+	c.Assert(err, IsNil)
+	c.Assert(path, Equals, exe)
+
+	for _, p := range []string{nonExe, dir, filepath.Join(dir, "nonexistent")} {
+		job.Config.InitPath = p
+		_, err = l.initPath(job)
+		c.Assert(err, NotNil, Commentf("path %q", p))
+	}
+}
+
+func (S) TestResolveDiscoverdURITimeout(c *C) {
+	log := log15.New()
+	log.SetHandler(log15.DiscardHandler())
+	l := &LibvirtLXCBackend{
+		LibvirtLXCConfig:    LibvirtLXCConfig{DiscoverdTimeout: 10 * time.Millisecond},
+		discoverdConfigured: make(chan struct{}),
+		logger:              log,
+	}
+
+	// URIs not using discoverd are returned unchanged
+	uri, err := l.resolveDiscoverdURI("http://example.com/foo")
+	c.Assert(err, IsNil)
+	c.Assert(uri, Equals, "http://example.com/foo")
+
+	_, err = l.resolveDiscoverdURI("http://blobstore.discoverd/foo")
+	c.Assert(err, ErrorMatches, "host: error resolving blobstore.discoverd: host: discoverd not configured after 10ms")
+}
+
+func (S) TestWaitConfigured(c *C) {
+	var warnings int32
+	log := log15.New()
+	log.SetHandler(log15.FuncHandler(func(r *log15.Record) error {
+		if r.Lvl == log15.LvlWarn {
+			atomic.AddInt32(&warnings, 1)
+		}
+		return nil
+	}))
+	l := &LibvirtLXCBackend{
+		LibvirtLXCConfig: LibvirtLXCConfig{
+			DiscoverdTimeout:  time.Second,
+			ConfigWaitWarning: 10 * time.Millisecond,
+		},
+		networkConfigured: make(chan struct{}),
+	}
+
+	// the number of waiting jobs is tracked while blocked
+	done := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { done <- l.waitNetworkConfigured(log) }()
+	}
+	for start := time.Now(); atomic.LoadInt32(&l.networkWaiting) != 2; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			c.Fatalf("expected 2 waiting jobs, got %d", atomic.LoadInt32(&l.networkWaiting))
+		}
+	}
+
+	// a warning is logged while waiting
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(atomic.LoadInt32(&warnings) > 0, Equals, true)
+
+	close(l.networkConfigured)
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-done:
+			c.Assert(err, IsNil)
+		case <-time.After(time.Second):
+			c.Fatal("timed out waiting for network to be configured")
+		}
+	}
+	c.Assert(atomic.LoadInt32(&l.networkWaiting), Equals, int32(0))
+
+	// jobs fail once the timeout elapses
+	l.DiscoverdTimeout = 10 * time.Millisecond
+	l.discoverdConfigured = make(chan struct{})
+	c.Assert(l.waitDiscoverdConfigured(log), ErrorMatches, "host: discoverd not configured after 10ms")
+	c.Assert(atomic.LoadInt32(&l.discoverdWaiting), Equals, int32(0))
+
+	// jobs keep waiting if the timeout is not set rather than failing
+	// straight away
+	l.DiscoverdTimeout = 0
+	c.Assert(l.discoverdTimeout(), Equals, defaultDiscoverdTimeout)
+	go func() { done <- l.waitDiscoverdConfigured(log) }()
+	select {
+	case err := <-done:
+		c.Fatalf("expected job to wait for discoverd, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(l.discoverdConfigured)
+	c.Assert(<-done, IsNil)
+}
+
+func (S) TestDecodeContainerState(c *C) {
+	log := log15.New()
+	log.SetHandler(log15.DiscardHandler())
+
+	// current version
+	container, err := decodeContainerState(log, []byte(`{"Version":1,"RootPath":"/root","Domain":{"ID":5}}`))
+	c.Assert(err, IsNil)
+	c.Assert(container.RootPath, Equals, "/root")
+	c.Assert(container.Domain.ID, Equals, 5)
+
+	// unversioned state is migrated
+	container, err = decodeContainerState(log, []byte(`{"RootPath":"/root","Domain":{"ID":5}}`))
+	c.Assert(err, IsNil)
+	c.Assert(container.Version, Equals, libvirtContainerStateVersion)
+
+	// newer versions are rejected
+	_, err = decodeContainerState(log, []byte(`{"Version":2,"RootPath":"/root","Domain":{"ID":5}}`))
+	c.Assert(err, Equals, errUnsupportedStateVersion)
+
+	// state which would produce a broken container is rejected
+	_, err = decodeContainerState(log, []byte(`{"Version":1}`))
+	c.Assert(err, Equals, errInvalidContainerState)
+
+	_, err = decodeContainerState(log, []byte(`{`))
+	c.Assert(err, NotNil)
+}
+
+func (S) TestIPPoolSize(c *C) {
+	for _, t := range []struct {
+		cidr string
+		size int
+	}{
+		{cidr: "100.100.1.0/24", size: 254},
+		{cidr: "100.100.0.0/16", size: 65534},
+		{cidr: "100.100.1.0/31", size: 0},
+		{cidr: "100.100.1.1/32", size: 0},
+	} {
+		_, n, err := net.ParseCIDR(t.cidr)
+		c.Assert(err, IsNil)
+		c.Assert(ipPoolSize(n), Equals, t.size, Commentf("cidr %s", t.cidr))
+	}
+}
+
+func (S) TestContainerResolvConf(c *C) {
+	c.Assert(string(containerResolvConf(nil, []string{"192.0.2.1"}, nil)), Equals, "nameserver 192.0.2.1\n")
+	c.Assert(
+		string(containerResolvConf([]string{"a.example.com", "b.example.com"}, []string{"192.0.2.1"}, []string{"ndots:0", "timeout:1"})),
+		Equals,
+		"search a.example.com b.example.com\nnameserver 192.0.2.1\noptions ndots:0 timeout:1\n",
+	)
+	c.Assert(
+		string(containerResolvConf(nil, []string{"192.0.2.1", "198.51.100.1"}, nil)),
+		Equals,
+		"nameserver 192.0.2.1\nnameserver 198.51.100.1\n",
+	)
+}
+
+func (S) TestContainerNameservers(c *C) {
+	resolvers := []string{"127.0.0.53", "198.51.100.1", "192.0.2.1", "198.51.100.2", "198.51.100.3"}
+	c.Assert(containerNameservers("192.0.2.1", resolvers, false), DeepEquals, []string{"192.0.2.1"})
+	c.Assert(containerNameservers("192.0.2.1", resolvers, true), DeepEquals, []string{"192.0.2.1", "198.51.100.1", "198.51.100.2"})
+	c.Assert(containerNameservers("192.0.2.1", nil, true), DeepEquals, []string{"192.0.2.1"})
+}
+
+func (S) TestDrain(c *C) {
+	state := NewState("host1", filepath.Join(c.MkDir(), "host-state-db"))
+	c.Assert(state.OpenDB(), IsNil)
+	defer state.CloseDB()
+	log := log15.New()
+	log.SetHandler(log15.DiscardHandler())
+	l := &LibvirtLXCBackend{
+		state:             state,
+		logger:            log,
+		containers:        make(map[string]*libvirtContainer),
+		networkConfigured: make(chan struct{}),
+	}
+
+	c.Assert(l.Drain(true), IsNil)
+	c.Assert(l.IsDraining(), Equals, true)
+	data, err := l.DebugState()
+	c.Assert(err, IsNil)
+	var debugState libvirtDebugState
+	c.Assert(json.Unmarshal(data, &debugState), IsNil)
+	c.Assert(debugState.Draining, Equals, true)
+
+	// new jobs should be rejected and marked as failed
+	job := &host.Job{ID: "job1", ImageArtifact: &host.Artifact{}}
+	c.Assert(state.AddJob(job), IsNil)
+	c.Assert(l.Run(job, nil), Equals, ErrHostDraining)
+	c.Assert(state.GetJob("job1").Status, Equals, host.StatusFailed)
+
+	l.Undrain()
+	c.Assert(l.IsDraining(), Equals, false)
+}
+
+func (S) TestResolveBindSource(c *C) {
+	// resolve the temp dir in case it is itself under a symlink
+	dir, err := filepath.EvalSymlinks(c.MkDir())
+	c.Assert(err, IsNil)
+	subdir := filepath.Join(dir, "dir")
+	c.Assert(os.Mkdir(subdir, 0755), IsNil)
+	file := filepath.Join(dir, "file")
+	c.Assert(ioutil.WriteFile(file, nil, 0644), IsNil)
+	dirLink := filepath.Join(dir, "dir-link")
+	c.Assert(os.Symlink(subdir, dirLink), IsNil)
+	fileLink := filepath.Join(dir, "file-link")
+	c.Assert(os.Symlink(file, fileLink), IsNil)
+	danglingLink := filepath.Join(dir, "dangling-link")
+	c.Assert(os.Symlink(filepath.Join(dir, "nonexistent"), danglingLink), IsNil)
+
+	for _, t := range []struct {
+		src      string
+		resolved string
+		isDir    bool
+	}{
+		{src: subdir, resolved: subdir, isDir: true},
+		{src: file, resolved: file, isDir: false},
+		{src: dirLink, resolved: subdir, isDir: true},
+		{src: fileLink, resolved: file, isDir: false},
+	} {
+		resolved, isDir, err := resolveBindSource(t.src)
+		c.Assert(err, IsNil)
+		c.Assert(resolved, Equals, t.resolved)
+		c.Assert(isDir, Equals, t.isDir, Commentf("src %s", t.src))
+	}
+
+	_, _, err = resolveBindSource(danglingLink)
+	c.Assert(err, ErrorMatches, ".*dangling symlink")
+	_, _, err = resolveBindSource(filepath.Join(dir, "nonexistent"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (S) TestBindMountReadOnly(c *C) {
+	dir := c.MkDir()
+	src := filepath.Join(dir, "src")
+	c.Assert(os.Mkdir(src, 0755), IsNil)
+
+	for _, writeable := range []bool{false, true} {
+		dest := filepath.Join(dir, fmt.Sprintf("dest-%t", writeable))
+		if err := bindMount(src, dest, bindMountOptions{Writeable: writeable, Private: true}); err == syscall.EPERM {
+			c.Skip("bind mounting requires CAP_SYS_ADMIN")
+		} else {
+			c.Assert(err, IsNil)
+		}
+		err := ioutil.WriteFile(filepath.Join(dest, "file"), nil, 0644)
+		c.Assert(syscall.Unmount(dest, 0), IsNil)
+		if writeable {
+			c.Assert(err, IsNil)
+		} else {
+			pathErr, ok := err.(*os.PathError)
+			c.Assert(ok, Equals, true, Commentf("err %v", err))
+			c.Assert(pathErr.Err, Equals, syscall.EROFS)
+		}
+	}
+}
+
+func (S) TestTmpfsVolume(c *C) {
+	const tmpfsMagic = 0x01021994
+	isTmpfs := func(dir string) bool {
+		var st syscall.Statfs_t
+		c.Assert(syscall.Statfs(dir, &st), IsNil)
+		return st.Type == tmpfsMagic
+	}
+
+	root := c.MkDir()
+	v := host.VolumeBinding{Target: "/scratch", Type: host.VolumeTypeTmpfs, Writeable: true}
+	c.Assert(mountTmpfsVolume(filepath.Join(root, v.Target), v, 0), ErrorMatches, "host: invalid tmpfs volume size 0")
+
+	v.Size = 1 << 20
+	if err := mountTmpfsVolume(filepath.Join(root, v.Target), v, 0); err == syscall.EPERM {
+		c.Skip("mounting tmpfs requires CAP_SYS_ADMIN")
+	} else {
+		c.Assert(err, IsNil)
+	}
+	target := filepath.Join(root, v.Target)
+	c.Assert(isTmpfs(target), Equals, true)
+	var st syscall.Statfs_t
+	c.Assert(syscall.Statfs(target, &st), IsNil)
+	c.Assert(int64(st.Blocks)*st.Bsize, Equals, v.Size)
+	c.Assert(ioutil.WriteFile(filepath.Join(target, "file"), []byte("data"), 0644), IsNil)
+
+	// the tmpfs is unmounted with the job's other volumes
+	log := log15.New()
+	log.SetHandler(log15.DiscardHandler())
+	container := &libvirtContainer{
+		l:        &LibvirtLXCBackend{logger: log},
+		job:      &host.Job{ID: "job1", Config: host.ContainerConfig{Volumes: []host.VolumeBinding{v}}},
+		RootPath: root,
+	}
+	container.unbindMounts()
+	c.Assert(isTmpfs(target), Equals, false)
+	_, err := os.Stat(filepath.Join(target, "file"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+type removeCountingDriver struct {
+	graphdriver.Driver
+	removes int32
+}
+
+func (d *removeCountingDriver) Remove(id string) error {
+	atomic.AddInt32(&d.removes, 1)
+	return nil
+}
+
+func (S) TestConcurrentCleanup(c *C) {
+	// bind mount the files a container has mounted in its root
+	root := c.MkDir()
+	src := filepath.Join(c.MkDir(), "file")
+	c.Assert(ioutil.WriteFile(src, nil, 0644), IsNil)
+	c.Assert(os.MkdirAll(filepath.Join(root, "etc"), 0755), IsNil)
+	targets := []string{".containerinit", "etc/resolv.conf", "etc/localtime"}
+	for _, target := range targets {
+		dest := filepath.Join(root, target)
+		c.Assert(ioutil.WriteFile(dest, nil, 0644), IsNil)
+		if err := bindMount(src, dest, bindMountOptions{Private: true}); err == syscall.EPERM {
+			c.Skip("bind mounting requires CAP_SYS_ADMIN")
+		} else {
+			c.Assert(err, IsNil)
+		}
+	}
+
+	var errMsgsMtx sync.Mutex
+	var errMsgs []string
+	log := log15.New()
+	log.SetHandler(log15.FuncHandler(func(r *log15.Record) error {
+		if r.Lvl <= log15.LvlError {
+			errMsgsMtx.Lock()
+			errMsgs = append(errMsgs, r.Msg)
+			errMsgsMtx.Unlock()
+		}
+		return nil
+	}))
+	driver := &removeCountingDriver{}
+	l := &LibvirtLXCBackend{
+		logger:    log,
+		pinkerton: pinkerton.NewContext(nil, nil, driver),
+		cpusets:   newCPUSetReservations(),
+		hostPorts: newHostPortReservations(),
+		jobIPs:    map[string]net.IP{"job1": net.ParseIP("10.0.0.2")},
+	}
+	container := &libvirtContainer{l: l, job: &host.Job{ID: "job1"}, RootPath: root}
+
+	// clean up from several goroutines at once, as watch and the code which
+	// started the container may
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%2 == 0 {
+				container.cleanup()
+			} else {
+				container.unbindMounts()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// each mount is unmounted and each resource released exactly once
+	c.Assert(errMsgs, HasLen, 0)
+	for _, target := range targets {
+		c.Assert(syscall.Unmount(filepath.Join(root, target), 0), Equals, syscall.EINVAL)
+	}
+	c.Assert(atomic.LoadInt32(&driver.removes), Equals, int32(1))
+	c.Assert(l.jobIPs, HasLen, 0)
+}
+
+// fakeContainerInit records the calls made to it by the backend, running
+// preStop as the pre-stop hook and calling signaled when signaled
+type fakeContainerInit struct {
+	mtx      sync.Mutex
+	calls    []string
+	preStop  func()
+	signaled func()
+}
+
+func (f *fakeContainerInit) RunPreStop(timeout time.Duration, res *struct{}) error {
+	f.mtx.Lock()
+	f.calls = append(f.calls, fmt.Sprintf("pre-stop %s", timeout))
+	f.mtx.Unlock()
+	f.preStop()
+	return nil
+}
+
+func (f *fakeContainerInit) Signal(sig int, res *struct{}) error {
+	f.mtx.Lock()
+	f.calls = append(f.calls, fmt.Sprintf("signal %d", sig))
+	f.mtx.Unlock()
+	f.signaled()
+	return nil
+}
+
+func (S) TestPreStop(c *C) {
+	// bind mount a volume into the container's root
+	root := c.MkDir()
+	volume := c.MkDir()
+	target := filepath.Join(root, "data")
+	if err := bindMount(volume, target, bindMountOptions{Writeable: true, Private: true}); err == syscall.EPERM {
+		c.Skip("bind mounting requires CAP_SYS_ADMIN")
+	} else {
+		c.Assert(err, IsNil)
+	}
+
+	state := NewState("host1", filepath.Join(c.MkDir(), "host-state-db"))
+	c.Assert(state.OpenDB(), IsNil)
+	defer state.CloseDB()
+	job := &host.Job{ID: "job1", Config: host.ContainerConfig{
+		PreStop:     []string{"/bin/flush-state", "/data"},
+		StopTimeout: 5 * time.Second,
+		Volumes:     []host.VolumeBinding{{Target: "/data", Writeable: true}},
+	}}
+	c.Assert(state.AddJob(job), IsNil)
+	state.SetStatusRunning(job.ID)
+	log := log15.New()
+	log.SetHandler(log15.DiscardHandler())
+	container := &libvirtContainer{
+		job:      job,
+		RootPath: root,
+		done:     make(chan struct{}),
+	}
+	container.l = &LibvirtLXCBackend{
+		state:      state,
+		logger:     log,
+		containers: map[string]*libvirtContainer{job.ID: container},
+	}
+
+	// the job is paused, so has to be thawed to stop it
+	defer func(root string) { cgroupRoot = root }(cgroupRoot)
+	cgroupRoot = c.MkDir()
+	freezer := jobCGroupPath("freezer", job.Partition, job.ID)
+	c.Assert(os.MkdirAll(freezer, 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(freezer, "freezer.state"), []byte(freezerThawed), 0644), IsNil)
+	c.Assert(container.l.Pause(job.ID), IsNil)
+
+	// serve a fake containerinit whose pre-stop hook writes to the volume
+	// and which exits once signaled, the volume then being unmounted
+	init := &fakeContainerInit{
+		preStop: func() {
+			data, err := ioutil.ReadFile(filepath.Join(freezer, "freezer.state"))
+			c.Assert(err, IsNil)
+			c.Assert(string(data), Equals, freezerThawed)
+			c.Assert(ioutil.WriteFile(filepath.Join(target, "state"), []byte("flushed"), 0644), IsNil)
+		},
+		signaled: func() {
+			container.unbindMounts()
+			close(container.done)
+		},
+	}
+	c.Assert(rpcplus.RegisterName("ContainerInit", init), IsNil)
+	socketPath := filepath.Join(c.MkDir(), "rpc.sock")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Net: "unix", Name: socketPath})
+	c.Assert(err, IsNil)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.AcceptUnix()
+			if err != nil {
+				return
+			}
+			go fdrpc.ServeConn(conn)
+		}
+	}()
+	client, err := containerinit.NewClient(socketPath)
+	c.Assert(err, IsNil)
+	defer client.Close()
+	container.Client = client
+
+	// the hook runs before the job is signaled, while the volume is
+	// mounted, and what it writes is kept once the volume is unmounted
+	c.Assert(container.Stop(), IsNil)
+	c.Assert(init.calls, DeepEquals, []string{"pre-stop 5s", fmt.Sprintf("signal %d", syscall.SIGTERM)})
+	c.Assert(container.isPaused(), Equals, false)
+	c.Assert(state.GetJob(job.ID).Paused, Equals, false)
+	c.Assert(syscall.Unmount(target, 0), Equals, syscall.EINVAL)
+	data, err := ioutil.ReadFile(filepath.Join(volume, "state"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "flushed")
+}
+
+func (S) TestJobSpec(c *C) {
+	state := NewState("host1", filepath.Join(c.MkDir(), "host-state-db"))
+	c.Assert(state.OpenDB(), IsNil)
+	defer state.CloseDB()
+	memory := int64(512 * 1024 * 1024)
+	job := &host.Job{
+		ID: "job1",
+		Config: host.ContainerConfig{
+			Env:       map[string]string{"FOO": "bar", "DB_PASSWORD": "secret"},
+			SecretEnv: []string{"*_PASSWORD"},
+		},
+		Resources: resource.Resources{resource.TypeMemory: {Limit: &memory}},
+	}
+	c.Assert(state.AddJob(job), IsNil)
+	rootPath := c.MkDir()
+	l := &LibvirtLXCBackend{
+		state:      state,
+		containers: map[string]*libvirtContainer{"job1": {job: job, RootPath: rootPath}},
+	}
+
+	// the spec is only available while the job is running
+	_, err := l.JobSpec("job1")
+	c.Assert(err, Equals, ErrNotFound)
+	state.SetStatusRunning("job1")
+
+	config := &containerinit.Config{
+		Args:      []string{"/bin/app", "--port", "5000"},
+		WorkDir:   "/app",
+		User:      "1000",
+		Resources: job.Resources,
+	}
+	c.Assert(writeContainerConfig(filepath.Join(rootPath, ".containerconfig"), config,
+		map[string]string{"PATH": "/usr/bin:/bin"},
+		job.Config.Env,
+	), IsNil)
+	spec, err := l.JobSpec("job1")
+	c.Assert(err, IsNil)
+	c.Assert(spec, DeepEquals, &host.ReproSpec{
+		Args: []string{"/bin/app", "--port", "5000"},
+		Env: map[string]string{
+			"PATH":        "/usr/bin:/bin",
+			"FOO":         "bar",
+			"DB_PASSWORD": redactedSecret,
+		},
+		WorkDir:   "/app",
+		User:      "1000",
+		Resources: job.Resources,
+	})
+}
+
+func (S) TestCleanupMountsExitedProcess(c *C) {
+	// pids are at most 2^22, so this one never exists
+	pid := math.MaxInt32
+	mountpoints, err := leakedMountpoints(pid)
+	c.Assert(err, IsNil)
+	c.Assert(mountpoints, HasLen, 0)
+	container := &libvirtContainer{l: &LibvirtLXCBackend{UmountPath: "/bin/false"}}
+	c.Assert(container.cleanupMounts(pid), IsNil)
+
+	// other errors are still returned
+	c.Assert(isProcessGone(&os.PathError{Op: "open", Path: "/proc/1/mounts", Err: syscall.ESRCH}), Equals, true)
+	c.Assert(isProcessGone(&os.PathError{Op: "open", Path: "/proc/1/mounts", Err: syscall.EACCES}), Equals, false)
+}
+
+func (S) TestPartitions(c *C) {
+	defer func(root string) { cgroupRoot = root }(cgroupRoot)
+	cgroupRoot = c.MkDir()
+	write := func(path, data string) {
+		c.Assert(os.MkdirAll(filepath.Dir(path), 0755), IsNil)
+		c.Assert(ioutil.WriteFile(path, []byte(data), 0644), IsNil)
+	}
+	write(filepath.Join(cgroupRoot, "cpuset", "cpuset.cpus"), "0-7\n")
+	write(filepath.Join(cgroupRoot, "cpuset", "cpuset.mems"), "0\n")
+	write(filepath.Join(cgroupRoot, "cpuset", "machine", "cpuset.cpus"), "\n")
+	write(filepath.Join(cgroupRoot, "cpuset", "machine", "cpuset.mems"), "\n")
+	write(filepath.Join(cgroupRoot, "pids", "cgroup.procs"), "")
+
+	partitions := map[string]PartitionConfig{
+		"system": {CPUShares: 2048, CPUSet: "0-1"},
+		"user":   {CPUShares: 1024},
+	}
+	for name, config := range partitions {
+		c.Assert(createCGroupPartition(name, config), IsNil)
+	}
+	// the kernel initializes the memory and pids limits of new cgroups
+	write(filepath.Join(partitionCGroupPath("memory", "system"), "memory.limit_in_bytes"), "9223372036854771712\n")
+	write(filepath.Join(partitionCGroupPath("pids", "system"), "pids.max"), "max\n")
+	write(filepath.Join(partitionCGroupPath("memory", "user"), "memory.limit_in_bytes"), "1073741824\n")
+	write(filepath.Join(partitionCGroupPath("pids", "user"), "pids.max"), "1000\n")
+
+	log := log15.New()
+	log.SetHandler(log15.DiscardHandler())
+	l := &LibvirtLXCBackend{partitionCGroups: partitions, logger: log}
+	c.Assert(l.Partitions(), DeepEquals, map[string]PartitionInfo{
+		"system": {CPUShares: 2048, CPUSet: "0-1"},
+		"user":   {CPUShares: 1024, CPUSet: "0-7", Memory: 1 << 30, PIDs: 1000},
+	})
+
+	// errors reading a partition's cgroups are reported for that partition
+	c.Assert(os.Remove(filepath.Join(partitionCGroupPath("pids", "user"), "pids.max")), IsNil)
+	info := l.Partitions()["user"]
+	c.Assert(info.Error, Not(Equals), "")
+}
+
+func (S) TestPIDsLimit(c *C) {
+	limit := int64(100)
+	specified := &host.Job{Resources: resource.Resources{resource.TypePIDs: {Limit: &limit}}}
+
+	// jobs get the host default unless they specify a pids limit, max_procs
+	// being the separate per-user process limit
+	l := &LibvirtLXCBackend{LibvirtLXCConfig: LibvirtLXCConfig{DefaultPIDs: 4096}}
+	c.Assert(l.jobPIDs(&host.Job{}), Equals, int64(4096))
+	c.Assert(l.jobPIDs(specified), Equals, limit)
+	maxProcs := &host.Job{Resources: resource.Resources{resource.TypeMaxProcs: {Limit: &limit}}}
+	c.Assert(l.jobPIDs(maxProcs), Equals, int64(4096))
+	l.DefaultPIDs = 0
+	c.Assert(l.jobPIDs(&host.Job{}), Equals, int64(0))
+
+	defer func(root string) { cgroupRoot = root }(cgroupRoot)
+	cgroupRoot = c.MkDir()
+	write := func(path, data string) {
+		c.Assert(os.MkdirAll(filepath.Dir(path), 0755), IsNil)
+		c.Assert(ioutil.WriteFile(path, []byte(data), 0644), IsNil)
+	}
+	c.Assert(pidsCGroupSupported(), Equals, false)
+	write(filepath.Join(cgroupRoot, "pids", "cgroup.procs"), "")
+	c.Assert(pidsCGroupSupported(), Equals, true)
+
+	// libvirt creates the job's cgroup in the other controllers, but the
+	// pids cgroup is created with the limit and the container's process
+	// moved into it
+	write(filepath.Join(jobCGroupPath("cpu", "user", "job1"), "cgroup.procs"), "1234\n")
+	dir := jobCGroupPath("pids", "user", "job1")
+	write(filepath.Join(dir, "cgroup.procs"), "")
+	c.Assert(limitPIDs("user", "job1", l.jobPIDs(specified)), IsNil)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "pids.max"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "100")
+	data, err = ioutil.ReadFile(filepath.Join(dir, "cgroup.procs"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "1234\n")
+
+	// the limit is read back with the current count
+	write(filepath.Join(dir, "pids.current"), "3\n")
+	stats, err := readPIDStats(dir)
+	c.Assert(err, IsNil)
+	c.Assert(stats, DeepEquals, &host.PIDStats{Current: 3, Limit: 100})
+	write(filepath.Join(dir, "pids.max"), "max\n")
+	stats, err = readPIDStats(dir)
+	c.Assert(err, IsNil)
+	c.Assert(stats, DeepEquals, &host.PIDStats{Current: 3})
+
+	// jobs without a pids cgroup have their tasks counted instead
+	write(filepath.Join(jobCGroupPath("cpu", "user", "job1"), "tasks"), "1234\n1235\n")
+	stats, err = countTasks(jobCGroupPath("cpu", "user", "job1"))
+	c.Assert(err, IsNil)
+	c.Assert(stats, DeepEquals, &host.PIDStats{Current: 2})
+
+	// the pids cgroup is removed on cleanup
+	for _, name := range []string{"cgroup.procs", "pids.max", "pids.current"} {
+		c.Assert(os.Remove(filepath.Join(dir, name)), IsNil)
+	}
+	c.Assert(removePIDsCGroup("user", "job1"), IsNil)
+	_, err = os.Stat(dir)
+	c.Assert(os.IsNotExist(err), Equals, true)
+	c.Assert(removePIDsCGroup("user", "job1"), IsNil)
+}
+
+func (S) TestJobMemory(c *C) {
+	limit := int64(256 << 20)
+	specified := &host.Job{Resources: resource.Resources{resource.TypeMemory: {Limit: &limit}}}
+	unspecified := &host.Job{Resources: resource.Resources{resource.TypeCPU: {Limit: &limit}}}
+
+	// without a configured default, jobs get 1GiB
+	l := &LibvirtLXCBackend{}
+	c.Assert(l.jobMemory(unspecified), Equals, int64(1<<30))
+	c.Assert(l.jobMemory(&host.Job{}), Equals, int64(1<<30))
+	c.Assert(l.jobMemory(specified), Equals, limit)
+
+	// the configured default only applies to jobs without a limit
+	l.DefaultMemory = 512 << 20
+	c.Assert(l.jobMemory(unspecified), Equals, int64(512<<20))
+	c.Assert(l.jobMemory(&host.Job{}), Equals, int64(512<<20))
+	c.Assert(l.jobMemory(specified), Equals, limit)
+
+	perJob, err := memoryPerJob(4)
+	c.Assert(err, IsNil)
+	total, err := memoryPerJob(1)
+	c.Assert(err, IsNil)
+	c.Assert(total > 0, Equals, true)
+	c.Assert(perJob, Equals, total/4)
+	_, err = memoryPerJob(0)
+	c.Assert(err, NotNil)
+}
+
+func (S) TestCPUSetReservations(c *C) {
+	r := newCPUSetReservations()
+
+	// non-exclusive cpusets may overlap
+	c.Assert(r.Reserve("job1", "0-1", false), IsNil)
+	c.Assert(r.Reserve("job2", "1", false), IsNil)
+
+	// exclusive cpusets may not overlap existing reservations
+	c.Assert(r.Reserve("job3", "1-2", true), NotNil)
+	c.Assert(r.Reserve("job3", "2-3", true), IsNil)
+
+	// and nothing may overlap an exclusive reservation
+	c.Assert(r.Reserve("job4", "3", false), NotNil)
+	c.Assert(r.Reserve("job4", "3", true), NotNil)
+
+	// releasing the reservation frees the CPUs
+	r.Release("job3")
+	c.Assert(r.Reserve("job4", "3", true), IsNil)
+
+	c.Assert(r.Reserve("job5", "a", false), NotNil)
+}
+
+func (S) TestContainerArgs(c *C) {
+	type test struct {
+		image      string
+		entrypoint []string
+		cmd        []string
+		expected   []string
+	}
+	for _, t := range []test{
+		// exec form
+		{
+			image:    `{"Config":{"Entrypoint":["/bin/app"],"Cmd":["-v"]}}`,
+			expected: []string{"/bin/app", "-v"},
+		},
+		{
+			image:    `{"Config":{"Entrypoint":["/bin/app"],"Cmd":["-v"]}}`,
+			cmd:      []string{"-q"},
+			expected: []string{"/bin/app", "-q"},
+		},
+		{
+			image:    `{"Config":{"Entrypoint":null,"Cmd":["/bin/app", "-v"]}}`,
+			expected: []string{"/bin/app", "-v"},
+		},
+		// shell form
+		{
+			image:    `{"Config":{"Cmd":"/bin/app -v | tee log"}}`,
+			expected: []string{"/bin/sh", "-c", "/bin/app -v | tee log"},
+		},
+		{
+			image:    `{"Config":{"Entrypoint":["/bin/app"],"Cmd":"-v"}}`,
+			expected: []string{"/bin/app", "/bin/sh", "-c", "-v"},
+		},
+		{
+			image:    `{"Config":{"Entrypoint":"/bin/app -v","Cmd":["-q"]}}`,
+			cmd:      []string{"-x"},
+			expected: []string{"/bin/sh", "-c", "/bin/app -v"},
+		},
+		// job entrypoint overrides the image
+		{
+			image:      `{"Config":{"Entrypoint":"/bin/app -v","Cmd":"-q"}}`,
+			entrypoint: []string{"/bin/other"},
+			cmd:        []string{"-x"},
+			expected:   []string{"/bin/other", "-x"},
+		},
+	} {
+		res := &struct{ Config dockerImageConfig }{}
+		c.Assert(json.Unmarshal([]byte(t.image), res), IsNil)
+		job := &host.Job{Config: host.ContainerConfig{Entrypoint: t.entrypoint, Cmd: t.cmd}}
+		c.Assert(containerArgs(job, &res.Config), DeepEquals, t.expected, Commentf("image %s", t.image))
+	}
+}
+
+func (S) TestTimezone(c *C) {
+	root := c.MkDir()
+	zoneinfo := filepath.Join(root, "zoneinfo")
+	c.Assert(os.MkdirAll(filepath.Join(zoneinfo, "Europe"), 0755), IsNil)
+	for _, name := range []string{"UTC", "Europe/London"} {
+		c.Assert(ioutil.WriteFile(filepath.Join(zoneinfo, name), []byte(name), 0644), IsNil)
+	}
+	localtime := filepath.Join(root, "localtime")
+	c.Assert(os.Symlink(filepath.Join(zoneinfo, "Europe/London"), localtime), IsNil)
+	l := &LibvirtLXCBackend{localtime: localtime, zoneinfoRoot: zoneinfo}
+
+	type test struct {
+		tz   string
+		name string
+		path string
+		err  bool
+	}
+	for _, t := range []test{
+		{tz: "", name: "UTC", path: filepath.Join(zoneinfo, "UTC")},
+		{tz: "Europe/London", name: "Europe/London", path: filepath.Join(zoneinfo, "Europe/London")},
+		{tz: "host", name: "Europe/London", path: filepath.Join(zoneinfo, "Europe/London")},
+		{tz: "Europe", err: true},
+		{tz: "Mars/Olympus_Mons", err: true},
+		{tz: "../zoneinfo/UTC", err: true},
+		{tz: "/etc/passwd", err: true},
+	} {
+		job := &host.Job{Config: host.ContainerConfig{Timezone: t.tz}}
+		name, path, err := l.timezone(job)
+		if t.err {
+			c.Assert(err, NotNil, Commentf("tz %q", t.tz))
+			continue
+		}
+		c.Assert(err, IsNil, Commentf("tz %q", t.tz))
+		c.Assert(name, Equals, t.name)
+		c.Assert(path, Equals, t.path)
+	}
+
+	// the host timezone name is unknown if it isn't in the zoneinfo database
+	c.Assert(os.Remove(localtime), IsNil)
+	c.Assert(ioutil.WriteFile(localtime, nil, 0644), IsNil)
+	name, path, err := l.timezone(&host.Job{Config: host.ContainerConfig{Timezone: "host"}})
+	c.Assert(err, IsNil)
+	c.Assert(name, Equals, "")
+	c.Assert(path, Equals, localtime)
+}
+
+func (S) TestWaitReadySignals(c *C) {
+	signals := make(map[string]chan error, 100)
+	hang := make(chan struct{})
+	for i := 0; i < 100; i++ {
+		id := fmt.Sprintf("job%d", i)
+		ch := make(chan error)
+		signals[id] = ch
+		switch i % 4 {
+		case 0, 1:
+			// live jobs which reconnect quickly
+			go func() { ch <- nil }()
+		case 2:
+			// dead jobs which fail to reconnect after a delay
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				ch <- &ContainerInitUnreachableError{Err: errors.New("timeout")}
+			}()
+		case 3:
+			// jobs which are still reconnecting after the timeout
+			go func() {
+				<-hang
+				ch <- nil
+			}()
+		}
+	}
+
+	var mtx sync.Mutex
+	results := make(map[string]error)
+	allDone := make(chan struct{})
+	start := time.Now()
+	pending := waitReadySignals(signals, 500*time.Millisecond, func(id string, err error) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		results[id] = err
+		if len(results) == len(signals) {
+			close(allDone)
+		}
+	})
+	c.Assert(time.Since(start) < 2*time.Second, Equals, true)
+	c.Assert(pending, Equals, 25)
+
+	mtx.Lock()
+	c.Assert(results, HasLen, 75)
+	for id, err := range results {
+		var i int
+		fmt.Sscanf(id, "job%d", &i)
+		if i%4 == 2 {
+			c.Assert(err, FitsTypeOf, &ContainerInitUnreachableError{})
+		} else {
+			c.Assert(err, IsNil)
+		}
+	}
+	mtx.Unlock()
+
+	// the pending jobs are still handled once they finish
+	close(hang)
+	select {
+	case <-allDone:
+	case <-time.After(time.Second):
+		c.Fatal("timed out waiting for pending jobs")
+	}
+
+	// all signals being received returns before the timeout
+	start = time.Now()
+	ch := make(chan error, 1)
+	ch <- nil
+	c.Assert(waitReadySignals(map[string]chan error{"job": ch}, time.Minute, func(string, error) {}), Equals, 0)
+	c.Assert(time.Since(start) < time.Second, Equals, true)
+}
+
+func (S) TestCreateMountedWorkDir(c *C) {
+	root := c.MkDir()
+	c.Assert(os.MkdirAll(filepath.Join(root, "vol", "existing"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(root, "vol", "file"), nil, 0644), IsNil)
+	outside := c.MkDir()
+	c.Assert(os.Symlink(outside, filepath.Join(root, "vol", "link")), IsNil)
+	targets := []string{"/data", "vol"}
+
+	// directories inside a mount target are created
+	c.Assert(createMountedWorkDir(root, "/vol/app/data", targets), IsNil)
+	info, err := os.Stat(filepath.Join(root, "vol", "app", "data"))
+	c.Assert(err, IsNil)
+	c.Assert(info.IsDir(), Equals, true)
+	c.Assert(createMountedWorkDir(root, "/vol/existing", targets), IsNil)
+	c.Assert(createMountedWorkDir(root, "/vol", targets), IsNil)
+
+	// directories outside of mount targets are left to the image
+	c.Assert(createMountedWorkDir(root, "/app", targets), IsNil)
+	_, err = os.Stat(filepath.Join(root, "app"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+	c.Assert(createMountedWorkDir(root, "", targets), IsNil)
+
+	// invalid working directories return an error
+	for _, dir := range []string{"vol/app", "/vol/file/app", "/vol/link/app"} {
+		c.Assert(createMountedWorkDir(root, dir, targets), NotNil, Commentf("dir %q", dir))
+	}
+	_, err = os.Stat(filepath.Join(outside, "app"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (S) TestRestoredJobIPs(c *C) {
+	log := log15.New()
+	log.SetHandler(log15.DiscardHandler())
+	l := &LibvirtLXCBackend{
+		ipalloc: ipallocator.New(),
+		jobIPs:  make(map[string]net.IP),
+		logger:  log,
+	}
+
+	// restore a job before networking is configured
+	restored := net.ParseIP("10.0.0.5")
+	l.restoreJobIP("restored1", restored)
+
+	var err error
+	l.bridgeAddr, l.bridgeNet, err = net.ParseCIDR("10.0.0.1/24")
+	c.Assert(err, IsNil)
+	_, err = l.ipalloc.RequestIP(l.bridgeNet, l.bridgeAddr)
+	c.Assert(err, IsNil)
+	l.reserveJobIPs()
+
+	// restore a job after networking is configured
+	lateRestored := net.ParseIP("10.0.0.6")
+	l.restoreJobIP("restored2", lateRestored)
+
+	// new jobs should never be allocated a restored job's IP
+	for i := 0; i < ipPoolSize(l.bridgeNet)-3; i++ {
+		ip, err := l.requestJobIP(fmt.Sprintf("job%d", i), nil)
+		c.Assert(err, IsNil)
+		c.Assert(ip.Equal(restored), Equals, false)
+		c.Assert(ip.Equal(lateRestored), Equals, false)
+	}
+	_, err = l.requestJobIP("job", nil)
+	c.Assert(err, NotNil)
+	_, err = l.requestJobIP("job", restored)
+	c.Assert(err, NotNil)
+
+	// releasing a restored job's IP makes it available again
+	l.releaseJobIP("restored1")
+	l.releaseJobIP("restored1")
+	ip, err := l.requestJobIP("job", nil)
+	c.Assert(err, IsNil)
+	c.Assert(ip.Equal(restored), Equals, true)
+}
+
+func (S) TestSetJobPartition(c *C) {
+	log := log15.New()
+	log.SetHandler(log15.DiscardHandler())
+	l := &LibvirtLXCBackend{
+		partitionCGroups: map[string]PartitionConfig{
+			"system": {CPUShares: 1024},
+			"user":   {CPUShares: 1024},
+		},
+	}
+
+	type test struct {
+		partition string
+		fallback  bool
+		expected  string
+		err       bool
+	}
+	for _, t := range []test{
+		{partition: "", expected: defaultPartition},
+		{partition: "system", expected: "system"},
+		{partition: "system", fallback: true, expected: "system"},
+		{partition: "new", err: true},
+		{partition: "new", fallback: true, expected: defaultPartition},
+	} {
+		l.PartitionFallback = t.fallback
+		job := &host.Job{Partition: t.partition}
+		err := l.setJobPartition(log, job)
+		if t.err {
+			c.Assert(err, ErrorMatches, `host: invalid job partition "new"`)
+			continue
+		}
+		c.Assert(err, IsNil)
+		c.Assert(job.Partition, Equals, t.expected)
+	}
+
+	// there is nothing to fall back to without a default partition
+	delete(l.partitionCGroups, defaultPartition)
+	l.PartitionFallback = true
+	c.Assert(l.setJobPartition(log, &host.Job{Partition: "new"}), NotNil)
+}
+
+func (S) TestContainerInitSymlinks(c *C) {
+	log := log15.New()
+	log.SetHandler(log15.DiscardHandler())
+	dir := c.MkDir()
+
+	// failed connections should not leave symlinks behind
+	for i := 0; i < 5; i++ {
+		socketPath := filepath.Join(dir, fmt.Sprintf("missing%d.sock", i))
+		symlink := filepath.Join(dir, containerInitSymlinkPrefix+"job")
+		_, err := connectContainerInit(log, socketPath, symlink, 10*time.Millisecond, 1)
+		c.Assert(err, FitsTypeOf, &ContainerInitUnreachableError{})
+	}
+	links, err := filepath.Glob(filepath.Join(dir, containerInitSymlinkPrefix+"*"))
+	c.Assert(err, IsNil)
+	c.Assert(links, HasLen, 0)
+
+	// only orphaned symlinks should be removed by the startup sweep
+	socketPath := filepath.Join(dir, "rpc.sock")
+	c.Assert(ioutil.WriteFile(socketPath, nil, 0644), IsNil)
+	live := filepath.Join(dir, containerInitSymlinkPrefix+"live")
+	c.Assert(os.Symlink(socketPath, live), IsNil)
+	orphaned := filepath.Join(dir, containerInitSymlinkPrefix+"orphaned")
+	c.Assert(os.Symlink(filepath.Join(dir, "gone.sock"), orphaned), IsNil)
+	other := filepath.Join(dir, "other")
+	c.Assert(os.Symlink(filepath.Join(dir, "gone.sock"), other), IsNil)
+
+	removeOrphanedContainerInitSymlinks(log, dir)
+	for path, exists := range map[string]bool{live: true, orphaned: false, other: true} {
+		_, err := os.Lstat(path)
+		c.Assert(err == nil, Equals, exists, Commentf("path %s", path))
+	}
+}
+
+func (S) TestHostPortReservations(c *C) {
+	r := newHostPortReservations()
+	ip1 := net.ParseIP("10.0.0.2")
+	ip2 := net.ParseIP("10.0.0.3")
+
+	c.Assert(r.Reserve("job1", ip1, []host.Port{{Port: 8080, Proto: "tcp", HostPort: 80}}), IsNil)
+
+	// the same host port and proto conflicts, a different proto doesn't
+	err := r.Reserve("job2", ip2, []host.Port{{Port: 5000, Proto: "tcp", HostPort: 80}})
+	c.Assert(err, ErrorMatches, `host: host port 80/tcp is already in use by job job1`)
+	c.Assert(r.Reserve("job2", ip2, []host.Port{{Port: 5000, Proto: "udp", HostPort: 80}}), IsNil)
+	err = r.Reserve("job3", ip2, []host.Port{{Port: 5000, Proto: "tcp", HostPort: 81}, {Port: 5001, Proto: "tcp", HostPort: 81}})
+	c.Assert(err, ErrorMatches, `host: host port 81/tcp is forwarded more than once`)
+	c.Assert(r.All(), HasLen, 2)
+
+	// releasing makes the host port available again
+	res, ok := r.Release("job1")
+	c.Assert(ok, Equals, true)
+	c.Assert(res.ip.Equal(ip1), Equals, true)
+	c.Assert(res.ports, DeepEquals, []host.Port{{Port: 8080, Proto: "tcp", HostPort: 80}})
+	_, ok = r.Release("job1")
+	c.Assert(ok, Equals, false)
+	c.Assert(r.Reserve("job3", ip2, []host.Port{{Port: 5000, Proto: "tcp", HostPort: 80}}), IsNil)
+}
+
+func (S) TestCheckHostPortFree(c *C) {
+	l, err := net.Listen("tcp", ":0")
+	c.Assert(err, IsNil)
+	port := l.Addr().(*net.TCPAddr).Port
+	c.Assert(checkHostPortFree("tcp", port), NotNil)
+	l.Close()
+	c.Assert(checkHostPortFree("tcp", port), IsNil)
+}
+
+func (S) TestTail(c *C) {
+	state := NewState("host1", filepath.Join(c.MkDir(), "host-state-db"))
+	c.Assert(state.OpenDB(), IsNil)
+	defer state.CloseDB()
+	log := log15.New()
+	log.SetHandler(log15.DiscardHandler())
+	l := &LibvirtLXCBackend{
+		state: state,
+		mux:   logmux.New("host1", c.MkDir(), log),
+	}
+
+	appID := "8c4f6a7a-2bd4-4a3c-8b54-6f0b0bbbe1f1"
+	for _, job := range []*host.Job{
+		{ID: "job1", Metadata: map[string]string{"flynn-controller.app": appID}},
+		{ID: "job2", Metadata: map[string]string{"flynn-controller.app": appID}},
+		{ID: "job3", Config: host.ContainerConfig{DisableLog: true}},
+	} {
+		c.Assert(state.AddJob(job), IsNil)
+	}
+
+	// log lines from two jobs of the same app, which then exit
+	for _, jobID := range []string{"job1", "job2"} {
+		var lines string
+		for i := 0; i < 10; i++ {
+			lines += fmt.Sprintf("%s line %d\n", jobID, i)
+		}
+		l.mux.Follow(ioutil.NopCloser(strings.NewReader(lines)), host.LogStreamBuffer{}, 1, logmux.Config{AppID: appID, JobID: jobID})
+	}
+	var msgs1, msgs2 []*rfc5424.Message
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		var err error
+		msgs1, err = l.Tail("job1", 100)
+		c.Assert(err, IsNil)
+		msgs2, err = l.Tail("job2", 3)
+		c.Assert(err, IsNil)
+		if len(msgs1) == 10 && len(msgs2) == 3 && string(msgs2[2].Msg) == "job2 line 9" {
+			break
+		}
+	}
+	c.Assert(msgs1, HasLen, 10)
+	c.Assert(msgs2, HasLen, 3)
+	for i, msg := range msgs2 {
+		c.Assert(string(msg.Msg), Equals, fmt.Sprintf("job2 line %d", 7+i))
+	}
+
+	_, err := l.Tail("job1", 0)
+	c.Assert(err, NotNil)
+	_, err = l.Tail("job3", 10)
+	c.Assert(err, ErrorMatches, "host: logging is disabled for job job3")
+	_, err = l.Tail("nonexistent", 10)
+	c.Assert(err, Equals, ErrNotFound)
+}
+
+func (S) TestLogMaxLineLength(c *C) {
+	state := NewState("host1", filepath.Join(c.MkDir(), "host-state-db"))
+	c.Assert(state.OpenDB(), IsNil)
+	defer state.CloseDB()
+	log := log15.New()
+	log.SetHandler(log15.DiscardHandler())
+	l := &LibvirtLXCBackend{
+		state: state,
+		mux:   logmux.New("host1", c.MkDir(), log),
+	}
+	l.mux.MaxLineLength = 100
+	appID := "8c4f6a7a-2bd4-4a3c-8b54-6f0b0bbbe1f1"
+	c.Assert(state.AddJob(&host.Job{ID: "job1", Metadata: map[string]string{"flynn-controller.app": appID}}), IsNil)
+
+	// lines longer than the read buffer but within the limit are not split,
+	// longer lines are truncated and marked with how much was dropped
+	expected := []string{
+		"short line",
+		strings.Repeat("a", 80),
+		strings.Repeat("b", 100),
+		strings.Repeat("c", 100),
+		"after",
+	}
+	lines := strings.Join([]string{
+		expected[0],
+		expected[1],
+		expected[2],
+		strings.Repeat("c", 250),
+		expected[4],
+	}, "\n") + "\n"
+	l.mux.Follow(ioutil.NopCloser(strings.NewReader(lines)), host.LogStreamBuffer{}, 1, logmux.Config{AppID: appID, JobID: "job1", BufferSize: 32})
+
+	var msgs []*rfc5424.Message
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		var err error
+		msgs, err = l.Tail("job1", 10)
+		c.Assert(err, IsNil)
+		if len(msgs) == len(expected) {
+			break
+		}
+	}
+	c.Assert(msgs, HasLen, len(expected))
+	for i, msg := range msgs {
+		c.Assert(string(msg.Msg), Equals, expected[i])
+		if i == 3 {
+			c.Assert(logmux.Truncated(msg), Equals, 150)
+		} else {
+			c.Assert(logmux.Truncated(msg), Equals, 0)
+		}
+	}
+}
+
+func (S) TestLogBufferTruncated(c *C) {
+	state := NewState("host1", filepath.Join(c.MkDir(), "host-state-db"))
+	c.Assert(state.OpenDB(), IsNil)
+	defer state.CloseDB()
+	log := log15.New()
+	log.SetHandler(log15.DiscardHandler())
+	l := &LibvirtLXCBackend{
+		state:  state,
+		mux:    logmux.New("host1", c.MkDir(), log),
+		logger: log,
+	}
+	l.mux.MaxLineLength = 100
+	appID := "8c4f6a7a-2bd4-4a3c-8b54-6f0b0bbbe1f1"
+	job := &host.Job{ID: "job1", Metadata: map[string]string{"flynn-controller.app": appID}}
+	c.Assert(state.AddJob(job), IsNil)
+	config := logmux.Config{AppID: appID, JobID: job.ID, BufferSize: 32}
+
+	// close the stream part way through a line longer than the limit, as
+	// when the daemon is updated
+	r, w := io.Pipe()
+	stream := l.mux.Follow(r, host.LogStreamBuffer{}, 1, config)
+	go w.Write([]byte(strings.Repeat("a", 250)))
+	c.Assert(stream.Flush(5*time.Second), Equals, true)
+	buffer := stream.Close()
+	c.Assert(buffer, DeepEquals, host.LogStreamBuffer{Data: strings.Repeat("a", 100), Truncated: 150})
+
+	// the buffer is passed to the updated daemon as JSON, older daemons
+	// passing a plain string
+	data, err := json.Marshal(host.LogBuffer{"stdout": buffer})
+	c.Assert(err, IsNil)
+	var decoded host.LogBuffer
+	c.Assert(json.Unmarshal(data, &decoded), IsNil)
+	c.Assert(decoded["stdout"], DeepEquals, buffer)
+	decoded = nil
+	c.Assert(json.Unmarshal([]byte(`{"stdout":"partial"}`), &decoded), IsNil)
+	c.Assert(decoded["stdout"], DeepEquals, host.LogStreamBuffer{Data: "partial"})
+
+	// the line logged once the rest of it is read by the next stream is
+	// marked as truncated, including the bytes discarded from the buffer
+	l.mux.Follow(ioutil.NopCloser(strings.NewReader("bb\nnext\n")), buffer, 1, config)
+	expected := strings.Repeat("a", 100) + "...[truncated 152 bytes]\nnext\n"
+	var stdout bytes.Buffer
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		msgs, err := l.Tail(job.ID, 10)
+		c.Assert(err, IsNil)
+		if len(msgs) == 2 {
+			break
+		}
+	}
+
+	// and replayed as such by Attach
+	err = l.Attach(&AttachRequest{
+		Job:    state.GetJob(job.ID),
+		Logs:   true,
+		Stdout: nopWriteCloser{&stdout},
+	})
+	c.Assert(err, Equals, io.EOF)
+	c.Assert(stdout.String(), Equals, expected)
+}
+
+func (S) TestEnvFileData(c *C) {
+	data, err := envFileData(map[string]string{"SECRET": "s3cr3t", "API_KEY": "a=b", "EMPTY": ""})
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "API_KEY=a=b\nEMPTY=\nSECRET=s3cr3t\n")
+
+	data, err = envFileData(nil)
+	c.Assert(err, IsNil)
+	c.Assert(data, HasLen, 0)
+
+	for _, env := range []map[string]string{
+		{"": "foo"},
+		{"A=B": "foo"},
+		{"A\nB": "foo"},
+		{"KEY": "foo\nBAR=baz"},
+	} {
+		_, err := envFileData(env)
+		c.Assert(err, NotNil, Commentf("env %v", env))
+	}
+}
+
+func (S) TestResolveRootPath(c *C) {
+	root := c.MkDir()
+	c.Assert(os.MkdirAll(filepath.Join(root, "etc"), 0755), IsNil)
+	c.Assert(os.Symlink("/etc", filepath.Join(root, "abs")), IsNil)
+	c.Assert(os.Symlink("../../../../etc", filepath.Join(root, "etc", "rel")), IsNil)
+
+	for path, expected := range map[string]string{
+		"/etc/secret":     filepath.Join(root, "etc/secret"),
+		"etc/secret":      filepath.Join(root, "etc/secret"),
+		"/abs/secret":     filepath.Join(root, "etc/secret"),
+		"/etc/rel/secret": filepath.Join(root, "etc/secret"),
+	} {
+		actual, err := resolveRootPath(root, path)
+		c.Assert(err, IsNil)
+		c.Assert(actual, Equals, expected, Commentf("path %s", path))
+	}
+
+	for _, path := range []string{"../secret", "/etc/../../secret", "/etc/.."} {
+		_, err := resolveRootPath(root, path)
+		c.Assert(err, NotNil, Commentf("path %s", path))
+	}
+}
+
+func (S) TestJobGid(c *C) {
+	root := c.MkDir()
+
+	// no passwd file
+	gid, err := jobGid(root, 1000)
+	c.Assert(err, IsNil)
+	c.Assert(gid, Equals, 0)
+
+	c.Assert(os.MkdirAll(filepath.Join(root, "etc"), 0755), IsNil)
+	passwd := "root:x:0:0:root:/root:/bin/sh\napp:x:1000:1001::/app:/bin/sh\n"
+	c.Assert(ioutil.WriteFile(filepath.Join(root, "etc", "passwd"), []byte(passwd), 0644), IsNil)
+	gid, err = jobGid(root, 1000)
+	c.Assert(err, IsNil)
+	c.Assert(gid, Equals, 1001)
+	gid, err = jobGid(root, 2000)
+	c.Assert(err, IsNil)
+	c.Assert(gid, Equals, 0)
+}
+
+func (S) TestNoExecTmp(c *C) {
+	l := &LibvirtLXCBackend{}
+	yes, no := true, false
+	for _, t := range []struct {
+		hostDefault bool
+		job         *bool
+		expected    bool
+	}{
+		{hostDefault: false, job: nil, expected: false},
+		{hostDefault: true, job: nil, expected: true},
+		{hostDefault: true, job: &no, expected: false},
+		{hostDefault: false, job: &yes, expected: true},
+	} {
+		l.NoExecTmp = t.hostDefault
+		job := &host.Job{Config: host.ContainerConfig{NoExecTmp: t.job}}
+		c.Assert(l.noexecTmp(job), Equals, t.expected)
+	}
+
+	// /tmp should only be a tmpfs in the domain if enabled
+	xml := func(noexecTmp bool) string {
+		domain := &lt.Domain{Devices: lt.Devices{Filesystems: domainFilesystems("/root", noexecTmp)}}
+		return string(domain.XML())
+	}
+	c.Assert(strings.Contains(xml(false), `<filesystem type="ram"><source usage="65535"></source><target dir="/dev/shm"></target></filesystem>`), Equals, true)
+	c.Assert(strings.Contains(xml(false), `dir="/tmp"`), Equals, false)
+	c.Assert(strings.Contains(xml(true), `<filesystem type="ram"><source usage="65535"></source><target dir="/tmp"></target></filesystem>`), Equals, true)
+}
+
+func (S) TestMemBalloon(c *C) {
+	// no balloon by default
+	l := &LibvirtLXCBackend{}
+	domain := &lt.Domain{Type: "lxc", Devices: lt.Devices{MemBalloon: l.memBalloon()}}
+	c.Assert(strings.Contains(string(domain.XML()), "memballoon"), Equals, false)
+
+	l.MemBalloonModel = "virtio"
+	domain = &lt.Domain{
+		Type:    "lxc",
+		Name:    "job1",
+		Memory:  lt.UnitInt{Value: l.jobMemory(&host.Job{}), Unit: "bytes"},
+		Devices: lt.Devices{MemBalloon: l.memBalloon()},
+	}
+	data := domain.XML()
+	c.Assert(strings.Contains(string(data), `<memballoon model="virtio"></memballoon>`), Equals, true, Commentf("xml: %s", data))
+	var parsed lt.Domain
+	c.Assert(xml.Unmarshal(data, &parsed), IsNil)
+	c.Assert(parsed.Devices.MemBalloon, NotNil)
+	c.Assert(parsed.Devices.MemBalloon.Model, Equals, "virtio")
+	c.Assert(parsed.Memory, Equals, lt.UnitInt{Value: 1 << 30, Unit: "bytes"})
+}
+
+func (S) TestDiskUsage(c *C) {
+	dir := c.MkDir()
+	empty, err := diskUsage(dir)
+	c.Assert(err, IsNil)
+
+	c.Assert(os.MkdirAll(filepath.Join(dir, "a/b"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "a/b/file"), bytes.Repeat([]byte("x"), 64*1024), 0644), IsNil)
+	size, err := diskUsage(dir)
+	c.Assert(err, IsNil)
+	c.Assert(size-empty >= 64*1024, Equals, true, Commentf("size %d", size-empty))
+
+	_, err = diskUsage(filepath.Join(dir, "missing"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (S) TestCheckoutWithRetry(c *C) {
+	type test struct {
+		driver   string
+		errs     []error
+		expected error
+		calls    int
+	}
+	for _, t := range []test{
+		// transient errors are retried until the checkout succeeds
+		{driver: "aufs", errs: []error{syscall.EINVAL, syscall.EINVAL}, calls: 3},
+		{driver: "overlay", errs: []error{syscall.EBUSY, fmt.Errorf("error creating overlay mount: %s", syscall.EBUSY)}, calls: 3},
+		{driver: "overlay", errs: []error{syscall.EINVAL}, calls: 2},
+		// other errors fail immediately
+		{driver: "aufs", errs: []error{syscall.EBUSY}, expected: syscall.EBUSY, calls: 1},
+		{driver: "overlay", errs: []error{syscall.EACCES}, expected: syscall.EACCES, calls: 1},
+	} {
+		calls := 0
+		path, err := checkoutWithRetry(func() (string, error) {
+			calls++
+			if calls <= len(t.errs) {
+				return "", t.errs[calls-1]
+			}
+			return "/root", nil
+		}, transientMountErrors[t.driver], time.Second, time.Millisecond)
+		c.Assert(err, Equals, t.expected)
+		c.Assert(calls, Equals, t.calls)
+		if t.expected == nil {
+			c.Assert(path, Equals, "/root")
+		}
+	}
+
+	// transient errors are returned once the timeout has elapsed
+	calls := 0
+	_, err := checkoutWithRetry(func() (string, error) {
+		calls++
+		return "", syscall.EINVAL
+	}, transientMountErrors["aufs"], 20*time.Millisecond, time.Millisecond)
+	c.Assert(err, Equals, syscall.EINVAL)
+	c.Assert(calls > 1, Equals, true)
+}
+
+func (S) TestFlushLogs(c *C) {
+	state := NewState("host1", filepath.Join(c.MkDir(), "host-state-db"))
+	c.Assert(state.OpenDB(), IsNil)
+	defer state.CloseDB()
+	log := log15.New()
+	log.SetHandler(log15.DiscardHandler())
+	l := &LibvirtLXCBackend{
+		state:      state,
+		mux:        logmux.New("host1", c.MkDir(), log),
+		logStreams: make(map[string]map[string]*logmux.LogStream),
+	}
+	appID := "8c4f6a7a-2bd4-4a3c-8b54-6f0b0bbbe1f1"
+	for _, id := range []string{"job1", "job2"} {
+		c.Assert(state.AddJob(&host.Job{ID: id, Metadata: map[string]string{"flynn-controller.app": appID}}), IsNil)
+	}
+
+	// write lines to a pipe which the stream has yet to read
+	r, w, err := os.Pipe()
+	c.Assert(err, IsNil)
+	defer w.Close()
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(w, "line %d\n", i)
+	}
+	stream := l.mux.Follow(r, host.LogStreamBuffer{}, 1, logmux.Config{AppID: appID, JobID: "job1"})
+	defer stream.Close()
+	l.logStreams["job1"] = map[string]*logmux.LogStream{"stdout": stream}
+	c.Assert(l.FlushLogs(5*time.Second), IsNil)
+	msgs, err := l.Tail("job1", 1000)
+	c.Assert(err, IsNil)
+	c.Assert(msgs, HasLen, 100)
+
+	// a stream which is continuously written to should time out
+	busyReader := &busyReader{stop: make(chan struct{})}
+	busy := l.mux.Follow(ioutil.NopCloser(busyReader), host.LogStreamBuffer{}, 1, logmux.Config{AppID: appID, JobID: "job2"})
+	l.logStreams["job2"] = map[string]*logmux.LogStream{"stdout": busy}
+	c.Assert(l.FlushLogs(100*time.Millisecond), DeepEquals, []string{"job2"})
+	close(busyReader.stop)
+	busy.Close()
+}
+
+// busyReader returns a line every millisecond until stop is closed
+type busyReader struct {
+	stop chan struct{}
+}
+
+func (r *busyReader) Read(p []byte) (int, error) {
+	select {
+	case <-r.stop:
+		return 0, io.EOF
+	case <-time.After(time.Millisecond):
+		return copy(p, "line\n"), nil
+	}
+}
+
+func (S) TestCheckDockerSocket(c *C) {
+	l := &LibvirtLXCBackend{LibvirtLXCConfig: LibvirtLXCConfig{DockerSocketApps: []string{"app1"}}}
+	for _, t := range []struct {
+		app   string
+		mount bool
+		err   string
+	}{
+		{app: "app2", mount: false},
+		{app: "app1", mount: true},
+		{app: "app2", mount: true, err: `host: app "app2" is not permitted to mount the Docker socket`},
+		{app: "", mount: true, err: `host: app "" is not permitted to mount the Docker socket`},
+	} {
+		job := &host.Job{
+			Metadata: map[string]string{"flynn-controller.app": t.app},
+			Config:   host.ContainerConfig{MountDockerSocket: t.mount},
+		}
+		err := l.checkDockerSocket(job)
+		if t.err == "" {
+			c.Assert(err, IsNil)
+		} else {
+			c.Assert(err, ErrorMatches, t.err)
+		}
+	}
+}
+
+func (S) TestDockerSocketTarget(c *C) {
+	// /var/run is created if missing
+	root := c.MkDir()
+	target, err := dockerSocketTarget(root)
+	c.Assert(err, IsNil)
+	c.Assert(target, Equals, filepath.Join(root, "var/run/docker.sock"))
+	info, err := os.Stat(filepath.Join(root, "var/run"))
+	c.Assert(err, IsNil)
+	c.Assert(info.IsDir(), Equals, true)
+
+	// a /var/run symlink is not followed
+	root = c.MkDir()
+	c.Assert(os.MkdirAll(filepath.Join(root, "var"), 0755), IsNil)
+	c.Assert(os.Symlink("/run", filepath.Join(root, "var/run")), IsNil)
+	target, err = dockerSocketTarget(root)
+	c.Assert(err, IsNil)
+	c.Assert(target, Equals, filepath.Join(root, "run/docker.sock"))
+
+	// /var/run must be a directory
+	root = c.MkDir()
+	c.Assert(os.MkdirAll(filepath.Join(root, "var"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(root, "var/run"), nil, 0644), IsNil)
+	_, err = dockerSocketTarget(root)
+	c.Assert(err, ErrorMatches, "host: cannot mount the Docker socket in /var/run, it is not a directory")
+}
+
+func (S) TestCgroupPath(c *C) {
+	state := NewState("host1", filepath.Join(c.MkDir(), "host-state-db"))
+	c.Assert(state.OpenDB(), IsNil)
+	defer state.CloseDB()
+	l := &LibvirtLXCBackend{
+		state:      state,
+		containers: make(map[string]*libvirtContainer),
+	}
+	for _, id := range []string{"running", "exited"} {
+		job := &host.Job{ID: id, Partition: "user"}
+		c.Assert(state.AddJob(job), IsNil)
+		state.SetStatusRunning(id)
+		l.containers[id] = &libvirtContainer{
+			job: job,
+			Domain: &lt.Domain{
+				Name:     id,
+				Resource: &lt.Resource{Partition: "/machine/user"},
+			},
+		}
+	}
+	state.SetStatusDone("exited", 0)
+
+	path, err := l.CgroupPath("running")
+	c.Assert(err, IsNil)
+	c.Assert(path, Equals, "/machine/user.partition/running.libvirt-lxc")
+	c.Assert(filepath.Join("/sys/fs/cgroup/cpu", path), Equals, jobCGroupPath("cpu", "user", "running"))
+
+	_, err = l.CgroupPath("exited")
+	c.Assert(err, Equals, ErrNotFound)
+	_, err = l.CgroupPath("nonexistent")
+	c.Assert(err, Equals, ErrNotFound)
+}
+
+func (S) TestMinFreeIPs(c *C) {
+	state := NewState("host1", filepath.Join(c.MkDir(), "host-state-db"))
+	c.Assert(state.OpenDB(), IsNil)
+	defer state.CloseDB()
+	log := log15.New()
+	log.SetHandler(log15.DiscardHandler())
+	l := &LibvirtLXCBackend{
+		state:             state,
+		logger:            log,
+		ipalloc:           ipallocator.New(),
+		jobIPs:            make(map[string]net.IP),
+		containers:        make(map[string]*libvirtContainer),
+		networkConfigured: make(chan struct{}),
+		LibvirtLXCConfig:  LibvirtLXCConfig{MinFreeIPs: 3},
+	}
+
+	// the free IPs are unknown until networking is configured
+	_, ok := l.FreeIPs()
+	c.Assert(ok, Equals, false)
+
+	var err error
+	l.bridgeAddr, l.bridgeNet, err = net.ParseCIDR("10.0.0.1/28")
+	c.Assert(err, IsNil)
+	_, err = l.ipalloc.RequestIP(l.bridgeNet, l.bridgeAddr)
+	c.Assert(err, IsNil)
+	l.reserveJobIPs()
+	free, ok := l.FreeIPs()
+	c.Assert(ok, Equals, true)
+	c.Assert(free, Equals, 13)
+
+	// drive the pool to just below the threshold
+	for i := 0; i < 11; i++ {
+		_, err := l.requestJobIP(fmt.Sprintf("job%d", i), nil)
+		c.Assert(err, IsNil)
+	}
+	free, _ = l.FreeIPs()
+	c.Assert(free, Equals, 2)
+
+	// jobs needing an IP should be rejected before pulling the image
+	job := &host.Job{ID: "job-ip", ImageArtifact: &host.Artifact{}}
+	c.Assert(state.AddJob(job), IsNil)
+	c.Assert(l.Run(job, nil), Equals, ErrInsufficientIPs)
+	c.Assert(state.GetJob("job-ip").Status, Equals, host.StatusFailed)
+
+	// releasing an IP brings the pool back to the threshold
+	l.releaseJobIP("job0")
+	free, _ = l.FreeIPs()
+	c.Assert(free, Equals, 3)
+}
+
+func (S) TestRestartKeepsIP(c *C) {
+	l := &LibvirtLXCBackend{
+		ipalloc:     ipallocator.New(),
+		jobIPs:      make(map[string]net.IP),
+		containers:  make(map[string]*libvirtContainer),
+		starting:    make(map[string]struct{}),
+		ipsReserved: true,
+	}
+	_, l.bridgeNet, _ = net.ParseCIDR("10.0.0.1/28")
+	ip, err := l.requestJobIP("job1", nil)
+	c.Assert(err, IsNil)
+	free, _ := l.FreeIPs()
+
+	// the IP kept whilst restarting is not allocated to other jobs, and
+	// the restarted job is given it again
+	_, err = l.requestJobIP("job2", ip)
+	c.Assert(err, NotNil)
+	restartIP, err := l.requestJobIP("job1", ip)
+	c.Assert(err, IsNil)
+	c.Assert(restartIP.Equal(ip), Equals, true)
+	restartFree, _ := l.FreeIPs()
+	c.Assert(restartFree, Equals, free)
+
+	// the IP is kept once the job is running again
+	l.containers["job1"] = &libvirtContainer{}
+	l.releaseRestartIP("job1")
+	c.Assert(l.jobIPs["job1"].Equal(ip), Equals, true)
+
+	// and released if it wasn't
+	delete(l.containers, "job1")
+	l.releaseRestartIP("job1")
+	c.Assert(l.jobIPs, HasLen, 0)
+	_, err = l.requestJobIP("job2", ip)
+	c.Assert(err, IsNil)
+}
+
+func (S) TestShouldRestart(c *C) {
+	for _, typ := range []string{"", "unknown"} {
+		c.Assert(validateRestartPolicy(&host.RestartPolicy{Type: typ}), NotNil)
+	}
+	c.Assert(validateRestartPolicy(&host.RestartPolicy{Type: host.RestartPolicyAlways, MaxRetries: -1}), NotNil)
+	c.Assert(validateRestartPolicy(nil), IsNil)
+
+	type test struct {
+		policy     *host.RestartPolicy
+		exitStatus int
+		restarts   int
+		restart    bool
+		delay      time.Duration
+	}
+	never := &host.RestartPolicy{Type: host.RestartPolicyNever}
+	onFailure := &host.RestartPolicy{Type: host.RestartPolicyOnFailure, MaxRetries: 3}
+	always := &host.RestartPolicy{Type: host.RestartPolicyAlways, Backoff: 10 * time.Second}
+	for i, t := range []test{
+		{policy: nil, exitStatus: 1},
+		{policy: never, exitStatus: 0},
+		{policy: never, exitStatus: 1},
+
+		// clean exits are not restarted under on-failure
+		{policy: onFailure, exitStatus: 0},
+		{policy: onFailure, exitStatus: 1, restart: true, delay: time.Second},
+		{policy: onFailure, exitStatus: 1, restarts: 2, restart: true, delay: 4 * time.Second},
+		{policy: onFailure, exitStatus: 1, restarts: 3},
+
+		// the backoff doubles up to a minute
+		{policy: always, exitStatus: 0, restart: true, delay: 10 * time.Second},
+		{policy: always, exitStatus: 1, restarts: 1, restart: true, delay: 20 * time.Second},
+		{policy: always, exitStatus: 0, restarts: 3, restart: true, delay: time.Minute},
+		{policy: always, exitStatus: 0, restarts: 100, restart: true, delay: time.Minute},
+	} {
+		restart, delay := shouldRestart(t.policy, t.exitStatus, t.restarts)
+		c.Assert(restart, Equals, t.restart, Commentf("test %d", i))
+		c.Assert(delay, Equals, t.delay, Commentf("test %d", i))
+	}
+}
+
+func (S) TestAttachStreamRestartPolicy(c *C) {
+	state := NewState("host1", filepath.Join(c.MkDir(), "host-state-db"))
+	c.Assert(state.OpenDB(), IsNil)
+	defer state.CloseDB()
+	log := log15.New()
+	log.SetHandler(log15.DiscardHandler())
+	l := &LibvirtLXCBackend{
+		state:      state,
+		mux:        logmux.New("host1", c.MkDir(), log),
+		logger:     log,
+		containers: make(map[string]*libvirtContainer),
+	}
+	appID := "2f0d8f3e-5c6b-4b6e-9a7e-3c1d4e5f6a7b"
+	job := &host.Job{
+		ID:       "job1",
+		Metadata: map[string]string{"flynn-controller.app": appID},
+		Config:   host.ContainerConfig{RestartPolicy: &host.RestartPolicy{Type: host.RestartPolicyAlways}},
+	}
+	c.Assert(state.AddJob(job), IsNil)
+	state.SetStatusRunning(job.ID)
+	container := &libvirtContainer{l: l, job: job, done: make(chan struct{})}
+	l.containers[job.ID] = container
+
+	// attach to the job's output and then have the container exit
+	r, w := io.Pipe()
+	l.mux.Follow(r, host.LogStreamBuffer{}, 1, logmux.Config{AppID: appID, JobID: job.ID})
+	var stdout bytes.Buffer
+	attached := make(chan struct{})
+	errs := make(chan error)
+	go func() {
+		errs <- l.Attach(&AttachRequest{
+			Job:      state.GetJob(job.ID),
+			Stream:   true,
+			Stdout:   nopWriteCloser{&stdout},
+			Attached: attached,
+		})
+	}()
+	<-attached
+	w.Write([]byte("foo\n"))
+	w.Close()
+
+	// the job is left running once it has been started again in a new
+	// container, so the attach ends cleanly when the old one is done
+	close(container.done)
+	c.Assert(<-errs, Equals, io.EOF)
+	c.Assert(stdout.String(), Equals, "foo\n")
+
+	// a job removed whilst waiting to restart is not run again
+	removed := &libvirtContainer{l: l, job: &host.Job{ID: "removed"}, done: make(chan struct{})}
+	atomic.StoreInt32(&removed.restarting, 1)
+	close(removed.done)
+	removed.restartAfter(0, 0)
+	c.Assert(removed.isRestarting(), Equals, false)
+}
+
+func (S) TestWriteCABundle(c *C) {
+	dir := c.MkDir()
+	extra := filepath.Join(dir, "extra.crt")
+	c.Assert(ioutil.WriteFile(extra, []byte("private\n"), 0644), IsNil)
+
+	newRoot := func() string {
+		root := c.MkDir()
+		c.Assert(os.MkdirAll(filepath.Join(root, filepath.Dir(caBundlePath)), 0755), IsNil)
+		return root
+	}
+	assertBundle := func(root, expected string) {
+		dst := filepath.Join(dir, "bundles", filepath.Base(root))
+		c.Assert(writeCABundle(dst, root, extra), IsNil)
+		data, err := ioutil.ReadFile(dst)
+		c.Assert(err, IsNil)
+		c.Assert(string(data), Equals, expected)
+	}
+
+	// the private CA is appended to the system CAs
+	root := newRoot()
+	c.Assert(ioutil.WriteFile(filepath.Join(root, caBundlePath), []byte("system"), 0644), IsNil)
+	assertBundle(root, "system\nprivate\n")
+
+	// an image without a system bundle just gets the private CA
+	assertBundle(newRoot(), "private\n")
+
+	// symlinks are resolved in the container root and replaced
+	root = newRoot()
+	c.Assert(os.MkdirAll(filepath.Join(root, "etc/pki"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(root, "etc/pki/bundle.crt"), []byte("pki\n"), 0644), IsNil)
+	c.Assert(os.Symlink("/etc/pki/bundle.crt", filepath.Join(root, caBundlePath)), IsNil)
+	assertBundle(root, "pki\nprivate\n")
+	info, err := os.Lstat(filepath.Join(root, caBundlePath))
+	c.Assert(os.IsNotExist(err) || info.Mode()&os.ModeSymlink == 0, Equals, true)
+
+	// symlinks to further symlinks are not followed
+	root = newRoot()
+	c.Assert(os.Symlink(extra, filepath.Join(root, "etc/ssl/certs/host.crt")), IsNil)
+	c.Assert(os.Symlink("host.crt", filepath.Join(root, caBundlePath)), IsNil)
+	assertBundle(root, "private\n")
+
+	// symlinked directories are refused rather than resolved on the host
+	root = c.MkDir()
+	c.Assert(os.MkdirAll(filepath.Join(root, "etc"), 0755), IsNil)
+	c.Assert(os.Symlink(dir, filepath.Join(root, "etc/ssl")), IsNil)
+	c.Assert(writeCABundle(filepath.Join(dir, "bundles", "dir"), root, extra), NotNil)
+	root = newRoot()
+	c.Assert(os.Symlink(dir, filepath.Join(root, "etc/pki")), IsNil)
+	c.Assert(os.Symlink("/etc/pki/extra.crt", filepath.Join(root, caBundlePath)), IsNil)
+	c.Assert(writeCABundle(filepath.Join(dir, "bundles", "link"), root, extra), NotNil)
+
+	// links can't use .. to escape the container root
+	root = newRoot()
+	c.Assert(os.Symlink("../../../../../../../../.."+extra, filepath.Join(root, caBundlePath)), IsNil)
+	assertBundle(root, "private\n")
+}
+
+func (S) TestReapLogStreams(c *C) {
+	log := log15.New()
+	log.SetHandler(log15.DiscardHandler())
+	l := &LibvirtLXCBackend{
+		logger:     log,
+		mux:        logmux.New("host1", c.MkDir(), log),
+		containers: map[string]*libvirtContainer{"job1": {}},
+		logStreams: make(map[string]map[string]*logmux.LogStream),
+	}
+	appID := "8c4f6a7a-2bd4-4a3c-8b54-6f0b0bbbe1f1"
+	for _, id := range []string{"job1", "job2"} {
+		l.logStreams[id] = make(map[string]*logmux.LogStream)
+		for i, name := range []string{"stdout", "stderr"} {
+			r, w, err := os.Pipe()
+			c.Assert(err, IsNil)
+			defer w.Close()
+			l.logStreams[id][name] = l.mux.Follow(r, host.LogStreamBuffer{}, i+1, logmux.Config{AppID: appID, JobID: id})
+		}
+	}
+	c.Assert(l.LogStreams(), DeepEquals, map[string][]string{
+		"job1": {"stderr", "stdout"},
+		"job2": {"stderr", "stdout"},
+	})
+
+	// only the streams of the job without a container should be reaped
+	c.Assert(l.ReapLogStreams(), DeepEquals, []string{"job2"})
+	c.Assert(l.LogStreams(), DeepEquals, map[string][]string{"job1": {"stderr", "stdout"}})
+	c.Assert(l.ReapLogStreams(), IsNil)
+
+	for _, s := range l.logStreams["job1"] {
+		s.Close()
+	}
+}
+
+func (S) TestCleanupSystemCritical(c *C) {
+	log := log15.New()
+	log.SetHandler(log15.DiscardHandler())
+	l := &LibvirtLXCBackend{
+		logger:     log,
+		containers: make(map[string]*libvirtContainer),
+	}
+
+	// connect the containers to a containerinit which has gone away, so
+	// stopping them fails but marks them as stopped
+	socketPath := filepath.Join(c.MkDir(), "rpc.sock")
+	listener, err := net.Listen("unix", socketPath)
+	c.Assert(err, IsNil)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	for _, job := range []*host.Job{
+		{ID: "critical", Config: host.ContainerConfig{SystemCritical: true}},
+		{ID: "excepted"},
+		{ID: "other"},
+	} {
+		client, err := containerinit.NewClient(socketPath)
+		c.Assert(err, IsNil)
+		client.Close()
+		l.containers[job.ID] = &libvirtContainer{job: job, l: l, Client: client}
+	}
+
+	// a system critical job survives a cleanup, as do the excepted jobs
+	l.Cleanup([]string{"excepted"})
+	c.Assert(l.containers["other"].isStopped(), Equals, true)
+	c.Assert(l.containers["excepted"].isStopped(), Equals, false)
+	c.Assert(l.containers["critical"].isStopped(), Equals, false)
+	l.Cleanup(nil)
+	c.Assert(l.containers["excepted"].isStopped(), Equals, true)
+	c.Assert(l.containers["critical"].isStopped(), Equals, false)
+}
+
+func (S) TestPauseResume(c *C) {
+	// use a fake freezer cgroup
+	defer func(root string) { cgroupRoot = root }(cgroupRoot)
+	cgroupRoot = c.MkDir()
+	dir := jobCGroupPath("freezer", "user", "job1")
+	c.Assert(os.MkdirAll(dir, 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "freezer.state"), []byte(freezerThawed), 0644), IsNil)
+
+	state := NewState("host1", filepath.Join(c.MkDir(), "host-state-db"))
+	c.Assert(state.OpenDB(), IsNil)
+	defer state.CloseDB()
+	events := state.AddListener("all")
+	job := &host.Job{ID: "job1", Partition: "user"}
+	c.Assert(state.AddJob(job), IsNil)
+	c.Assert((<-events).Event, Equals, host.JobEventCreate)
+	log := log15.New()
+	log.SetHandler(log15.DiscardHandler())
+	l := &LibvirtLXCBackend{
+		state:      state,
+		logger:     log,
+		containers: map[string]*libvirtContainer{"job1": {job: job}},
+	}
+
+	// only running jobs can be paused
+	c.Assert(l.Pause("job1"), Equals, host.ErrJobNotRunning)
+	state.SetStatusRunning("job1")
+	c.Assert((<-events).Event, Equals, host.JobEventStart)
+
+	assertFrozen := func(frozen bool, event string) {
+		data, err := ioutil.ReadFile(filepath.Join(dir, "freezer.state"))
+		c.Assert(err, IsNil)
+		expected := freezerThawed
+		if frozen {
+			expected = freezerFrozen
+		}
+		c.Assert(string(data), Equals, expected)
+		c.Assert(state.GetJob("job1").Paused, Equals, frozen)
+		e := <-events
+		c.Assert(e.Event, Equals, event)
+		c.Assert(e.Job.Paused, Equals, frozen)
+	}
+	c.Assert(l.Pause("job1"), IsNil)
+	assertFrozen(true, host.JobEventPause)
+
+	// a paused job doesn't accept input
+	err := l.Attach(&AttachRequest{Job: state.GetJob("job1"), Stdin: ioutil.NopCloser(strings.NewReader("foo"))})
+	c.Assert(err, Equals, host.ErrJobPaused)
+
+	c.Assert(l.Resume("job1"), IsNil)
+	assertFrozen(false, host.JobEventResume)
+	c.Assert(l.Pause("job1"), IsNil)
+	assertFrozen(true, host.JobEventPause)
+	c.Assert(l.Resume("job1"), IsNil)
+	assertFrozen(false, host.JobEventResume)
+}
+
+func (S) TestRemoveOrphanedCheckouts(c *C) {
+	state := NewState("host1", filepath.Join(c.MkDir(), "host-state-db"))
+	c.Assert(state.OpenDB(), IsNil)
+	defer state.CloseDB()
+	log := log15.New()
+	log.SetHandler(log15.DiscardHandler())
+	l := &LibvirtLXCBackend{
+		state:      state,
+		logger:     log,
+		containers: map[string]*libvirtContainer{"running": {}},
+		starting:   map[string]struct{}{"starting": {}},
+	}
+
+	// a restored job which has yet to be reconnected to is only in the
+	// state database
+	c.Assert(state.AddJob(&host.Job{ID: "restored"}), IsNil)
+	state.SetStatusRunning("restored")
+	c.Assert(state.AddJob(&host.Job{ID: "done"}), IsNil)
+	state.SetStatusRunning("done")
+	state.SetStatusDone("done", 0)
+
+	// only the checkouts of jobs which are not running are removed
+	var removed []string
+	remove := func(id string) error {
+		removed = append(removed, id)
+		return nil
+	}
+	ids, err := l.removeOrphanedCheckouts([]string{"running", "orphaned", "starting", "restored", "done"}, remove)
+	c.Assert(err, IsNil)
+	c.Assert(ids, DeepEquals, []string{"orphaned", "done"})
+	c.Assert(removed, DeepEquals, []string{"orphaned", "done"})
+
+	// errors are returned along with the checkouts already removed
+	remove = func(id string) error {
+		if id == "orphaned2" {
+			return errors.New("device busy")
+		}
+		return nil
+	}
+	ids, err = l.removeOrphanedCheckouts([]string{"orphaned1", "orphaned2", "orphaned3"}, remove)
+	c.Assert(err, ErrorMatches, "device busy")
+	c.Assert(ids, DeepEquals, []string{"orphaned1"})
+}
+
+func (S) TestUpdateImage(c *C) {
+	state := NewState("host1", filepath.Join(c.MkDir(), "host-state-db"))
+	c.Assert(state.OpenDB(), IsNil)
+	defer state.CloseDB()
+	log := log15.New()
+	log.SetHandler(log15.DiscardHandler())
+	l := &LibvirtLXCBackend{
+		state:      state,
+		logger:     log,
+		containers: make(map[string]*libvirtContainer),
+	}
+	c.Assert(l.UpdateImage("job1", &host.Artifact{}), NotNil)
+
+	oldImage := &host.Artifact{Type: host.ArtifactTypeDocker, URI: "https://example.com?name=app&id=old"}
+	newImage := &host.Artifact{Type: host.ArtifactTypeDocker, URI: "https://example.com?name=app&id=new"}
+	job := &host.Job{ID: "job1", ImageArtifact: oldImage}
+	c.Assert(state.AddJob(job), IsNil)
+	state.SetStatusRunning("job1")
+
+	type started struct {
+		uri    string
+		ip     string
+		update bool
+	}
+	var runs []started
+	run := func(failNew bool) func(*host.Job, *RunConfig) error {
+		return func(job *host.Job, config *RunConfig) error {
+			runs = append(runs, started{job.ImageArtifact.URI, config.IP.String(), config.Update})
+			if failNew && job.ImageArtifact == newImage {
+				return errors.New("checkout failed")
+			}
+			return nil
+		}
+	}
+	runConfig := &RunConfig{IP: net.ParseIP("192.0.2.5")}
+
+	// the job is started with the new image at the same IP
+	c.Assert(l.swapImage(log, job, newImage, runConfig, run(false)), IsNil)
+	c.Assert(runs, DeepEquals, []started{{newImage.URI, "192.0.2.5", true}})
+	c.Assert(state.GetJob("job1").Job.ImageArtifact, DeepEquals, newImage)
+
+	// a failure to start with the new image rolls back to the previous one
+	job.ImageArtifact = oldImage
+	state.SetImageArtifact("job1", oldImage)
+	runs = nil
+	err := l.swapImage(log, job, newImage, runConfig, run(true))
+	c.Assert(err, NotNil)
+	c.Assert(runs, DeepEquals, []started{
+		{newImage.URI, "192.0.2.5", true},
+		{oldImage.URI, "192.0.2.5", false},
+	})
+	c.Assert(job.ImageArtifact, Equals, oldImage)
+	c.Assert(state.GetJob("job1").Job.ImageArtifact, DeepEquals, oldImage)
+
+	// failing to run an update doesn't mark the job as failed, so it can
+	// be rolled back
+	c.Assert(l.Drain(true), IsNil)
+	c.Assert(l.Run(job, &RunConfig{Update: true}), Equals, ErrHostDraining)
+	c.Assert(state.GetJob("job1").Status, Equals, host.StatusRunning)
+}
+
+func (S) TestRunDuplicateJob(c *C) {
+	state := NewState("host1", filepath.Join(c.MkDir(), "host-state-db"))
+	c.Assert(state.OpenDB(), IsNil)
+	defer state.CloseDB()
+	log := log15.New()
+	log.SetHandler(log15.DiscardHandler())
+	l := &LibvirtLXCBackend{
+		state:      state,
+		logger:     log,
+		containers: make(map[string]*libvirtContainer),
+	}
+
+	// only one of many concurrent claims for a job should succeed
+	var wg sync.WaitGroup
+	var mtx sync.Mutex
+	var claimed int
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := l.claimJob("job1"); err == nil {
+				mtx.Lock()
+				claimed++
+				mtx.Unlock()
+			} else {
+				c.Check(err, Equals, ErrJobRunning)
+			}
+		}()
+	}
+	wg.Wait()
+	c.Assert(claimed, Equals, 1)
+
+	// concurrent runs of the job being started should be rejected without
+	// affecting its state
+	job := &host.Job{ID: "job1"}
+	c.Assert(state.AddJob(job), IsNil)
+	state.SetStatusRunning("job1")
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { errs <- l.Run(job, nil) }()
+	}
+	for i := 0; i < 2; i++ {
+		c.Assert(<-errs, Equals, ErrJobRunning)
+	}
+	c.Assert(state.GetJob("job1").Status, Equals, host.StatusRunning)
+
+	// once running, the job is still rejected
+	l.containers["job1"] = &libvirtContainer{}
+	l.releaseJob("job1")
+	c.Assert(l.Run(job, nil), Equals, ErrJobRunning)
+
+	// a released job which is not running can be claimed again
+	delete(l.containers, "job1")
+	c.Assert(l.claimJob("job1"), IsNil)
+}
+
+func (S) TestMarkStoppedRestartDone(c *C) {
+	state := NewState("host1", filepath.Join(c.MkDir(), "host-state-db"))
+	c.Assert(state.OpenDB(), IsNil)
+	defer state.CloseDB()
+	log := log15.New()
+	log.SetHandler(log15.DiscardHandler())
+	l := &LibvirtLXCBackend{
+		state:      state,
+		containers: make(map[string]*libvirtContainer),
+		starting:   make(map[string]struct{}),
+	}
+
+	// a job stopped whilst restarting is not run again, so is marked as
+	// done with the exit status of the stopped container (which being
+	// non-zero marks it as crashed)
+	stopped := &host.Job{ID: "stopped"}
+	c.Assert(state.AddJob(stopped), IsNil)
+	state.SetStatusRunning(stopped.ID)
+	state.SetForceStop(stopped.ID, host.StopReasonOperator)
+	l.markStoppedRestartDone(log, &libvirtContainer{job: stopped, exitStatus: 2})
+	job := state.GetJob(stopped.ID)
+	c.Assert(job.Status, Equals, host.StatusCrashed)
+	c.Assert(*job.ExitStatus, Equals, 2)
+
+	// a job which was started again is left running
+	restarted := &host.Job{ID: "restarted"}
+	c.Assert(state.AddJob(restarted), IsNil)
+	state.SetStatusRunning(restarted.ID)
+	state.SetForceStop(restarted.ID, host.StopReasonOperator)
+	container := &libvirtContainer{job: restarted}
+	l.containers[restarted.ID] = container
+	l.markStoppedRestartDone(log, container)
+	c.Assert(state.GetJob(restarted.ID).Status, Equals, host.StatusRunning)
+
+	// a job which wasn't stopped is left running
+	running := &host.Job{ID: "running"}
+	c.Assert(state.AddJob(running), IsNil)
+	state.SetStatusRunning(running.ID)
+	l.markStoppedRestartDone(log, &libvirtContainer{job: running})
+	c.Assert(state.GetJob(running.ID).Status, Equals, host.StatusRunning)
+}
@@ -14,8 +14,10 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/host/types"
 	"github.com/flynn/flynn/logaggregator/client"
 	"github.com/flynn/flynn/logaggregator/utils"
 	"github.com/flynn/flynn/pkg/stream"
@@ -33,6 +35,11 @@ type message struct {
 // LogMux collects log lines from multiple leaders and forwards them to
 // logaggregator instances and local files.
 type Mux struct {
+	// MaxLineLength is the maximum length in bytes of a log line, longer
+	// lines being truncated and marked as such in their structured data
+	// (see Truncated). It defaults to DefaultMaxLineLength.
+	MaxLineLength int
+
 	hostID string
 	logDir string
 	logger log15.Logger
@@ -70,8 +77,19 @@ func New(hostID, logDir string, logger log15.Logger) *Mux {
 
 type Config struct {
 	AppID, HostID, JobID, JobType string
+
+	// BufferSize is the size in bytes of the buffer used to read log
+	// lines, which bounds the data retained by LogStream.Close. It
+	// defaults to DefaultBufferSize and is limited to MaxBufferSize.
+	BufferSize int
 }
 
+const (
+	DefaultBufferSize    = 10000
+	MaxBufferSize        = 1 << 20
+	DefaultMaxLineLength = 64 * 1024
+)
+
 func (m *Mux) StreamToAggregators(s discoverd.Service) error {
 	l := m.logger.New("fn", "StreamToAggregators")
 	ch := make(chan *discoverd.Event)
@@ -271,7 +289,7 @@ func (m *Mux) addAggregator(addr string) {
 // Follow starts a goroutine that reads log lines from the reader into the mux.
 // It runs until the reader is closed or an error occurs. If an error occurs,
 // the reader may still be open.
-func (m *Mux) Follow(r io.ReadCloser, buffer string, fd int, config Config) *LogStream {
+func (m *Mux) Follow(r io.ReadCloser, buffer host.LogStreamBuffer, fd int, config Config) *LogStream {
 	hdr := &rfc5424.Header{
 		Hostname: []byte(config.HostID),
 		AppName:  []byte(config.AppID),
@@ -316,26 +334,107 @@ func (m *Mux) Follow(r io.ReadCloser, buffer string, fd int, config Config) *Log
 		delete(m.jobStarts, config.JobID)
 	}
 
-	go s.follow(r, buffer, config.AppID, hdr, wg)
+	bufferSize := config.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = DefaultBufferSize
+	} else if bufferSize > MaxBufferSize {
+		bufferSize = MaxBufferSize
+	}
+	maxLineLength := m.MaxLineLength
+	if maxLineLength <= 0 {
+		maxLineLength = DefaultMaxLineLength
+	}
+	go s.follow(r, buffer, bufferSize, maxLineLength, config.AppID, hdr, wg)
 	return s
 }
 
 type LogStream struct {
 	m      *Mux
 	log    io.Closer
-	buf    string
+	buf    host.LogStreamBuffer
 	closed atomic.Value // bool
 	done   chan struct{}
+
+	// reads counts the reads from the followed reader and reading is set
+	// whilst one is in progress, so Flush can tell when the stream is
+	// waiting for more data
+	reads   uint64
+	reading int32
+}
+
+// flushInterval is how long a stream must be waiting in the same read for
+// Flush to consider it drained
+const flushInterval = 10 * time.Millisecond
+
+// Flush waits for up to timeout for the data written to the followed reader
+// so far to be read into the mux, returning whether it was
+func (s *LogStream) Flush(timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	var lastReads uint64
+	for {
+		reads := atomic.LoadUint64(&s.reads)
+		if atomic.LoadInt32(&s.reading) == 1 && reads == lastReads {
+			return true
+		}
+		lastReads = reads
+		select {
+		case <-s.done:
+			return true
+		case <-deadline:
+			return false
+		case <-time.After(flushInterval):
+		}
+	}
+}
+
+// streamReader tracks reads from the reader followed by a LogStream
+type streamReader struct {
+	io.Reader
+	s *LogStream
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	atomic.AddUint64(&r.s.reads, 1)
+	atomic.StoreInt32(&r.s.reading, 1)
+	defer atomic.StoreInt32(&r.s.reading, 0)
+	return r.Reader.Read(p)
+}
+
+// truncatedParam is the name of the structured data parameter set to the
+// number of bytes discarded from lines longer than MaxLineLength
+const truncatedParam = "truncated"
+
+// TruncatedMarker is the format of the suffix to display after a truncated
+// line, given the number of bytes which were discarded from it
+const TruncatedMarker = "...[truncated %d bytes]"
+
+// Truncated returns the number of bytes discarded from the given message as
+// it was longer than MaxLineLength, which is zero if it was not truncated
+func Truncated(msg *rfc5424.Message) int {
+	sd, err := rfc5424.ParseStructuredData(msg.StructuredData)
+	if err != nil || sd == nil || !bytes.Equal(sd.ID, []byte("flynn")) {
+		return 0
+	}
+	for _, p := range sd.Params {
+		if bytes.Equal(p.Name, []byte(truncatedParam)) {
+			n, _ := strconv.Atoi(string(p.Value))
+			return n
+		}
+	}
+	return 0
 }
 
-func (s *LogStream) Close() string {
+// Close stops reading from the followed reader and returns the partial line
+// read but not yet logged, which should be passed to Follow when following
+// the reader again.
+func (s *LogStream) Close() host.LogStreamBuffer {
 	s.closed.Store(true)
 	s.log.Close()
 	<-s.done
 	return s.buf
 }
 
-func (s *LogStream) follow(r io.Reader, buffer, appID string, h *rfc5424.Header, wg *sync.WaitGroup) {
+func (s *LogStream) follow(r io.Reader, buffer host.LogStreamBuffer, bufferSize, maxLineLength int, appID string, h *rfc5424.Header, wg *sync.WaitGroup) {
 	defer wg.Done()
 	defer close(s.done)
 	l := s.m.appLog(appID)
@@ -345,25 +444,53 @@ func (s *LogStream) follow(r io.Reader, buffer, appID string, h *rfc5424.Header,
 		Params: []rfc5424.StructuredDataParam{{Name: []byte("seq")}},
 	}
 
-	br := bufio.NewReaderSize(io.MultiReader(strings.NewReader(buffer), r), 10000)
+	// lines longer than the buffer are read into pending, retaining up to
+	// maxLineLength bytes and counting the rest in truncated, which
+	// includes those discarded from the buffered line before it was passed
+	// on by a previous stream
+	var pending []byte
+	truncated := buffer.Truncated
+	appendPending := func(data []byte) {
+		n := maxLineLength - len(pending)
+		if n > len(data) {
+			n = len(data)
+		}
+		pending = append(pending, data[:n]...)
+		truncated += len(data) - n
+	}
+
+	br := bufio.NewReaderSize(io.MultiReader(strings.NewReader(buffer.Data), &streamReader{r, s}), bufferSize)
 	for {
 		line, err := br.ReadSlice('\n')
-		if err != nil && err != bufio.ErrBufferFull {
+		if err == bufio.ErrBufferFull {
+			appendPending(line)
+			continue
+		}
+		if err != nil {
 			// if the log was explicitly closed (because an update
 			// is in progress), store the buffer and return so it
 			// can be passed to the new flynn-host daemon.
 			if s.closed.Load().(bool) {
-				s.buf = string(line)
+				appendPending(line)
+				s.buf = host.LogStreamBuffer{Data: string(pending), Truncated: truncated}
 				return
 			}
-			if len(line) == 0 {
+			if len(line) == 0 && len(pending) == 0 {
 				// only return if there is no final line to return
 				return
 			}
 		}
-		if line[len(line)-1] == '\n' {
+		if len(line) > 0 && line[len(line)-1] == '\n' {
 			line = line[:len(line)-1]
 		}
+		var lineTruncated int
+		if len(pending) > 0 || truncated > 0 || len(line) > maxLineLength {
+			appendPending(line)
+			line = pending
+			lineTruncated = truncated
+			pending = nil
+			truncated = 0
+		}
 
 		msg := rfc5424.NewMessage(h, line)
 		cursor := &utils.HostCursor{
@@ -371,12 +498,19 @@ func (s *LogStream) follow(r io.Reader, buffer, appID string, h *rfc5424.Header,
 			Seq:  uint64(atomic.AddUint32(&s.m.msgSeq, 1)),
 		}
 		sd.Params[0].Value = strconv.AppendUint(seqBuf[:0], cursor.Seq, 10)
+		sd.Params = sd.Params[:1]
+		if lineTruncated > 0 {
+			sd.Params = append(sd.Params, rfc5424.StructuredDataParam{
+				Name:  []byte(truncatedParam),
+				Value: []byte(strconv.Itoa(lineTruncated)),
+			})
+		}
 		var sdBuf bytes.Buffer
 		sd.Encode(&sdBuf)
 		msg.StructuredData = sdBuf.Bytes()
 		l.Write(message{cursor, msg})
 
-		if err != nil && err != bufio.ErrBufferFull {
+		if err != nil {
 			return
 		}
 	}
@@ -600,6 +734,48 @@ func (m *Mux) streamWithHistory(appID, jobID string, follow bool, ch chan<- *rfc
 	return s, nil
 }
 
+// Tail returns up to the last n messages logged by the given job, read from
+// the app's log files so that logs of jobs which have exited are included.
+func (m *Mux) Tail(appID, jobID string, n int) ([]*rfc5424.Message, error) {
+	logs, err := m.logFiles(appID)
+	if err != nil {
+		return nil, err
+	}
+	var msgs []*rfc5424.Message
+	for _, name := range logs[appID] {
+		if err := func() error {
+			f, err := os.Open(name)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			sc := bufio.NewScanner(f)
+			sc.Split(rfc6587.SplitWithNewlines)
+			for sc.Scan() {
+				msgBytes := sc.Bytes()
+				msgCopy := make([]byte, len(msgBytes)-1)
+				copy(msgCopy, msgBytes)
+				msg, _, err := utils.ParseMessage(msgCopy)
+				if err != nil {
+					return err
+				}
+				if !strings.HasSuffix(string(msg.Header.ProcID), jobID) {
+					continue
+				}
+				if len(msgs) == n {
+					msgs = append(msgs[1:], msg)
+				} else {
+					msgs = append(msgs, msg)
+				}
+			}
+			return sc.Err()
+		}(); err != nil {
+			return nil, err
+		}
+	}
+	return msgs, nil
+}
+
 var appIDPrefixPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}`)
 
 // logFiles returns a list of app IDs and the list of log file names associated
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/flynn/flynn/host/types"
+	"github.com/vishvananda/netlink"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+const defaultNetworkCheckInterval = 10 * time.Second
+
+// checkLinkUp checks that the named network interface exists and is up,
+// looking it up directly via netlink rather than listing all interfaces.
+func checkLinkUp(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return err
+	}
+	if link.Attrs().Flags&net.FlagUp == 0 {
+		return fmt.Errorf("host: network interface %s is down", name)
+	}
+	return nil
+}
+
+func validateNetworkCheck(check *host.NetworkCheck) error {
+	if check == nil {
+		return nil
+	}
+	if check.Interval < 0 {
+		return fmt.Errorf("host: invalid network check interval %s", check.Interval)
+	}
+	if check.Threshold < 0 {
+		return fmt.Errorf("host: invalid network check threshold %d", check.Threshold)
+	}
+	return nil
+}
+
+// monitorLink calls linkUp for the given interface every check.Interval
+// until done is closed, logging a warning each time it fails. If
+// check.Threshold is non-zero, it returns an error once that many consecutive
+// checks have failed, otherwise it only returns once done is closed.
+func monitorLink(log log15.Logger, dev string, check *host.NetworkCheck, linkUp func(string) error, done <-chan struct{}) error {
+	interval := check.Interval
+	if interval == 0 {
+		interval = defaultNetworkCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var failures int
+	for {
+		select {
+		case <-done:
+			return nil
+		case <-ticker.C:
+		}
+		err := linkUp(dev)
+		if err == nil {
+			if failures > 0 {
+				log.Info("network interface recovered", "dev", dev)
+			}
+			failures = 0
+			continue
+		}
+		failures++
+		log.Warn("network interface check failed", "dev", dev, "failures", failures, "err", err)
+		if check.Threshold > 0 && failures >= check.Threshold {
+			return fmt.Errorf("host: lost network interface %s after %d failed checks: %s", dev, failures, err)
+		}
+	}
+}
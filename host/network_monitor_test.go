@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/flynn/flynn/host/types"
+	. "github.com/flynn/go-check"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+func (S) TestMonitorLink(c *C) {
+	log := log15.New()
+	log.SetHandler(log15.DiscardHandler())
+	check := &host.NetworkCheck{Interval: time.Millisecond, Threshold: 3}
+
+	// the interface goes down, recovers, then goes down for good
+	var checks int
+	linkUp := func(dev string) error {
+		c.Assert(dev, Equals, "veth0")
+		checks++
+		if checks == 2 || checks > 3 {
+			return errors.New("link not found")
+		}
+		return nil
+	}
+	done := make(chan struct{})
+	err := monitorLink(log, "veth0", check, linkUp, done)
+	c.Assert(err, NotNil)
+	c.Assert(checks, Equals, 6)
+
+	// without a threshold it only warns until done is closed
+	check.Threshold = 0
+	checks = 0
+	linkUp = func(string) error {
+		if checks++; checks == 10 {
+			close(done)
+		}
+		return errors.New("link not found")
+	}
+	c.Assert(monitorLink(log, "veth0", check, linkUp, done), IsNil)
+}
+
+func (S) TestValidateNetworkCheck(c *C) {
+	for _, check := range []*host.NetworkCheck{
+		nil,
+		{},
+		{Interval: time.Second, Threshold: 3},
+	} {
+		c.Assert(validateNetworkCheck(check), IsNil, Commentf("check %+v", check))
+	}
+	for _, check := range []*host.NetworkCheck{
+		{Interval: -time.Second},
+		{Threshold: -1},
+	} {
+		c.Assert(validateNetworkCheck(check), NotNil, Commentf("check %+v", check))
+	}
+}
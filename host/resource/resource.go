@@ -40,6 +40,11 @@ const (
 	// TypeMaxProcs specifies the maximum number of processes which can
 	// be started inside a container.
 	TypeMaxProcs Type = "max_procs"
+
+	// TypePIDs specifies the maximum number of processes and threads
+	// which can exist in a container at once, enforced by the container's
+	// pids cgroup.
+	TypePIDs Type = "pids"
 )
 
 var defaults = Resources{
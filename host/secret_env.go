@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/flynn/flynn/host/types"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+const redactedSecret = "[redacted]"
+
+func validateSecretEnv(patterns []string) error {
+	for _, p := range patterns {
+		if p == "" {
+			return fmt.Errorf("host: invalid empty secret env pattern")
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("host: invalid secret env pattern %q", p)
+		}
+	}
+	return nil
+}
+
+// isSecretEnv returns whether the given environment variable name matches
+// any of the job's secret env patterns
+func isSecretEnv(config *host.ContainerConfig, name string) bool {
+	for _, p := range config.SecretEnv {
+		if matched, _ := path.Match(p, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// secretEnvValues returns the values of the job's secret environment
+// variables, longest first so that a value containing another is redacted
+// in full
+func secretEnvValues(config *host.ContainerConfig) []string {
+	if len(config.SecretEnv) == 0 {
+		return nil
+	}
+	seen := make(map[string]struct{})
+	var values []string
+	for k, v := range config.Env {
+		if v == "" || !isSecretEnv(config, k) {
+			continue
+		}
+		if _, ok := seen[v]; ok {
+			continue
+		}
+		seen[v] = struct{}{}
+		values = append(values, v)
+	}
+	sort.Sort(longestFirst(values))
+	return values
+}
+
+type longestFirst []string
+
+func (s longestFirst) Len() int      { return len(s) }
+func (s longestFirst) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s longestFirst) Less(i, j int) bool {
+	if len(s[i]) != len(s[j]) {
+		return len(s[i]) > len(s[j])
+	}
+	return s[i] < s[j]
+}
+
+// redactSecrets returns a logger which replaces the values of the job's
+// secret environment variables in log messages and context with
+// "[redacted]"
+func redactSecrets(log log15.Logger, config *host.ContainerConfig) log15.Logger {
+	values := secretEnvValues(config)
+	if len(values) == 0 {
+		return log
+	}
+	pairs := make([]string, 0, 2*len(values))
+	for _, v := range values {
+		pairs = append(pairs, v, redactedSecret)
+	}
+	return &redactingLogger{log, strings.NewReplacer(pairs...)}
+}
+
+type redactingLogger struct {
+	log15.Logger
+	r *strings.Replacer
+}
+
+func (l *redactingLogger) New(ctx ...interface{}) log15.Logger {
+	return &redactingLogger{l.Logger.New(l.redact(ctx)...), l.r}
+}
+
+func (l *redactingLogger) Debug(msg string, ctx ...interface{}) {
+	l.Logger.Debug(l.r.Replace(msg), l.redact(ctx)...)
+}
+
+func (l *redactingLogger) Info(msg string, ctx ...interface{}) {
+	l.Logger.Info(l.r.Replace(msg), l.redact(ctx)...)
+}
+
+func (l *redactingLogger) Warn(msg string, ctx ...interface{}) {
+	l.Logger.Warn(l.r.Replace(msg), l.redact(ctx)...)
+}
+
+func (l *redactingLogger) Error(msg string, ctx ...interface{}) {
+	l.Logger.Error(l.r.Replace(msg), l.redact(ctx)...)
+}
+
+func (l *redactingLogger) Crit(msg string, ctx ...interface{}) {
+	l.Logger.Crit(l.r.Replace(msg), l.redact(ctx)...)
+}
+
+// redact returns a copy of ctx with secrets replaced, values which are not
+// strings only being replaced (by their redacted string form) if they
+// contain a secret when formatted
+func (l *redactingLogger) redact(ctx []interface{}) []interface{} {
+	redacted := make([]interface{}, len(ctx))
+	for i, v := range ctx {
+		switch v := v.(type) {
+		case string:
+			redacted[i] = l.r.Replace(v)
+		case []string:
+			s := make([]string, len(v))
+			for j, x := range v {
+				s[j] = l.r.Replace(x)
+			}
+			redacted[i] = s
+		case nil:
+			redacted[i] = v
+		default:
+			s := fmt.Sprint(v)
+			if r := l.r.Replace(s); r != s {
+				redacted[i] = r
+			} else {
+				redacted[i] = v
+			}
+		}
+	}
+	return redacted
+}
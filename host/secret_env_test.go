@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+
+	"github.com/flynn/flynn/host/types"
+	. "github.com/flynn/go-check"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+func (S) TestRedactSecretEnv(c *C) {
+	var buf bytes.Buffer
+	log := log15.New()
+	log.SetHandler(log15.StreamHandler(&buf, log15.LogfmtFormat()))
+
+	config := &host.ContainerConfig{
+		Env: map[string]string{
+			"DB_PASSWORD": "hunter2",
+			"API_KEY":     "s3cr3t",
+			"PORT":        "8080",
+		},
+		SecretEnv: []string{"DB_PASSWORD", "*_KEY"},
+	}
+	c.Assert(validateSecretEnv(config.SecretEnv), IsNil)
+	c.Assert(isSecretEnv(config, "API_KEY"), Equals, true)
+	c.Assert(isSecretEnv(config, "PORT"), Equals, false)
+
+	// a marked key's value never appears in the logs, wherever it is logged
+	log = redactSecrets(log, config).New("db.url", "postgres://user:hunter2@db")
+	log.Info("starting job with s3cr3t", "job.cmd", []string{"app", "--password=hunter2"}, "port", config.Env["PORT"])
+	log.Error("error starting job", "err", errors.New("auth failed for s3cr3t"))
+	out := buf.String()
+	c.Assert(strings.Contains(out, "hunter2"), Equals, false, Commentf("logs: %s", out))
+	c.Assert(strings.Contains(out, "s3cr3t"), Equals, false, Commentf("logs: %s", out))
+	c.Assert(strings.Count(out, redactedSecret), Equals, 5, Commentf("logs: %s", out))
+	c.Assert(strings.Contains(out, "port=8080"), Equals, true, Commentf("logs: %s", out))
+
+	// without secrets the logger is returned unchanged
+	plain := log15.New()
+	c.Assert(redactSecrets(plain, &host.ContainerConfig{Env: config.Env}), Equals, plain)
+
+	for _, p := range []string{"", "["} {
+		c.Assert(validateSecretEnv([]string{p}), NotNil, Commentf("pattern %q", p))
+	}
+}
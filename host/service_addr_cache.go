@@ -0,0 +1,57 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// serviceAddrCache caches the addresses of discoverd services for a short
+// TTL so that a burst of image pulls does not look each one up separately
+type serviceAddrCache struct {
+	ttl time.Duration
+
+	mtx     sync.Mutex
+	entries map[string]serviceAddrs
+}
+
+type serviceAddrs struct {
+	addrs   []string
+	expires time.Time
+}
+
+func newServiceAddrCache(ttl time.Duration) *serviceAddrCache {
+	return &serviceAddrCache{ttl: ttl, entries: make(map[string]serviceAddrs)}
+}
+
+// Get returns the cached addresses of the given service if they have not
+// expired, otherwise it calls lookup and caches the addresses it returns.
+// Nothing is cached if the TTL is zero.
+func (s *serviceAddrCache) Get(service string, lookup func(string) ([]string, error)) ([]string, error) {
+	if s.ttl <= 0 {
+		return lookup(service)
+	}
+
+	s.mtx.Lock()
+	entry, ok := s.entries[service]
+	s.mtx.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.addrs, nil
+	}
+
+	addrs, err := lookup(service)
+	if err != nil || len(addrs) == 0 {
+		return addrs, err
+	}
+	s.mtx.Lock()
+	s.entries[service] = serviceAddrs{addrs: addrs, expires: time.Now().Add(s.ttl)}
+	s.mtx.Unlock()
+	return addrs, nil
+}
+
+// Invalidate removes the cached addresses of the given service, for example
+// because one of them could not be reached
+func (s *serviceAddrCache) Invalidate(service string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	delete(s.entries, service)
+}
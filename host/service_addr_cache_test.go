@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	. "github.com/flynn/go-check"
+)
+
+func (S) TestServiceAddrCache(c *C) {
+	lookups := 0
+	var lookupErr error
+	lookup := func(service string) ([]string, error) {
+		lookups++
+		if lookupErr != nil {
+			return nil, lookupErr
+		}
+		return []string{service + ":80"}, nil
+	}
+
+	// repeated lookups within the TTL hit the cache
+	cache := newServiceAddrCache(100 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		addrs, err := cache.Get("registry", lookup)
+		c.Assert(err, IsNil)
+		c.Assert(addrs, DeepEquals, []string{"registry:80"})
+	}
+	c.Assert(lookups, Equals, 1)
+	_, err := cache.Get("blobstore", lookup)
+	c.Assert(err, IsNil)
+	c.Assert(lookups, Equals, 2)
+
+	// invalidating a service looks it up again
+	cache.Invalidate("registry")
+	cache.Get("registry", lookup)
+	c.Assert(lookups, Equals, 3)
+
+	// expired entries are looked up again
+	time.Sleep(150 * time.Millisecond)
+	cache.Get("registry", lookup)
+	c.Assert(lookups, Equals, 4)
+
+	// failed lookups are not cached
+	cache.Invalidate("registry")
+	lookupErr = errors.New("lookup failed")
+	_, err = cache.Get("registry", lookup)
+	c.Assert(err, Equals, lookupErr)
+	lookupErr = nil
+	cache.Get("registry", lookup)
+	c.Assert(lookups, Equals, 6)
+
+	// a zero TTL disables caching
+	cache = newServiceAddrCache(0)
+	cache.Get("registry", lookup)
+	cache.Get("registry", lookup)
+	c.Assert(lookups, Equals, 8)
+}
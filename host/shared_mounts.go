@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// sharedMountRegistry manages host directories which are bind mounted into
+// all jobs of the same app declaring a shared mount with the same name,
+// removing each directory once the last job referencing it has exited.
+type sharedMountRegistry struct {
+	root string
+
+	mtx  sync.Mutex
+	refs map[string]int
+}
+
+func newSharedMountRegistry(root string) *sharedMountRegistry {
+	return &sharedMountRegistry{
+		root: root,
+		refs: make(map[string]int),
+	}
+}
+
+// sharedMountNoApp is the scope of the shared mounts of jobs without an app
+// ID, which can't clash with an app's scope as app IDs are UUIDs
+const sharedMountNoApp = "_"
+
+// key returns the path relative to the registry root of the directory of the
+// named shared mount of the given app, so that jobs only share directories
+// with jobs of the same app
+func (r *sharedMountRegistry) key(appID, name string) (string, error) {
+	if appID == "" {
+		appID = sharedMountNoApp
+	}
+	if !validSharedMountName(appID) {
+		return "", fmt.Errorf("host: invalid shared mount app ID %q", appID)
+	}
+	if !validSharedMountName(name) {
+		return "", fmt.Errorf("host: invalid shared mount name %q", name)
+	}
+	return filepath.Join(appID, name), nil
+}
+
+func validSharedMountName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.Contains(name, "/")
+}
+
+// Acquire adds a reference to the named shared mount of the given app,
+// creating its directory if necessary, and returns the path of the directory.
+func (r *sharedMountRegistry) Acquire(appID, name string) (string, error) {
+	key, err := r.key(appID, name)
+	if err != nil {
+		return "", err
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	dir := filepath.Join(r.root, key)
+	if r.refs[key] == 0 {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", err
+		}
+	}
+	r.refs[key]++
+	return dir, nil
+}
+
+// Release removes a reference to the named shared mount of the given app,
+// removing its directory if there are no references left.
+func (r *sharedMountRegistry) Release(appID, name string) error {
+	key, err := r.key(appID, name)
+	if err != nil {
+		return err
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.refs[key] == 0 {
+		return nil
+	}
+	r.refs[key]--
+	if r.refs[key] > 0 {
+		return nil
+	}
+	delete(r.refs, key)
+	return os.RemoveAll(filepath.Join(r.root, key))
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/flynn/go-check"
+)
+
+func (S) TestSharedMountRegistry(c *C) {
+	root := c.MkDir()
+	r := newSharedMountRegistry(root)
+	appID := "8c4f6a7a-2bd4-4a3c-8b54-6f0b0bbbe1f1"
+
+	for _, name := range []string{"", ".", "..", "foo/bar"} {
+		_, err := r.Acquire(appID, name)
+		c.Assert(err, NotNil, Commentf("name %q", name))
+	}
+	for _, id := range []string{".", "..", "foo/bar"} {
+		_, err := r.Acquire(id, "sock")
+		c.Assert(err, NotNil, Commentf("app ID %q", id))
+	}
+
+	// acquire the same shared mount for two jobs
+	dir, err := r.Acquire(appID, "sock")
+	c.Assert(err, IsNil)
+	c.Assert(dir, Equals, filepath.Join(root, appID, "sock"))
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "file"), nil, 0644), IsNil)
+	dir2, err := r.Acquire(appID, "sock")
+	c.Assert(err, IsNil)
+	c.Assert(dir2, Equals, dir)
+
+	// jobs of other apps, or without an app, get their own directory
+	otherDir, err := r.Acquire("6f3e8e2c-1d4b-4f5a-9c3e-2b7d9a1e4c5f", "sock")
+	c.Assert(err, IsNil)
+	c.Assert(otherDir, Not(Equals), dir)
+	noAppDir, err := r.Acquire("", "sock")
+	c.Assert(err, IsNil)
+	c.Assert(noAppDir, Equals, filepath.Join(root, sharedMountNoApp, "sock"))
+	_, err = os.Stat(filepath.Join(otherDir, "file"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	// the directory should remain until the last reference is released
+	c.Assert(r.Release(appID, "sock"), IsNil)
+	_, err = os.Stat(filepath.Join(dir, "file"))
+	c.Assert(err, IsNil)
+	c.Assert(r.Release(appID, "sock"), IsNil)
+	_, err = os.Stat(dir)
+	c.Assert(os.IsNotExist(err), Equals, true)
+	_, err = os.Stat(otherDir)
+	c.Assert(err, IsNil)
+
+	// releasing an unknown shared mount is a no-op
+	c.Assert(r.Release(appID, "sock"), IsNil)
+}
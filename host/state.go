@@ -245,7 +245,7 @@ func (s *State) persist(jobID string) {
 
 		// save the opaque blob the backend provides regarding this job if it is starting/running
 		if backend, ok := s.backend.(JobStateSaver); ok {
-			if job, exists := s.jobs[jobID]; exists && (job.Status == host.StatusStarting || job.Status == host.StatusRunning) {
+			if job, exists := s.jobs[jobID]; exists && (job.Status == host.StatusStarting || job.Status == host.StatusRunning || job.Status == host.StatusReady) {
 				backendState, err := backend.MarshalJobState(jobID)
 				if err != nil {
 					return fmt.Errorf("backend failed to serialize job state: %s", err)
@@ -344,6 +344,23 @@ func (s *State) SetContainerID(jobID, containerID string) {
 	s.persist(jobID)
 }
 
+// SetImageArtifact sets the image the job is run with when it is updated in
+// place
+func (s *State) SetImageArtifact(jobID string, artifact *host.Artifact) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	job, ok := s.jobs[jobID]
+	if !ok {
+		return
+	}
+	job.Job.ImageArtifact = artifact
+	if err := s.Acquire(); err == nil {
+		s.persist(jobID)
+		s.Release()
+	}
+}
+
 func (s *State) SetContainerIP(jobID string, ip net.IP) {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
@@ -351,7 +368,9 @@ func (s *State) SetContainerIP(jobID string, ip net.IP) {
 	s.persist(jobID)
 }
 
-func (s *State) SetForceStop(jobID string) {
+// SetForceStop marks the job as stopped for the given reason, defaulting to
+// host.StopReasonUnknown, which is recorded alongside the job's final status
+func (s *State) SetForceStop(jobID string, reason host.StopReason) {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
@@ -360,7 +379,11 @@ func (s *State) SetForceStop(jobID string) {
 		return
 	}
 
+	if reason == "" {
+		reason = host.StopReasonUnknown
+	}
 	job.ForceStop = true
+	job.StopReason = reason
 	s.persist(jobID)
 }
 
@@ -382,6 +405,47 @@ func (s *State) SetStatusRunning(jobID string) {
 	}
 }
 
+// SetStatusReady marks a running job as ready once it has passed its
+// readiness check
+func (s *State) SetStatusReady(jobID string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	job, ok := s.jobs[jobID]
+	if !ok || job.Status != host.StatusRunning {
+		return
+	}
+
+	job.Status = host.StatusReady
+	s.sendEvent(job, host.JobEventReady)
+	if err := s.Acquire(); err == nil {
+		s.persist(jobID)
+		s.Release()
+	}
+}
+
+// SetPaused records whether a running job's processes are frozen
+func (s *State) SetPaused(jobID string, paused bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	job, ok := s.jobs[jobID]
+	if !ok || job.Paused == paused || (job.Status != host.StatusRunning && job.Status != host.StatusReady) {
+		return
+	}
+
+	job.Paused = paused
+	if paused {
+		s.sendEvent(job, host.JobEventPause)
+	} else {
+		s.sendEvent(job, host.JobEventResume)
+	}
+	if err := s.Acquire(); err == nil {
+		s.persist(jobID)
+		s.Release()
+	}
+}
+
 func (s *State) SetContainerStatusDone(containerID string, exitCode int) {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
@@ -59,3 +59,63 @@ func (S) TestStateDuplicateID(c *C) {
 	c.Assert(state.AddJob(&host.Job{ID: "a"}), IsNil)
 	c.Assert(state.AddJob(&host.Job{ID: "a"}), Equals, ErrJobExists)
 }
+
+func (S) TestStateStatusReady(c *C) {
+	workdir := c.MkDir()
+	hostID := "abc123"
+	state := NewState(hostID, filepath.Join(workdir, "host-state-db"))
+	c.Assert(state.OpenDB(), IsNil)
+	// events are sent asynchronously, so listen before adding the job to
+	// avoid racing with the create event
+	events := state.AddListener("all")
+	c.Assert(state.AddJob(&host.Job{ID: "a"}), IsNil)
+	c.Assert((<-events).Event, Equals, host.JobEventCreate)
+
+	// a job must be running before it can be ready
+	state.SetStatusReady("a")
+	c.Assert(state.GetJob("a").Status, Equals, host.StatusStarting)
+	state.SetStatusRunning("a")
+	c.Assert((<-events).Event, Equals, host.JobEventStart)
+	state.SetStatusReady("a")
+	c.Assert(state.GetJob("a").Status, Equals, host.StatusReady)
+	c.Assert((<-events).Event, Equals, host.JobEventReady)
+	state.SetStatusRunning("a")
+	c.Assert(state.GetJob("a").Status, Equals, host.StatusReady)
+	state.CloseDB()
+
+	// the ready status should be persisted
+	state = NewState(hostID, filepath.Join(workdir, "host-state-db"))
+	c.Assert(state.OpenDB(), IsNil)
+	defer state.CloseDB()
+	state.Restore(&MockBackend{}, nil)
+	c.Assert(state.GetJob("a").Status, Equals, host.StatusReady)
+}
+
+func (S) TestStateForceStopReason(c *C) {
+	workdir := c.MkDir()
+	hostID := "abc123"
+	state := NewState(hostID, filepath.Join(workdir, "host-state-db"))
+	c.Assert(state.OpenDB(), IsNil)
+	for _, id := range []string{"a", "b"} {
+		c.Assert(state.AddJob(&host.Job{ID: id}), IsNil)
+		state.SetStatusRunning(id)
+	}
+
+	// a missing reason defaults to unknown
+	state.SetForceStop("a", host.StopReasonScheduler)
+	state.SetForceStop("b", "")
+	state.SetStatusDone("a", 0)
+	state.SetStatusDone("b", 0)
+	c.Assert(state.GetJob("a").StopReason, Equals, host.StopReasonScheduler)
+	c.Assert(state.GetJob("b").StopReason, Equals, host.StopReasonUnknown)
+	state.CloseDB()
+
+	// the reason should be persisted with the final status
+	state = NewState(hostID, filepath.Join(workdir, "host-state-db"))
+	c.Assert(state.OpenDB(), IsNil)
+	defer state.CloseDB()
+	state.Restore(&MockBackend{}, nil)
+	job := state.GetJob("a")
+	c.Assert(job.Status, Equals, host.StatusDone)
+	c.Assert(job.StopReason, Equals, host.StopReasonScheduler)
+}
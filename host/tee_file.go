@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// teeFileBufferSize is the number of writes buffered for a tee file, further
+// writes being dropped until the file catches up
+const teeFileBufferSize = 1024
+
+// teeFile writes a copy of an attached job's output to a file on the host.
+// Writes are buffered and written from a separate goroutine so that a slow
+// disk doesn't block streaming the output to the client.
+type teeFile struct {
+	f       *os.File
+	ch      chan []byte
+	done    chan struct{}
+	mtx     sync.Mutex
+	closed  bool
+	dropped int
+}
+
+// ErrTeeDisabled is returned when attaching with a tee file on a host which
+// has no tee directory configured
+var ErrTeeDisabled = errors.New("host: attach tee files are disabled")
+
+// teeFilePath returns the path of the tee file with the given name in dir,
+// which must be a bare file name so that clients can't create files
+// elsewhere on the host
+func teeFilePath(dir, name string) (string, error) {
+	if dir == "" {
+		return "", ErrTeeDisabled
+	}
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) || filepath.IsAbs(name) {
+		return "", fmt.Errorf("host: invalid tee file name %q, it must be a file name without a directory", name)
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// openTeeFile creates the file with the given name in dir, which must not
+// already exist, readable only by the owner
+func openTeeFile(dir, name string) (*teeFile, error) {
+	path, err := teeFilePath(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	t := &teeFile{
+		f:    f,
+		ch:   make(chan []byte, teeFileBufferSize),
+		done: make(chan struct{}),
+	}
+	go t.writeLoop()
+	return t, nil
+}
+
+func (t *teeFile) writeLoop() {
+	defer close(t.done)
+	for p := range t.ch {
+		t.f.Write(p)
+	}
+}
+
+// Write queues a copy of p to be written to the file, dropping it if the
+// buffer is full, and never returns an error
+func (t *teeFile) Write(p []byte) (int, error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.closed {
+		return len(p), nil
+	}
+	buf := make([]byte, len(p))
+	copy(buf, p)
+	select {
+	case t.ch <- buf:
+	default:
+		t.dropped += len(p)
+	}
+	return len(p), nil
+}
+
+// Dropped returns the number of bytes which were dropped because the buffer
+// was full
+func (t *teeFile) Dropped() int {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return t.dropped
+}
+
+// Close waits for buffered writes to be written and closes the file
+func (t *teeFile) Close() error {
+	t.mtx.Lock()
+	if t.closed {
+		t.mtx.Unlock()
+		return nil
+	}
+	t.closed = true
+	close(t.ch)
+	t.mtx.Unlock()
+	<-t.done
+	return t.f.Close()
+}
+
+// teeWriteCloser writes to w and then to tee
+type teeWriteCloser struct {
+	io.WriteCloser
+	tee io.Writer
+}
+
+func (t *teeWriteCloser) Write(p []byte) (int, error) {
+	n, err := t.WriteCloser.Write(p)
+	t.tee.Write(p[:n])
+	return n, err
+}
+
+// teeWriter returns w with writes copied to tee, or nil if w is nil
+func teeWriter(w io.WriteCloser, tee io.Writer) io.WriteCloser {
+	if w == nil {
+		return nil
+	}
+	return &teeWriteCloser{w, tee}
+}
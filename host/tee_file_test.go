@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/host/logmux"
+	"github.com/flynn/flynn/host/types"
+	. "github.com/flynn/go-check"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func (S) TestAttachTeeFile(c *C) {
+	state := NewState("host1", filepath.Join(c.MkDir(), "host-state-db"))
+	c.Assert(state.OpenDB(), IsNil)
+	defer state.CloseDB()
+	log := log15.New()
+	log.SetHandler(log15.DiscardHandler())
+	l := &LibvirtLXCBackend{
+		state:            state,
+		mux:              logmux.New("host1", c.MkDir(), log),
+		logger:           log,
+		LibvirtLXCConfig: LibvirtLXCConfig{TeeDir: filepath.Join(c.MkDir(), "tee")},
+	}
+
+	appID := "8c4f6a7a-2bd4-4a3c-8b54-6f0b0bbbe1f1"
+	job := &host.Job{ID: "job1", Metadata: map[string]string{"flynn-controller.app": appID}}
+	c.Assert(state.AddJob(job), IsNil)
+	var lines string
+	for i := 0; i < 10; i++ {
+		lines += fmt.Sprintf("line %d\n", i)
+	}
+	l.mux.Follow(ioutil.NopCloser(strings.NewReader(lines)), host.LogStreamBuffer{}, 1, logmux.Config{AppID: appID, JobID: job.ID})
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		msgs, err := l.Tail(job.ID, 10)
+		c.Assert(err, IsNil)
+		if len(msgs) == 10 {
+			break
+		}
+	}
+
+	// the tee file should contain exactly the streamed output
+	path := filepath.Join(l.TeeDir, "attach.log")
+	var stdout bytes.Buffer
+	err := l.Attach(&AttachRequest{
+		Job:     state.GetJob(job.ID),
+		Logs:    true,
+		Stdout:  nopWriteCloser{&stdout},
+		TeeFile: "attach.log",
+	})
+	c.Assert(err, Equals, io.EOF)
+	c.Assert(stdout.String(), Equals, lines)
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, stdout.String())
+	info, err := os.Stat(path)
+	c.Assert(err, IsNil)
+	c.Assert(info.Mode().Perm(), Equals, os.FileMode(0600))
+
+	// existing files are not overwritten
+	err = l.Attach(&AttachRequest{Job: state.GetJob(job.ID), Logs: true, TeeFile: "attach.log"})
+	c.Assert(os.IsExist(err), Equals, true)
+
+	// files can only be created in the tee directory
+	outside := filepath.Join(c.MkDir(), "outside.log")
+	for _, name := range []string{outside, "../outside.log", "a/b.log", "..", ".", ""} {
+		_, err := teeFilePath(l.TeeDir, name)
+		c.Assert(err, NotNil, Commentf("name %q", name))
+	}
+	err = l.Attach(&AttachRequest{Job: state.GetJob(job.ID), Logs: true, TeeFile: outside})
+	c.Assert(err, NotNil)
+	_, err = os.Stat(outside)
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	// tee files are rejected if no tee directory is configured
+	l.TeeDir = ""
+	err = l.Attach(&AttachRequest{Job: state.GetJob(job.ID), Logs: true, TeeFile: "other.log"})
+	c.Assert(err, Equals, ErrTeeDisabled)
+}
+
+func (S) TestTeeFileDropsWhenFull(c *C) {
+	path := filepath.Join(c.MkDir(), "tee")
+	f, err := os.Create(path)
+	c.Assert(err, IsNil)
+	t := &teeFile{f: f, ch: make(chan []byte, 1), done: make(chan struct{})}
+
+	// with the write loop not yet draining the buffer, writes beyond it are
+	// dropped rather than blocking
+	for _, s := range []string{"a", "bc"} {
+		n, err := t.Write([]byte(s))
+		c.Assert(err, IsNil)
+		c.Assert(n, Equals, len(s))
+	}
+	c.Assert(t.Dropped(), Equals, 2)
+
+	go t.writeLoop()
+	c.Assert(t.Close(), IsNil)
+	c.Assert(t.Close(), IsNil)
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "a")
+
+	// writes after closing are ignored
+	n, err := t.Write([]byte("foo"))
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 3)
+}
@@ -1,7 +1,10 @@
 package host
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/flynn/flynn/host/resource"
@@ -51,7 +54,10 @@ func (j *Job) Dup() *Job {
 	job.Metadata = dupMap(j.Metadata)
 	job.Config.Entrypoint = dupSlice(j.Config.Entrypoint)
 	job.Config.Cmd = dupSlice(j.Config.Cmd)
+	job.Config.PostStart = dupSlice(j.Config.PostStart)
+	job.Config.PreStop = dupSlice(j.Config.PreStop)
 	job.Config.Env = dupMap(j.Config.Env)
+	job.Config.SecretEnv = dupSlice(j.Config.SecretEnv)
 	if j.Config.Ports != nil {
 		job.Config.Ports = make([]Port, len(j.Config.Ports))
 		for i, p := range j.Config.Ports {
@@ -64,6 +70,40 @@ func (j *Job) Dup() *Job {
 			job.Config.Mounts[i] = m
 		}
 	}
+	if j.Config.SharedMounts != nil {
+		job.Config.SharedMounts = make([]SharedMount, len(j.Config.SharedMounts))
+		copy(job.Config.SharedMounts, j.Config.SharedMounts)
+	}
+	if j.Config.StopSignals != nil {
+		job.Config.StopSignals = make([]StopSignal, len(j.Config.StopSignals))
+		copy(job.Config.StopSignals, j.Config.StopSignals)
+	}
+	if j.Config.AllowedDevices != nil {
+		job.Config.AllowedDevices = make([]DeviceRule, len(j.Config.AllowedDevices))
+		copy(job.Config.AllowedDevices, j.Config.AllowedDevices)
+	}
+	if j.Config.EnvFiles != nil {
+		job.Config.EnvFiles = make([]EnvFile, len(j.Config.EnvFiles))
+		for i, f := range j.Config.EnvFiles {
+			job.Config.EnvFiles[i] = EnvFile{Path: f.Path, Env: dupMap(f.Env)}
+		}
+	}
+	if j.Config.Readiness != nil {
+		readiness := *j.Config.Readiness
+		job.Config.Readiness = &readiness
+	}
+	if j.Config.NoExecTmp != nil {
+		noexecTmp := *j.Config.NoExecTmp
+		job.Config.NoExecTmp = &noexecTmp
+	}
+	if j.Config.NetworkCheck != nil {
+		networkCheck := *j.Config.NetworkCheck
+		job.Config.NetworkCheck = &networkCheck
+	}
+	if j.Config.RestartPolicy != nil {
+		restartPolicy := *j.Config.RestartPolicy
+		job.Config.RestartPolicy = &restartPolicy
+	}
 
 	return &job
 }
@@ -73,19 +113,171 @@ type JobResources struct {
 }
 
 type ContainerConfig struct {
-	TTY         bool              `json:"tty,omitempty"`
-	Stdin       bool              `json:"stdin,omitempty"`
-	Data        bool              `json:"data,omitempty"`
-	Entrypoint  []string          `json:"entry_point,omitempty"`
-	Cmd         []string          `json:"cmd,omitempty"`
-	Env         map[string]string `json:"env,omitempty"`
-	Mounts      []Mount           `json:"mounts,omitempty"`
-	Volumes     []VolumeBinding   `json:"volumes,omitempty"`
-	Ports       []Port            `json:"ports,omitempty"`
-	WorkingDir  string            `json:"working_dir,omitempty"`
-	Uid         int               `json:"uid,omitempty"`
-	HostNetwork bool              `json:"host_network,omitempty"`
-	DisableLog  bool              `json:"disable_log,omitempty"`
+	TTY          bool              `json:"tty,omitempty"`
+	Stdin        bool              `json:"stdin,omitempty"`
+	Data         bool              `json:"data,omitempty"`
+	Entrypoint   []string          `json:"entry_point,omitempty"`
+	Cmd          []string          `json:"cmd,omitempty"`
+	Env          map[string]string `json:"env,omitempty"`
+	Mounts       []Mount           `json:"mounts,omitempty"`
+	Volumes      []VolumeBinding   `json:"volumes,omitempty"`
+	SharedMounts []SharedMount     `json:"shared_mounts,omitempty"`
+	Ports        []Port            `json:"ports,omitempty"`
+	WorkingDir   string            `json:"working_dir,omitempty"`
+	Uid          int               `json:"uid,omitempty"`
+	HostNetwork  bool              `json:"host_network,omitempty"`
+	DisableLog   bool              `json:"disable_log,omitempty"`
+
+	// AllowedDevices is the list of devices the job may access, defaulting
+	// to a minimal set (see DefaultDeviceRules) if not set.
+	AllowedDevices []DeviceRule `json:"allowed_devices,omitempty"`
+
+	// StopTimeout is how long the job is given to exit after being sent
+	// SIGTERM before it is killed, defaulting to ten seconds.
+	StopTimeout time.Duration `json:"stop_timeout,omitempty"`
+
+	// StopSignals, if set, is the sequence of signals sent to stop the
+	// job, each followed by waiting up to its Timeout (defaulting to
+	// StopTimeout) for the job to exit before sending the next. The job is
+	// killed if it is still running at the end of the sequence.
+	StopSignals []StopSignal `json:"stop_signals,omitempty"`
+
+	// CPUSet, if set, pins the job to the given host CPUs (e.g. "2,3"),
+	// which must be a subset of the CPUs of the job's partition. If
+	// CPUSetExclusive is also set, the job fails to start if any other job
+	// is pinned to any of the CPUs, and vice versa.
+	CPUSet          string `json:"cpuset,omitempty"`
+	CPUSetExclusive bool   `json:"cpuset_exclusive,omitempty"`
+
+	// LogBufferSize is the size in bytes of the buffer used to read each of
+	// the job's log streams, which bounds the length of log lines and the
+	// log data retained across a host update. It defaults to
+	// logmux.DefaultBufferSize and must not exceed logmux.MaxBufferSize.
+	LogBufferSize int `json:"log_buffer_size,omitempty"`
+
+	// InitPath is the path on the host of an alternative container init
+	// binary to run the job with, which is only permitted if the host was
+	// started with --allow-init-override (intended for debugging).
+	InitPath string `json:"init_path,omitempty"`
+
+	// Timezone is the name of the timezone to run the job in (e.g.
+	// "Europe/London"), or "host" to use the host's timezone. It defaults
+	// to UTC.
+	Timezone string `json:"timezone,omitempty"`
+
+	// Readiness, if set, is checked once the job is running to determine
+	// when it is ready, at which point its status changes from
+	// StatusRunning to StatusReady. Jobs without a Readiness check stay
+	// in StatusRunning.
+	Readiness *ReadinessCheck `json:"readiness,omitempty"`
+
+	// EnvFiles are written to files in the container rather than being
+	// set in the job's environment, keeping secrets out of the process
+	// environment.
+	EnvFiles []EnvFile `json:"env_files,omitempty"`
+
+	// NoExecTmp, if set, overrides the host's --noexec-tmp default of
+	// whether /dev/shm and a tmpfs at /tmp are mounted noexec,nosuid,nodev
+	// in the container.
+	NoExecTmp *bool `json:"noexec_tmp,omitempty"`
+
+	// PostStart, if set, is a command run once in the container after the
+	// job's process has started, with its output written to the init log.
+	// If it fails, the job is killed if PostStartFatal is set, otherwise
+	// the failure is just logged.
+	PostStart      []string `json:"post_start,omitempty"`
+	PostStartFatal bool     `json:"post_start_fatal,omitempty"`
+
+	// PreStop, if set, is a command run in the container when the job is
+	// stopped, before it is sent any stop signals and so while its volumes
+	// are still mounted, with its output written to the init log. It is
+	// killed if it runs for longer than the job's stop timeout, and the
+	// job is stopped whether or not it succeeds.
+	PreStop []string `json:"pre_stop,omitempty"`
+
+	// MountDockerSocket bind mounts the host's Docker socket into the
+	// container, which is only permitted for apps in the host's
+	// --docker-socket-apps allowlist.
+	MountDockerSocket bool `json:"mount_docker_socket,omitempty"`
+
+	// NetworkCheck, if set, periodically checks that the host side of the
+	// job's network interface still exists and is up, logging a warning
+	// each time it is not.
+	NetworkCheck *NetworkCheck `json:"network_check,omitempty"`
+
+	// RestartPolicy, if set, has the host run the job again in place,
+	// with the same ID and IP address, when it exits rather than leaving
+	// it to the scheduler. The job stays running while being restarted.
+	RestartPolicy *RestartPolicy `json:"restart_policy,omitempty"`
+
+	// DisableCABundle opts the job out of having the CA bundle configured
+	// with the host's --ca-bundle flag appended to its system CA bundle.
+	DisableCABundle bool `json:"disable_ca_bundle,omitempty"`
+
+	// SecretEnv is a list of environment variable names, or patterns in
+	// the syntax of path.Match (e.g. "*_PASSWORD"), whose values are
+	// redacted from host logs and debug output. The values are still
+	// passed to the job as normal.
+	SecretEnv []string `json:"secret_env,omitempty"`
+
+	// SystemCritical marks the job as cluster infrastructure (e.g.
+	// discoverd) which is not stopped when the host cleans up jobs,
+	// only being stopped explicitly or when the host shuts down.
+	SystemCritical bool `json:"system_critical,omitempty"`
+}
+
+const (
+	// RestartPolicyNever never restarts the job
+	RestartPolicyNever = "never"
+	// RestartPolicyOnFailure restarts the job if it exits with a non-zero
+	// status
+	RestartPolicyOnFailure = "on-failure"
+	// RestartPolicyAlways restarts the job whenever it exits
+	RestartPolicyAlways = "always"
+)
+
+type RestartPolicy struct {
+	Type string `json:"type"`
+
+	// MaxRetries, if non-zero, is the maximum number of times the job is
+	// restarted.
+	MaxRetries int `json:"max_retries,omitempty"`
+
+	// Backoff is the time to wait before the first restart, which doubles
+	// with each subsequent restart up to a minute. It defaults to one
+	// second.
+	Backoff time.Duration `json:"backoff,omitempty"`
+}
+
+// NetworkCheck configures the monitoring of a job's network interface.
+type NetworkCheck struct {
+	// Interval is the time between checks, defaulting to ten seconds.
+	Interval time.Duration `json:"interval,omitempty"`
+
+	// Threshold, if non-zero, is the number of consecutive failed checks
+	// after which the job is stopped and marked as failed.
+	Threshold int `json:"threshold,omitempty"`
+}
+
+// EnvFile is a file of KEY=VALUE lines written to a tmpfs and mounted into
+// the container at Path, owned by the job's user with mode 0600.
+type EnvFile struct {
+	Path string            `json:"path"`
+	Env  map[string]string `json:"env"`
+}
+
+const (
+	// ReadinessCheckPort waits until the job accepts TCP connections on
+	// the check's Port
+	ReadinessCheckPort = "port"
+	// ReadinessCheckFD waits until the job writes to the file descriptor
+	// given in the READY_FD environment variable
+	ReadinessCheckFD = "fd"
+)
+
+type ReadinessCheck struct {
+	Type string `json:"type"`
+	Port int    `json:"port,omitempty"`
 }
 
 // Apply 'y' to 'x', returning a new structure.  'y' trumps.
@@ -107,6 +299,10 @@ func (x ContainerConfig) Merge(y ContainerConfig) ContainerConfig {
 		env[k] = v
 	}
 	x.Env = env
+	secretEnv := make([]string, 0, len(x.SecretEnv)+len(y.SecretEnv))
+	secretEnv = append(secretEnv, x.SecretEnv...)
+	secretEnv = append(secretEnv, y.SecretEnv...)
+	x.SecretEnv = secretEnv
 	mounts := make([]Mount, 0, len(x.Mounts)+len(y.Mounts))
 	mounts = append(mounts, x.Mounts...)
 	mounts = append(mounts, y.Mounts...)
@@ -115,6 +311,14 @@ func (x ContainerConfig) Merge(y ContainerConfig) ContainerConfig {
 	volumes = append(volumes, x.Volumes...)
 	volumes = append(volumes, y.Volumes...)
 	x.Volumes = volumes
+	sharedMounts := make([]SharedMount, 0, len(x.SharedMounts)+len(y.SharedMounts))
+	sharedMounts = append(sharedMounts, x.SharedMounts...)
+	sharedMounts = append(sharedMounts, y.SharedMounts...)
+	x.SharedMounts = sharedMounts
+	envFiles := make([]EnvFile, 0, len(x.EnvFiles)+len(y.EnvFiles))
+	envFiles = append(envFiles, x.EnvFiles...)
+	envFiles = append(envFiles, y.EnvFiles...)
+	x.EnvFiles = envFiles
 	ports := make([]Port, 0, len(x.Ports)+len(y.Ports))
 	ports = append(ports, x.Ports...)
 	ports = append(ports, y.Ports...)
@@ -126,13 +330,67 @@ func (x ContainerConfig) Merge(y ContainerConfig) ContainerConfig {
 		x.Uid = y.Uid
 	}
 	x.HostNetwork = x.HostNetwork || y.HostNetwork
+	x.MountDockerSocket = x.MountDockerSocket || y.MountDockerSocket
+	x.DisableCABundle = x.DisableCABundle || y.DisableCABundle
+	x.SystemCritical = x.SystemCritical || y.SystemCritical
+	if y.AllowedDevices != nil {
+		x.AllowedDevices = y.AllowedDevices
+	}
+	if y.StopTimeout != 0 {
+		x.StopTimeout = y.StopTimeout
+	}
+	if y.StopSignals != nil {
+		x.StopSignals = y.StopSignals
+	}
+	if y.CPUSet != "" {
+		x.CPUSet = y.CPUSet
+		x.CPUSetExclusive = y.CPUSetExclusive
+	}
+	if y.LogBufferSize != 0 {
+		x.LogBufferSize = y.LogBufferSize
+	}
+	if y.InitPath != "" {
+		x.InitPath = y.InitPath
+	}
+	if y.Timezone != "" {
+		x.Timezone = y.Timezone
+	}
+	if y.Readiness != nil {
+		x.Readiness = y.Readiness
+	}
+	if y.NoExecTmp != nil {
+		x.NoExecTmp = y.NoExecTmp
+	}
+	if y.PostStart != nil {
+		x.PostStart = y.PostStart
+		x.PostStartFatal = y.PostStartFatal
+	}
+	if y.PreStop != nil {
+		x.PreStop = y.PreStop
+	}
+	if y.NetworkCheck != nil {
+		x.NetworkCheck = y.NetworkCheck
+	}
+	if y.RestartPolicy != nil {
+		x.RestartPolicy = y.RestartPolicy
+	}
 	return x
 }
 
+type StopSignal struct {
+	Signal  int           `json:"signal"`
+	Timeout time.Duration `json:"timeout,omitempty"`
+}
+
 type Port struct {
 	Port    int      `json:"port,omitempty"`
 	Proto   string   `json:"proto,omitempty"`
 	Service *Service `json:"service,omitempty"`
+
+	// HostPort, if set, is a port on the host which is forwarded to Port
+	// in the container, so that jobs not using host networking can be
+	// reached on a fixed port from outside the host.
+	HostPort int `json:"host_port,omitempty"`
 }
 
 type Service struct {
@@ -172,17 +430,130 @@ type Mount struct {
 	Writeable bool   `json:"writeable,omitempty"`
 }
 
+// DeviceRule is an entry in the devices cgroup whitelist of a job
+type DeviceRule struct {
+	// Type is one of "a" (all), "b" (block) or "c" (char)
+	Type string `json:"type,omitempty"`
+	// Major and Minor are the device numbers, with -1 matching any number
+	Major int64 `json:"major"`
+	Minor int64 `json:"minor"`
+	// Access is a combination of "r" (read), "w" (write) and "m" (mknod)
+	Access string `json:"access,omitempty"`
+}
+
+func (r DeviceRule) String() string {
+	num := func(n int64) string {
+		if n < 0 {
+			return "*"
+		}
+		return strconv.FormatInt(n, 10)
+	}
+	return fmt.Sprintf("%s %s:%s %s", r.Type, num(r.Major), num(r.Minor), r.Access)
+}
+
+// DefaultDeviceRules are the devices a job may access if it does not set
+// AllowedDevices
+var DefaultDeviceRules = []DeviceRule{
+	{Type: "c", Major: 1, Minor: 3, Access: "rwm"},    // /dev/null
+	{Type: "c", Major: 1, Minor: 5, Access: "rwm"},    // /dev/zero
+	{Type: "c", Major: 1, Minor: 8, Access: "rwm"},    // /dev/random
+	{Type: "c", Major: 1, Minor: 9, Access: "rwm"},    // /dev/urandom
+	{Type: "c", Major: 5, Minor: 0, Access: "rwm"},    // /dev/tty
+	{Type: "c", Major: 5, Minor: 2, Access: "rwm"},    // /dev/ptmx
+	{Type: "c", Major: 136, Minor: -1, Access: "rwm"}, // /dev/pts/*
+}
+
 type VolumeBinding struct {
 	// Target defines the filesystem path inside the container where the volume will be mounted.
 	Target string `json:"target"`
 	// VolumeID can be thought of as the source path if this were a simple bind-mount.  It is resolved by a VolumeManager.
 	VolumeID  string `json:"volume"`
 	Writeable bool   `json:"writeable"`
+	// NoExec and NoSUID mount the volume noexec and nosuid respectively,
+	// preventing binaries stored in the volume from being executed or
+	// gaining privileges.
+	NoExec bool `json:"noexec,omitempty"`
+	NoSUID bool `json:"nosuid,omitempty"`
+	// Type is VolumeTypeDisk (the default) for a volume provisioned by the
+	// host's volume manager, or VolumeTypeTmpfs for an ephemeral memory
+	// backed volume of Size bytes which is discarded when the job exits
+	// (VolumeID is not used).
+	Type string `json:"type,omitempty"`
+	Size int64  `json:"size,omitempty"`
+}
+
+const (
+	VolumeTypeDisk  = "disk"
+	VolumeTypeTmpfs = "tmpfs"
+)
+
+// DiskUsage is the disk space in bytes used by a job's root filesystem
+// changes and by each of its volumes
+type DiskUsage struct {
+	RootFS  int64             `json:"rootfs"`
+	Volumes []VolumeDiskUsage `json:"volumes,omitempty"`
+}
+
+// MemoryStats is the memory in bytes of a job's domain
+type MemoryStats struct {
+	// Limit is the maximum memory of the domain
+	Limit int64 `json:"limit"`
+
+	// Balloon is the current memory of the domain if it has a memory
+	// balloon, which is less than Limit when the host has reclaimed
+	// unused memory
+	Balloon int64 `json:"balloon,omitempty"`
+}
+
+// PIDStats is the number of processes and threads in a job's pids cgroup
+type PIDStats struct {
+	Current int64 `json:"current"`
+
+	// Limit is the maximum number of processes and threads, or zero if
+	// unlimited
+	Limit int64 `json:"limit,omitempty"`
+}
+
+// ReproSpec is the process configuration a job was started with, for
+// reproducing its launch outside of the host
+type ReproSpec struct {
+	// Args is the job's entrypoint and command after being merged with
+	// its image config
+	Args []string `json:"args"`
+
+	// Env is the job's complete environment, including host defaults,
+	// with the values of secret variables redacted
+	Env map[string]string `json:"env"`
+
+	WorkDir   string             `json:"working_dir,omitempty"`
+	User      string             `json:"user,omitempty"`
+	Resources resource.Resources `json:"resources,omitempty"`
+}
+
+type VolumeDiskUsage struct {
+	VolumeID string `json:"volume"`
+	Target   string `json:"target"`
+	Size     int64  `json:"size"`
+}
+
+// SharedMount is a host directory which is shared between all jobs of the
+// same app on the same host which declare a SharedMount with the same Name,
+// for example to communicate over a Unix socket.
+type SharedMount struct {
+	Name string `json:"name"`
+	// Target defines the filesystem path inside the container where the
+	// shared directory will be mounted.
+	Target string `json:"target"`
 }
 
 type Artifact struct {
 	URI  string       `json:"url,omitempty"`
 	Type ArtifactType `json:"type,omitempty"`
+
+	// Digest, if set, is the expected manifest digest of the image (e.g.
+	// "sha256:e3d9..."), and the job fails to start if the pulled image
+	// does not match it.
+	Digest string `json:"digest,omitempty"`
 }
 
 type ArtifactType string
@@ -217,6 +588,33 @@ type ActiveJob struct {
 	EndedAt     time.Time `json:"ended_at,omitempty"`
 	ExitStatus  *int      `json:"exit_status,omitempty"`
 	Error       *string   `json:"error,omitempty"`
+
+	// StopReason is why the job was stopped if ForceStop is set
+	StopReason StopReason `json:"stop_reason,omitempty"`
+
+	// Paused is whether the job's processes are frozen
+	Paused bool `json:"paused,omitempty"`
+}
+
+// StopReason is why a job was requested to stop
+type StopReason string
+
+const (
+	StopReasonUnknown   StopReason = "unknown"
+	StopReasonOperator  StopReason = "operator"
+	StopReasonScheduler StopReason = "scheduler"
+	StopReasonDrain     StopReason = "drain"
+)
+
+// Valid returns whether r is a known reason, or empty (which is recorded as
+// StopReasonUnknown)
+func (r StopReason) Valid() bool {
+	switch r {
+	case "", StopReasonUnknown, StopReasonOperator, StopReasonScheduler, StopReasonDrain:
+		return true
+	default:
+		return false
+	}
 }
 
 func (j *ActiveJob) Dup() *ActiveJob {
@@ -234,6 +632,7 @@ func (j *ActiveJob) Dup() *ActiveJob {
 var (
 	ErrJobNotRunning = errors.New("host: job not running")
 	ErrAttached      = errors.New("host: job is attached")
+	ErrJobPaused     = errors.New("host: job is paused")
 )
 
 type AttachReq struct {
@@ -241,6 +640,11 @@ type AttachReq struct {
 	Flags  AttachFlag `json:"flags,omitempty"`
 	Height uint16     `json:"height,omitempty"`
 	Width  uint16     `json:"width,omitempty"`
+
+	// TeeFile, if set, is the name of a file to create in the host's tee
+	// directory (see flynn-host's --tee-dir) with a copy of the attached
+	// output, which must not already exist
+	TeeFile string `json:"tee_file,omitempty"`
 }
 
 type AttachFlag uint8
@@ -263,6 +667,7 @@ func (s JobStatus) String() string {
 		StatusDone:     "done",
 		StatusCrashed:  "crashed",
 		StatusFailed:   "failed",
+		StatusReady:    "ready",
 	}[s]
 }
 
@@ -272,6 +677,9 @@ const (
 	StatusDone
 	StatusCrashed
 	StatusFailed
+	// StatusReady follows StatusRunning once a job with a Readiness check
+	// has passed it
+	StatusReady
 )
 
 const (
@@ -305,6 +713,10 @@ type HostStatus struct {
 	Discoverd *DiscoverdConfig  `json:"discoverd,omitempty"`
 	Network   *NetworkConfig    `json:"network,omitempty"`
 	Version   string            `json:"version"`
+
+	// FreeIPs is the number of free addresses in the host's container IP
+	// pool, set once networking is configured
+	FreeIPs *int `json:"free_ips,omitempty"`
 }
 
 const (
@@ -312,6 +724,9 @@ const (
 	JobEventStart  string = "start"
 	JobEventStop   string = "stop"
 	JobEventError  string = "error"
+	JobEventReady  string = "ready"
+	JobEventPause  string = "pause"
+	JobEventResume string = "resume"
 )
 
 type ResourceCheck struct {
@@ -326,4 +741,26 @@ type Command struct {
 
 type LogBuffers map[string]LogBuffer
 
-type LogBuffer map[string]string
+// LogBuffer is the partial line read from each of a job's log streams but not
+// yet logged when the streams were closed, keyed by stream name
+type LogBuffer map[string]LogStreamBuffer
+
+// LogStreamBuffer is the partial line read from a log stream but not yet
+// logged, which is passed on to the stream which continues reading it
+type LogStreamBuffer struct {
+	Data string `json:"data"`
+
+	// Truncated is the number of bytes of the line which were discarded as
+	// it is longer than the maximum log line length
+	Truncated int `json:"truncated,omitempty"`
+}
+
+// UnmarshalJSON also accepts the plain string buffers of older daemons
+func (b *LogStreamBuffer) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		*b = LogStreamBuffer{}
+		return json.Unmarshal(data, &b.Data)
+	}
+	type buffer LogStreamBuffer
+	return json.Unmarshal(data, (*buffer)(b))
+}
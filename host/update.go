@@ -26,6 +26,10 @@ var (
 	ControlMsgOK = []byte{1}
 )
 
+// logFlushTimeout is how long to wait for job logs to be flushed before
+// closing them during an update
+const logFlushTimeout = 5 * time.Second
+
 // Update performs a zero-downtime update of the flynn-host daemon, replacing
 // the current daemon with an instance of the given command.
 //
@@ -91,6 +95,11 @@ func (h *Host) Update(cmd *host.Command) error {
 		return err
 	}
 
+	log.Info("flushing logs")
+	if failed := h.FlushLogs(logFlushTimeout); len(failed) > 0 {
+		log.Error("timed out flushing logs", "job.ids", failed)
+	}
+
 	log.Info("closing logs")
 	buffers, err := h.CloseLogs()
 	if err != nil {
@@ -6,12 +6,15 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/url"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"sync"
 
+	"github.com/docker/distribution/digest"
 	"github.com/docker/docker/cliconfig"
 	"github.com/docker/docker/daemon/events"
 	"github.com/docker/docker/daemon/graphdriver"
@@ -42,6 +45,7 @@ type Context struct {
 	store  *graph.TagStore
 	graph  *graph.Graph
 	driver graphdriver.Driver
+	root   string
 }
 
 func BuildContext(driver, root string) (*Context, error) {
@@ -68,7 +72,9 @@ func BuildContext(driver, root string) (*Context, error) {
 		return nil, err
 	}
 
-	return NewContext(store, g, d), nil
+	ctx := NewContext(store, g, d)
+	ctx.root = root
+	return ctx, nil
 }
 
 func NewContext(store *graph.TagStore, graph *graph.Graph, driver graphdriver.Driver) *Context {
@@ -80,7 +86,10 @@ func (c *Context) PullDocker(url string, out io.Writer) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	return c.pullRef(ref, out)
+}
 
+func (c *Context) pullRef(ref *Ref, out io.Writer) (string, error) {
 	if ref.imageID != "" && c.graph.Exists(ref.imageID) {
 		return ref.imageID, nil
 	}
@@ -168,6 +177,31 @@ func (c *Context) PullTUF(url string, client *tuf.Client, progress chan<- layer.
 	return nil
 }
 
+// VerifyDigest checks that imageID, as pulled from url, is the image with
+// the given manifest digest. The manifest is pulled by digest if it has not
+// been already, which verifies the manifest content against the digest.
+func (c *Context) VerifyDigest(url, imageID, dgst string) error {
+	ref, err := NewRef(url)
+	if err != nil {
+		return err
+	}
+	if _, err := digest.ParseDigest(dgst); err != nil {
+		return fmt.Errorf("pinkerton: invalid image digest %q: %s", dgst, err)
+	}
+
+	digestRef := *ref
+	digestRef.tag = ""
+	digestRef.imageID = dgst
+	id, err := c.pullRef(&digestRef, ioutil.Discard)
+	if err != nil {
+		return fmt.Errorf("pinkerton: error verifying image digest %s: %s", dgst, err)
+	}
+	if id != imageID {
+		return fmt.Errorf("pinkerton: image digest mismatch, expected image %s to have digest %s", imageID, dgst)
+	}
+	return nil
+}
+
 func (c *Context) Checkout(id, imageID string) (string, error) {
 	id = "tmp-" + id
 	if err := c.driver.Create(id, imageID); err != nil {
@@ -180,10 +214,41 @@ func (c *Context) Checkout(id, imageID string) (string, error) {
 	return path, nil
 }
 
+// CheckoutSize returns the size of the changes made to the checkout with the
+// given id
+func (c *Context) CheckoutSize(id string) (int64, error) {
+	return c.driver.DiffSize("tmp-"+id, "")
+}
+
 func (c *Context) Cleanup(id string) error {
 	return c.driver.Remove("tmp-" + id)
 }
 
+// Checkouts returns the IDs of the existing checkouts, found by listing the
+// layer directories of the storage driver
+func (c *Context) Checkouts() ([]string, error) {
+	if c.root == "" {
+		return nil, errors.New("pinkerton: unknown storage root")
+	}
+	dir := filepath.Join(c.root, c.driver.String())
+	if c.driver.String() == "aufs" {
+		dir = filepath.Join(dir, "diff")
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, e := range entries {
+		if e.IsDir() && strings.HasPrefix(e.Name(), "tmp-") {
+			ids = append(ids, strings.TrimPrefix(e.Name(), "tmp-"))
+		}
+	}
+	return ids, nil
+}
+
 func InfoPrinter(jsonOut bool) chan<- layer.PullInfo {
 	enc := json.NewEncoder(os.Stdout)
 	info := make(chan layer.PullInfo)
@@ -13,6 +13,7 @@ import (
 	"github.com/docker/distribution/context"
 	"github.com/docker/distribution/registry/handlers"
 	_ "github.com/docker/distribution/registry/storage/driver/filesystem"
+	"github.com/docker/docker/daemon/graphdriver"
 	"github.com/flynn/flynn/pkg/random"
 )
 
@@ -65,6 +66,15 @@ func TestDocker(t *testing.T) {
 		t.Fatalf("expected image to have ID %q, got %q", testImageID, imageID)
 	}
 
+	// verify the image digest
+	if err := ctx.VerifyDigest(srv.URL+"?name=pinkerton-test&id="+testImageDigest, imageID, testImageDigest); err != nil {
+		t.Fatal(err)
+	}
+	wrongDigest := "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+	if err := ctx.VerifyDigest(srv.URL+"?name=pinkerton-test&id="+testImageDigest, imageID, wrongDigest); err == nil {
+		t.Fatal("expected error verifying image with wrong digest")
+	}
+
 	// checkout image
 	name := random.String(8)
 	path, err := ctx.Checkout(name, imageID)
@@ -87,3 +97,42 @@ func TestDocker(t *testing.T) {
 		t.Fatalf("expected foo.txt to contain %q, got %q", testImageData, string(data))
 	}
 }
+
+type namedDriver struct {
+	graphdriver.Driver
+	name string
+}
+
+func (d namedDriver) String() string { return d.name }
+
+func TestCheckouts(t *testing.T) {
+	root, err := ioutil.TempDir("", "pinkerton-checkouts-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	ctx := &Context{driver: namedDriver{name: "aufs"}, root: root}
+
+	// a missing layer directory has no checkouts
+	ids, err := ctx.Checkouts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 0 {
+		t.Fatalf("expected no checkouts, got %v", ids)
+	}
+
+	// only checkout layers are returned, not image layers
+	for _, name := range []string{"tmp-job1", "tmp-job2", testImageID} {
+		if err := os.MkdirAll(filepath.Join(root, "aufs", "diff", name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ids, err = ctx.Checkouts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"job1", "job2"}; !reflect.DeepEqual(ids, expected) {
+		t.Fatalf("expected checkouts %v, got %v", expected, ids)
+	}
+}
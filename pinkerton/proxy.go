@@ -0,0 +1,148 @@
+package pinkerton
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/docker/docker/registry"
+)
+
+// ProxyConfig is the configuration of the HTTP(S) proxies used to pull
+// images. Unset fields default to the corresponding environment variable.
+type ProxyConfig struct {
+	HTTPProxy  string
+	HTTPSProxy string
+	NoProxy    string
+}
+
+// proxyBypass are the hosts which are always pulled from directly, as they
+// are internal to the cluster
+var proxyBypass = append([]string{"localhost", "127.0.0.0/8", ".discoverd"}, internalDockerEndpoints...)
+
+// SetProxy configures the proxies used to pull images. They are set on the
+// transports of the Docker registry client rather than in the environment of
+// the process, so SetProxy must be called before any images are pulled. The
+// internal registry endpoints are never proxied.
+func SetProxy(config ProxyConfig) error {
+	config = config.withEnvDefaults()
+	proxies := make(map[string]*url.URL, 2)
+	for scheme, u := range map[string]string{"http": config.HTTPProxy, "https": config.HTTPSProxy} {
+		if u == "" {
+			continue
+		}
+		proxy, err := parseProxyURL(u)
+		if err != nil {
+			return fmt.Errorf("pinkerton: invalid proxy URL %q", RedactProxyURL(u))
+		}
+		proxies[scheme] = proxy
+	}
+	noProxy := proxyBypass
+	if config.NoProxy != "" {
+		noProxy = append(strings.Split(config.NoProxy, ","), noProxy...)
+	}
+	registry.Proxy = func(req *http.Request) (*url.URL, error) {
+		proxy, ok := proxies[req.URL.Scheme]
+		if !ok || bypassProxy(req.URL.Host, noProxy) {
+			return nil, nil
+		}
+		return proxy, nil
+	}
+	return nil
+}
+
+// parseProxyURL parses a proxy URL, defaulting to the http scheme if it has
+// none like http.ProxyFromEnvironment does
+func parseProxyURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		if u, err := url.Parse("http://" + s); err == nil {
+			return u, nil
+		}
+	}
+	return u, err
+}
+
+// bypassProxy returns whether host matches any of the given hosts, which may
+// be domains (matching their subdomains too), IP addresses or CIDR ranges
+func bypassProxy(host string, hosts []string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+	for _, h := range hosts {
+		h = strings.ToLower(strings.TrimSpace(h))
+		switch {
+		case h == "":
+			continue
+		case h == "*":
+			return true
+		case strings.Contains(h, "/"):
+			if _, network, err := net.ParseCIDR(h); err == nil && ip != nil && network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if hh, _, err := net.SplitHostPort(h); err == nil {
+			h = hh
+		}
+		if ip != nil {
+			if ip.Equal(net.ParseIP(h)) {
+				return true
+			}
+			continue
+		}
+		h = strings.TrimPrefix(strings.TrimPrefix(h, "*"), ".")
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c ProxyConfig) withEnvDefaults() ProxyConfig {
+	getenv := func(name string) string {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+		return os.Getenv(strings.ToLower(name))
+	}
+	if c.HTTPProxy == "" {
+		c.HTTPProxy = getenv("HTTP_PROXY")
+	}
+	if c.HTTPSProxy == "" {
+		c.HTTPSProxy = getenv("HTTPS_PROXY")
+	}
+	if c.NoProxy == "" {
+		c.NoProxy = getenv("NO_PROXY")
+	}
+	return c
+}
+
+// String returns a description of the config suitable for logging, with any
+// credentials in the proxy URLs redacted
+func (c ProxyConfig) String() string {
+	return fmt.Sprintf("http_proxy=%q https_proxy=%q no_proxy=%q", RedactProxyURL(c.HTTPProxy), RedactProxyURL(c.HTTPSProxy), c.NoProxy)
+}
+
+// RedactProxyURL returns the given proxy URL with any password replaced so
+// that it can be logged
+func RedactProxyURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		if strings.Contains(s, "@") {
+			// the URL may contain credentials but can't be parsed, so
+			// don't include any of it
+			return "[redacted]"
+		}
+		return s
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "redacted")
+	}
+	return u.String()
+}
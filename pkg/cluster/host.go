@@ -109,7 +109,21 @@ func (c *Host) GetJob(id string) (*host.ActiveJob, error) {
 
 // StopJob stops a running job.
 func (c *Host) StopJob(id string) error {
-	return c.c.Delete(fmt.Sprintf("/host/jobs/%s", id))
+	return c.StopJobWithReason(id, "")
+}
+
+// StopJobWithReason stops a running job, recording why it was stopped.
+func (c *Host) StopJobWithReason(id string, reason host.StopReason) error {
+	path := fmt.Sprintf("/host/jobs/%s", id)
+	if reason != "" {
+		path += "?reason=" + url.QueryEscape(string(reason))
+	}
+	return c.c.Delete(path)
+}
+
+// RestartJob restarts a running job in place, keeping its ID and IP address.
+func (c *Host) RestartJob(id string) error {
+	return c.c.Post(fmt.Sprintf("/host/jobs/%s/restart", id), nil, nil)
 }
 
 // SignalJob sends a signal to a running job.
@@ -206,3 +220,18 @@ func (c *Host) Update(name string, args ...string) (pid int, err error) {
 func (c *Host) UpdateTags(tags map[string]string) error {
 	return c.c.Post("/host/tags", tags, nil)
 }
+
+// Drain stops the host from running new jobs, and if stopJobs is true also
+// stops its running jobs, returning once they have stopped.
+func (c *Host) Drain(stopJobs bool) error {
+	path := "/host/drain"
+	if stopJobs {
+		path += "?stop_jobs=true"
+	}
+	return c.c.Post(path, nil, nil)
+}
+
+// Undrain allows the host to run new jobs again after a call to Drain.
+func (c *Host) Undrain() error {
+	return c.c.Post("/host/undrain", nil, nil)
+}
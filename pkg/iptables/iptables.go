@@ -7,7 +7,9 @@ package iptables
 import (
 	"errors"
 	"fmt"
+	"net"
 	"os/exec"
+	"strconv"
 	"strings"
 )
 
@@ -29,11 +31,45 @@ func init() {
 	supportsXlock = exec.Command("iptables", "--wait", "-L", "-n").Run() == nil
 }
 
+// NATChain is the chain in the nat table which contains the outbound NAT
+// rules, so that they are kept separate from rules managed by other tools.
+const NATChain = "FLYNN-POSTROUTING"
+
+// EnableOutboundNAT sets up NAT and forwarding for outbound traffic from the
+// given bridge. It is idempotent, so can be called again to restore rules
+// which have been removed (e.g. by an iptables flush).
 func EnableOutboundNAT(bridge, network string) error {
-	natArgs := []string{"POSTROUTING", "-t", "nat", "-s", network, "!", "-o", bridge, "-j", "MASQUERADE"}
+	if !ChainExists("nat", NATChain) {
+		if output, err := Raw("-t", "nat", "-N", NATChain); err != nil {
+			return fmt.Errorf("Unable to create NAT chain: %s", err)
+		} else if len(output) != 0 {
+			return &ChainError{Chain: NATChain, Output: output}
+		}
+	}
+
+	natArgs := []string{NATChain, "-t", "nat", "-s", network, "!", "-o", bridge, "-j", "MASQUERADE"}
 	if !Exists(natArgs...) {
-		if output, err := Raw(append([]string{"-I"}, natArgs...)...); err != nil {
+		if output, err := Raw(append([]string{"-A"}, natArgs...)...); err != nil {
 			return fmt.Errorf("Unable to enable network bridge NAT: %s", err)
+		} else if len(output) != 0 {
+			return &ChainError{Chain: NATChain, Output: output}
+		}
+	}
+
+	jumpArgs := []string{"POSTROUTING", "-t", "nat", "-j", NATChain}
+	if !Exists(jumpArgs...) {
+		if output, err := Raw(append([]string{"-I"}, jumpArgs...)...); err != nil {
+			return fmt.Errorf("Unable to jump to NAT chain: %s", err)
+		} else if len(output) != 0 {
+			return &ChainError{Chain: "POSTROUTING", Output: output}
+		}
+	}
+
+	// remove the rule previously inserted directly into POSTROUTING
+	oldNATArgs := []string{"POSTROUTING", "-t", "nat", "-s", network, "!", "-o", bridge, "-j", "MASQUERADE"}
+	if Exists(oldNATArgs...) {
+		if output, err := Raw(append([]string{"-D"}, oldNATArgs...)...); err != nil {
+			return fmt.Errorf("Unable to remove old network bridge NAT: %s", err)
 		} else if len(output) != 0 {
 			return &ChainError{Chain: "POSTROUTING", Output: output}
 		}
@@ -62,6 +98,81 @@ func EnableOutboundNAT(bridge, network string) error {
 	return nil
 }
 
+// DNATChain is the chain in the nat table which forwards host ports to
+// containers
+const DNATChain = "FLYNN-DNAT"
+
+// ForwardPort forwards traffic sent to hostPort on the host to port on the
+// container with the given IP. It is idempotent.
+func ForwardPort(bridge, proto string, hostPort int, ip string, port int) error {
+	if !ChainExists("nat", DNATChain) {
+		if output, err := Raw("-t", "nat", "-N", DNATChain); err != nil {
+			return fmt.Errorf("Unable to create DNAT chain: %s", err)
+		} else if len(output) != 0 {
+			return &ChainError{Chain: DNATChain, Output: output}
+		}
+	}
+
+	// jump to the DNAT chain for traffic to local addresses, both from
+	// other hosts and from the host itself
+	for _, chain := range []string{"PREROUTING", "OUTPUT"} {
+		jumpArgs := []string{chain, "-t", "nat", "-m", "addrtype", "--dst-type", "LOCAL", "-j", DNATChain}
+		if !Exists(jumpArgs...) {
+			if output, err := Raw(append([]string{"-I"}, jumpArgs...)...); err != nil {
+				return fmt.Errorf("Unable to jump to DNAT chain: %s", err)
+			} else if len(output) != 0 {
+				return &ChainError{Chain: chain, Output: output}
+			}
+		}
+	}
+
+	for _, rule := range portForwardRules(bridge, proto, hostPort, ip, port) {
+		if !Exists(rule.args...) {
+			if output, err := Raw(append([]string{rule.action}, rule.args...)...); err != nil {
+				return fmt.Errorf("Unable to forward port %d: %s", hostPort, err)
+			} else if len(output) != 0 {
+				return &ChainError{Chain: rule.args[0], Output: output}
+			}
+		}
+	}
+	return nil
+}
+
+// RemovePortForward removes the rules added by ForwardPort with the same
+// arguments
+func RemovePortForward(bridge, proto string, hostPort int, ip string, port int) error {
+	for _, rule := range portForwardRules(bridge, proto, hostPort, ip, port) {
+		if Exists(rule.args...) {
+			if output, err := Raw(append([]string{"-D"}, rule.args...)...); err != nil {
+				return fmt.Errorf("Unable to remove forward of port %d: %s", hostPort, err)
+			} else if len(output) != 0 {
+				return &ChainError{Chain: rule.args[0], Output: output}
+			}
+		}
+	}
+	return nil
+}
+
+type rule struct {
+	action string
+	args   []string
+}
+
+func portForwardRules(bridge, proto string, hostPort int, ip string, port int) []rule {
+	return []rule{
+		{"-A", []string{DNATChain, "-t", "nat", "-p", proto, "--dport", strconv.Itoa(hostPort), "-j", "DNAT", "--to-destination", net.JoinHostPort(ip, strconv.Itoa(port))}},
+		{"-I", []string{"FORWARD", "-d", ip, "!", "-i", bridge, "-o", bridge, "-p", proto, "--dport", strconv.Itoa(port), "-j", "ACCEPT"}},
+	}
+}
+
+// Check if a chain exists in the given table
+func ChainExists(table, chain string) bool {
+	if _, err := Raw("-t", table, "-n", "-L", chain); err != nil {
+		return false
+	}
+	return true
+}
+
 // Check if an existing rule exists
 func Exists(args ...string) bool {
 	if _, err := Raw(append([]string{"-C"}, args...)...); err != nil {
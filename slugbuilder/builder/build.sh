@@ -104,7 +104,13 @@ if [[ -f "${env_cookie}" ]]; then
 fi
 
 if [[ -n "${BUILD_CACHE_URL}" ]]; then
-  curl "${BUILD_CACHE_URL}" | tar --extract --gunzip --directory "${cache_root}" &>/dev/null || true
+  if [[ -n "${BUILD_CACHE_SKIP}" ]]; then
+    # build from scratch, the fresh cache is still uploaded below so the
+    # following builds are cached again
+    echo_title "Build cache skipped"
+  else
+    curl "${BUILD_CACHE_URL}" | tar --extract --gunzip --directory "${cache_root}" &>/dev/null || true
+  fi
 fi
 
 # In heroku, there are two separate directories, and some
@@ -153,12 +159,74 @@ if [[ -f "${build_root}/.slugignore" ]]; then
   prune_slugignore
 fi
 
+## Build manifest
+
+# An app can name its buildpack, set environment variables for the build and
+# declare resource limits for its process types in .flynn/build.json, for
+# example if no buildpack detects it:
+#
+#   {"buildpack": "heroku-buildpack-ruby", "env": {"KEY": "value"},
+#    "limits": {"web": {"memory": "512MB"}}}
+#
+# The buildpack is either a URL or the name of a built-in buildpack, and is
+# ignored if BUILDPACK_URL is set, as are variables already set for the app.
+# The limits are reported below and applied to the release by the receiver.
+build_manifest="${build_root}/.flynn/build.json"
+manifest_buildpack=
+manifest_limits=/tmp/manifest-limits
+
+if [[ -f "${build_manifest}" ]]; then
+  echo_title "Reading build manifest"
+  mkdir -p "${env_dir}"
+  manifest_buildpack=$(ruby -r json -e '
+    manifest = JSON.parse(File.read(ARGV[0]))
+    abort "build manifest must be an object" unless manifest.is_a?(Hash)
+    env = manifest.fetch("env", {})
+    abort "build manifest env must be an object" unless env.is_a?(Hash)
+    env.each do |key, value|
+      abort "invalid env key in build manifest: #{key}" unless key =~ /\A[A-Za-z_][A-Za-z0-9_]*\z/
+      path = File.join(ARGV[1], key)
+      File.write(path, value.to_s) unless File.exist?(path)
+    end
+    limits = manifest.fetch("limits", {})
+    unless limits.is_a?(Hash) && limits.values.all? { |l| l.is_a?(Hash) }
+      abort "build manifest limits must be an object of objects"
+    end
+    File.write(ARGV[2], limits.flat_map { |type, l| l.map { |key, value| "#{type}.#{key}=#{value}" } }.join(", "))
+    puts manifest.fetch("buildpack", "")
+  ' "${build_manifest}" "${env_dir}" "${manifest_limits}") || {
+    echo_title "Invalid build manifest"
+    exit 1
+  }
+  if [[ -n "$(ls -A ${env_dir})" ]]; then
+    envdir="true"
+  fi
+fi
+
 ## Buildpack detection
 
 # Ordering here is in line number order from buildpacks.txt
 buildpacks=(${buildpack_root}/*)
 selected_buildpack=
 
+if [[ -z "${BUILDPACK_URL}" ]] && [[ -n "${manifest_buildpack}" ]]; then
+  if [[ "${manifest_buildpack}" == *://* ]] || [[ "${manifest_buildpack}" == git@* ]]; then
+    BUILDPACK_URL="${manifest_buildpack}"
+  else
+    # built-in buildpacks are installed as <order>_<name>
+    shopt -s nullglob
+    buildpacks=(${buildpack_root}/*_${manifest_buildpack})
+    shopt -u nullglob
+    if [[ ${#buildpacks[@]} -eq 0 ]]; then
+      echo_title "Unknown buildpack in build manifest: ${manifest_buildpack}"
+      exit 1
+    fi
+    selected_buildpack="${buildpacks[0]}"
+    buildpack_name=$(run_unprivileged ${selected_buildpack}/bin/detect "${build_root}") \
+      || buildpack_name="${manifest_buildpack}"
+  fi
+fi
+
 if [[ -n "${BUILDPACK_URL}" ]]; then
   echo_title "Fetching custom buildpack"
 
@@ -173,7 +241,7 @@ if [[ -n "${BUILDPACK_URL}" ]]; then
   buildpacks=($buildpack)
   selected_buildpack=${buildpack[0]}
   buildpack_name=$(run_unprivileged ${buildpack}/bin/detect "${build_root}")
-else
+elif [[ -z "${selected_buildpack}" ]]; then
   for buildpack in "${buildpacks[@]}"; do
     buildpack_name=$(run_unprivileged ${buildpack}/bin/detect "${build_root}") \
       && selected_buildpack="${buildpack}" \
@@ -214,6 +282,9 @@ if [[ -f "${build_root}/Procfile" ]]; then
   types=$(ruby -r yaml -e "puts YAML.load_file('${build_root}/Procfile').keys.join(', ')")
   echo_normal "Procfile declares types -> ${types}"
 fi
+if [[ -s "${manifest_limits}" ]]; then
+  echo_normal "Build manifest declares limits -> $(< ${manifest_limits})"
+fi
 default_types=""
 if [[ -s "${build_root}/.release" ]]; then
   default_types=$(ruby -r yaml -e "puts (YAML.load_file('${build_root}/.release') || {}).fetch('default_process_types', {}).keys.join(', ')")
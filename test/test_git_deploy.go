@@ -12,11 +12,14 @@ import (
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
+	"github.com/docker/go-units"
 	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/host/resource"
 	"github.com/flynn/flynn/pkg/attempt"
 	c "github.com/flynn/go-check"
 )
@@ -73,6 +76,28 @@ func (s *GitDeploySuite) TestBuildCaching(t *c.C) {
 	t.Assert(push, SuccessfulOutputContains, "cached: 1")
 }
 
+func (s *GitDeploySuite) TestBuildCacheSkip(t *c.C) {
+	r := s.newGitRepo(t, "build-cache")
+	t.Assert(r.flynn("create"), Succeeds)
+	t.Assert(r.flynn("env", "set", "BUILDPACK_URL=https://github.com/kr/heroku-buildpack-inline"), Succeeds)
+
+	r.git("commit", "-m", "bump", "--allow-empty")
+	t.Assert(r.git("push", "flynn", "master"), Succeeds)
+
+	r.git("commit", "-m", "bump", "--allow-empty")
+	t.Assert(r.git("push", "flynn", "master"), SuccessfulOutputContains, "cached: 0")
+
+	// pushing to flynn-nocache should rebuild from scratch
+	r.git("commit", "-m", "bump", "--allow-empty")
+	push := r.git("push", "flynn", "master:flynn-nocache")
+	t.Assert(push, SuccessfulOutputContains, "cache skipped")
+	t.Assert(push, c.Not(OutputContains), "cached:")
+
+	// the following push should use the cache again
+	r.git("commit", "-m", "bump", "--allow-empty")
+	t.Assert(r.git("push", "flynn", "master"), SuccessfulOutputContains, "cached: 0")
+}
+
 func (s *GitDeploySuite) TestAppRecreation(t *c.C) {
 	r := s.newGitRepo(t, "empty")
 	t.Assert(r.flynn("create", "-y", "app-recreation"), Succeeds)
@@ -235,6 +260,46 @@ func (s *GitDeploySuite) TestLargeRepo(t *c.C) {
 	t.Assert(r.git("push", "flynn", "master"), OutputContains, "Unable to select a buildpack")
 }
 
+func (s *GitDeploySuite) TestBuildManifest(t *c.C) {
+	r := s.newGitRepo(t, "env-dir")
+	t.Assert(r.flynn("create"), Succeeds)
+
+	// no buildpack detects the app without the manifest
+	t.Assert(r.git("push", "flynn", "master"), OutputContains, "Unable to select a buildpack")
+
+	t.Assert(os.MkdirAll(filepath.Join(r.dir, ".flynn"), 0755), c.IsNil)
+	manifest := `{"buildpack": "https://github.com/kr/heroku-buildpack-inline", "env": {"FOO": "bar"}}`
+	t.Assert(ioutil.WriteFile(filepath.Join(r.dir, ".flynn", "build.json"), []byte(manifest), 0644), c.IsNil)
+	t.Assert(r.git("add", ".flynn"), Succeeds)
+	t.Assert(r.git("commit", "-m", "add build manifest"), Succeeds)
+
+	push := r.git("push", "flynn", "master")
+	t.Assert(push, SuccessfulOutputContains, "Reading build manifest")
+	t.Assert(push, SuccessfulOutputContains, "bar")
+}
+
+func (s *GitDeploySuite) TestBuildManifestLimits(t *c.C) {
+	r := s.newGitRepo(t, "empty-release")
+	t.Assert(r.flynn("create", "build-manifest-limits"), Succeeds)
+
+	t.Assert(ioutil.WriteFile(filepath.Join(r.dir, "Procfile"), []byte("worker: sleep 1000\n"), 0644), c.IsNil)
+	t.Assert(os.MkdirAll(filepath.Join(r.dir, ".flynn"), 0755), c.IsNil)
+	manifest := `{"buildpack": "https://github.com/kr/heroku-buildpack-inline", "limits": {"worker": {"memory": "256MB", "cpu": "500"}}}`
+	t.Assert(ioutil.WriteFile(filepath.Join(r.dir, ".flynn", "build.json"), []byte(manifest), 0644), c.IsNil)
+	t.Assert(r.git("add", "."), Succeeds)
+	t.Assert(r.git("commit", "-m", "add build manifest"), Succeeds)
+
+	push := r.git("push", "flynn", "master")
+	t.Assert(push, SuccessfulOutputContains, "Build manifest declares limits")
+
+	release, err := s.controllerClient(t).GetAppRelease("build-manifest-limits")
+	t.Assert(err, c.IsNil)
+	proc, ok := release.Processes["worker"]
+	t.Assert(ok, c.Equals, true)
+	t.Assert(*proc.Resources[resource.TypeMemory].Limit, c.Equals, int64(256*units.MiB))
+	t.Assert(*proc.Resources[resource.TypeCPU].Limit, c.Equals, int64(500))
+}
+
 func (s *GitDeploySuite) TestPrivateSSHKeyClone(t *c.C) {
 	r := s.newGitRepo(t, "private-clone")
 	t.Assert(r.flynn("create"), Succeeds)
@@ -273,6 +338,22 @@ func (s *GitDeploySuite) TestSlugbuilderLimit(t *c.C) {
 	t.Assert(push, OutputContains, "524288000")
 }
 
+func (s *GitDeploySuite) TestBuildSummary(t *c.C) {
+	r := s.newGitRepo(t, "env-dir")
+	t.Assert(r.flynn("create"), Succeeds)
+	t.Assert(r.flynn("env", "set", "BUILDPACK_URL=https://github.com/kr/heroku-buildpack-inline"), Succeeds)
+
+	push := r.git("push", "flynn", "master")
+	t.Assert(push, SuccessfulOutputContains, "Build duration: ")
+
+	// the slug of a tiny app should be a compressed tarball of a few KB
+	m := regexp.MustCompile(`Slug size: (\d+) bytes`).FindStringSubmatch(push.Output)
+	t.Assert(m, c.HasLen, 2)
+	size, err := strconv.Atoi(m[1])
+	t.Assert(err, c.IsNil)
+	t.Assert(size > 100 && size < 1024*1024, c.Equals, true, c.Commentf("slug size %d", size))
+}
+
 func (s *GitDeploySuite) TestCancel(t *c.C) {
 	r := s.newGitRepo(t, "cancel-hang")
 	t.Assert(r.flynn("create", "cancel-hang"), Succeeds)
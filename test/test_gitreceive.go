@@ -1,6 +1,9 @@
 package main
 
 import (
+	"os/exec"
+	"path/filepath"
+	"strings"
 	"time"
 
 	c "github.com/flynn/go-check"
@@ -33,3 +36,50 @@ func (s *GitreceiveSuite) TestRepoCaching(t *c.C) {
 	// should only contain one object
 	t.Assert(push, SuccessfulOutputContains, "Counting objects: 1, done.")
 }
+
+func (s *GitreceiveSuite) TestConcurrentPushes(t *c.C) {
+	r1 := s.newGitRepo(t, "empty")
+	t.Assert(r1.flynn("create"), Succeeds)
+	r2 := &gitRepo{filepath.Join(t.MkDir(), "repo"), t}
+	t.Assert(run(t, exec.Command("cp", "-r", r1.dir, r2.dir)), Succeeds)
+
+	t.Assert(r1.git("commit", "-m", "push one", "--allow-empty"), Succeeds)
+	t.Assert(r2.git("commit", "-m", "push two", "--allow-empty"), Succeeds)
+
+	// push both repos at once, the pushes should be serialized so exactly
+	// one of them succeeds and the other is rejected as out of date
+	type pushResult struct {
+		repo *gitRepo
+		res  *CmdResult
+	}
+	results := make(chan pushResult, 2)
+	for _, r := range []*gitRepo{r1, r2} {
+		go func(r *gitRepo) {
+			results <- pushResult{r, r.git("push", "flynn", "master")}
+		}(r)
+	}
+	var winner, loser *gitRepo
+	for i := 0; i < 2; i++ {
+		push := <-results
+		if push.res.Err == nil {
+			t.Assert(winner, c.IsNil)
+			winner = push.repo
+		} else {
+			loser = push.repo
+		}
+	}
+	t.Assert(winner, c.NotNil)
+	t.Assert(loser, c.NotNil)
+
+	// the stored repo should be intact and contain the successful push
+	url := strings.TrimSpace(r1.git("config", "remote.flynn.url").Output)
+	clone := &gitRepo{filepath.Join(t.MkDir(), "repo"), t}
+	t.Assert(run(t, exec.Command("git", "clone", url, clone.dir)), Succeeds)
+	t.Assert(clone.git("fsck"), Succeeds)
+	head := strings.TrimSpace(clone.git("rev-parse", "HEAD").Output)
+	t.Assert(head, c.Equals, strings.TrimSpace(winner.git("rev-parse", "HEAD").Output))
+
+	// the rejected push should succeed once rebased onto the successful one
+	t.Assert(loser.git("pull", "--rebase", "flynn", "master"), Succeeds)
+	t.Assert(loser.git("push", "flynn", "master"), Succeeds)
+}
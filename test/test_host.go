@@ -20,6 +20,7 @@ import (
 	hh "github.com/flynn/flynn/pkg/httphelper"
 	"github.com/flynn/flynn/pkg/random"
 	"github.com/flynn/flynn/pkg/schedutil"
+	tc "github.com/flynn/flynn/test/cluster"
 	c "github.com/flynn/go-check"
 )
 
@@ -87,6 +88,22 @@ loop:
 	t.Assert(*jobErr, c.Equals, `host: invalid job partition "nonexistent"`)
 }
 
+func (s *HostSuite) TestAddJobWithInvalidEntrypoint(t *c.C) {
+	cmd := exec.CommandUsingCluster(s.clusterClient(t), exec.DockerImage(imageURIs["test-apps"]), "/bin/nonexistent")
+	runErr := make(chan error)
+	go func() {
+		runErr <- cmd.Run()
+	}()
+	select {
+	case err := <-runErr:
+		// the error should include the reason from the init log
+		t.Assert(err, c.NotNil)
+		t.Assert(err.Error(), c.Matches, `(?s).*no such file or directory.*init log:.*`)
+	case <-time.After(30 * time.Second):
+		t.Fatal("timed out waiting for job to fail")
+	}
+}
+
 func (s *HostSuite) TestAttachNonExistentJob(t *c.C) {
 	cluster := s.clusterClient(t)
 	hosts, err := cluster.Hosts()
@@ -218,6 +235,42 @@ func (s *HostSuite) TestNetworkedPersistentJob(t *c.C) {
 	t.Assert(resp, c.Equals, "echocococo\n")
 }
 
+func (s *HostSuite) TestRestartJob(t *c.C) {
+	if testCluster == nil {
+		t.Skip("cannot boot new hosts")
+	}
+
+	// boot a new host so the job's libvirt domain can be inspected
+	instance := s.addHost(t, "router-api")
+	defer s.removeHost(t, instance, "router-api")
+	h := s.hostClient(t, instance.ID)
+
+	cmd, _, err := makeIshApp(s.clusterClient(t), h, s.discoverdClient(t), host.ContainerConfig{})
+	t.Assert(err, c.IsNil)
+	defer cmd.Kill()
+	before, err := h.GetJob(cmd.Job.ID)
+	t.Assert(err, c.IsNil)
+	domainID := func() string {
+		var out bytes.Buffer
+		t.Assert(instance.Run("sudo virsh -c lxc:/// domid "+cmd.Job.ID, &tc.Streams{Stdout: &out}), c.IsNil)
+		return strings.TrimSpace(out.String())
+	}
+	prevDomainID := domainID()
+
+	t.Assert(h.RestartJob(cmd.Job.ID), c.IsNil)
+
+	// the job keeps its ID, domain UUID and IP
+	after, err := h.GetJob(cmd.Job.ID)
+	t.Assert(err, c.IsNil)
+	t.Assert(after.Job.ID, c.Equals, before.Job.ID)
+	t.Assert(after.ContainerID, c.Equals, before.ContainerID)
+	t.Assert(after.InternalIP, c.Equals, before.InternalIP)
+
+	// but runs in a new domain, the previous one having been undefined
+	t.Assert(domainID(), c.Not(c.Equals), prevDomainID)
+	t.Assert(instance.Run("sudo virsh -c lxc:/// dominfo "+prevDomainID, nil), c.NotNil)
+}
+
 func (s *HostSuite) TestVolumeCreation(t *c.C) {
 	h := s.anyHostClient(t)
 
@@ -279,6 +332,164 @@ func (s *HostSuite) TestVolumePersistence(t *c.C) {
 	t.Assert(resp, c.Equals, "testcontent\n")
 }
 
+func (s *HostSuite) TestVolumeNoExec(t *c.C) {
+	cluster := s.clusterClient(t)
+	h := s.anyHostClient(t)
+
+	vol, err := h.CreateVolume("default")
+	t.Assert(err, c.IsNil)
+	defer func() {
+		t.Assert(h.DestroyVolume(vol.ID), c.IsNil)
+	}()
+
+	cmd, service, err := makeIshApp(cluster, h, s.discoverdClient(t), host.ContainerConfig{
+		Volumes: []host.VolumeBinding{{
+			Target:    "/vol",
+			VolumeID:  vol.ID,
+			Writeable: true,
+			NoExec:    true,
+			NoSUID:    true,
+		}},
+	})
+	t.Assert(err, c.IsNil)
+	defer cmd.Kill()
+
+	// the volume should be writeable, but binaries in it not executable
+	resp, err := runIshCommand(service, "cp /bin/echo /vol/echo ; echo $?")
+	t.Assert(err, c.IsNil)
+	t.Assert(resp, c.Equals, "0\n")
+	resp, err = runIshCommand(service, "/vol/echo foo >/dev/null 2>&1 ; echo $?")
+	t.Assert(err, c.IsNil)
+	t.Assert(resp, c.Equals, "126\n")
+}
+
+func (s *HostSuite) TestVolumeWorkingDir(t *c.C) {
+	cluster := s.clusterClient(t)
+	h := s.anyHostClient(t)
+
+	vol, err := h.CreateVolume("default")
+	t.Assert(err, c.IsNil)
+	defer func() {
+		t.Assert(h.DestroyVolume(vol.ID), c.IsNil)
+	}()
+
+	// the working directory doesn't exist in the new volume, so should be
+	// created before the job starts
+	cmd, service, err := makeIshApp(cluster, h, s.discoverdClient(t), host.ContainerConfig{
+		Volumes: []host.VolumeBinding{{
+			Target:    "/vol",
+			VolumeID:  vol.ID,
+			Writeable: true,
+		}},
+		WorkingDir: "/vol/app/data",
+	})
+	t.Assert(err, c.IsNil)
+	defer cmd.Kill()
+	resp, err := runIshCommand(service, "pwd")
+	t.Assert(err, c.IsNil)
+	t.Assert(resp, c.Equals, "/vol/app/data\n")
+}
+
+func (s *HostSuite) TestSharedMount(t *c.C) {
+	cluster := s.clusterClient(t)
+	h := s.anyHostClient(t)
+
+	config := host.ContainerConfig{
+		SharedMounts: []host.SharedMount{{
+			Name:   "test-" + random.String(8),
+			Target: "/shared",
+		}},
+	}
+	cmd, service, err := makeIshApp(cluster, h, s.discoverdClient(t), config)
+	t.Assert(err, c.IsNil)
+	defer cmd.Kill()
+	resp, err := runIshCommand(service, "echo 'testcontent' > /shared/alpha ; echo $?")
+	t.Assert(err, c.IsNil)
+	t.Assert(resp, c.Equals, "0\n")
+
+	// a second job declaring the same shared mount should see the data
+	cmd, service, err = makeIshApp(cluster, h, s.discoverdClient(t), config)
+	t.Assert(err, c.IsNil)
+	defer cmd.Kill()
+	resp, err = runIshCommand(service, "cat /shared/alpha")
+	t.Assert(err, c.IsNil)
+	t.Assert(resp, c.Equals, "testcontent\n")
+}
+
+func (s *HostSuite) TestReadinessCheck(t *c.C) {
+	cluster := s.clusterClient(t)
+	h := s.anyHostClient(t)
+
+	// ish listens on the job's first port, which is allocated 5000
+	cmd, _, err := makeIshApp(cluster, h, s.discoverdClient(t), host.ContainerConfig{
+		Readiness: &host.ReadinessCheck{Type: host.ReadinessCheckPort, Port: 5000},
+	})
+	t.Assert(err, c.IsNil)
+	defer cmd.Kill()
+
+	err = Attempts.Run(func() error {
+		job, err := h.GetJob(cmd.Job.ID)
+		if err != nil {
+			return err
+		}
+		if job.Status != host.StatusReady {
+			return fmt.Errorf("expected job to be ready, got %s", job.Status)
+		}
+		return nil
+	})
+	t.Assert(err, c.IsNil)
+}
+
+func (s *HostSuite) TestEnvFiles(t *c.C) {
+	cluster := s.clusterClient(t)
+	h := s.anyHostClient(t)
+
+	cmd, service, err := makeIshApp(cluster, h, s.discoverdClient(t), host.ContainerConfig{
+		EnvFiles: []host.EnvFile{{
+			Path: "/etc/app/secrets.env",
+			Env:  map[string]string{"SECRET": "s3cr3t"},
+		}},
+	})
+	t.Assert(err, c.IsNil)
+	defer cmd.Kill()
+
+	resp, err := runIshCommand(service, "cat /etc/app/secrets.env")
+	t.Assert(err, c.IsNil)
+	t.Assert(resp, c.Equals, "SECRET=s3cr3t\n")
+	resp, err = runIshCommand(service, "stat -c %a /etc/app/secrets.env")
+	t.Assert(err, c.IsNil)
+	t.Assert(resp, c.Equals, "600\n")
+
+	// the secret should not be in the environment
+	resp, err = runIshCommand(service, "env | grep -c SECRET")
+	t.Assert(err, c.IsNil)
+	t.Assert(resp, c.Equals, "0\n")
+}
+
+func (s *HostSuite) TestPostStart(t *c.C) {
+	cluster := s.clusterClient(t)
+	h := s.anyHostClient(t)
+
+	cmd, service, err := makeIshApp(cluster, h, s.discoverdClient(t), host.ContainerConfig{
+		PostStart: []string{"sh", "-c", "echo ran >> /tmp/post-start"},
+	})
+	t.Assert(err, c.IsNil)
+	defer cmd.Kill()
+
+	// the hook should have run exactly once
+	err = Attempts.Run(func() error {
+		resp, err := runIshCommand(service, "cat /tmp/post-start")
+		if err != nil {
+			return err
+		}
+		if resp != "ran\n" {
+			return fmt.Errorf("unexpected post-start output %q", resp)
+		}
+		return nil
+	})
+	t.Assert(err, c.IsNil)
+}
+
 func (s *HostSuite) TestSignalJob(t *c.C) {
 	cluster := s.clusterClient(t)
 
@@ -593,7 +593,7 @@ loop:
 		jobs, err := h.ListJobs()
 		t.Assert(err, c.IsNil)
 		for _, job := range jobs {
-			if job.Status != host.StatusRunning {
+			if job.Status != host.StatusRunning && job.Status != host.StatusReady {
 				continue
 			}
 			appID := job.Job.Metadata["flynn-controller.app"]
@@ -674,7 +674,7 @@ loop:
 		jobs, err := h.ListJobs()
 		t.Assert(err, c.IsNil)
 		for _, job := range jobs {
-			if job.Status != host.StatusRunning {
+			if job.Status != host.StatusRunning && job.Status != host.StatusReady {
 				continue
 			}
 			appID := job.Job.Metadata["flynn-controller.app"]